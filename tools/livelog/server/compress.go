@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a partial line (one with no line ending yet) is held back from a
+// compressed response, waiting for the rest of the line, before it is flushed
+// anyway. This is a time.Duration, accessed atomically, as it is overridden in
+// tests.
+var partialLineDelay = int64(500 * time.Millisecond)
+
+// compressor is implemented by *gzip.Writer and *zlib.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// acceptedEncoding returns the content encoding ("gzip" or "deflate") to
+// compress the response to the given request with, according to its
+// Accept-Encoding header, or "" if the response should not be compressed.
+// gzip is preferred when both are equally acceptable.
+func acceptedEncoding(req *http.Request) string {
+	qualities := map[string]float64{}
+	for _, coding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		qualities[name] = quality
+	}
+	best, bestQuality := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		quality, listed := qualities[encoding]
+		if !listed {
+			quality, listed = qualities["*"]
+		}
+		if listed && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressedWriter compresses the log written to it, for a reader that
+// accepts a compressed content encoding. So that compressed output still
+// arrives as it is written, the compressor is flushed to the reader whenever
+// StreamHandle.WriteTo calls Flush, having caught up with the stream. Only
+// complete lines are flushed: a partial line is held back until it is
+// completed, the log ends, or it has been held for partialLineDelay.
+type compressedWriter struct {
+	// mutex covers all of the fields below, as Flush may also be called by
+	// the partial line timer
+	mutex      sync.Mutex
+	compressor compressor
+	flusher    http.Flusher
+	// partialLine holds the bytes after the last line ending written, which
+	// have not yet been passed to the compressor
+	partialLine []byte
+	timer       *time.Timer
+	closed      bool
+	err         error
+}
+
+func newCompressedWriter(writer http.ResponseWriter, encoding string) *compressedWriter {
+	cw := &compressedWriter{}
+	if encoding == "gzip" {
+		cw.compressor = gzip.NewWriter(writer)
+	} else {
+		cw.compressor = zlib.NewWriter(writer)
+	}
+	cw.flusher, _ = writer.(http.Flusher)
+	return cw
+}
+
+func (cw *compressedWriter) Write(p []byte) (int, error) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	lineEnd := bytes.LastIndexByte(p, '\n') + 1
+	if lineEnd > 0 {
+		cw.compress(cw.partialLine)
+		cw.compress(p[:lineEnd])
+		cw.partialLine = cw.partialLine[:0]
+		// the partial line being held back, if any, has been completed
+		if cw.timer != nil {
+			cw.timer.Stop()
+			cw.timer = nil
+		}
+	}
+	cw.partialLine = append(cw.partialLine, p[lineEnd:]...)
+	if len(cw.partialLine) >= MAX_EVENT_LINE_LENGTH {
+		cw.compress(cw.partialLine)
+		cw.partialLine = cw.partialLine[:0]
+	}
+	return len(p), cw.err
+}
+
+// Flush flushes the complete lines written so far to the reader, and starts
+// the timer for flushing any partial line
+func (cw *compressedWriter) Flush() {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.flush()
+	if len(cw.partialLine) > 0 && cw.timer == nil && !cw.closed {
+		cw.timer = time.AfterFunc(time.Duration(atomic.LoadInt64(&partialLineDelay)), cw.flushPartialLine)
+	}
+}
+
+func (cw *compressedWriter) flushPartialLine() {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.timer = nil
+	if cw.closed {
+		return
+	}
+	cw.compress(cw.partialLine)
+	cw.partialLine = cw.partialLine[:0]
+	cw.flush()
+}
+
+// Close writes any partial line, and the end of the compressed stream. The
+// compressedWriter must be closed or abandoned before the handler returns.
+func (cw *compressedWriter) Close() error {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.stopTimer()
+	cw.compress(cw.partialLine)
+	cw.partialLine = nil
+	if cw.err == nil {
+		cw.err = cw.compressor.Close()
+	}
+	return cw.err
+}
+
+// Abandon stops writing to the reader, without completing the compressed
+// stream, for example when the response is being aborted
+func (cw *compressedWriter) Abandon() {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	cw.stopTimer()
+}
+
+func (cw *compressedWriter) stopTimer() {
+	cw.closed = true
+	if cw.timer != nil {
+		cw.timer.Stop()
+		cw.timer = nil
+	}
+}
+
+func (cw *compressedWriter) compress(p []byte) {
+	if cw.err != nil || len(p) == 0 {
+		return
+	}
+	_, cw.err = cw.compressor.Write(p)
+}
+
+func (cw *compressedWriter) flush() {
+	if cw.err != nil || cw.closed {
+		return
+	}
+	cw.err = cw.compressor.Flush()
+	if cw.err == nil && cw.flusher != nil {
+		cw.flusher.Flush()
+	}
+}
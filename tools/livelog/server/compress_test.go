@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// getCompressedLog requests a log with the given Accept-Encoding header. The
+// response body is not transparently decompressed.
+func getCompressedLog(t *testing.T, url, acceptEncoding string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   "gzip",
+		"deflate":                "deflate",
+		"deflate, gzip":          "gzip",
+		"gzip;q=0.5, deflate":    "deflate",
+		"GZIP":                   "gzip",
+		"gzip;q=0":               "",
+		"*":                      "gzip",
+		"*;q=0.1, deflate;q=0.5": "deflate",
+		"br, gzip;q=0.8":         "gzip",
+	} {
+		req, err := http.NewRequest("GET", "http://localhost/log/token", nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		require.Equal(t, expected, acceptedEncoding(req), "Accept-Encoding %q", acceptEncoding)
+	}
+}
+
+func TestCompressedLog(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	logContents := strings.Repeat("a very compressible line\n", 1000)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/log", ts.PutPort()), ioutil.NopCloser(strings.NewReader(logContents)))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 201, res.StatusCode)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/log/7_3HoMEbQau1Qlzwx-JZgg", ts.GetPort())
+
+	res = getCompressedLog(t, url, "gzip")
+	defer res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	compressed, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.True(t, len(compressed) < len(logContents)/10, "compressed log is %v bytes", len(compressed))
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, logContents, string(body))
+
+	res = getCompressedLog(t, url, "deflate")
+	defer res.Body.Close()
+	require.Equal(t, "deflate", res.Header.Get("Content-Encoding"))
+	zr, err := zlib.NewReader(res.Body)
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	require.Equal(t, logContents, string(body))
+
+	// partial responses are not compressed
+	res = getCompressedLog(t, url+"?offset=25", "gzip")
+	defer res.Body.Close()
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "", res.Header.Get("Content-Encoding"))
+	body, err = ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, logContents[25:], string(body))
+}
+
+func TestCompressedLiveLogFlushesLines(t *testing.T) {
+	defer atomic.StoreInt64(&partialLineDelay, atomic.SwapInt64(&partialLineDelay, int64(time.Hour)))
+
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	stdout, stdoutResult := startPutStream(t, ts, "stdout", "stdout-token")
+	_, err := stdout.Write([]byte("line 1\nline 2\npart"))
+	require.NoError(t, err)
+
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		res = getCompressedLog(t, getStreamURL(ts, "stdout", "stdout-token"), "gzip")
+		if res.StatusCode != 404 {
+			break
+		}
+		res.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	defer res.Body.Close()
+	gz, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+
+	// read the given number of bytes of the decompressed log in the
+	// background, as reading blocks until they have been flushed
+	read := func(n int) chan string {
+		result := make(chan string, 1)
+		go func() {
+			buf := make([]byte, n)
+			_, err := io.ReadFull(gz, buf)
+			if err != nil {
+				result <- err.Error()
+				return
+			}
+			result <- string(buf)
+		}()
+		return result
+	}
+
+	// complete lines are flushed while the log is being written...
+	require.Equal(t, "line 1\nline 2\n", <-read(14))
+
+	// ...but a partial line is held back until it is completed
+	result := read(13)
+	select {
+	case r := <-result:
+		t.Fatalf("Partial line was flushed: %q", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = stdout.Write([]byte("ial line\nprompt> "))
+	require.NoError(t, err)
+	require.Equal(t, "partial line\n", <-result)
+
+	// ...or the partial line delay has passed
+	atomic.StoreInt64(&partialLineDelay, int64(10*time.Millisecond))
+	_, err = stdout.Write([]byte("line 4\nprompt> "))
+	require.NoError(t, err)
+	require.Equal(t, "prompt> line 4\nprompt> ", <-read(23))
+
+	require.NoError(t, stdout.Close())
+	require.Equal(t, 201, (<-stdoutResult).StatusCode)
+	rest, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, "", string(rest))
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"fmt"
@@ -104,16 +104,14 @@ func StartServer(t *testing.T, tls bool) *TestLivelogServer {
 	writer.TempDir = tempdir
 
 	// set up some config for the put server
-	os.Setenv("ACCESS_TOKEN", "7_3HoMEbQau1Qlzwx-JZgg")
+	crtFile, keyFile := "", ""
 	if tls {
-		os.Setenv("SERVER_CRT_FILE", "test/server.crt")
-		os.Setenv("SERVER_KEY_FILE", "test/server.key")
-	} else {
-		os.Unsetenv("SERVER_CRT_FILE")
-		os.Unsetenv("SERVER_KEY_FILE")
+		crtFile, keyFile = "test/server.crt", "test/server.key"
 	}
 
-	go serve(":putport", ":getport")
+	go func() {
+		_ = New("7_3HoMEbQau1Qlzwx-JZgg").Serve(":putport", ":getport", crtFile, keyFile, false)
+	}()
 
 	return ts
 }
@@ -124,6 +122,7 @@ func (ts *TestLivelogServer) Close() {
 		panic(err)
 	}
 	writer.TempDir = ""
+	runServer = ts.oldRunServer
 
 	ts.getCond.L.Lock()
 	defer ts.getCond.L.Unlock()
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getLogRange(t *testing.T, ts *TestLivelogServer, query string, rangeHeader string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/log/7_3HoMEbQau1Qlzwx-JZgg%s", ts.GetPort(), query), nil)
+	require.NoError(t, err)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res, string(body)
+}
+
+func TestRangeOfCompletedLog(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	logContents := "0123456789abcdefghij"
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/log", ts.PutPort()), ioutil.NopCloser(strings.NewReader(logContents)))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 201, res.StatusCode)
+
+	res, body := getLogRange(t, ts, "", "")
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "bytes", res.Header.Get("Accept-Ranges"))
+	require.Equal(t, logContents, body)
+
+	res, body = getLogRange(t, ts, "", "bytes=10-")
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "bytes 10-19/20", res.Header.Get("Content-Range"))
+	require.Equal(t, "abcdefghij", body)
+
+	res, body = getLogRange(t, ts, "", "bytes=5-9")
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "bytes 5-9/20", res.Header.Get("Content-Range"))
+	require.Equal(t, "56789", body)
+
+	res, body = getLogRange(t, ts, "", "bytes=15-100")
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "bytes 15-19/20", res.Header.Get("Content-Range"))
+	require.Equal(t, "fghij", body)
+
+	res, body = getLogRange(t, ts, "?offset=12", "")
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "bytes 12-19/20", res.Header.Get("Content-Range"))
+	require.Equal(t, "cdefghij", body)
+
+	res, body = getLogRange(t, ts, "", "bytes=0-9223372036854775807")
+	require.Equal(t, 206, res.StatusCode)
+	require.Equal(t, "bytes 0-19/20", res.Header.Get("Content-Range"))
+	require.Equal(t, logContents, body)
+
+	res, _ = getLogRange(t, ts, "", "bytes=20-")
+	require.Equal(t, 416, res.StatusCode)
+	require.Equal(t, "bytes */20", res.Header.Get("Content-Range"))
+
+	res, _ = getLogRange(t, ts, "?offset=-1", "")
+	require.Equal(t, 400, res.StatusCode)
+
+	// unsupported ranges are ignored
+	res, body = getLogRange(t, ts, "", "bytes=-5")
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, logContents, body)
+}
+
+func TestRangeOfLiveLog(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	var chunks [][]byte
+	for i := 0; i < 2000; i++ {
+		chunks = append(chunks, []byte(fmt.Sprintf("%d|%s\n", i, TEXT)))
+	}
+	logContents := bytes.Join(chunks, []byte{})
+
+	go func() {
+		body := ioutil.NopCloser(&ChunkReader{chunks: chunks})
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/log", ts.PutPort()), body)
+		if err != nil {
+			panic(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		if res.StatusCode != 201 {
+			panic(fmt.Sprintf("writer got %s", res.Status))
+		}
+	}()
+
+	// resume from an offset that may not have been written yet
+	res, body := getLogRange(t, ts, "?offset=100000", "")
+	require.Equal(t, 206, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Content-Range"), "bytes 100000-"))
+	require.Equal(t, string(logContents[100000:]), body)
+}
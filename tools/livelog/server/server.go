@@ -0,0 +1,366 @@
+// Package server implements livelog, which serves logs over HTTP while they
+// are being written. It is used by the livelog executable, and can be used to
+// serve logs from within another process, such as generic-worker.
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	stream "github.com/taskcluster/taskcluster/v39/tools/livelog/writer"
+)
+
+// Run an http.Server.  In production this is just `ListenAndServe`, but
+// is overridden in testing to use ephemeral ports and ensure servers are
+// shut down correctly.
+var runServer = func(server *http.Server, addr, crtFile, keyFile string) error {
+	server.Addr = addr
+	if crtFile != "" && keyFile != "" {
+		return server.ListenAndServeTLS(crtFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// Server serves livelog streams over HTTP. Streams can be PUT to the PUT
+// interface (see Serve) or set directly with SetLogStream, and are read from
+// the GET interface (see GetHandler).
+type Server struct {
+	// accessToken is the access token required to read the stream PUT to
+	// /log
+	accessToken string
+	registry    *streamRegistry
+}
+
+// New returns a Server that requires the given access token for reading the
+// stream PUT to /log, or set with SetLogStream.
+func New(accessToken string) *Server {
+	return &Server{
+		accessToken: accessToken,
+		registry:    newStreamRegistry(),
+	}
+}
+
+func abort(writer http.ResponseWriter) {
+	// We need to hijack and abort the request...
+	conn, _, err := writer.(http.Hijacker).Hijack()
+
+	if err != nil {
+		return
+	}
+
+	// Force the connection closed to signal that the response was not
+	// completed...
+	conn.Close()
+}
+
+// accessDenied responds to a GET request with an invalid access token
+func accessDenied(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(401)
+	fmt.Fprint(w, "Access denied")
+}
+
+// GetHandler returns the http.Handler of the GET interface, which serves the
+// stream set with SetLogStream at /log/<accessToken>, and named streams at
+// /streams/<name>/<accessToken>. Appending /events to either URL serves the
+// stream as Server-Sent Events.
+func (server *Server) GetHandler() http.Handler {
+	routes := http.NewServeMux()
+	routes.HandleFunc("/log/", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("output %s %s", r.Method, r.URL.String())
+
+		// Authenticate the request with accessToken, this is good enough because
+		// live logs are short-lived, we do this by slicing away '/log/' from the
+		// URL path and comparing the reminder to the accessToken, ensuring a URL
+		// pattern /log/<accessToken>, or /log/<accessToken>/events for the log
+		// as Server-Sent Events
+		token := r.URL.Path[5:]
+		events := strings.HasSuffix(token, EVENTS_SUFFIX)
+		token = strings.TrimSuffix(token, EVENTS_SUFFIX)
+		logStream := server.registry.getLogStream()
+		if token != server.accessToken || logStream == nil {
+			accessDenied(w)
+		} else if events {
+			getLogEvents(logStream, w, r)
+		} else {
+			getLog(logStream, w, r)
+		}
+	})
+	routes.HandleFunc("/streams/", getStream(server.registry))
+	return routes
+}
+
+// SetLogStream sets the stream served at /log/<accessToken>. This is the
+// in-process equivalent of a PUT to /log; the caller is responsible for
+// calling Consume on the stream.
+func (server *Server) SetLogStream(logStream *stream.Stream) {
+	server.registry.setLogStream(logStream)
+}
+
+func (server *Server) startLogServe(getAddr, crtFile, keyFile string) {
+	httpServer := http.Server{
+		Handler: server.GetHandler(),
+	}
+
+	var err error
+	if crtFile != "" && keyFile != "" {
+		log.Printf("Output server listening... %s (with TLS)", httpServer.Addr)
+		log.Printf("key %s ", keyFile)
+		log.Printf("crt %s ", crtFile)
+		err = runServer(&httpServer, getAddr, crtFile, keyFile)
+	} else {
+		log.Printf("Output server listening... %s (without TLS)", httpServer.Addr)
+		err = runServer(&httpServer, getAddr, "", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("%s", err)
+	}
+}
+
+// HTTP logic for serving the contents of a stream...
+func getLog(
+	stream *stream.Stream,
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	start, stop, partial, err := requestedRange(req)
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, err)
+		return
+	}
+
+	// The length of the log is only known once the stream has ended
+	length, ended := stream.GetState()
+	if partial && ended {
+		if start >= length {
+			writer.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			writer.Header().Set("Access-Control-Allow-Origin", "*")
+			writer.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if stop > length {
+			stop = length
+		}
+	}
+
+	handle := stream.Observe(start, stop)
+
+	defer func() {
+		// Ensure we close our file handle...
+		// Ensure the stream is cleaned up after errors, etc...
+		stream.Unobserve(handle)
+		log.Print("send connection close...")
+	}()
+
+	// TODO: Allow the input stream to configure headers rather then assume
+	// intentions...
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.Header().Set("Access-Control-Expose-Headers", "Transfer-Encoding, Content-Range")
+	writer.Header().Set("Accept-Ranges", "bytes")
+	writer.Header().Add("Vary", "Accept-Encoding")
+
+	// Compress the log if the reader accepts it. Ranges refer to the
+	// uncompressed log, so partial responses are not compressed.
+	var target io.Writer = writer
+	var cw *compressedWriter
+	if encoding := acceptedEncoding(req); encoding != "" && !partial {
+		writer.Header().Set("Content-Encoding", encoding)
+		cw = newCompressedWriter(writer, encoding)
+		target = cw
+	}
+
+	// Send headers so its clear what we are trying to do...
+	if partial {
+		writer.Header().Set("Content-Range", contentRange(start, stop, length, ended))
+		writer.WriteHeader(http.StatusPartialContent)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+	log.Print("wrote headers...")
+
+	// Begin streaming any pending results...
+	_, writeToErr := handle.WriteTo(target)
+	if writeToErr != nil {
+		log.Println("Error during write...", writeToErr)
+		if cw != nil {
+			cw.Abandon()
+		}
+		abort(writer)
+		return
+	}
+	if cw != nil {
+		if closeErr := cw.Close(); closeErr != nil {
+			log.Println("Error completing compressed response...", closeErr)
+		}
+	}
+}
+
+// requestedRange returns the range of bytes of the log that the request asks
+// for, from start (inclusive) to stop (exclusive). A range may be requested
+// with a Range header of the form "bytes=N-" or "bytes=N-M", or with query
+// string parameter offset=N, so that clients that lose their connection can
+// resume reading where they left off. Other forms of Range header are ignored,
+// as permitted by RFC 7233, and the whole log is returned. If no range is
+// requested, partial is false.
+func requestedRange(req *http.Request) (start, stop int64, partial bool, err error) {
+	start, stop = 0, math.MaxInt64
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		if match := byteRange.FindStringSubmatch(rangeHeader); match != nil {
+			first, firstErr := strconv.ParseInt(match[1], 10, 64)
+			last, lastErr := int64(math.MaxInt64-1), error(nil)
+			if match[2] != "" {
+				last, lastErr = strconv.ParseInt(match[2], 10, 64)
+				// no log is this long, and stop (last + 1) must not overflow
+				if last == math.MaxInt64 {
+					last--
+				}
+			}
+			if firstErr == nil && lastErr == nil && first <= last {
+				return first, last + 1, true, nil
+			}
+		}
+		return start, stop, false, nil
+	}
+	if offset := req.URL.Query().Get("offset"); offset != "" {
+		start, err = strconv.ParseInt(offset, 10, 64)
+		if err != nil || start < 0 {
+			return 0, 0, false, fmt.Errorf("Query string parameter offset must be a non-negative integer, but is %q", offset)
+		}
+		return start, stop, true, nil
+	}
+	return start, stop, false, nil
+}
+
+var byteRange = regexp.MustCompile(`^bytes=([0-9]+)-([0-9]*)$`)
+
+// contentRange returns the Content-Range header for a response containing
+// the bytes of the log from start (inclusive) to stop (exclusive). While the
+// log is still being written, its length is unknown, and so is the position
+// of the last byte of an open ended range, which are both given as "*".
+func contentRange(start, stop, length int64, ended bool) string {
+	last := "*"
+	if stop != math.MaxInt64 {
+		last = strconv.FormatInt(stop-1, 10)
+	}
+	total := "*"
+	if ended {
+		total = strconv.FormatInt(length, 10)
+	}
+	return fmt.Sprintf("bytes %d-%s/%s", start, last, total)
+}
+
+// Logic here mostly inspired by what docker does...
+func attachProfiler(router *http.ServeMux) {
+	router.HandleFunc("/debug/pprof/", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/heap", pprof.Handler("heap").ServeHTTP)
+	router.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
+	router.HandleFunc("/debug/pprof/threadcreate", pprof.Handler("threadcreate").ServeHTTP)
+}
+
+// Serve serves the PUT interface on putAddr, until it fails. Once the first
+// stream has been PUT, the GET interface is served on getAddr, using TLS if
+// crtFile and keyFile are both given. If debug is true, profiling data is
+// served by the PUT interface under /debug/pprof/. This is what the livelog
+// executable does.
+func (server *Server) Serve(putAddr, getAddr, crtFile, keyFile string, debug bool) error {
+	handlingPut := false
+	mutex := sync.Mutex{}
+	registry := server.registry
+
+	// The GET server is started once the first stream has been PUT
+	var getServerOnce sync.Once
+	startGetServer := func() {
+		getServerOnce.Do(func() {
+			go server.startLogServe(getAddr, crtFile, keyFile)
+		})
+	}
+
+	routes := http.NewServeMux()
+
+	if debug {
+		attachProfiler(routes)
+	}
+
+	httpServer := http.Server{
+		Handler: routes,
+	}
+
+	// The "main" http server is for the PUT side which should not be exposed
+	// publicly but via links in the docker container... In the future we can
+	// handle something fancier.
+	routes.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("input %s %s", r.Method, r.URL.String())
+
+		if r.Method != "PUT" {
+			log.Print("input not put")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("This endpoint can only handle PUT requests"))
+			return
+		}
+
+		// Threadsafe checking of the `handlingPut` flag
+		mutex.Lock()
+		if handlingPut {
+			log.Print("Attempt to put when in progress")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("This endpoint can only process one http PUT at a time"))
+			mutex.Unlock() // used instead of defer so we don't block other rejections
+			return
+		}
+		handlingPut = true
+		mutex.Unlock() // So we don't block other rejections...
+
+		stream, streamErr := stream.NewStream(r.Body)
+
+		if streamErr != nil {
+			log.Printf("input stream open err %v", streamErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Could not open stream for body"))
+
+			// Allow for retries of the initial put if something goes wrong...
+			mutex.Lock()
+			handlingPut = false
+			mutex.Unlock()
+			return
+		}
+
+		// Signal initial success...
+		w.WriteHeader(http.StatusCreated)
+
+		// Initialize the sub server in another go routine...
+		log.Print("Begin consuming...")
+		registry.setLogStream(stream)
+		startGetServer()
+		consumeErr := stream.Consume()
+		if consumeErr != nil {
+			log.Println("Error finalizing consume of stream", consumeErr)
+			abort(w)
+			return
+		}
+	})
+
+	// Named streams are created with PUT /streams/<name>, and read with GET
+	// /streams/<name>/<accessToken>
+	routes.HandleFunc("/streams/", putStream(registry, startGetServer))
+
+	// Listen forever on the PUT side...
+	log.Printf("input server listening... %s", httpServer.Addr)
+	// Main put server listens on the public root for the worker.
+	return runServer(&httpServer, putAddr, "", "")
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	stream "github.com/taskcluster/taskcluster/v39/tools/livelog/writer"
+)
+
+const (
+	// EVENTS_SUFFIX is appended to the URL of a stream, to read it as
+	// Server-Sent Events
+	EVENTS_SUFFIX = "/events"
+
+	// MAX_EVENT_LINE_LENGTH is the length (in bytes) after which a line with
+	// no line ending yet is sent as an event anyway, split so as not to break
+	// up a UTF-8 encoded character
+	MAX_EVENT_LINE_LENGTH = 64 * 1024
+)
+
+// How often a heartbeat event is sent to readers of Server-Sent Events, so
+// that they can tell a live connection with no new output from a dead one.
+// This is a time.Duration, accessed atomically, as it is overridden in tests.
+var heartbeatInterval = int64(15 * time.Second)
+
+// eventWriter is the io.Writer that a StreamHandle writes the stream to, when
+// serving Server-Sent Events. It sends each complete line as a message event,
+// whose id is the byte offset in the stream of the end of the line.
+type eventWriter struct {
+	// mutex covers all of the fields below, and writes to writer, which are
+	// also made by the heartbeat goroutine
+	mutex   sync.Mutex
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	// offset is the byte offset in the stream of the end of line
+	offset int64
+	// line is the partial line that has been received, but not sent yet
+	line []byte
+	err  error
+}
+
+func (ew *eventWriter) Write(p []byte) (int, error) {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	for _, b := range p {
+		ew.line = append(ew.line, b)
+		if b == '\n' {
+			ew.sendLine(len(ew.line))
+		} else if len(ew.line) >= MAX_EVENT_LINE_LENGTH {
+			ew.sendLine(runeBoundary(ew.line))
+		}
+	}
+	return len(p), ew.err
+}
+
+// Flush is called by StreamHandle.WriteTo when it has no more data to write
+// for now
+func (ew *eventWriter) Flush() {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+	if ew.flusher != nil {
+		ew.flusher.Flush()
+	}
+}
+
+// runeBoundary returns the length of line, less any UTF-8 encoded character
+// at its end that is not complete yet
+func runeBoundary(line []byte) int {
+	for i := len(line) - 1; i >= 0 && i >= len(line)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(line[i]) {
+			if i > 0 && !utf8.FullRune(line[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(line)
+}
+
+// sendLine sends the first n bytes of the partial line as a message event,
+// with line endings removed. A carriage return cannot be part of the data of
+// an event, so a line containing carriage returns is sent as several data
+// fields, which readers join with line feeds. Invalid UTF-8 is replaced.
+func (ew *eventWriter) sendLine(n int) {
+	ew.offset += int64(n)
+	line := strings.TrimSuffix(strings.TrimSuffix(string(ew.line[:n]), "\n"), "\r")
+	ew.line = append(ew.line[:0], ew.line[n:]...)
+	var event bytes.Buffer
+	fmt.Fprintf(&event, "id: %d\n", ew.offset)
+	for _, data := range strings.Split(strings.ToValidUTF8(line, "�"), "\r") {
+		fmt.Fprintf(&event, "data: %s\n", data)
+	}
+	event.WriteString("\n")
+	ew.send(event.Bytes())
+}
+
+// sendEvent sends an event of the given type, whose data is the byte offset
+// of the end of the last line sent, and flushes it
+func (ew *eventWriter) sendEvent(eventType string) {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+	ew.send([]byte(fmt.Sprintf("event: %s\ndata: %d\n\n", eventType, ew.offset)))
+	if ew.flusher != nil {
+		ew.flusher.Flush()
+	}
+}
+
+func (ew *eventWriter) send(event []byte) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = ew.writer.Write(event)
+}
+
+// getLogEvents serves the contents of a stream as Server-Sent Events (see
+// https://html.spec.whatwg.org/multipage/server-sent-events.html). Each line
+// is sent as a message event with the byte offset of the end of the line as
+// its id, so that a reader that reconnects with a Last-Event-ID header (or an
+// offset query string parameter) continues after the last line it received.
+// A heartbeat event is sent every heartbeatInterval, and an end event once
+// the stream has ended. The data of heartbeat and end events is the byte
+// offset of the end of the last line sent.
+func getLogEvents(
+	stream *stream.Stream,
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	var start int64
+	var err error
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		start, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || start < 0 {
+			err = fmt.Errorf("Header Last-Event-ID must be a non-negative integer, but is %q", lastEventID)
+		}
+	} else {
+		start, _, _, err = requestedRange(req)
+	}
+	if err != nil {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, err)
+		return
+	}
+
+	handle := stream.Observe(start, math.MaxInt64)
+	defer func() {
+		stream.Unobserve(handle)
+		log.Print("send connection close...")
+	}()
+
+	writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	// prevent proxies such as nginx from buffering the events
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+
+	ew := &eventWriter{
+		writer: writer,
+		offset: start,
+	}
+	ew.flusher, _ = writer.(http.Flusher)
+	ew.Flush()
+
+	done := make(chan struct{})
+	var heartbeats sync.WaitGroup
+	heartbeats.Add(1)
+	go func() {
+		defer heartbeats.Done()
+		ticker := time.NewTicker(time.Duration(atomic.LoadInt64(&heartbeatInterval)))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ew.sendEvent("heartbeat")
+			}
+		}
+	}()
+
+	_, writeToErr := handle.WriteTo(ew)
+	// writer must not be used once the connection has been aborted or the
+	// handler has returned, so wait for heartbeats to stop
+	close(done)
+	heartbeats.Wait()
+	if writeToErr != nil {
+		log.Println("Error during write...", writeToErr)
+		abort(writer)
+		return
+	}
+	// send any final line that has no line ending
+	ew.mutex.Lock()
+	if len(ew.line) > 0 {
+		ew.sendLine(len(ew.line))
+	}
+	ew.mutex.Unlock()
+	ew.sendEvent("end")
+}
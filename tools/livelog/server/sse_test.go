@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	stream "github.com/taskcluster/taskcluster/v39/tools/livelog/writer"
+)
+
+// event is a Server-Sent Event read by readEvent
+type event struct {
+	id        string
+	eventType string
+	data      string
+}
+
+// readEvent reads the next event from the given reader
+func readEvent(t *testing.T, reader *bufio.Reader) event {
+	var e event
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			e.data = strings.Join(data, "\n")
+			return e
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		require.Len(t, parts, 2, "invalid event line %q", line)
+		switch parts[0] {
+		case "id":
+			e.id = parts[1]
+		case "event":
+			e.eventType = parts[1]
+		case "data":
+			data = append(data, parts[1])
+		default:
+			t.Fatalf("unexpected event field %q", line)
+		}
+	}
+}
+
+func getLogEventsResponse(t *testing.T, url string, lastEventID string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func TestLogEvents(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	logContents := "first\nsecond\r\nprogress 1%\rprogress 100%\nlast"
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/log", ts.PutPort()), ioutil.NopCloser(strings.NewReader(logContents)))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 201, res.StatusCode)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/log/7_3HoMEbQau1Qlzwx-JZgg/events", ts.GetPort())
+	res = getLogEventsResponse(t, url, "")
+	defer res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "text/event-stream; charset=utf-8", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+	require.Equal(t, event{id: "6", data: "first"}, readEvent(t, reader))
+	require.Equal(t, event{id: "14", data: "second"}, readEvent(t, reader))
+	require.Equal(t, event{id: "40", data: "progress 1%\nprogress 100%"}, readEvent(t, reader))
+	require.Equal(t, event{id: "44", data: "last"}, readEvent(t, reader))
+	require.Equal(t, event{eventType: "end", data: "44"}, readEvent(t, reader))
+
+	// reconnecting continues after the last event received
+	res = getLogEventsResponse(t, url, "14")
+	defer res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	reader = bufio.NewReader(res.Body)
+	require.Equal(t, event{id: "40", data: "progress 1%\nprogress 100%"}, readEvent(t, reader))
+	require.Equal(t, event{id: "44", data: "last"}, readEvent(t, reader))
+	require.Equal(t, event{eventType: "end", data: "44"}, readEvent(t, reader))
+
+	res = getLogEventsResponse(t, url, "not-an-offset")
+	res.Body.Close()
+	require.Equal(t, 400, res.StatusCode)
+
+	res = getLogEventsResponse(t, fmt.Sprintf("http://127.0.0.1:%d/log/wrong-token/events", ts.GetPort()), "")
+	res.Body.Close()
+	require.Equal(t, 401, res.StatusCode)
+}
+
+func TestNamedStreamEvents(t *testing.T) {
+	defer atomic.StoreInt64(&heartbeatInterval, atomic.SwapInt64(&heartbeatInterval, int64(10*time.Millisecond)))
+
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	stdout, stdoutResult := startPutStream(t, ts, "stdout", "stdout-token")
+	_, err := stdout.Write([]byte("hello "))
+	require.NoError(t, err)
+
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		res = getLogEventsResponse(t, getStreamURL(ts, "stdout", "stdout-token")+EVENTS_SUFFIX, "")
+		if res.StatusCode != 404 {
+			break
+		}
+		res.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 200, res.StatusCode)
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+
+	// a partial line is not sent, but heartbeats are
+	require.Equal(t, event{eventType: "heartbeat", data: "0"}, readEvent(t, reader))
+
+	_, err = stdout.Write([]byte("world\nbye\n"))
+	require.NoError(t, err)
+	e := readEvent(t, reader)
+	for e.eventType == "heartbeat" {
+		e = readEvent(t, reader)
+	}
+	require.Equal(t, event{id: "12", data: "hello world"}, e)
+
+	require.NoError(t, stdout.Close())
+	require.Equal(t, 201, (<-stdoutResult).StatusCode)
+	var events []event
+	for e.eventType != "end" {
+		e = readEvent(t, reader)
+		if e.eventType != "heartbeat" {
+			events = append(events, e)
+		}
+	}
+	require.Equal(t, []event{{id: "16", data: "bye"}, {eventType: "end", data: "16"}}, events)
+}
+
+func TestLogEventsLongLines(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	ew := &eventWriter{writer: recorder}
+	line := strings.Repeat("a", MAX_EVENT_LINE_LENGTH-1) + "é"
+	_, err := ew.Write([]byte(line + "\n"))
+	require.NoError(t, err)
+
+	// a long line is split before a character that would not fit, rather
+	// than in the middle of it
+	reader := bufio.NewReader(recorder.Body)
+	require.Equal(t, event{id: strconv.Itoa(MAX_EVENT_LINE_LENGTH - 1), data: line[:MAX_EVENT_LINE_LENGTH-1]}, readEvent(t, reader))
+	require.Equal(t, event{id: strconv.Itoa(len(line) + 1), data: "é"}, readEvent(t, reader))
+}
+
+func TestLogEventsNoHeartbeatAfterEnd(t *testing.T) {
+	defer atomic.StoreInt64(&heartbeatInterval, atomic.SwapInt64(&heartbeatInterval, int64(time.Microsecond)))
+
+	s, err := stream.NewStream(strings.NewReader("hello\n"))
+	require.NoError(t, err)
+	require.NoError(t, s.Consume())
+	defer s.Remove()
+
+	req := httptest.NewRequest("GET", "/log/events", nil)
+	recorder := httptest.NewRecorder()
+	getLogEvents(s, recorder, req)
+	body := recorder.Body.String()
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, body, recorder.Body.String())
+	require.True(t, strings.HasSuffix(body, "event: end\ndata: 6\n\n"), "events do not finish with end event: %q", body)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	stream "github.com/taskcluster/taskcluster/v39/tools/livelog/writer"
+)
+
+// ACCESS_TOKEN_HEADER is the request header of a PUT to /streams/<name> that
+// holds the access token required to read the stream
+const ACCESS_TOKEN_HEADER = "X-Livelog-Access-Token"
+
+// streamName is the pattern that names of streams must match
+var streamName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// namedStream is a stream created by a PUT to /streams/<name>
+type namedStream struct {
+	stream      *stream.Stream
+	accessToken string
+}
+
+// streamRegistry holds the streams being served
+type streamRegistry struct {
+	mutex sync.Mutex
+	// logStream is the stream created by a PUT to /log, if any. It is served
+	// for the life of the process, with the access token given by the
+	// ACCESS_TOKEN environment variable.
+	logStream *stream.Stream
+	// streams are the named streams. A named stream is removed once its PUT
+	// request completes.
+	streams map[string]*namedStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		streams: map[string]*namedStream{},
+	}
+}
+
+// setLogStream sets the stream served at /log/<accessToken>
+func (registry *streamRegistry) setLogStream(logStream *stream.Stream) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.logStream = logStream
+}
+
+// getLogStream returns the stream served at /log/<accessToken>, or nil
+func (registry *streamRegistry) getLogStream() *stream.Stream {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.logStream
+}
+
+// reserve reserves the given stream name, and returns false if a stream with
+// the given name already exists
+func (registry *streamRegistry) reserve(name string) bool {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if _, exists := registry.streams[name]; exists {
+		return false
+	}
+	// a nil entry reserves the name, without the stream being readable yet
+	registry.streams[name] = nil
+	return true
+}
+
+// set makes the named stream readable, under a name that has been reserved
+func (registry *streamRegistry) set(name string, ns *namedStream) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.streams[name] = ns
+}
+
+// remove unregisters the named stream, and deletes its backing file once
+// its current readers have finished
+func (registry *streamRegistry) remove(name string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if ns, exists := registry.streams[name]; exists {
+		delete(registry.streams, name)
+		if ns != nil {
+			ns.stream.Remove()
+		}
+	}
+}
+
+// get returns the named stream, or nil
+func (registry *streamRegistry) get(name string) *namedStream {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	return registry.streams[name]
+}
+
+// putStream is the HTTP handler for PUT /streams/<name>, which creates a
+// stream with the given name from the request body. The stream can be read
+// with GET /streams/<name>/<accessToken> until the request body has been
+// fully consumed, after which the stream is removed.
+func putStream(registry *streamRegistry, startGetServer func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("input %s %s", r.Method, r.URL.String())
+
+		if r.Method != "PUT" {
+			log.Print("input not put")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("This endpoint can only handle PUT requests"))
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/streams/")
+		if !streamName.MatchString(name) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("Stream name must match regular expression %v", streamName)))
+			return
+		}
+
+		accessToken := r.Header.Get(ACCESS_TOKEN_HEADER)
+		if accessToken == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(fmt.Sprintf("The access token for reading the stream must be given in request header %v", ACCESS_TOKEN_HEADER)))
+			return
+		}
+
+		if !registry.reserve(name) {
+			log.Printf("Attempt to put stream %v when in progress", name)
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(fmt.Sprintf("Stream %v is already being written", name)))
+			return
+		}
+		defer registry.remove(name)
+
+		stream, streamErr := stream.NewStream(r.Body)
+		if streamErr != nil {
+			log.Printf("input stream open err %v", streamErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Could not open stream for body"))
+			return
+		}
+		registry.set(name, &namedStream{stream: stream, accessToken: accessToken})
+
+		// Signal initial success...
+		w.WriteHeader(http.StatusCreated)
+
+		startGetServer()
+		log.Printf("Begin consuming stream %v...", name)
+		consumeErr := stream.Consume()
+		if consumeErr != nil {
+			log.Printf("Error finalizing consume of stream %v: %v", name, consumeErr)
+			abort(w)
+		}
+	}
+}
+
+// getStream is the HTTP handler for GET /streams/<name>/<accessToken>, and
+// GET /streams/<name>/<accessToken>/events for the stream as Server-Sent
+// Events
+func getStream(registry *streamRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("output %s %s", r.Method, r.URL.String())
+
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/streams/"), "/", 2)
+		var ns *namedStream
+		if len(parts) == 2 {
+			ns = registry.get(parts[0])
+		}
+		if ns == nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Stream not found")
+			return
+		}
+		token := strings.TrimSuffix(parts[1], EVENTS_SUFFIX)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ns.accessToken)) != 1 {
+			accessDenied(w)
+			return
+		}
+		if token != parts[1] {
+			getLogEvents(ns.stream, w, r)
+			return
+		}
+		getLog(ns.stream, w, r)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startPutStream starts a PUT of a named stream, whose content is written to the
+// returned pipe, and returns a channel that receives the response
+func startPutStream(t *testing.T, ts *TestLivelogServer, name, accessToken string) (*io.PipeWriter, chan *http.Response) {
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/streams/%s", ts.PutPort(), name), reader)
+	require.NoError(t, err)
+	req.Header.Set(ACCESS_TOKEN_HEADER, accessToken)
+	result := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		result <- res
+	}()
+	return writer, result
+}
+
+func getStreamURL(ts *TestLivelogServer, name, accessToken string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d/streams/%s/%s", ts.GetPort(), name, accessToken)
+}
+
+func TestNamedStreams(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	var err error
+	stdout, stdoutResult := startPutStream(t, ts, "stdout", "stdout-token")
+	stderr, stderrResult := startPutStream(t, ts, "stderr", "stderr-token")
+	_, err = stdout.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = stderr.Write([]byte("oops "))
+	require.NoError(t, err)
+
+	// the streams are readable once their PUT requests have been handled
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		res, err = http.Get(getStreamURL(ts, "stdout", "stdout-token") + "?offset=6")
+		require.NoError(t, err)
+		if res.StatusCode != 404 {
+			break
+		}
+		res.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 206, res.StatusCode)
+	stdoutReader := res.Body
+	defer stdoutReader.Close()
+
+	// each stream has its own access token
+	res, err = http.Get(getStreamURL(ts, "stderr", "stdout-token"))
+	require.NoError(t, err)
+	require.Equal(t, 401, res.StatusCode)
+
+	// a stream name can only be written once at a time
+	conflict, conflictResult := startPutStream(t, ts, "stdout", "another-token")
+	require.NoError(t, conflict.Close())
+	require.Equal(t, 409, (<-conflictResult).StatusCode)
+
+	_, err = stdout.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, stdout.Close())
+	require.Equal(t, 201, (<-stdoutResult).StatusCode)
+	body, err := ioutil.ReadAll(stdoutReader)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(body))
+
+	// once written, a stream is removed
+	res, err = http.Get(getStreamURL(ts, "stdout", "stdout-token"))
+	require.NoError(t, err)
+	require.Equal(t, 404, res.StatusCode)
+
+	// ...but others are still served
+	require.NoError(t, stderr.Close())
+	require.Equal(t, 201, (<-stderrResult).StatusCode)
+
+	// ...and the name can be reused
+	stdout, stdoutResult = startPutStream(t, ts, "stdout", "new-token")
+	require.NoError(t, stdout.Close())
+	require.Equal(t, 201, (<-stdoutResult).StatusCode)
+}
+
+func TestInvalidNamedStreams(t *testing.T) {
+	ts := StartServer(t, false)
+	defer ts.Close()
+
+	for name, accessToken := range map[string]string{
+		"no-token":               "",
+		"bad/name":               "token",
+		strings.Repeat("x", 129): "token",
+	} {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("http://127.0.0.1:%d/streams/%s", ts.PutPort(), name), strings.NewReader("content"))
+		require.NoError(t, err)
+		if accessToken != "" {
+			req.Header.Set(ACCESS_TOKEN_HEADER, accessToken)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, 400, res.StatusCode, "stream name %q", name)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -40,6 +41,10 @@ type Stream struct {
 	offset  int64
 	ended   bool
 	handles Handles
+	// observers is the number of handles that have not been unobserved yet
+	observers int
+	// removed is true once Remove has been called
+	removed bool
 }
 
 func NewStream(read io.Reader) (*Stream, error) {
@@ -75,6 +80,10 @@ func (self *Stream) Unobserve(handle *StreamHandle) {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 	delete(self.handles, handle)
+	self.observers--
+	if self.removed && self.observers == 0 {
+		self.removeBackingFile()
+	}
 }
 
 func (self *Stream) Observe(start, stop int64) *StreamHandle {
@@ -83,9 +92,29 @@ func (self *Stream) Observe(start, stop int64) *StreamHandle {
 	self.mutex.Lock()
 	defer self.mutex.Unlock()
 	self.handles[&handle] = emptyStruct
+	self.observers++
 	return &handle
 }
 
+// Remove deletes the backing file of the stream, once all handles have been
+// unobserved. It should be called after Consume has returned, once no new
+// handles will be created.
+func (self *Stream) Remove() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.removed = true
+	if self.observers == 0 {
+		self.removeBackingFile()
+	}
+}
+
+func (self *Stream) removeBackingFile() {
+	err := os.RemoveAll(filepath.Dir(self.Path))
+	if err != nil {
+		log.Printf("Could not remove backing file of stream %v: %v", self.Path, err)
+	}
+}
+
 // Get the state of this stream in a thread-safe fashion
 func (self *Stream) GetState() (offset int64, ended bool) {
 	self.mutex.Lock()
@@ -153,8 +182,9 @@ func (self *Stream) Consume() error {
 		// Emit all the messages...
 		for handle := range self.handles {
 
-			// Don't write anything that starts after we end...
-			if event.Offset > handle.Stop || event.Offset+event.Length <= handle.Start {
+			// Don't write anything that starts after we end, but always send
+			// the final event, so that handles waiting for more data finish...
+			if !event.End && (event.Offset >= handle.Stop || event.Offset+event.Length <= handle.Start) {
 				continue
 			}
 
@@ -47,7 +47,7 @@ func (self *StreamHandle) writeEvent(event *Event, w io.Writer) (int64, error) {
 	startInEvent := self.Offset - event.Offset
 	var endInEvent int64
 	if eventEndOffset > self.Stop {
-		endInEvent = eventEndOffset - self.Stop
+		endInEvent = self.Stop - event.Offset
 	} else {
 		endInEvent = event.Length
 	}
@@ -86,8 +86,14 @@ func (self *StreamHandle) WriteTo(target io.Writer) (n int64, err error) {
 			offset = self.Stop
 		}
 
-		// Begin by copying the initial data from the sink...
-		written, copyErr := io.CopyN(target, file, offset)
+		// Begin by copying the initial data from the sink, starting at the
+		// `Start` value for this handle...
+		_, seekErr := file.Seek(self.Start, io.SeekStart)
+		if seekErr != nil {
+			file.Close()
+			return 0, seekErr
+		}
+		written, copyErr := io.CopyN(target, file, offset-self.Start)
 		file.Close()
 
 		self.Offset += written
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the record of a proxied request that is written to the audit
+// log. Request and response bodies are never recorded, and the values of
+// query string parameters that may hold secrets are redacted.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Service    string    `json:"service"`
+	APIVersion string    `json:"apiVersion,omitempty"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// AuditLog writes an AuditRecord for each proxied request, as a line of json.
+// A nil *AuditLog records nothing.
+type AuditLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// redactedQueryParameters are substrings of (lower case) query string
+// parameter names, whose values are not recorded in the audit log
+var redactedQueryParameters = []string{
+	"bewit",
+	"credential",
+	"key",
+	"password",
+	"secret",
+	"signature",
+	"token",
+}
+
+// NewAuditLog returns an AuditLog that writes records to w. Each record is
+// written with a single call to w.Write, so that records are not lost if the
+// proxy is killed, provided w is unbuffered.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{
+		w: w,
+	}
+}
+
+// Record writes the given record to the audit log
+func (auditLog *AuditLog) Record(record *AuditRecord) {
+	if auditLog == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		panic(err)
+	}
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	_, err = auditLog.w.Write(append(line, '\n'))
+	if err != nil {
+		log.Printf("Could not write to audit log: %v", err)
+	}
+}
+
+// newAuditRecord returns the audit record for a request with the given method
+// to the given target URL, that started at the given time, and completed with
+// the given status
+func newAuditRecord(method string, targetPath *url.URL, start time.Time, status int) *AuditRecord {
+	record := &AuditRecord{
+		Time:       start.UTC(),
+		Method:     method,
+		Service:    targetPath.Host,
+		Path:       targetPath.EscapedPath(),
+		Query:      redactQuery(targetPath.Query()),
+		Status:     status,
+		DurationMs: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if match := apiPath.FindStringSubmatch(record.Path); match != nil {
+		record.Service = match[1]
+		record.APIVersion = match[2]
+		record.Path = "/" + match[3]
+	}
+	return record
+}
+
+// redactQuery returns the encoded query string, with the values of parameters
+// that may hold secrets replaced by "REDACTED"
+func redactQuery(query url.Values) string {
+	for name, values := range query {
+		lowerName := strings.ToLower(name)
+		for _, redacted := range redactedQueryParameters {
+			if strings.Contains(lowerName, redacted) {
+				for i := range values {
+					values[i] = "REDACTED"
+				}
+				break
+			}
+		}
+	}
+	return query.Encode()
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code of
+// the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"code": "ResourceNotFound"}`))
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+	var auditLog bytes.Buffer
+	routes.auditLog = NewAuditLog(&auditLog)
+
+	req := httptest.NewRequest("POST", "http://localhost:60024/api/secrets/v1/secret/garbage/foo?limit=10&accessToken=abc&X-Amz-Signature=def", strings.NewReader(`{"secret": "do not log me"}`))
+	res := httptest.NewRecorder()
+	routes.APIHandler(res, req)
+
+	if strings.Contains(auditLog.String(), "do not log me") || strings.Contains(auditLog.String(), "abc") || strings.Contains(auditLog.String(), "def") {
+		t.Fatalf("Audit log contains secrets: %s", auditLog.String())
+	}
+	lines := strings.Split(strings.TrimSpace(auditLog.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 audit record but got %v: %s", len(lines), auditLog.String())
+	}
+	var record AuditRecord
+	err := json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatalf("Could not interpret audit record as json: %v", err)
+	}
+	expected := AuditRecord{
+		Time:       record.Time,
+		Method:     "POST",
+		Service:    "secrets",
+		APIVersion: "v1",
+		Path:       "/secret/garbage/foo",
+		Query:      "X-Amz-Signature=REDACTED&accessToken=REDACTED&limit=10",
+		Status:     404,
+		DurationMs: record.DurationMs,
+	}
+	if record != expected {
+		t.Fatalf("Expected audit record\n%#v\nbut got\n%#v", expected, record)
+	}
+	if record.Time.IsZero() {
+		t.Fatal("Expected audit record to have a time")
+	}
+}
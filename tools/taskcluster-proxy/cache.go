@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCachedBodySize is the largest response body (in bytes) that is
+	// cached
+	maxCachedBodySize = 1024 * 1024
+	// maxCacheEntries is the maximum number of responses held in the cache
+	maxCacheEntries = 1000
+)
+
+// cacheableEndpoints are the Taskcluster API endpoints, per service, whose
+// responses may be cached. Only GET endpoints whose results rarely change
+// are included. Status calls, listings and the like are never cached.
+var cacheableEndpoints = map[string][]*regexp.Regexp{
+	// index.findTask
+	"index": {regexp.MustCompile("^task/[^/]+$")},
+	// queue.task (task definitions are immutable)
+	"queue": {regexp.MustCompile("^task/[^/]+$")},
+	// secrets.get
+	"secrets": {regexp.MustCompile("^secret/[^/]+$")},
+}
+
+// ResponseCache is an in-memory cache of responses to GET requests to
+// cacheableEndpoints. A nil *ResponseCache caches nothing.
+type ResponseCache struct {
+	mutex sync.Mutex
+	// ttl is the maximum time a response is cached for
+	ttl     time.Duration
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	created time.Time
+	expires time.Time
+}
+
+// responseCapture records a response body as it is proxied, so that it can
+// be added to the cache afterwards
+type responseCapture struct {
+	key      string
+	response *cachedResponse
+	// overflow is true if the body is larger than maxCachedBodySize, in which
+	// case the response is not cached
+	overflow bool
+}
+
+// NewResponseCache returns a ResponseCache that caches responses for up to
+// the given duration
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		ttl:     ttl,
+		entries: map[string]*cachedResponse{},
+	}
+}
+
+// cacheKey returns the cache key of a request with the given method to the
+// given target URL, or "" if the response may not be cached
+func (cache *ResponseCache) cacheKey(req *http.Request, targetPath *url.URL) string {
+	if cache == nil || req.Method != "GET" || req.Header.Get("Range") != "" {
+		return ""
+	}
+	match := apiPath.FindStringSubmatch(targetPath.EscapedPath())
+	if match == nil {
+		return ""
+	}
+	for _, endpoint := range cacheableEndpoints[match[1]] {
+		if endpoint.MatchString(match[3]) {
+			return req.Method + " " + targetPath.String()
+		}
+	}
+	return ""
+}
+
+// lookup returns the unexpired cached response with the given key, or nil
+func (cache *ResponseCache) lookup(key string) *cachedResponse {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	response := cache.entries[key]
+	if response == nil {
+		return nil
+	}
+	if !time.Now().Before(response.expires) {
+		delete(cache.entries, key)
+		return nil
+	}
+	return response
+}
+
+// capture returns a responseCapture for the given upstream response, or nil
+// if the response may not be cached, due to its status code, its
+// Cache-Control header, or its Content-Encoding header. Encoded responses
+// depend on the Accept-Encoding header of the request, which is passed
+// upstream, so they are not cached, to avoid replaying them to clients that
+// cannot decode them.
+func (cache *ResponseCache) capture(key string, res *http.Response) *responseCapture {
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	ttl, cacheable := cacheControlTTL(res.Header.Get("Cache-Control"), cache.ttl)
+	if !cacheable {
+		return nil
+	}
+	now := time.Now()
+	return &responseCapture{
+		key: key,
+		response: &cachedResponse{
+			status:  res.StatusCode,
+			header:  cloneHeader(res.Header),
+			created: now,
+			expires: now.Add(ttl),
+		},
+	}
+}
+
+// store adds the captured response to the cache
+func (cache *ResponseCache) store(capture *responseCapture) {
+	if capture.overflow {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(cache.entries) >= maxCacheEntries {
+		now := time.Now()
+		for key, response := range cache.entries {
+			if !now.Before(response.expires) {
+				delete(cache.entries, key)
+			}
+		}
+		if len(cache.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	cache.entries[capture.key] = capture.response
+}
+
+func (capture *responseCapture) Write(p []byte) (int, error) {
+	if !capture.overflow {
+		if len(capture.response.body)+len(p) > maxCachedBodySize {
+			capture.overflow = true
+			capture.response.body = nil
+		} else {
+			capture.response.body = append(capture.response.body, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// cacheControlTTL returns how long a response with the given Cache-Control
+// header may be cached for, given the configured ttl, and whether it may be
+// cached at all
+func cacheControlTTL(cacheControl string, ttl time.Duration) (time.Duration, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return 0, false
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || maxAge <= 0 {
+				return 0, false
+			}
+			if maxAgeTTL := time.Duration(maxAge) * time.Second; maxAgeTTL < ttl {
+				ttl = maxAgeTTL
+			}
+		}
+	}
+	return ttl, true
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
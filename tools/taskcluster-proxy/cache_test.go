@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	requests := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.RequestURI()]++
+		w.Header().Add("Link", "<https://example.com/a>; rel=\"a\"")
+		w.Header().Add("Link", "<https://example.com/b>; rel=\"b\"")
+		if r.URL.Path == "/api/secrets/v1/secret/uncacheable" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		_, _ = w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+	routes.cache = NewResponseCache(time.Hour)
+
+	get := func(path string, expectedCacheHeader string) {
+		req := httptest.NewRequest("GET", "http://localhost:60024"+path, nil)
+		res := httptest.NewRecorder()
+		routes.APIHandler(res, req)
+		if res.Code != 200 {
+			t.Fatalf("%v: expected status code 200 but got %v: %s", path, res.Code, res.Body)
+		}
+		if res.Body.String() != path {
+			t.Fatalf("%v: expected body %q but got %q", path, path, res.Body)
+		}
+		if cacheHeader := res.Header().Get("X-Taskcluster-Proxy-Cache"); cacheHeader != expectedCacheHeader {
+			t.Fatalf("%v: expected X-Taskcluster-Proxy-Cache header %q but got %q", path, expectedCacheHeader, cacheHeader)
+		}
+		// all values of headers with several values are kept
+		if links := res.Header()["Link"]; len(links) != 2 || links[0] != `<https://example.com/a>; rel="a"` || links[1] != `<https://example.com/b>; rel="b"` {
+			t.Fatalf("%v: expected both Link headers but got %q", path, links)
+		}
+	}
+
+	get("/api/queue/v1/task/abc", "MISS")
+	get("/api/queue/v1/task/abc", "HIT")
+	get("/api/queue/v1/task/def", "MISS")
+	get("/api/index/v1/task/project.foo.latest", "MISS")
+	get("/api/index/v1/task/project.foo.latest", "HIT")
+	// query is part of the cache key
+	get("/api/queue/v1/task/abc?foo=bar", "MISS")
+	// status calls are never cached
+	get("/api/queue/v1/task/abc/status", "")
+	get("/api/queue/v1/task/abc/status", "")
+	// upstream Cache-Control is respected
+	get("/api/secrets/v1/secret/uncacheable", "MISS")
+	get("/api/secrets/v1/secret/uncacheable", "MISS")
+
+	expectedRequests := map[string]int{
+		"/api/queue/v1/task/abc":                1,
+		"/api/queue/v1/task/def":                1,
+		"/api/index/v1/task/project.foo.latest": 1,
+		"/api/queue/v1/task/abc?foo=bar":        1,
+		"/api/queue/v1/task/abc/status":         2,
+		"/api/secrets/v1/secret/uncacheable":    2,
+	}
+	for path, expected := range expectedRequests {
+		if requests[path] != expected {
+			t.Fatalf("Expected %v upstream request(s) for %v but got %v", expected, path, requests[path])
+		}
+	}
+
+	// cached responses expire
+	routes.cache.ttl = time.Millisecond
+	get("/api/queue/v1/task/ghi", "MISS")
+	time.Sleep(5 * time.Millisecond)
+	get("/api/queue/v1/task/ghi", "MISS")
+}
+
+func TestCacheControlTTL(t *testing.T) {
+	for cacheControl, expected := range map[string]time.Duration{
+		"":                      time.Hour,
+		"public":                time.Hour,
+		"max-age=60":            time.Minute,
+		"private, max-age=7200": time.Hour,
+		"no-store":              -1,
+		"no-cache":              -1,
+		"max-age=0":             -1,
+	} {
+		ttl, cacheable := cacheControlTTL(cacheControl, time.Hour)
+		if expected < 0 {
+			if cacheable {
+				t.Fatalf("Cache-Control %q: expected response not to be cacheable", cacheControl)
+			}
+			continue
+		}
+		if !cacheable || ttl != expected {
+			t.Fatalf("Cache-Control %q: expected ttl %v but got %v (cacheable: %v)", cacheControl, expected, ttl, cacheable)
+		}
+	}
+}
+
+func TestResponseCacheContentEncoding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			_, _ = w.Write([]byte("plain"))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write([]byte("plain"))
+		_ = gz.Close()
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+	routes.cache = NewResponseCache(time.Hour)
+
+	get := func(acceptEncoding string, expectedCacheHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:60024/api/queue/v1/task/abc", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res := httptest.NewRecorder()
+		routes.APIHandler(res, req)
+		if res.Code != 200 {
+			t.Fatalf("Accept-Encoding %q: expected status code 200 but got %v: %s", acceptEncoding, res.Code, res.Body)
+		}
+		if cacheHeader := res.Header().Get("X-Taskcluster-Proxy-Cache"); cacheHeader != expectedCacheHeader {
+			t.Fatalf("Accept-Encoding %q: expected X-Taskcluster-Proxy-Cache header %q but got %q", acceptEncoding, expectedCacheHeader, cacheHeader)
+		}
+		return res
+	}
+
+	res := get("gzip", "MISS")
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoded response but got Content-Encoding %q", res.Header().Get("Content-Encoding"))
+	}
+	// the gzip encoded response was not cached, so a client that did not ask
+	// for it does not get it
+	res = get("", "MISS")
+	if res.Header().Get("Content-Encoding") != "" || res.Body.String() != "plain" {
+		t.Fatalf("Expected plain response but got Content-Encoding %q and body %q", res.Header().Get("Content-Encoding"), res.Body)
+	}
+	res = get("", "HIT")
+	if res.Header().Get("Content-Encoding") != "" || res.Body.String() != "plain" {
+		t.Fatalf("Expected plain response but got Content-Encoding %q and body %q", res.Header().Get("Content-Encoding"), res.Body)
+	}
+}
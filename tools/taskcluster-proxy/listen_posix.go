@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate listens on the unix domain socket at the given path,
+// which is created accessible to the current user only, so that no other user
+// can connect before its file mode has been set
+func listenUnixPrivate(path string) (net.Listener, error) {
+	oldUmask := syscall.Umask(0177)
+	defer syscall.Umask(oldUmask)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,64 @@
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskcluster-proxy-unix-socket")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "proxy.sock")
+	// a stale socket from a previous process should be replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	listener, err := listenUnix(socket, 0640)
+	if err != nil {
+		t.Fatalf("Could not listen on unix domain socket: %v", err)
+	}
+	defer listener.Close()
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0640 {
+		t.Fatalf("Expected unix domain socket with mode 0640 but got %v", fi.Mode())
+	}
+
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello"))
+		}))
+	}()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	res, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatalf("Could not connect to unix domain socket: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("Expected response body %q but got %q (%v)", "hello", body, err)
+	}
+}
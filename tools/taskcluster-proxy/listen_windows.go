@@ -0,0 +1,13 @@
+// +build windows
+
+package main
+
+import (
+	"net"
+)
+
+// listenUnixPrivate listens on the unix domain socket at the given path. On
+// Windows, access to the socket is controlled by the ACL of its directory.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	docopt "github.com/docopt/docopt-go"
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
@@ -34,11 +35,32 @@ task id.
     -i --ip-address <address>       IPv4 or IPv6 address of network interface to bind listener to.
                                     If not provided, will bind listener to all available network
                                     interfaces [default: ].
+    --unix-socket <path>            Listen on the unix domain socket <path> instead of a TCP
+                                    port, so that access to the proxy can be restricted with
+                                    file permissions. If provided, the port and IP address
+                                    options are ignored [default: ].
+    --unix-socket-mode <mode>       File mode (in octal) of the unix domain socket
+                                    [default: 0600].
     -t --task-id <taskId>           Restrict given scopes to those defined in taskId.
+    --task-deadline <deadline>      Deadline of the task, in RFC3339 format, after which
+                                    temporary credentials from /credentials/temporary are not
+                                    valid. If not provided, the deadline of the task given with
+                                    option --task-id is used, if any [default: ].
     --root-url <rootUrl>            The rootUrl for the TC deployment to access
     --client-id <clientId>          Use a specific auth.taskcluster hawk client id [default: ].
     --access-token <accessToken>    Use a specific auth.taskcluster hawk access token [default: ].
     --certificate <certificate>     Use a specific auth.taskcluster hawk certificate [default: ].
+    --audit-log <file>              Append a line of json to <file> for each proxied request,
+                                    recording its time, method, service, path, query, response
+                                    status and duration. Use - for standard out. Request and
+                                    response bodies are not recorded, and values of query
+                                    parameters that may hold secrets are redacted. If not
+                                    provided, no audit log is written [default: ].
+    --cache-ttl <duration>          Cache responses to GET requests for task definitions
+                                    (queue.task), indexed tasks (index.findTask) and secrets
+                                    (secrets.get) in memory for up to <duration>, such as 30s
+                                    or 5m. Upstream Cache-Control headers are respected. If 0,
+                                    responses are not cached [default: 0].
 `
 )
 
@@ -50,18 +72,47 @@ func main() {
 
 	http.HandleFunc("/bewit", routes.BewitHandler)
 	http.HandleFunc("/credentials", routes.CredentialsHandler)
+	http.HandleFunc("/credentials/temporary", routes.TemporaryCredentialsHandler)
 	http.HandleFunc("/api/", routes.APIHandler)
 	http.HandleFunc("/", routes.RootHandler)
 
-	// Only listen on loopback interface to reduce attack surface. If we later
-	// wish to make this service available over the network, we could add
-	// configuration settings for this, but for now, let's lock it down.
-	startError := http.ListenAndServe(address, nil)
+	var listener net.Listener
+	if routes.unixSocket {
+		listener, err = listenUnix(address, routes.unixSocketMode)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	startError := http.Serve(listener, nil)
 	if startError != nil {
 		log.Fatal(startError)
 	}
 }
 
+// listenUnix listens on the unix domain socket at the given path, with the
+// given file mode. A socket left behind at path by a previous process is
+// removed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not remove stale unix domain socket %v: %v", path, err)
+		}
+	}
+	listener, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("Could not set file mode of unix domain socket %v to %v: %v", path, mode, err)
+	}
+	return listener, nil
+}
+
 // Fetch a task by TaskID.  This is broken out to allow testing.
 var getTask = func(rootURL string, taskID string) (task *tcqueue.TaskDefinitionResponse, err error) {
 	queue := tcqueue.New(nil, rootURL)
@@ -106,6 +157,17 @@ func ParseCommandArgs(argv []string, exit bool) (routes Routes, address string,
 		}
 	}
 	address = ipAddress + ":" + portStr
+
+	unixSocket := arguments["--unix-socket"].(string)
+	var unixSocketMode uint64
+	if unixSocket != "" {
+		unixSocketMode, err = strconv.ParseUint(arguments["--unix-socket-mode"].(string), 8, 32)
+		if err != nil || unixSocketMode > 0777 {
+			err = fmt.Errorf("Invalid --unix-socket-mode %q: must be an octal file mode such as 0600", arguments["--unix-socket-mode"])
+			return
+		}
+		address = unixSocket
+	}
 	log.Printf("Listening on: %v", address)
 
 	rootURL := arguments["--root-url"]
@@ -148,6 +210,7 @@ func ParseCommandArgs(argv []string, exit bool) (routes Routes, address string,
 
 	// initially grant no scopes
 	var authorizedScopes = []string{}
+	var deadline time.Time
 
 	if arguments["<scope>"] != nil {
 		authorizedScopes = append(authorizedScopes, arguments["<scope>"].([]string)...)
@@ -166,6 +229,16 @@ func ParseCommandArgs(argv []string, exit bool) (routes Routes, address string,
 		}
 
 		authorizedScopes = append(authorizedScopes, task.Scopes...)
+		deadline = time.Time(task.Deadline)
+	}
+
+	if taskDeadline := arguments["--task-deadline"].(string); taskDeadline != "" {
+		deadline, err = time.Parse(time.RFC3339, taskDeadline)
+		if err != nil {
+			err = fmt.Errorf("Invalid --task-deadline %q: must be in RFC3339 format, such as 2006-01-02T15:04:05Z", taskDeadline)
+			return
+		}
+		log.Printf("Task deadline: %v", deadline)
 	}
 
 	// if no --task-id specified, AND no scopes were specified, don't restrict AuthorizedScopes
@@ -193,5 +266,34 @@ func ParseCommandArgs(argv []string, exit bool) (routes Routes, address string,
 			Credentials:  creds,
 		},
 	)
+	routes.deadline = deadline
+	routes.unixSocket = unixSocket != ""
+	routes.unixSocketMode = os.FileMode(unixSocketMode)
+
+	switch auditLogFile := arguments["--audit-log"].(string); auditLogFile {
+	case "":
+	case "-":
+		routes.auditLog = NewAuditLog(os.Stdout)
+	default:
+		var f *os.File
+		f, err = os.OpenFile(auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			err = fmt.Errorf("Could not open audit log %v: %v", auditLogFile, err)
+			return
+		}
+		log.Printf("Audit log: '%v'", auditLogFile)
+		routes.auditLog = NewAuditLog(f)
+	}
+
+	var cacheTTL time.Duration
+	cacheTTL, err = time.ParseDuration(arguments["--cache-ttl"].(string))
+	if err != nil || cacheTTL < 0 {
+		err = fmt.Errorf("Invalid --cache-ttl %q: must be a duration such as 30s or 5m", arguments["--cache-ttl"])
+		return
+	}
+	if cacheTTL > 0 {
+		log.Printf("Response cache TTL: %v", cacheTTL)
+		routes.cache = NewResponseCache(cacheTTL)
+	}
 	return
 }
@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcqueue"
 )
@@ -189,3 +194,112 @@ func TestBadIPAddress(t *testing.T) {
 		t.Fatalf("Was expecting error to say 'Invalid IPv4/IPv6 address specified - cannot parse: 172.17.0.44.66' but it says: %v", err)
 	}
 }
+
+func TestAuditLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskcluster-proxy-audit-log")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	auditLogFile := filepath.Join(dir, "audit.jsonl")
+	routes, _, err := ParseCommandArgs(
+		[]string{
+			"--root-url", "https://tc-tests.example.com",
+			"--client-id", "abc",
+			"--access-token", "ghi",
+			"--audit-log", auditLogFile,
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	routes.auditLog.Record(&AuditRecord{Method: "GET", Service: "queue", Path: "/ping", Status: 200})
+	content, err := ioutil.ReadFile(auditLogFile)
+	if err != nil {
+		t.Fatalf("Could not read audit log: %v", err)
+	}
+	if !strings.HasPrefix(string(content), `{"time":"0001-01-01T00:00:00Z","method":"GET","service":"queue","path":"/ping","status":200,"durationMs":0}`) {
+		t.Fatalf("Unexpected audit log content: %s", content)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	args := []string{
+		"--root-url", "https://tc-tests.example.com",
+		"--client-id", "abc",
+		"--access-token", "ghi",
+	}
+	routes, _, err := ParseCommandArgs(args, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if routes.cache != nil {
+		t.Fatal("Expected response cache to be disabled by default")
+	}
+	routes, _, err = ParseCommandArgs(append(args, "--cache-ttl", "5m"), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if routes.cache == nil || routes.cache.ttl != 5*time.Minute {
+		t.Fatalf("Expected response cache with ttl 5m but got %#v", routes.cache)
+	}
+	_, _, err = ParseCommandArgs(append(args, "--cache-ttl", "5 minutes"), false)
+	if err == nil {
+		t.Fatal("Expected invalid --cache-ttl to be rejected")
+	}
+}
+
+func TestTaskDeadline(t *testing.T) {
+	args := []string{
+		"--root-url", "https://tc-tests.example.com",
+		"--client-id", "abc",
+		"--access-token", "ghi",
+	}
+	routes, _, err := ParseCommandArgs(append(args, "--task-deadline", "2030-01-02T03:04:05.678Z"), false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := time.Date(2030, 1, 2, 3, 4, 5, 678000000, time.UTC); !routes.deadline.Equal(expected) {
+		t.Fatalf("Expected task deadline %v but got %v", expected, routes.deadline)
+	}
+	_, _, err = ParseCommandArgs(append(args, "--task-deadline", "tomorrow"), false)
+	if err == nil {
+		t.Fatal("Expected invalid --task-deadline to be rejected")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	routes, address, err := ParseCommandArgs(
+		[]string{
+			"--root-url", "https://tc-tests.example.com",
+			"--client-id", "abc",
+			"--access-token", "ghi",
+			"--unix-socket", "/tmp/taskcluster-proxy.sock",
+			"--unix-socket-mode", "0660",
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if address != "/tmp/taskcluster-proxy.sock" {
+		t.Fatalf("Was expecting address '/tmp/taskcluster-proxy.sock', but got address '%v'.", address)
+	}
+	if !routes.unixSocket || routes.unixSocketMode != 0660 {
+		t.Fatalf("Was expecting unix domain socket with mode 0660, but got %v with mode %v", routes.unixSocket, routes.unixSocketMode)
+	}
+	_, _, err = ParseCommandArgs(
+		[]string{
+			"--root-url", "https://tc-tests.example.com",
+			"--client-id", "abc",
+			"--access-token", "ghi",
+			"--unix-socket", "/tmp/taskcluster-proxy.sock",
+			"--unix-socket-mode", "0999",
+		},
+		false,
+	)
+	if err == nil {
+		t.Fatal("Expected invalid --unix-socket-mode to be rejected")
+	}
+}
@@ -4,18 +4,24 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cenkalti/backoff/v3"
 	"github.com/taskcluster/httpbackoff/v3"
 	tcUrls "github.com/taskcluster/taskcluster-lib-urls"
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
+	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcauth"
+	"github.com/taskcluster/taskcluster/v39/internal/scopes"
 	tc "github.com/taskcluster/taskcluster/v39/tools/taskcluster-proxy/taskcluster"
 )
 
@@ -24,6 +30,28 @@ type Routes struct {
 	tcclient.Client
 	services tc.Services
 	lock     sync.RWMutex
+	// auditLog records proxied requests, if not nil
+	auditLog *AuditLog
+	// cache holds responses to GET requests, if not nil
+	cache *ResponseCache
+	// unixSocket is true if the proxy listens on a unix domain socket rather
+	// than a TCP port
+	unixSocket bool
+	// unixSocketMode is the file mode of the unix domain socket
+	unixSocketMode os.FileMode
+	// deadline is the deadline of the task, if known, after which temporary
+	// credentials handed out by the proxy must not be valid
+	deadline time.Time
+}
+
+// TemporaryCredentials is the json body of the response from the
+// /credentials/temporary endpoint
+type TemporaryCredentials struct {
+	ClientID    string        `json:"clientId"`
+	AccessToken string        `json:"accessToken"`
+	Certificate string        `json:"certificate"`
+	Scopes      []string      `json:"scopes"`
+	Expires     tcclient.Time `json:"expires"`
 }
 
 // CredentialsUpdate is the internal representation of the json body which is
@@ -34,7 +62,29 @@ type CredentialsUpdate struct {
 	Certificate string `json:"certificate"`
 }
 
-var httpClient = &http.Client{}
+// maxReplayableBodySize is the largest request body (in bytes) that is held
+// in memory, so that the request can be retried. Larger request bodies are
+// streamed to the upstream service, and the request is not retried.
+const maxReplayableBodySize = 1024 * 1024
+
+var (
+	httpClient = &http.Client{}
+	// httpBackOff retries upstream requests that fail intermittently
+	httpBackOff = &httpbackoff.Client{
+		BackOffSettings: backoff.NewExponentialBackOff(),
+	}
+)
+
+// requestBody is the body of a proxied request. Bodies of up to
+// maxReplayableBodySize bytes are read fully into memory, and can therefore be
+// sent more than once. Larger bodies are streamed, so can only be sent once.
+type requestBody struct {
+	// buffered is the body, or (if rest is not nil) its beginning
+	buffered []byte
+	// rest is the part of the body that has not been read yet, or nil if the
+	// whole body is buffered
+	rest io.Reader
+}
 
 // NewRoutes creates a new Routes instance.
 func NewRoutes(client tcclient.Client) Routes {
@@ -139,6 +189,127 @@ func (routes *Routes) CredentialsHandler(res http.ResponseWriter, req *http.Requ
 	res.WriteHeader(200)
 }
 
+// TemporaryCredentialsHandler is the HTTP Handler for serving the
+// /credentials/temporary endpoint. It creates temporary credentials with the
+// scopes given in query parameter scopes (which may be repeated), that expire
+// after the duration given in query parameter ttl (default 1h), or at the
+// task deadline, if that is earlier. The requested scopes must be satisfied by
+// the scopes the proxy is authorized to use. If the proxy itself holds
+// temporary credentials, these are handed out with authorizedScopes limited to
+// the requested scopes, and expire with the proxy's credentials.
+func (routes *Routes) TemporaryCredentialsHandler(res http.ResponseWriter, req *http.Request) {
+	routes.setHeaders(res)
+	if req.Method != "GET" {
+		log.Printf("Invalid method %s\n", req.Method)
+		res.WriteHeader(405)
+		return
+	}
+	requested := req.URL.Query()["scopes"]
+	if len(requested) == 0 {
+		res.WriteHeader(400)
+		fmt.Fprint(res, "At least one scope must be requested with query parameter scopes")
+		return
+	}
+	ttl := time.Hour
+	if ttlParam := req.URL.Query().Get("ttl"); ttlParam != "" {
+		var err error
+		ttl, err = time.ParseDuration(ttlParam)
+		if err != nil || ttl <= 0 {
+			res.WriteHeader(400)
+			fmt.Fprintf(res, "Query parameter ttl must be a positive duration, such as 15m or 2h, but is %q", ttlParam)
+			return
+		}
+	}
+	// temporary credentials cannot be valid for more than 31 days
+	if ttl > 31*24*time.Hour {
+		ttl = 31 * 24 * time.Hour
+	}
+	if !routes.deadline.IsZero() {
+		untilDeadline := time.Until(routes.deadline)
+		if untilDeadline <= 0 {
+			res.WriteHeader(403)
+			fmt.Fprintf(res, "Task deadline %v has passed", routes.deadline)
+			return
+		}
+		if ttl > untilDeadline {
+			ttl = untilDeadline
+		}
+	}
+
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
+
+	if routes.Credentials.Certificate != "" {
+		// The auth service only accepts temporary credentials that were
+		// issued by a permanent client, and the proxy's own credentials must
+		// never be handed out, as they may have scopes (such as those to
+		// resolve the task, or create its artifacts) that the task must not
+		// have
+		res.WriteHeader(501)
+		fmt.Fprint(res, "Taskcluster Proxy holds temporary credentials, which cannot be used to create further temporary credentials")
+		return
+	}
+
+	// scopes the proxy cannot satisfy are always refused
+	granted, err := routes.grantableScopes()
+	if err != nil {
+		res.WriteHeader(500)
+		fmt.Fprintf(res, "Could not determine the scopes of the proxy: %s", err)
+		return
+	}
+	satisfied, err := scopes.Given(granted).Satisfies(scopes.Required{requested}, tcauth.New(nil, routes.RootURL))
+	if err != nil {
+		res.WriteHeader(500)
+		fmt.Fprintf(res, "Could not expand scopes: %s", err)
+		return
+	}
+	if !satisfied {
+		log.Printf("Refusing to create temporary credentials with scopes %q", requested)
+		res.WriteHeader(403)
+		fmt.Fprintf(res, "Requested scopes %q are not satisfied by the scopes of the task", requested)
+		return
+	}
+
+	creds, err := routes.Credentials.CreateTemporaryCredentials(ttl, requested...)
+	if err != nil {
+		res.WriteHeader(500)
+		fmt.Fprintf(res, "Could not create temporary credentials: %s", err)
+		return
+	}
+	cert, err := creds.Cert()
+	if err != nil {
+		res.WriteHeader(500)
+		fmt.Fprintf(res, "Could not create temporary credentials: %s", err)
+		return
+	}
+	tempCreds := &TemporaryCredentials{
+		ClientID:    creds.ClientID,
+		AccessToken: creds.AccessToken,
+		Certificate: creds.Certificate,
+		Scopes:      cert.Scopes,
+		Expires:     tcclient.Time(time.Unix(0, cert.Expiry*int64(time.Millisecond))),
+	}
+	log.Printf("Created temporary credentials with scopes %q, expiring at %v", requested, tempCreds.Expires)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(200)
+	_ = json.NewEncoder(res).Encode(tempCreds)
+}
+
+// grantableScopes returns the scopes that temporary credentials handed out by
+// the proxy may have: the scopes the proxy is authorized to use if restricted,
+// otherwise the scopes of its (permanent) credentials, which are fetched from
+// the auth service. It must be called with routes.lock held.
+func (routes *Routes) grantableScopes() ([]string, error) {
+	if routes.Credentials.AuthorizedScopes != nil {
+		return routes.Credentials.AuthorizedScopes, nil
+	}
+	current, err := tcauth.New(routes.Credentials, routes.RootURL).CurrentScopes()
+	if err != nil {
+		return nil, err
+	}
+	return current.Scopes, nil
+}
+
 // RootHandler is the HTTP Handler for / endpoint
 func (routes *Routes) RootHandler(res http.ResponseWriter, req *http.Request) {
 	routes.setHeaders(res)
@@ -198,6 +369,33 @@ func (routes *Routes) commonHandler(res http.ResponseWriter, req *http.Request,
 	res.Header().Set("X-Taskcluster-Endpoint", targetPath.String())
 	log.Printf("Proxying %s | %s | %s", req.URL, req.Method, targetPath)
 
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+	res = recorder
+	defer func() {
+		routes.auditLog.Record(newAuditRecord(req.Method, targetPath, start, recorder.status))
+	}()
+
+	cacheKey := routes.cache.cacheKey(req, targetPath)
+	if cacheKey != "" {
+		// a client may request a fresh response with Cache-Control: no-cache,
+		// which is then cached for subsequent requests
+		if cached := routes.cache.lookup(cacheKey); cached != nil && !strings.Contains(req.Header.Get("Cache-Control"), "no-cache") {
+			for key, values := range cached.header {
+				res.Header()[key] = append([]string(nil), values...)
+			}
+			res.Header().Set("Age", strconv.Itoa(int(time.Since(cached.created).Seconds())))
+			res.Header().Set("X-Taskcluster-Proxy-Cache", "HIT")
+			res.WriteHeader(cached.status)
+			_, err := res.Write(cached.body)
+			if err != nil {
+				log.Printf("Error writing cached response body of %s: %s", targetPath, err)
+			}
+			return
+		}
+		res.Header().Set("X-Taskcluster-Proxy-Cache", "MISS")
+	}
+
 	// In theory, req.Body should never be nil when running as a server, but
 	// during testing, with a direct call to the method rather than a real http
 	// request coming in from outside, it could be. For example see:
@@ -208,35 +406,43 @@ func (routes *Routes) commonHandler(res http.ResponseWriter, req *http.Request,
 	// Technically a client request should not be passed to a server method,
 	// but in reality there are not separate types (e.g. HttpClientRequest,
 	// HttpServerRequest) and so it can easily happen and is usually done.  For
-	// this reason, and to avoid confusion around this, let's keep the nil
-	// check in here.
-	body := []byte{}
-	var err error
-	if req.Body != nil {
-		body, err = ioutil.ReadAll(req.Body)
-		// If we fail to create a request notify the client.
-		if err != nil {
-			res.WriteHeader(500)
-			fmt.Fprintf(res, "Failed to generate proxy request (could not read http body) - %s", err)
-			return
-		}
+	// this reason, and to avoid confusion around this, newRequestBody accepts
+	// a nil body.
+	body, err := newRequestBody(req.Body)
+	// If we fail to create a request notify the client.
+	if err != nil {
+		res.WriteHeader(500)
+		fmt.Fprintf(res, "Failed to generate proxy request (could not read http body) - %s", err)
+		return
 	}
 
+	// The response of a failed attempt is closed when the request is retried.
+	// The response of the final attempt is proxied back to the client.
+	var failedAttempt *http.Response
+
 	// function to perform http request - we call this using backoff library to
 	// have exponential backoff in case of intermittent failures (e.g. network
-	// blips or HTTP 5xx errors)
+	// blips or HTTP 5xx errors). Requests are only retried if their body can
+	// be sent again.
 	httpCall := func() (*http.Response, error, error) {
-		proxyreq, err := http.NewRequest(req.Method, targetPath.String(), bytes.NewReader(body))
+		if failedAttempt != nil {
+			failedAttempt.Body.Close()
+			failedAttempt = nil
+		}
+		proxyreq, err := http.NewRequest(req.Method, targetPath.String(), body.reader())
 		if err != nil {
 			return nil, nil, fmt.Errorf("Error constructing request: %s", err)
 		}
 		for k, v := range req.Header {
 			proxyreq.Header[k] = v
 		}
+		if !body.replayable() && req.ContentLength > 0 {
+			proxyreq.ContentLength = req.ContentLength
+		}
 
 		// for compatibility, if there is no request Content-Type and the body
 		// has nonzero length, we add a Content-Type header.  See #3521.
-		if _, ok := req.Header["Content-Type"]; !ok && len(body) != 0 {
+		if _, ok := req.Header["Content-Type"]; !ok && len(body.buffered) != 0 {
 			log.Printf("Adding missing Content-Type header (#3521)")
 			proxyreq.Header["Content-Type"] = []string{"application/json"}
 		}
@@ -246,48 +452,108 @@ func (routes *Routes) commonHandler(res http.ResponseWriter, req *http.Request,
 		if err != nil {
 			return nil, nil, err
 		}
-		var resp *http.Response
-		resp, err = httpClient.Do(proxyreq)
-		return resp, err, nil
-	}
-
-	proxyres, _, err := httpbackoff.Retry(httpCall)
-
-	var resbody []byte
-	if proxyres != nil {
-		var err2 error
-		resbody, err2 = ioutil.ReadAll(proxyres.Body)
-		if err == nil && err2 != nil {
-			res.WriteHeader(500)
-			fmt.Fprintf(res, "Failed to read response body: %s", err2)
-			return
+		resp, err := httpClient.Do(proxyreq)
+		if err != nil {
+			if body.replayable() {
+				return resp, err, nil
+			}
+			return resp, nil, err
+		}
+		// Response codes are checked here rather than by httpbackoff, since
+		// httpbackoff reads the whole body of non-2xx responses into memory.
+		switch {
+		case resp.StatusCode/100 == 2:
+			return resp, nil, nil
+		case resp.StatusCode/100 == 5 && body.replayable():
+			failedAttempt = resp
+			return resp, httpbackoff.BadHttpResponseCode{
+				HttpResponseCode: resp.StatusCode,
+				Message:          "(Intermittent) HTTP response code " + strconv.Itoa(resp.StatusCode) + " from " + targetPath.String(),
+			}, nil
+		default:
+			return resp, nil, httpbackoff.BadHttpResponseCode{
+				HttpResponseCode: resp.StatusCode,
+				Message:          "(Permanent) HTTP response code " + strconv.Itoa(resp.StatusCode) + " from " + targetPath.String(),
+			}
 		}
 	}
 
+	proxyres, _, err := httpBackOff.Retry(httpCall)
+
 	// If we fail to create a request notify the client.
 	if err != nil {
 		switch err.(type) {
 		case httpbackoff.BadHttpResponseCode:
 			// nothing extra to do - header and body will be proxied back
 		default:
+			if proxyres != nil {
+				proxyres.Body.Close()
+			}
 			res.WriteHeader(500)
 			fmt.Fprintf(res, "Failed during proxy request: %s", err)
 			return
 		}
 	}
+	defer proxyres.Body.Close()
 
 	// Map the headers from the proxy back into our proxyResponse
-	for key := range proxyres.Header {
-		res.Header().Set(key, proxyres.Header.Get(key))
+	for key, values := range proxyres.Header {
+		res.Header()[key] = values
 	}
 
 	// Write the proxyResponse headers and status.
 	res.WriteHeader(proxyres.StatusCode)
 
-	// Proxy the proxyResponse body from the endpoint to our response.
-	_, err = res.Write([]byte(resbody))
+	// Stream the proxyResponse body from the endpoint to our response,
+	// capturing it if it is to be cached. Since the status has already been
+	// written, errors can only be logged.
+	var capture *responseCapture
+	var dest io.Writer = res
+	if cacheKey != "" {
+		capture = routes.cache.capture(cacheKey, proxyres)
+		if capture != nil {
+			dest = io.MultiWriter(res, capture)
+		}
+	}
+	_, err = io.Copy(dest, proxyres.Body)
 	if err != nil {
-		fmt.Fprintf(res, "Error writing res: %s", err)
+		log.Printf("Error proxying response body of %s: %s", targetPath, err)
 		return
 	}
+	if capture != nil {
+		routes.cache.store(capture)
+	}
+}
+
+// newRequestBody reads body into memory if it is no larger than
+// maxReplayableBodySize bytes. Otherwise only the first
+// maxReplayableBodySize+1 bytes are read, and the remainder is streamed when
+// the request is sent. A nil body is treated as an empty body.
+func newRequestBody(body io.Reader) (*requestBody, error) {
+	if body == nil {
+		return &requestBody{}, nil
+	}
+	buffered, err := ioutil.ReadAll(io.LimitReader(body, maxReplayableBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buffered) <= maxReplayableBodySize {
+		return &requestBody{buffered: buffered}, nil
+	}
+	return &requestBody{buffered: buffered, rest: body}, nil
+}
+
+// replayable returns true if the whole body is held in memory, so that it can
+// be sent more than once
+func (body *requestBody) replayable() bool {
+	return body.rest == nil
+}
+
+// reader returns a reader for the body. If the body is not replayable, only
+// the first reader returned can be read from.
+func (body *requestBody) reader() io.Reader {
+	if body.replayable() {
+		return bytes.NewReader(body.buffered)
+	}
+	return io.MultiReader(bytes.NewReader(body.buffered), body.rest)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
+)
+
+// upstreamRoutes returns Routes that proxy requests to the given upstream
+// server, as if it were the root URL of a taskcluster deployment, with
+// short retry intervals. The returned function restores the retry settings.
+func upstreamRoutes(upstream *httptest.Server) (*Routes, func()) {
+	oldHTTPBackOff := httpBackOff
+	httpBackOff = newTestClient()
+	routes := NewRoutes(
+		tcclient.Client{
+			RootURL:      upstream.URL,
+			Authenticate: true,
+			Credentials:  permCredentials,
+		},
+	)
+	return &routes, func() {
+		httpBackOff = oldHTTPBackOff
+	}
+}
+
+func TestRetryReplayableRequestBody(t *testing.T) {
+	attempts := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Could not read request body: %v", err)
+		}
+		if string(body) != `{"hello": "world"}` {
+			t.Errorf("Attempt %v: got unexpected request body %q", attempts, body)
+		}
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("request body received"))
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+
+	req := httptest.NewRequest("POST", "http://localhost:60024/api/queue/v1/foo", strings.NewReader(`{"hello": "world"}`))
+	res := httptest.NewRecorder()
+	routes.APIHandler(res, req)
+
+	if res.Code != 200 {
+		t.Fatalf("Expected status code 200 but got %v: %s", res.Code, res.Body)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expected request to be attempted twice, but was attempted %v time(s)", attempts)
+	}
+}
+
+func TestStreamLargeRequestBody(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), maxReplayableBodySize/8)
+	attempts := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		received, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Could not read request body: %v", err)
+		}
+		if !bytes.Equal(received, body) {
+			t.Errorf("Upstream received %v bytes but %v bytes were sent", len(received), len(body))
+		}
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("Expected Content-Length %v but got %v", len(body), r.ContentLength)
+		}
+		// not retried, since the request body cannot be replayed
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("service unavailable"))
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+
+	req := httptest.NewRequest("PUT", "http://localhost:60024/api/object/v1/upload", bytes.NewReader(body))
+	res := httptest.NewRecorder()
+	routes.APIHandler(res, req)
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status code 503 but got %v: %s", res.Code, res.Body)
+	}
+	if res.Body.String() != "service unavailable" {
+		t.Fatalf("Expected upstream response body to be proxied, but got %q", res.Body)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected request to be attempted once, but was attempted %v time(s)", attempts)
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	content := "0123456789abcdef"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "artifact.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+	routes, restore := upstreamRoutes(upstream)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "http://localhost:60024/api/queue/v1/task/abc/artifacts/public/artifact.txt", nil)
+	req.Header.Set("Range", "bytes=4-9")
+	res := httptest.NewRecorder()
+	routes.APIHandler(res, req)
+
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("Expected status code 206 but got %v: %s", res.Code, res.Body)
+	}
+	if res.Body.String() != "456789" {
+		t.Fatalf("Expected body %q but got %q", "456789", res.Body)
+	}
+	if contentRange := res.Header().Get("Content-Range"); contentRange != "bytes 4-9/16" {
+		t.Fatalf("Expected Content-Range %q but got %q", "bytes 4-9/16", contentRange)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
+)
+
+// temporaryCredentialsRoutes returns Routes holding the given credentials,
+// with the given authorized scopes, for a task with the given deadline
+func temporaryCredentialsRoutes(creds tcclient.Credentials, authorizedScopes []string, deadline time.Time) *Routes {
+	creds.AuthorizedScopes = authorizedScopes
+	routes := NewRoutes(
+		tcclient.Client{
+			RootURL:      "https://tc.example.com",
+			Authenticate: true,
+			Credentials:  &creds,
+		},
+	)
+	routes.deadline = deadline
+	return &routes
+}
+
+func requestTemporaryCredentials(routes *Routes, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "http://localhost:60024/credentials/temporary?"+query, nil)
+	res := httptest.NewRecorder()
+	routes.TemporaryCredentialsHandler(res, req)
+	return res
+}
+
+func TestTemporaryCredentials(t *testing.T) {
+	deadline := time.Now().Add(30 * time.Minute)
+	routes := temporaryCredentialsRoutes(*permCredentials, []string{"queue:get-artifact:private/*", "secrets:get:foo"}, deadline)
+
+	res := requestTemporaryCredentials(routes, "scopes=queue:get-artifact:private/build/*&scopes=secrets:get:foo&ttl=2h")
+	if res.Code != 200 {
+		t.Fatalf("Expected status code 200 but got %v: %s", res.Code, res.Body)
+	}
+	var tempCreds TemporaryCredentials
+	err := json.Unmarshal(res.Body.Bytes(), &tempCreds)
+	if err != nil {
+		t.Fatalf("Could not interpret response %q: %v", res.Body, err)
+	}
+	if tempCreds.ClientID != permCredentials.ClientID {
+		t.Fatalf("Expected clientId %q but got %q", permCredentials.ClientID, tempCreds.ClientID)
+	}
+	if tempCreds.Certificate == "" || tempCreds.AccessToken == "" {
+		t.Fatalf("Expected temporary credentials, but got %#v", tempCreds)
+	}
+	expectedScopes := []string{"queue:get-artifact:private/build/*", "secrets:get:foo"}
+	if !reflect.DeepEqual(tempCreds.Scopes, expectedScopes) {
+		t.Fatalf("Expected scopes %q but got %q", expectedScopes, tempCreds.Scopes)
+	}
+	// the requested ttl of 2h is capped at the task deadline
+	if expires := time.Time(tempCreds.Expires); expires.After(deadline.Add(time.Second)) {
+		t.Fatalf("Expected credentials to expire at task deadline %v, but they expire at %v", deadline, expires)
+	}
+}
+
+func TestTemporaryCredentialsRefused(t *testing.T) {
+	routes := temporaryCredentialsRoutes(*permCredentials, []string{"secrets:get:foo"}, time.Now().Add(time.Hour))
+	for query, expectedStatusCode := range map[string]int{
+		"scopes=secrets:set:foo":         403,
+		"scopes=secrets:get:*":           403,
+		"":                               400,
+		"scopes=secrets:get:foo&ttl=bad": 400,
+	} {
+		res := requestTemporaryCredentials(routes, query)
+		if res.Code != expectedStatusCode {
+			t.Fatalf("Query %q: expected status code %v but got %v: %s", query, expectedStatusCode, res.Code, res.Body)
+		}
+	}
+
+	// task deadline has passed
+	routes = temporaryCredentialsRoutes(*permCredentials, []string{"secrets:get:foo"}, time.Now().Add(-time.Minute))
+	res := requestTemporaryCredentials(routes, "scopes=secrets:get:foo")
+	if res.Code != 403 {
+		t.Fatalf("Expected status code 403 but got %v: %s", res.Code, res.Body)
+	}
+}
+
+func TestTemporaryCredentialsFromTemporaryCredentials(t *testing.T) {
+	parentCreds, err := permCredentials.CreateTemporaryCredentials(time.Hour, "secrets:get:foo", "secrets:get:bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// whether or not the proxy's scopes are restricted, and whatever scopes
+	// are requested, the proxy's own credentials are never handed out
+	for _, authorizedScopes := range [][]string{nil, {"secrets:get:foo"}} {
+		routes := temporaryCredentialsRoutes(*parentCreds, authorizedScopes, time.Time{})
+		for _, query := range []string{"scopes=secrets:get:foo", "scopes=secrets:get:foo&ttl=2h", "scopes=secrets:set:foo"} {
+			res := requestTemporaryCredentials(routes, query)
+			if res.Code != 501 {
+				t.Fatalf("%v: expected status code 501 but got %v: %s", query, res.Code, res.Body)
+			}
+			if strings.Contains(res.Body.String(), parentCreds.AccessToken) {
+				t.Fatalf("%v: response contains the access token of the proxy: %s", query, res.Body)
+			}
+		}
+	}
+}
+
+func TestTemporaryCredentialsUnrestricted(t *testing.T) {
+	// the scopes of permanent credentials are fetched from the auth service
+	auth := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/auth/v1/scopes/current" {
+			res.WriteHeader(404)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		_, _ = res.Write([]byte(`{"scopes": ["secrets:get:*"]}`))
+	}))
+	defer auth.Close()
+	routes := temporaryCredentialsRoutes(*permCredentials, nil, time.Time{})
+	routes.RootURL = auth.URL
+
+	res := requestTemporaryCredentials(routes, "scopes=secrets:get:foo")
+	if res.Code != 200 {
+		t.Fatalf("Expected status code 200 but got %v: %s", res.Code, res.Body)
+	}
+	res = requestTemporaryCredentials(routes, "scopes=secrets:set:foo")
+	if res.Code != 403 {
+		t.Fatalf("Expected status code 403 but got %v: %s", res.Code, res.Body)
+	}
+}
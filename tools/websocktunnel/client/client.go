@@ -38,6 +38,13 @@ type Config struct {
 
 	// A Logger for logging status updates; default is no logging
 	Logger util.Logger
+
+	// Resume asks the server to keep the client's session, with its open
+	// streams, when the connection is lost, so that the client can reconnect
+	// and carry on without dropping them.  This requires a server with session
+	// resumption enabled; with any other server, the client reconnects as
+	// usual.
+	Resume bool
 }
 
 // Configurer is a function which can generate a Config object to be used by
@@ -56,6 +63,8 @@ type Client struct {
 	retry      RetryConfig
 	logger     util.Logger
 	configurer Configurer
+	resume     bool
+	sessionID  string
 	session    *wsmux.Session
 	state      clientState
 	closed     chan struct{}
@@ -72,12 +81,15 @@ func New(configurer Configurer) (*Client, error) {
 	cl := &Client{configurer: configurer}
 	cl.setConfig(config)
 	cl.closed = make(chan struct{}, 1)
-	conn, url, err := cl.connectWithRetry()
+	conn, url, sessionID, err := cl.connectWithRetry()
 	if err != nil {
 		return nil, err
 	}
 	cl.url.Store(url)
-	cl.session = wsmux.Client(conn, wsmux.Config{})
+	// the session may be disconnected, and resumed, as soon as it is created
+	cl.m.Lock()
+	cl.session = cl.newSession(conn, sessionID, wsmux.Config{})
+	cl.m.Unlock()
 	return cl, nil
 }
 
@@ -99,20 +111,42 @@ func (c *Client) Accept() (net.Conn, error) {
 	default:
 	}
 
-	c.m.Lock()
-	defer c.m.Unlock()
-	if c.state == stateBroken || c.state == stateClosed {
-		return nil, c.acceptErr
-	}
+	for {
+		c.m.Lock()
+		if c.state == stateBroken || c.state == stateClosed {
+			defer c.m.Unlock()
+			return nil, c.acceptErr
+		}
+		session := c.session
+		c.m.Unlock()
 
-	stream, err := c.session.Accept()
-	if err != nil {
-		c.state = stateBroken
-		c.acceptErr = ErrClientReconnecting
-		go c.reconnect()
+		// the lock is not held while waiting for a stream, so that the session
+		// can be closed or resumed meanwhile
+		stream, err := session.Accept()
+		if err == nil {
+			return stream, nil
+		}
+
+		select {
+		case <-c.closed:
+			return nil, ErrClientClosed
+		default:
+		}
+
+		c.m.Lock()
+		if c.session != session {
+			// the session was replaced while resuming, so accept from the new one
+			c.m.Unlock()
+			continue
+		}
+		defer c.m.Unlock()
+		if c.state == stateRunning {
+			c.state = stateBroken
+			c.acceptErr = ErrClientReconnecting
+			go c.reconnect()
+		}
 		return nil, c.acceptErr
 	}
-	return stream, nil
 }
 
 // Addr returns the net.Addr of the underlying wsmux session
@@ -148,19 +182,22 @@ func (c *Client) setConfig(config Config) {
 	c.token = config.Token
 
 	c.retry = config.Retry.withDefaultValues()
+	c.resume = config.Resume
 	c.logger = config.Logger
 	if c.logger == nil {
 		c.logger = &util.NilLogger{}
 	}
 }
 
-// connectWithRetry returns a websocket connection to the tunnel
-func (c *Client) connectWithRetry() (*websocket.Conn, string, error) {
+// connectWithRetry returns a websocket connection to the tunnel, along with
+// the client's URL and, if the server allows it to be resumed, the ID of the
+// session.  If the client has a resumable session, it asks to resume it.
+func (c *Client) connectWithRetry() (*websocket.Conn, string, string, error) {
 	// if token is expired or not usable, get a new token from the authorizer
 	if !util.IsTokenUsable(c.token) {
 		config, err := c.configurer()
 		if err != nil {
-			return nil, "", err
+			return nil, "", "", err
 		}
 		c.setConfig(config)
 	}
@@ -168,6 +205,12 @@ func (c *Client) connectWithRetry() (*websocket.Conn, string, error) {
 	header := make(http.Header)
 	header.Set("Authorization", "Bearer "+c.token)
 	header.Set("x-websocktunnel-id", c.id)
+	if c.resume {
+		header.Set("x-websocktunnel-resumable", "true")
+		if c.sessionID != "" {
+			header.Set("x-websocktunnel-session-id", c.sessionID)
+		}
+	}
 
 	currentDelay := c.retry.InitialDelay
 	maxTimer := time.After(c.retry.MaxElapsedTime)
@@ -179,32 +222,32 @@ func (c *Client) connectWithRetry() (*websocket.Conn, string, error) {
 		if err == nil {
 			c.logger.Printf("connected to %s ", c.tunnelAddr)
 			url := res.Header.Get("x-websocktunnel-client-url")
-			return conn, url, err
+			return conn, url, res.Header.Get("x-websocktunnel-session-id"), err
 		}
 
 		if !shouldRetry(res) {
 			c.logger.Printf("connection failed with error:%v, response:%v", err, res)
 			if isAuthError(res) {
-				return nil, "", ErrAuthFailed
+				return nil, "", "", ErrAuthFailed
 			}
-			return nil, "", ErrRetryFailed
+			return nil, "", "", ErrRetryFailed
 		}
 		c.logger.Printf("connection to %s failed -- retrying.", c.tunnelAddr)
 
 		// wait for the next time to try connecting
 		select {
 		case <-maxTimer:
-			return nil, "", ErrRetryTimedOut
+			return nil, "", "", ErrRetryTimedOut
 		case <-backoff:
 			c.logger.Printf("trying to connect to %s", c.tunnelAddr)
 			conn, res, err := websocket.DefaultDialer.Dial(c.tunnelAddr, header)
 			if err == nil {
 				url := res.Header.Get("x-websocktunnel-client-url")
-				return conn, url, nil
+				return conn, url, res.Header.Get("x-websocktunnel-session-id"), nil
 			}
 			if !shouldRetry(res) {
 				c.logger.Printf("connection to %s failed. could not connect", c.tunnelAddr)
-				return nil, "", ErrRetryFailed
+				return nil, "", "", ErrRetryFailed
 			}
 
 			currentDelay = c.retry.nextDelay(currentDelay)
@@ -217,7 +260,9 @@ func (c *Client) connectWithRetry() (*websocket.Conn, string, error) {
 func (c *Client) reconnect() {
 	c.m.Lock()
 	defer c.m.Unlock()
-	conn, url, err := c.connectWithRetry()
+	// the previous session is closed, so do not ask to resume it
+	c.sessionID = ""
+	conn, url, sessionID, err := c.connectWithRetry()
 	if err != nil {
 		// set error and return
 		c.logger.Printf("unable to reconnect to %s", c.tunnelAddr)
@@ -234,7 +279,7 @@ func (c *Client) reconnect() {
 		// Log:              c.logger,
 		StreamBufferSize: 4 * 1024,
 	}
-	c.session = wsmux.Client(conn, sessionConfig)
+	c.session = c.newSession(conn, sessionID, sessionConfig)
 	c.url.Store(url)
 	c.state = stateRunning
 	c.logger.Printf("state: running")
@@ -242,6 +287,65 @@ func (c *Client) reconnect() {
 
 }
 
+// newSession creates a wsmux session over the given connection, which is
+// resumable if the server gave it a session ID.
+func (c *Client) newSession(conn *websocket.Conn, sessionID string, config wsmux.Config) *wsmux.Session {
+	c.sessionID = ""
+	if c.resume && sessionID != "" {
+		c.sessionID = sessionID
+		// keep the session for as long as we keep trying to reconnect
+		config.ResumeGracePeriod = c.retry.MaxElapsedTime
+		config.DisconnectCallback = c.resumeSession
+	}
+	return wsmux.Client(conn, config)
+}
+
+// resumeSession reconnects to the tunnel after the connection of a resumable
+// session is lost, and resumes the session over the new connection, so that
+// its streams carry on.  If the server has discarded the session, a new session
+// replaces it, and if the client cannot reconnect, the session is closed, so
+// that Accept fails and the client reconnects as usual.
+func (c *Client) resumeSession() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+
+	session := c.session
+	conn, url, sessionID, err := c.connectWithRetry()
+	if err != nil {
+		c.logger.Printf("unable to reconnect to %s: %v", c.tunnelAddr, err)
+		_ = session.Close()
+		return
+	}
+
+	// the client may have been closed while reconnecting
+	select {
+	case <-c.closed:
+		_ = conn.Close()
+		return
+	default:
+	}
+
+	if sessionID != c.sessionID {
+		c.logger.Printf("session %s was not resumed; starting a new session", c.sessionID)
+		_ = session.Close()
+		c.session = c.newSession(conn, sessionID, wsmux.Config{StreamBufferSize: 4 * 1024})
+		c.url.Store(url)
+		return
+	}
+
+	if err := session.Resume(conn); err != nil {
+		c.logger.Printf("unable to resume session %s: %v", c.sessionID, err)
+		_ = session.Close()
+		return
+	}
+	c.logger.Printf("resumed session %s", c.sessionID)
+}
+
 // simple utility to check if client should retry connection
 func shouldRetry(r *http.Response) bool {
 	// retry on connection failures (e.g., server down)
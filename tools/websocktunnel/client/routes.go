@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Route directs streams accepted from a Client whose path begins with Prefix
+// to a local port.  Paths are those following the client's URL, and are
+// passed to the local service unchanged.
+type Route struct {
+	// Prefix is matched against whole path segments, so "/vnc" matches
+	// "/vnc" and "/vnc/websockify" but not "/vnc2".  The prefix "/" matches
+	// every path.
+	Prefix string
+
+	// Port is the local port to connect the stream to
+	Port int
+
+	// TCP routes match raw TCP streams (see TCPRequest), by the path given
+	// after the client's TCP endpoint.  Other routes match HTTP requests.
+	TCP bool
+}
+
+// ParseRoute parses a route of the form [tcp:]<prefix>=<port>, such as
+// "/livelog=60023" or "tcp:/ssh=22".
+func ParseRoute(spec string) (Route, error) {
+	route := Route{}
+	if strings.HasPrefix(spec, "tcp:") {
+		route.TCP = true
+		spec = strings.TrimPrefix(spec, "tcp:")
+	}
+	index := strings.LastIndex(spec, "=")
+	if index < 0 {
+		return route, fmt.Errorf("route %q must be of the form [tcp:]<prefix>=<port>", spec)
+	}
+	route.Prefix = spec[:index]
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return route, fmt.Errorf("route prefix %q must begin with /", route.Prefix)
+	}
+	port, err := strconv.Atoi(spec[index+1:])
+	if err != nil || port <= 0 || port > 65535 {
+		return route, fmt.Errorf("route port %q is invalid", spec[index+1:])
+	}
+	route.Port = port
+	return route, nil
+}
+
+// matches returns true if the route applies to the given path
+func (route Route) matches(path string, tcp bool) bool {
+	if route.TCP != tcp || !strings.HasPrefix(path, route.Prefix) {
+		return false
+	}
+	if len(path) == len(route.Prefix) || strings.HasSuffix(route.Prefix, "/") {
+		return true
+	}
+	next := path[len(route.Prefix)]
+	return next == '/' || next == '?'
+}
+
+// Routes is a routing table, allowing one Client to serve several local
+// services.  Each stream is directed to the route with the longest matching
+// prefix.
+type Routes []Route
+
+// Match returns the route for the given path, for a raw TCP stream if tcp is
+// true or an HTTP request otherwise.  The second return value is false if no
+// route matches.
+func (routes Routes) Match(path string, tcp bool) (Route, bool) {
+	best, found := Route{}, false
+	for _, route := range routes {
+		if route.matches(path, tcp) && (!found || len(route.Prefix) > len(best.Prefix)) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// Forward forwards a stream accepted from a Client to the local port given
+// by its route, copying data in both directions until both sides have
+// closed.  Streams with no matching route, or whose local port cannot be
+// connected to, are answered with an error response and closed.
+func (routes Routes) Forward(stream net.Conn) error {
+	conn, tcpReq, err := ParseStream(stream)
+	if err != nil {
+		_ = stream.Close()
+		return err
+	}
+
+	if tcpReq != nil {
+		route, ok := routes.Match(tcpReq.Path, true)
+		if !ok {
+			_ = tcpReq.Reject(404)
+			return fmt.Errorf("no route for TCP path %s", tcpReq.Path)
+		}
+		local, err := net.Dial("tcp", ":"+strconv.Itoa(route.Port))
+		if err != nil {
+			_ = tcpReq.Reject(502)
+			return err
+		}
+		conn, err = tcpReq.Accept()
+		if err != nil {
+			_ = local.Close()
+			return err
+		}
+		pipe(conn, local)
+		return nil
+	}
+
+	path, err := requestPath(conn.(*bufferedConn).reader)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	route, ok := routes.Match(path, false)
+	if !ok {
+		writeErrorResponse(conn, "404 Not Found")
+		return fmt.Errorf("no route for path %s", path)
+	}
+	local, err := net.Dial("tcp", ":"+strconv.Itoa(route.Port))
+	if err != nil {
+		writeErrorResponse(conn, "502 Bad Gateway")
+		return err
+	}
+	pipe(conn, local)
+	return nil
+}
+
+// requestPath returns the path of the HTTP request at the start of the
+// reader, without consuming it
+func requestPath(reader *bufio.Reader) (string, error) {
+	for {
+		buffered, err := reader.Peek(reader.Buffered())
+		if err != nil {
+			return "", err
+		}
+		if index := bytes.IndexByte(buffered, '\n'); index >= 0 {
+			fields := strings.Fields(string(buffered[:index]))
+			if len(fields) != 3 {
+				return "", errors.New("malformed HTTP request line")
+			}
+			return fields[1], nil
+		}
+		if len(buffered) == reader.Size() {
+			return "", errors.New("HTTP request line too long")
+		}
+		// wait for more data
+		if _, err := reader.Peek(len(buffered) + 1); err != nil {
+			return "", err
+		}
+	}
+}
+
+// writeErrorResponse writes an HTTP error response with the given status
+// line, and closes the stream
+func writeErrorResponse(stream net.Conn, status string) {
+	_, _ = fmt.Fprintf(stream, "HTTP/1.1 %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status)
+	_ = stream.Close()
+}
+
+// pipe copies data between the stream and the local connection in both
+// directions, closing each when the other has finished sending
+func pipe(stream net.Conn, local net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// outgoing stream (local -> tunnel)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(stream, local)
+		_ = stream.Close()
+	}()
+
+	// incoming stream (tunnel -> local)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(local, stream)
+		_ = local.Close()
+	}()
+	wg.Wait()
+}
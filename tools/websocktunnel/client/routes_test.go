@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	for spec, expected := range map[string]Route{
+		"/=8080":        {Prefix: "/", Port: 8080},
+		"/livelog=6002": {Prefix: "/livelog", Port: 6002},
+		"tcp:/ssh=22":   {Prefix: "/ssh", Port: 22, TCP: true},
+		"/a=b=1":        {Prefix: "/a=b", Port: 1},
+	} {
+		route, err := ParseRoute(spec)
+		require.NoError(t, err, spec)
+		require.Equal(t, expected, route, spec)
+	}
+
+	for _, spec := range []string{"", "/livelog", "livelog=6002", "/livelog=", "/livelog=x", "/livelog=70000", "tcp:ssh=22"} {
+		_, err := ParseRoute(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestRoutesMatch(t *testing.T) {
+	routes := Routes{
+		{Prefix: "/", Port: 1},
+		{Prefix: "/livelog", Port: 2},
+		{Prefix: "/livelog/raw/", Port: 3},
+		{Prefix: "/", Port: 4, TCP: true},
+		{Prefix: "/vnc", Port: 5, TCP: true},
+	}
+	for _, tc := range []struct {
+		path string
+		tcp  bool
+		port int
+	}{
+		{"/", false, 1},
+		{"/index.html", false, 1},
+		{"/livelog", false, 2},
+		{"/livelog?offset=3", false, 2},
+		{"/livelog/abc", false, 2},
+		{"/livelog2", false, 1},
+		{"/livelog/raw/abc", false, 3},
+		{"/vnc", false, 1},
+		{"/", true, 4},
+		{"/ssh", true, 4},
+		{"/vnc", true, 5},
+		{"/vnc/display", true, 5},
+	} {
+		route, ok := routes.Match(tc.path, tc.tcp)
+		require.True(t, ok, tc.path)
+		require.Equal(t, tc.port, route.Port, "%s (tcp: %v)", tc.path, tc.tcp)
+	}
+
+	_, ok := Routes{{Prefix: "/livelog", Port: 2}}.Match("/other", false)
+	require.False(t, ok)
+	_, ok = Routes{{Prefix: "/", Port: 2}}.Match("/", true)
+	require.False(t, ok)
+}
+
+// startLocalService starts a TCP service that responds to each connection
+// with the given name followed by the first line it receives
+func startLocalService(t *testing.T, name string) (net.Listener, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				_, _ = conn.Write([]byte(name + ": " + line))
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener, listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestRoutesForward(t *testing.T) {
+	web, webPort := startLocalService(t, "web")
+	defer web.Close()
+	livelog, livelogPort := startLocalService(t, "livelog")
+	defer livelog.Close()
+	vnc, vncPort := startLocalService(t, "vnc")
+	defer vnc.Close()
+
+	routes := Routes{
+		{Prefix: "/", Port: webPort},
+		{Prefix: "/livelog", Port: livelogPort},
+		{Prefix: "/vnc", Port: vncPort, TCP: true},
+	}
+
+	// forward sends the given data on a stream forwarded by the routes, and
+	// returns everything received in response
+	forward := func(data string) string {
+		stream, remote := net.Pipe()
+		go func() {
+			_ = routes.Forward(stream)
+		}()
+		go func() {
+			_, _ = remote.Write([]byte(data))
+		}()
+		response, err := ioutil.ReadAll(remote)
+		require.NoError(t, err)
+		return string(response)
+	}
+
+	require.Equal(t, "web: GET /index.html HTTP/1.1\r\n", forward("GET /index.html HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.Equal(t, "livelog: GET /livelog/token HTTP/1.1\r\n", forward("GET /livelog/token HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	require.Equal(t, "HTTP/1.1 200 Connection Established\r\n\r\nvnc: hello\n",
+		forward("CONNECT /vnc HTTP/1.1\r\nHost: localhost\r\n\r\nhello\n"))
+
+	// there is no TCP route for /ssh
+	response := forward("CONNECT /ssh HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(strings.NewReader(response)), nil)
+	require.NoError(t, err)
+	require.Equal(t, 404, res.StatusCode)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// TCPRequest is a request from the websocktunnel server to connect a stream
+// to a TCP service on the client, made when a viewer opens a websocket
+// connection to the client's TCP endpoint (see wsproxy.TCPPath).  It must be
+// either accepted or rejected.
+type TCPRequest struct {
+	// Path is the path that the viewer gave after the TCP endpoint, or "/"
+	// if none was given.
+	Path string
+
+	conn *bufferedConn
+}
+
+// Accept accepts the request, returning a net.Conn that carries the raw TCP
+// data between the viewer and the client.
+func (r *TCPRequest) Accept() (net.Conn, error) {
+	_, err := r.conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		_ = r.conn.Close()
+		return nil, err
+	}
+	return r.conn, nil
+}
+
+// Reject rejects the request with the given HTTP status code, and closes the
+// stream.
+func (r *TCPRequest) Reject(status int) error {
+	_, err := fmt.Fprintf(r.conn, "HTTP/1.1 %03d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+	closeErr := r.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// ParseStream reads the beginning of a stream accepted from a Client, to
+// determine whether it is a raw TCP stream.  If so, it returns a TCPRequest,
+// which must be accepted or rejected.  Otherwise, the stream carries HTTP,
+// and ParseStream returns a net.Conn from which the stream can be read from
+// its beginning.
+func ParseStream(stream net.Conn) (net.Conn, *TCPRequest, error) {
+	conn := &bufferedConn{Conn: stream, reader: bufio.NewReader(stream)}
+	method, err := conn.reader.Peek(len(http.MethodConnect) + 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(method, []byte(http.MethodConnect+" ")) {
+		return conn, nil, nil
+	}
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return nil, &TCPRequest{Path: path, conn: conn}, nil
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader, so that data
+// read ahead by the reader is not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
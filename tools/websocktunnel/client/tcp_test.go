@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStreamHTTP(t *testing.T) {
+	stream, remote := net.Pipe()
+	defer stream.Close()
+	request := "GET /some/path HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	go func() {
+		_, _ = remote.Write([]byte(request))
+		_ = remote.Close()
+	}()
+
+	conn, tcpReq, err := ParseStream(stream)
+	require.NoError(t, err)
+	require.Nil(t, tcpReq)
+
+	// the whole request can still be read
+	data, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, request, string(data))
+}
+
+func TestParseStreamTCP(t *testing.T) {
+	for path, reject := range map[string]bool{"/ssh": false, "/vnc": true} {
+		stream, remote := net.Pipe()
+		go func(path string) {
+			_, _ = remote.Write([]byte("CONNECT " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		}(path)
+
+		conn, tcpReq, err := ParseStream(stream)
+		require.NoError(t, err)
+		require.Nil(t, conn)
+		require.Equal(t, path, tcpReq.Path)
+
+		responses := make(chan *http.Response, 1)
+		remoteReader := bufio.NewReader(remote)
+		go func() {
+			res, err := http.ReadResponse(remoteReader, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				responses <- nil
+				return
+			}
+			responses <- res
+		}()
+
+		if reject {
+			require.NoError(t, tcpReq.Reject(404))
+			require.Equal(t, 404, (<-responses).StatusCode)
+			_ = remote.Close()
+			continue
+		}
+
+		conn, err = tcpReq.Accept()
+		require.NoError(t, err)
+		require.Equal(t, 200, (<-responses).StatusCode)
+
+		// raw data then flows in both directions
+		go func() {
+			_, _ = remote.Write([]byte("ping"))
+		}()
+		buf := make([]byte, 4)
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+
+		go func() {
+			_, _ = conn.Write([]byte("pong"))
+			_ = conn.Close()
+		}()
+		data, err := ioutil.ReadAll(remoteReader)
+		require.NoError(t, err)
+		require.Equal(t, "pong", string(data))
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto"
 	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"log/syslog"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	docopt "github.com/docopt/docopt-go"
 	"github.com/gorilla/websocket"
@@ -28,8 +32,27 @@ Environment:
  TLS_KEY                                     corresponding base64-encoded TLS key
  TASKCLUSTER_PROXY_SECRET_A                  JWT secret
  TASKCLUSTER_PROXY_SECRET_B                  alternate JWT secret
+ JWT_PUBLIC_KEYS                             JSON Web Key Set of public keys for JWTs
+                                             signed with EdDSA, ES256 or RS256
+ JWT_JWKS_FILE                               path of a JSON Web Key Set file of further
+                                             public keys, reloaded when it changes
  SYSLOG_ADDR                                 address to which to send syslog output
  AUDIENCE                                    JWT 'audience' claim
+ METRICS_PORT (optional)                     port on which to serve Prometheus metrics at
+                                             /metrics; not served if not provided
+ MAX_STREAMS_PER_CLIENT (optional)           maximum number of open streams to each client
+ REQUESTS_PER_SECOND_PER_CLIENT (optional)   maximum rate of viewer requests to each client
+ REQUEST_BURST_PER_CLIENT (optional)         maximum burst of viewer requests to each client
+ RESUME_GRACE_PERIOD (optional)              seconds to keep the session of a disconnected
+                                             client for it to resume; not resumable if not
+                                             provided
+ REDIS_URL (optional)                        redis://[:password@]host[:port][/db] of a Redis
+                                             server recording which instance each client is
+                                             connected to, for running several instances;
+                                             rediss:// to connect using TLS
+ INSTANCE_URL                                URL (http(s)://host(:port)) at which other
+                                             instances can reach this one; required with
+                                             REDIS_URL
 
 Options:
 -h --help       Show help`
@@ -65,6 +88,16 @@ func main() {
 	signingSecretA := os.Getenv("TASKCLUSTER_PROXY_SECRET_A")
 	signingSecretB := os.Getenv("TASKCLUSTER_PROXY_SECRET_B")
 
+	// Load public keys
+	var publicKeys map[string]crypto.PublicKey
+	if jwks := os.Getenv("JWT_PUBLIC_KEYS"); jwks != "" {
+		var err error
+		publicKeys, err = wsproxy.ParseJWKS([]byte(jwks))
+		if err != nil {
+			panic(fmt.Sprintf("invalid JWT_PUBLIC_KEYS: %v", err))
+		}
+	}
+
 	// Load TLS certificates
 	useTLS := true
 	tlsKeyEnc := os.Getenv("TLS_KEY")
@@ -91,21 +124,74 @@ func main() {
 	// load audience value
 	audience := os.Getenv("AUDIENCE")
 
+	// load per-client limits
+	maxStreams := envInt("MAX_STREAMS_PER_CLIENT")
+	requestBurst := envInt("REQUEST_BURST_PER_CLIENT")
+	resumeGracePeriod := time.Duration(envInt("RESUME_GRACE_PERIOD")) * time.Second
+	requestsPerSecond := 0.0
+	if rate := os.Getenv("REQUESTS_PER_SECOND_PER_CLIENT"); rate != "" {
+		requestsPerSecond, err = strconv.ParseFloat(rate, 64)
+		if err != nil || requestsPerSecond < 0 {
+			panic("invalid REQUESTS_PER_SECOND_PER_CLIENT")
+		}
+	}
+
+	// load the registry shared between instances
+	var registry wsproxy.Registry
+	instanceURL := os.Getenv("INSTANCE_URL")
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		if instanceURL == "" {
+			panic("INSTANCE_URL is required with REDIS_URL")
+		}
+		redisRegistry, err := wsproxy.NewRedisRegistry(redisURL)
+		if err != nil {
+			panic(fmt.Sprintf("invalid REDIS_URL: %v", err))
+		}
+		defer redisRegistry.Close()
+		registry = redisRegistry
+	}
+
+	metrics := wsproxy.NewMetrics()
+	if metricsPort := os.Getenv("METRICS_PORT"); metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		metricsServer := &http.Server{Addr: ":" + metricsPort, Handler: mux}
+		logger.WithFields(log.Fields{
+			"metrics-addr": metricsServer.Addr,
+		}).Info("serving metrics")
+		go func() {
+			panic(metricsServer.ListenAndServe())
+		}()
+	}
+
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 	}
 
-	// will panic if secrets are not loaded
-	proxy, _ := wsproxy.New(wsproxy.Config{
-		Logger:     logger,
-		Upgrader:   upgrader,
-		JWTSecretA: []byte(signingSecretA),
-		JWTSecretB: []byte(signingSecretB),
-		URLPrefix:  urlPrefix,
-		Audience:   audience,
+	// will panic if neither secrets nor public keys are loaded
+	proxy, err := wsproxy.New(wsproxy.Config{
+		Logger:        logger,
+		Upgrader:      upgrader,
+		JWTSecretA:    []byte(signingSecretA),
+		JWTSecretB:    []byte(signingSecretB),
+		JWTPublicKeys: publicKeys,
+		JWKSFile:      os.Getenv("JWT_JWKS_FILE"),
+		URLPrefix:     urlPrefix,
+		Audience:      audience,
+		Metrics:       metrics,
+
+		MaxStreamsPerClient: maxStreams,
+		RequestsPerSecond:   requestsPerSecond,
+		RequestBurst:        requestBurst,
+		ResumeGracePeriod:   resumeGracePeriod,
+		InstanceURL:         instanceURL,
+		Registry:            registry,
 	})
+	if err != nil {
+		panic(err)
+	}
 
 	server := &http.Server{Addr: ":" + port, Handler: proxy}
 	defer func() {
@@ -133,3 +219,17 @@ func main() {
 		}
 	}
 }
+
+// envInt returns the non-negative integer value of the given environment
+// variable, or 0 if it is not set
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("invalid %s", name))
+	}
+	return n
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -25,8 +24,8 @@ the internet.
 [Firewall/NAT [User] <--]---> [websocktunnel] <--- [Web]
 
 Usage:
-    wst-client <wstServer> <wstClientID> <targetPort> [--token <jwtToken>] [--out-file=<outFile>]
-	           [--verbose] [--json] 
+    wst-client <wstServer> <wstClientID> [<targetPort>] [--token <jwtToken>] [--out-file=<outFile>]
+	           [--tcp-port=<tcpPort>] [--route=<route>]... [--resume] [--verbose] [--json] 
     wst-client -h | --help
 
 The wstClientID is the ID to register with the websocktunnel server.  The JWT
@@ -38,11 +37,35 @@ subprocess of some other server for which it is managing the tunnel.  That
 server can then "feed" wst-client a new token before the most recent token
 expires.
 
+HTTP requests to the client URL, including websocket upgrades, are forwarded
+to the targetPort.  If --tcp-port is given, websocket connections to
+<clientURL>/__tcp__ are instead bridged to raw TCP connections to that port,
+so that services such as SSH or VNC can be reached through the tunnel (for
+example with wst-connect).
+
+Several local services can be served over the one tunnel with --route, which
+may be given multiple times.  A route of the form <prefix>=<port> forwards
+HTTP requests whose path (following the client URL) begins with <prefix> to
+that port, with the path unchanged.  A route of the form tcp:<prefix>=<port>
+does the same for raw TCP connections, matching the path following
+<clientURL>/__tcp__.  The longest matching prefix is used, and the targetPort
+and --tcp-port act as routes for the prefix /.  For example:
+
+    wst-client <wstServer> <wstClientID> 8080 --route=/livelog=60023 --route=tcp:/vnc=5900
+
+With --resume, if the connection to the websocktunnel server is lost, the
+client reconnects and resumes its session, so that open connections carry on
+rather than being dropped.  This requires a server with session resumption
+enabled; otherwise the client reconnects as usual.
+
 Options:
 -h --help               Show help
 --verbose               Verbose logging
 --token                 JWT Token, if not given on stdin (see above)
 --out-file=<outFile>    Dump url to this file
+--tcp-port=<tcpPort>    Local port to connect raw TCP streams to
+--route=<route>         Route a path prefix to a local port (see above)
+--resume                Resume the session after losing the connection (see above)
 --json                  Output logs in JSON format`
 
 const closeWait = 2 * time.Second
@@ -56,8 +79,32 @@ func main() {
 		jwtToken = arguments["<jwtToken>"].(string)
 	}
 
-	targetPort, err := strconv.Atoi(arguments["<targetPort>"].(string))
-	if err != nil || targetPort < 0 || targetPort > 65535 {
+	routes := client.Routes{}
+	if arguments["<targetPort>"] != nil {
+		targetPort, err := strconv.Atoi(arguments["<targetPort>"].(string))
+		if err != nil || targetPort < 0 || targetPort > 65535 {
+			log.Fatal(usage)
+		}
+		routes = append(routes, client.Route{Prefix: "/", Port: targetPort})
+	}
+
+	if arguments["--tcp-port"] != nil {
+		tcpPort, err := strconv.Atoi(arguments["--tcp-port"].(string))
+		if err != nil || tcpPort <= 0 || tcpPort > 65535 {
+			log.Fatal(usage)
+		}
+		routes = append(routes, client.Route{Prefix: "/", Port: tcpPort, TCP: true})
+	}
+
+	for _, spec := range arguments["--route"].([]string) {
+		route, err := client.ParseRoute(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		routes = append(routes, route)
+	}
+
+	if len(routes) == 0 {
 		log.Fatal(usage)
 	}
 
@@ -87,7 +134,7 @@ func main() {
 	// accept new streams from this channel
 	strChan := make(chan net.Conn, 1)
 
-	client, err := client.New(makeConfigurer(wstServer, wstClientID, jwtToken))
+	client, err := client.New(makeConfigurer(wstServer, wstClientID, jwtToken, arguments["--resume"].(bool)))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -151,7 +198,7 @@ func main() {
 			log.Debug("Accepting new connection")
 			f := &forwarder{
 				stream: stream,
-				port:   targetPort,
+				routes: routes,
 				count:  count,
 			}
 			f.notify = func() {
@@ -170,59 +217,27 @@ func main() {
 // struct for handling connection forwarding
 type forwarder struct {
 	stream net.Conn
-	conn   net.Conn
-	port   int
+	routes client.Routes
 	count  uint64
 	notify func()
 }
 
-// forwards multiplexed stream to port
+// forwards multiplexed stream to the local port given by its route
 func (f *forwarder) forward() {
-	var err error
-	strPort := strconv.Itoa(f.port)
-	f.conn, err = net.Dial("tcp", ":"+strPort)
 	defer f.notify()
-	// just to be sure
-	defer f.kill()
-	if err != nil {
-		return
-	}
-
-	var wg sync.WaitGroup
-
-	wg.Add(2)
-	// outgoing stream (local -> tunnel)
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(f.stream, f.conn)
-		_ = f.stream.Close()
-	}()
-
-	// incoming stream (tunnel -> local)
-	go func() {
-		defer wg.Done()
-		_, _ = io.Copy(f.conn, f.stream)
-		_ = f.conn.Close()
-	}()
-	wg.Wait()
-}
-
-func (f *forwarder) kill() {
-	if f.stream != nil {
-		_ = f.stream.Close()
-	}
-	if f.conn != nil {
-		_ = f.conn.Close()
+	if err := f.routes.Forward(f.stream); err != nil {
+		log.Debugf("Could not forward connection: %v", err)
 	}
 }
 
-func makeConfigurer(wstServer, wstClientID, jwtToken string) func() (client.Config, error) {
+func makeConfigurer(wstServer, wstClientID, jwtToken string, resume bool) func() (client.Config, error) {
 	if jwtToken != "" {
 		configurer := func() (client.Config, error) {
 			return client.Config{
 				ID:         wstClientID,
 				Token:      jwtToken,
 				TunnelAddr: wstServer,
+				Resume:     resume,
 			}, nil
 		}
 		return configurer
@@ -266,6 +281,7 @@ func makeConfigurer(wstServer, wstClientID, jwtToken string) func() (client.Conf
 			ID:         wstClientID,
 			Token:      token,
 			TunnelAddr: wstServer,
+			Resume:     resume,
 		}, nil
 	}
 	return configurer
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/docopt/docopt-go"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/taskcluster/taskcluster/v39/internal"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+const usage = `Websocktunnel Connect is a command line utility which connects to a TCP
+service exposed through the websocktunnel service by a client running
+wst-client --tcp-port.
+
+[User] ---> [wst-connect] ---> [websocktunnel] <--- [wst-client] ---> [TCP service]
+
+Usage:
+    wst-connect <url> [--listen=<addr>] [--verbose] [--json]
+    wst-connect -h | --help
+
+The url is the TCP endpoint of the client: the client URL followed by
+/__tcp__, such as https://tunnel.example.com/my-client/__tcp__.
+
+If --listen is not provided, a single connection is made, carrying the data on
+stdin and stdout.  This allows wst-connect to be used as an SSH ProxyCommand:
+
+    ssh -o ProxyCommand="wst-connect <url>" user@host
+
+Options:
+-h --help               Show help
+--listen=<addr>         Listen for TCP connections at this address, such as
+                        localhost:2222, connecting each in turn
+--verbose               Verbose logging
+--json                  Output logs in JSON format`
+
+func main() {
+	arguments, _ := docopt.ParseArgs(usage, nil, "wst-connect "+internal.Version)
+
+	url := util.MakeWsURL(arguments["<url>"].(string))
+
+	if arguments["--json"].(bool) {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	if arguments["--verbose"].(bool) {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if arguments["--listen"] == nil {
+		if err := connect(url, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	listener, err := net.Listen("tcp", arguments["--listen"].(string))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.WithFields(log.Fields{"addr": listener.Addr().String()}).Info("listening")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{"remote-addr": conn.RemoteAddr().String()}).Debug("accepted connection")
+		go func() {
+			if err := connect(url, conn, conn); err != nil {
+				log.WithFields(log.Fields{"remote-addr": conn.RemoteAddr().String()}).Error(err)
+			}
+		}()
+	}
+}
+
+// connect opens a websocket connection to the TCP endpoint at url, and
+// bridges it to the given local reader and writer
+func connect(url string, reader io.Reader, writer io.WriteCloser) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		_ = writer.Close()
+		return err
+	}
+	log.WithFields(log.Fields{"url": url}).Debug("connected")
+	return util.BridgeWebsocket(conn, reader, writer)
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// BridgeWebsocket carries a raw TCP stream over a websocket connection, as
+// used for websocktunnel's TCP endpoints.  It writes the binary messages of
+// the websocket connection to the writer, and data read from the reader to
+// the websocket connection as binary messages, until either side closes.  The
+// writer and the websocket connection are closed when it returns.
+func BridgeWebsocket(conn *websocket.Conn, reader io.Reader, writer io.WriteCloser) error {
+	defer func() {
+		_ = conn.Close()
+		_ = writer.Close()
+	}()
+
+	errs := make(chan error, 2)
+
+	// reader -> websocket
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				if werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					errs <- nil
+					return
+				}
+			}
+			if err != nil {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				_ = conn.WriteMessage(websocket.CloseMessage, msg)
+				if err == io.EOF {
+					err = nil
+				}
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// websocket -> writer
+	go func() {
+		for {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure,
+					websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					errs <- err
+					return
+				}
+				errs <- nil
+				return
+			}
+			if _, err := io.Copy(writer, r); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	// wait for either direction to finish; closing the websocket connection
+	// then ends the other
+	return <-errs
+}
@@ -39,4 +39,14 @@ var (
 
 	// ErrTooManySyns indicates too many un-accepted new incoming streams
 	ErrTooManySyns = errors.New("too many un-accepted new incoming streams")
+
+	// ErrTooManyStreams is returned when a stream cannot be opened because the session
+	// already has the maximum number of open streams, at either end
+	ErrTooManyStreams = errors.New("too many open streams")
+
+	// ErrNotResumable is returned when Resume is called on a session that is not resumable
+	ErrNotResumable = errors.New("session is not resumable")
+
+	// ErrResumeTimeout is returned when a session is not resumed within its grace period
+	ErrResumeTimeout = errors.New("session was not resumed in time")
 )
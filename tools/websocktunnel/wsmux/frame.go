@@ -15,9 +15,13 @@ const (
 	msgACK byte = 2
 	// Used to close a stream
 	msgFIN byte = 3
+	// Acknowledges frames received on a stream of a resumable session
+	msgSEQ byte = 4
+	// Resumes a session over a new connection
+	msgRES byte = 5
 
 	// last message type
-	msgMax byte = msgFIN
+	msgMax byte = msgRES
 )
 
 // header contains a frame header.  It contains an 8-bit message type (`msg`,
@@ -57,6 +61,10 @@ func newHeader(msg byte, id uint32) header {
 // * msgACK: payload is a little-endian u32 indicating the number of bytes handled
 //   on the remote end and thus no longer "in flight".
 // * msgFIN: no payload
+// * msgSEQ: payload is a little-endian u32 giving the number of frames received
+//   on the stream (see resume.go)
+// * msgRES: payload is a sequence of pairs of little-endian u32s, giving a stream
+//   ID and the number of frames received on that stream; the frame's ID is unused
 type frame struct {
 	id      uint32
 	msg     byte
@@ -107,6 +115,11 @@ func (f frame) String() string {
 		str += strconv.Itoa(int(binary.LittleEndian.Uint32(f.payload)))
 	case msgFIN:
 		str += "FIN"
+	case msgSEQ:
+		str += "SEQ "
+		str += strconv.Itoa(int(binary.LittleEndian.Uint32(f.payload)))
+	case msgRES:
+		str += "RES"
 	}
 	return str
 }
@@ -137,3 +150,39 @@ func newAckFrame(id uint32, cap uint32) frame {
 func newFinFrame(id uint32) frame {
 	return frame{id: id, msg: msgFIN, payload: nil}
 }
+
+// newSeqFrame creates a new msgSEQ frame containing the given number of
+// received frames.
+func newSeqFrame(id uint32, received uint32) frame {
+	frame := frame{id: id, msg: msgSEQ}
+	frame.payload = make([]byte, 4)
+	binary.LittleEndian.PutUint32(frame.payload, received)
+	return frame
+}
+
+// newResFrame creates a new msgRES frame containing the given numbers of
+// received frames, by stream ID.
+func newResFrame(received map[uint32]uint32) frame {
+	frame := frame{id: 0, msg: msgRES}
+	frame.payload = make([]byte, 0, 8*len(received))
+	for id, n := range received {
+		frame.payload = append(frame.payload, make([]byte, 8)...)
+		pair := frame.payload[len(frame.payload)-8:]
+		binary.LittleEndian.PutUint32(pair, id)
+		binary.LittleEndian.PutUint32(pair[4:], n)
+	}
+	return frame
+}
+
+// resReceived returns the numbers of received frames, by stream ID, contained
+// in a msgRES frame.
+func (f frame) resReceived() (map[uint32]uint32, error) {
+	if len(f.payload)%8 != 0 {
+		return nil, ErrMalformedHeader
+	}
+	received := make(map[uint32]uint32, len(f.payload)/8)
+	for p := f.payload; len(p) > 0; p = p[8:] {
+		received[binary.LittleEndian.Uint32(p)] = binary.LittleEndian.Uint32(p[4:])
+	}
+	return received, nil
+}
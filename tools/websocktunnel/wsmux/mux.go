@@ -34,6 +34,21 @@ type Config struct {
 	// StreamBufferSize sets the maximum buffer size of streams created by the session.
 	// Default: 1024 bytes
 	StreamBufferSize int
+
+	// MaxStreams is the maximum number of streams, opened by either end, that may be
+	// open in the session at once.  Beyond this, Open fails with ErrTooManyStreams, and
+	// streams opened by the remote end are refused.  Default: no limit
+	MaxStreams int
+
+	// ResumeGracePeriod, if non-zero, makes the session resumable: if its websocket
+	// connection is lost, the session waits this long for a new connection to be
+	// passed to Resume, rather than closing, and its streams carry on where they left
+	// off.  Both ends of the session must be resumable.  Default: not resumable
+	ResumeGracePeriod time.Duration
+
+	// DisconnectCallback is invoked when the connection of a resumable session is
+	// lost, so that a new connection can be made and passed to Resume.
+	DisconnectCallback func()
 }
 
 // Server instantiates a new server session over a websocket connection.
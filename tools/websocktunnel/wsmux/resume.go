@@ -0,0 +1,336 @@
+package wsmux
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Resumable sessions
+//
+// A session with a non-zero Config.ResumeGracePeriod survives the loss of its
+// websocket connection: rather than closing, it waits for a new connection to
+// be passed to Resume, and its streams carry on where they left off.
+//
+// To support this, the frames sent on each stream are numbered, implicitly, from
+// 1.  The sender keeps each frame until the remote end acknowledges it with a
+// msgSEQ frame giving the number of frames it has received on the stream.  When
+// the session is resumed, each end first sends a msgRES frame giving the number
+// of frames it has received on each stream it knows of, and then sends the
+// frames that the other end has not received, before anything new.
+//
+// A stream that the remote end does not include in its msgRES frame has been
+// removed there, and needs nothing more, unless nothing has been received from
+// the remote end on the stream.  In that case the remote end may never have
+// received its msgSYN frame, so all of its frames are sent again.
+
+const (
+	// acknowledge frames received on a stream once this many are unacknowledged
+	seqAckFrames = 16
+	// and otherwise acknowledge them at this interval
+	seqAckInterval = time.Second
+)
+
+// streamSeq tracks the frames sent and received on a stream of a resumable
+// session.
+type streamSeq struct {
+	// number of frames sent and received on the stream
+	sent     uint32
+	received uint32
+
+	// number of received frames last acknowledged to the remote end
+	acked uint32
+
+	// frames sent but not yet acknowledged by the remote end, numbered
+	// sent-len(unacked)+1 to sent
+	unacked []frame
+
+	// true once the stream has been removed from the session
+	removed bool
+}
+
+// ack discards the sent frames that the remote end has received.
+func (q *streamSeq) ack(received uint32) {
+	n := int64(received) - int64(q.sent) + int64(len(q.unacked))
+	if n <= 0 {
+		return
+	}
+	if n >= int64(len(q.unacked)) {
+		q.unacked = nil
+		return
+	}
+	q.unacked = q.unacked[n:]
+}
+
+// done returns true if the streamSeq is no longer needed: the stream has been
+// removed, and all frames in both directions have been acknowledged.
+func (q *streamSeq) done() bool {
+	return q.removed && len(q.unacked) == 0 && q.acked == q.received
+}
+
+// Resume continues a resumable session over a new websocket connection, after
+// its connection was lost or in place of a connection that is no longer
+// wanted.  The remote end must resume its session over the other end of the
+// same connection.  Frames lost with the old connection are sent again, so
+// streams are unaffected.
+//
+// This function takes ownership of `conn`; nothing else should use the connection.
+func (s *Session) Resume(conn *websocket.Conn) error {
+	if s.resumeGracePeriod == 0 {
+		return ErrNotResumable
+	}
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+
+	s.resumeLock.Lock()
+	old, broken := s.conn, s.broken
+	s.conn = conn
+	s.broken = false
+	s.live = false
+	if s.resumeTimer != nil {
+		s.resumeTimer.Stop()
+		s.resumeTimer = nil
+	}
+	received := make(map[uint32]uint32, len(s.seqs))
+	for id, q := range s.seqs {
+		received[id] = q.received
+		q.acked = q.received
+	}
+	s.resumeLock.Unlock()
+
+	// frames arriving on the old connection are now ignored, so it can be
+	// closed; this also ends any send blocked on it
+	if !broken {
+		_ = old.Close()
+	}
+
+	s.mu.Lock()
+	s.pongSeen = true
+	s.mu.Unlock()
+	conn.SetCloseHandler(s.closeHandler)
+	conn.SetPongHandler(s.pongHandler)
+
+	s.sendLock.Lock()
+	err := conn.WriteMessage(websocket.BinaryMessage, newResFrame(received).serialize())
+	s.sendLock.Unlock()
+	if err != nil {
+		s.disconnect(conn, err)
+		return err
+	}
+
+	s.logger.Printf("session resumed")
+	go s.recvLoop(conn)
+	return nil
+}
+
+// disconnect handles the failure of the given connection.  A resumable session
+// waits for Resume to be called, while any other session is aborted.
+func (s *Session) disconnect(conn *websocket.Conn, err error) {
+	if s.resumeGracePeriod == 0 {
+		s.abort(err)
+		return
+	}
+
+	s.resumeLock.Lock()
+	if conn != s.conn || s.broken {
+		// this connection has already been replaced or handled
+		s.resumeLock.Unlock()
+		return
+	}
+	s.broken = true
+	s.live = false
+	s.resumeTimer = time.AfterFunc(s.resumeGracePeriod, s.resumeExpired)
+	s.resumeLock.Unlock()
+
+	_ = conn.Close()
+	s.logger.Printf("connection lost; waiting for session to be resumed: %v", err)
+	if s.disconnectCallback != nil {
+		go s.disconnectCallback()
+	}
+}
+
+// resumeExpired aborts the session if it has not been resumed within its grace
+// period.
+func (s *Session) resumeExpired() {
+	s.resumeLock.Lock()
+	broken := s.broken
+	s.resumeLock.Unlock()
+	if broken {
+		s.abort(ErrResumeTimeout)
+	}
+}
+
+// sequence records a frame about to be sent on a resumable session, returning
+// the connection on which to send it, or nil if the frame must wait for the
+// session to be resumed.  It must be called with s.sendLock held.
+func (s *Session) sequence(f frame) *websocket.Conn {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+
+	q, ok := s.seqs[f.id]
+	if !ok {
+		q = &streamSeq{}
+		s.seqs[f.id] = q
+	}
+	q.sent++
+	q.unacked = append(q.unacked, f)
+
+	if !s.live {
+		return nil
+	}
+	return s.conn
+}
+
+// receive records a frame received on the given connection of a resumable
+// session, and returns true if the frame should be handled as usual.  Frames
+// received on a connection that has since been replaced are ignored, and
+// msgSEQ and msgRES frames are handled here.
+func (s *Session) receive(conn *websocket.Conn, f *frame) bool {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+
+	if conn != s.conn || s.broken {
+		return false
+	}
+
+	switch f.msg {
+	case msgSEQ:
+		if q, ok := s.seqs[f.id]; ok && len(f.payload) == 4 {
+			q.ack(binary.LittleEndian.Uint32(f.payload))
+			if q.done() {
+				delete(s.seqs, f.id)
+			}
+		}
+		return false
+
+	case msgRES:
+		received, err := f.resReceived()
+		if err != nil {
+			s.logger.Print(err)
+			return false
+		}
+		for id, q := range s.seqs {
+			if n, ok := received[id]; ok {
+				q.ack(n)
+			} else if q.received > 0 {
+				// the remote end has removed the stream
+				q.unacked = nil
+				q.acked = q.received
+			}
+			if q.done() {
+				delete(s.seqs, id)
+			}
+		}
+		go s.replay(conn)
+		return false
+	}
+
+	q, ok := s.seqs[f.id]
+	if f.msg == msgSYN && (!ok || q.removed) {
+		// a new stream, possibly reusing the id of a removed stream
+		q = &streamSeq{}
+		s.seqs[f.id] = q
+	} else if !ok {
+		return true
+	}
+	q.received++
+	if q.received-q.acked >= seqAckFrames {
+		select {
+		case s.ackDue <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// replay sends the frames that the remote end has not received, after it has
+// resumed the session, and then allows new frames to be sent.
+func (s *Session) replay(conn *websocket.Conn) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	s.resumeLock.Lock()
+	if conn != s.conn || s.broken {
+		s.resumeLock.Unlock()
+		return
+	}
+	var frames []frame
+	for _, q := range s.seqs {
+		frames = append(frames, q.unacked...)
+	}
+	s.live = true
+	s.resumeLock.Unlock()
+
+	s.logger.Printf("replaying %d frames", len(frames))
+	for _, f := range frames {
+		if err := conn.WriteMessage(websocket.BinaryMessage, f.serialize()); err != nil {
+			s.disconnect(conn, err)
+			return
+		}
+	}
+}
+
+// hasSeq returns true if the session is tracking frames for the given stream
+// id, which therefore cannot yet be reused.
+func (s *Session) hasSeq(id uint32) bool {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	_, ok := s.seqs[id]
+	return ok
+}
+
+// streamRemoved records that a stream has been removed from the session, so
+// that the frames tracked for it are discarded once no longer needed.
+func (s *Session) streamRemoved(id uint32) {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	if q, ok := s.seqs[id]; ok {
+		q.removed = true
+		if q.done() {
+			delete(s.seqs, id)
+		}
+	}
+}
+
+// sendSeqAcks acknowledges the frames received on each stream of a resumable
+// session, once enough are unacknowledged and otherwise periodically, until the
+// session is closed.
+func (s *Session) sendSeqAcks() {
+	ticker := time.NewTicker(seqAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		case <-s.ackDue:
+		}
+
+		s.sendLock.Lock()
+		s.resumeLock.Lock()
+		conn := s.conn
+		var acks []frame
+		if s.live {
+			for id, q := range s.seqs {
+				if q.acked != q.received {
+					q.acked = q.received
+					acks = append(acks, newSeqFrame(id, q.received))
+				}
+				if q.done() {
+					delete(s.seqs, id)
+				}
+			}
+		}
+		s.resumeLock.Unlock()
+
+		for _, f := range acks {
+			if err := conn.WriteMessage(websocket.BinaryMessage, f.serialize()); err != nil {
+				s.disconnect(conn, err)
+				break
+			}
+		}
+		s.sendLock.Unlock()
+	}
+}
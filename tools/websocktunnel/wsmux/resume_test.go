@@ -0,0 +1,214 @@
+package wsmux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+// connPairs returns a function which returns the client and server ends of a
+// new websocket connection to the given server, which must send the server
+// ends to serverConns.
+func connPairs(t *testing.T, url string, serverConns chan *websocket.Conn) func() (*websocket.Conn, *websocket.Conn) {
+	return func() (*websocket.Conn, *websocket.Conn) {
+		conn, _, err := (&websocket.Dialer{}).Dial(util.MakeWsURL(url), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, <-serverConns
+	}
+}
+
+func TestResume(t *testing.T) {
+	serverConns := make(chan *websocket.Conn)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		serverConns <- conn
+	}))
+	defer server.Close()
+	newPair := connPairs(t, server.URL, serverConns)
+
+	clientConn, serverConn := newPair()
+	disconnected := make(chan struct{}, 1)
+	clientSession := Client(clientConn, Config{
+		Log:               genLogger(),
+		ResumeGracePeriod: 10 * time.Second,
+		DisconnectCallback: func() {
+			disconnected <- struct{}{}
+		},
+	})
+	defer clientSession.Close()
+	serverSession := Server(serverConn, Config{Log: genLogger(), ResumeGracePeriod: 10 * time.Second})
+	defer serverSession.Close()
+
+	// the server echoes a stream
+	go func() {
+		stream, err := serverSession.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(stream, stream)
+		_ = stream.Close()
+	}()
+
+	stream, err := clientSession.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send data in many frames, over long enough that the connection breaks
+	// part way through
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go func() {
+		for p := data; len(p) > 0; p = p[4096:] {
+			_, _ = stream.Write(p[:4096])
+			time.Sleep(2 * time.Millisecond)
+		}
+		_ = stream.Close()
+	}()
+	received := make(chan []byte)
+	go func() {
+		buf := new(bytes.Buffer)
+		_, _ = io.Copy(buf, stream)
+		received <- buf.Bytes()
+	}()
+
+	// closing the server end discards any frames it has not yet read
+	time.Sleep(50 * time.Millisecond)
+	_ = serverConn.UnderlyingConn().Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("disconnect callback not called")
+	}
+	if clientSession.IsClosed() {
+		t.Fatal("resumable session closed on disconnect")
+	}
+
+	// frames sent meanwhile are queued
+	time.Sleep(50 * time.Millisecond)
+
+	clientConn, serverConn = newPair()
+	if err := serverSession.Resume(serverConn); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientSession.Resume(clientConn); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("data not consistent after resumption: received %d of %d bytes", len(buf), len(data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream did not complete after resumption")
+	}
+
+	// new streams can be opened after resumption
+	go func() {
+		stream, err := serverSession.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = stream.Write([]byte("resumed"))
+		_ = stream.Close()
+	}()
+	stream, err = clientSession.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, stream); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "resumed" {
+		t.Fatalf("unexpected data %q", buf.String())
+	}
+}
+
+func TestResumeTimeout(t *testing.T) {
+	serverConns := make(chan *websocket.Conn)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		serverConns <- conn
+	}))
+	defer server.Close()
+
+	clientConn, serverConn := connPairs(t, server.URL, serverConns)()
+	clientSession := Client(clientConn, Config{Log: genLogger(), ResumeGracePeriod: 10 * time.Second})
+	defer clientSession.Close()
+	serverSession := Server(serverConn, Config{Log: genLogger(), ResumeGracePeriod: 100 * time.Millisecond})
+
+	_ = clientConn.UnderlyingConn().Close()
+
+	// the server session closes once the grace period has passed
+	accepted := make(chan error)
+	go func() {
+		_, err := serverSession.Accept()
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err == nil || !serverSession.IsClosed() {
+			t.Fatalf("expected session to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after grace period")
+	}
+
+	if err := serverSession.Resume(serverConn); err != ErrSessionClosed {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func TestResumeClose(t *testing.T) {
+	serverConns := make(chan *websocket.Conn)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		serverConns <- conn
+	}))
+	defer server.Close()
+
+	clientConn, serverConn := connPairs(t, server.URL, serverConns)()
+	clientSession := Client(clientConn, Config{Log: genLogger(), ResumeGracePeriod: 10 * time.Second})
+	serverSession := Server(serverConn, Config{Log: genLogger(), ResumeGracePeriod: 10 * time.Second})
+
+	// closing a resumable session closes the remote end at once
+	_ = clientSession.Close()
+	accepted := make(chan error)
+	go func() {
+		_, err := serverSession.Accept()
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != ErrSessionClosed {
+			t.Fatalf("expected ErrSessionClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote session not closed")
+	}
+}
+
+func TestResumeNotResumable(t *testing.T) {
+	serverConns := make(chan *websocket.Conn)
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		serverConns <- conn
+	}))
+	defer server.Close()
+
+	clientConn, serverConn := connPairs(t, server.URL, serverConns)()
+	clientSession := Client(clientConn, Config{Log: genLogger()})
+	defer clientSession.Close()
+	serverSession := Server(serverConn, Config{Log: genLogger()})
+	defer serverSession.Close()
+
+	if err := clientSession.Resume(clientConn); err != ErrNotResumable {
+		t.Fatalf("expected ErrNotResumable, got %v", err)
+	}
+}
@@ -33,7 +33,8 @@ type Session struct {
 	// this channel.
 	streamCh chan *stream
 
-	// the underlying websocket connection
+	// the underlying websocket connection; this is replaced when a resumable
+	// session is resumed, so is accessed with resumeLock held
 	conn *websocket.Conn
 
 	// error to be returned by any outstanding Accept calls
@@ -65,11 +66,44 @@ type Session struct {
 	// to the remote end, avoiding buffering too much data.
 	streamBufferSize int
 
+	// Maximum number of open streams; 0 for no limit
+	maxStreams int
+
 	// Keep alives are sent at this period
 	keepAliveInterval time.Duration
 
 	// Set by the pong handler
 	pongSeen bool
+
+	// Time to wait for Resume after the connection is lost; 0 if the session
+	// is not resumable
+	resumeGracePeriod time.Duration
+
+	// Callback when the connection of a resumable session is lost. default: nil
+	disconnectCallback func()
+
+	// lock for conn and the fields below
+	resumeLock sync.Mutex
+
+	// true when conn has failed and the session is waiting for Resume
+	broken bool
+
+	// true when frames may be sent on conn; this is false from when the
+	// connection fails until the remote end has sent msgRES over a new one
+	live bool
+
+	// aborts the session if it is not resumed within the grace period
+	resumeTimer *time.Timer
+
+	// frames sent and received on each stream of a resumable session, by id
+	seqs map[uint32]*streamSeq
+
+	// signalled when received frames should be acknowledged
+	ackDue chan struct{}
+
+	// held while handling a received frame, so that frames are handled in
+	// order even as a resumed session switches connections
+	recvLock sync.Mutex
 }
 
 // newSession creates a new session based on the given configuration, applying
@@ -87,6 +121,12 @@ func newSession(conn *websocket.Conn, server bool, conf Config) *Session {
 		logger:               &util.NilLogger{},
 		streamBufferSize:     DefaultCapacity,
 		closeCallback:        conf.CloseCallback,
+		maxStreams:           conf.MaxStreams,
+		resumeGracePeriod:    conf.ResumeGracePeriod,
+		disconnectCallback:   conf.DisconnectCallback,
+		live:                 true,
+		seqs:                 make(map[uint32]*streamSeq),
+		ackDue:               make(chan struct{}, 1),
 	}
 
 	// streams opened by server are even numbered
@@ -112,9 +152,12 @@ func newSession(conn *websocket.Conn, server bool, conf Config) *Session {
 	s.conn.SetCloseHandler(s.closeHandler)
 	s.conn.SetPongHandler(s.pongHandler)
 
-	go s.recvLoop()
+	go s.recvLoop(conn)
 	go s.removeDeadStreams()
 	go s.sendKeepAlives()
+	if s.resumeGracePeriod != 0 {
+		go s.sendSeqAcks()
+	}
 	return s
 }
 
@@ -159,12 +202,16 @@ func (s *Session) Open() (net.Conn, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.atStreamLimit() {
+		return nil, ErrTooManyStreams
+	}
+
 	// search for an unused stream id; this makes the conservative assumption
 	// that there are far fewer than 2**31 streams open simultaneously, but
 	// allows for example a single long-lived stream with a large number of
 	// transient streams that cause the id space to wrap
 	for {
-		if _, ok := s.streams[s.nextID]; !ok {
+		if _, ok := s.streams[s.nextID]; !ok && !s.hasSeq(s.nextID) {
 			break
 		}
 		s.nextID += 2
@@ -173,6 +220,7 @@ func (s *Session) Open() (net.Conn, error) {
 	s.nextID += 2
 
 	str := newStream(id, s)
+	str.local = true
 	s.streams[id] = str
 
 	if err := s.send(newSynFrame(id)); err != nil {
@@ -186,17 +234,24 @@ func (s *Session) Open() (net.Conn, error) {
 	select {
 	case <-str.accepted:
 		s.mu.Lock()
+		if str.isRefused() {
+			delete(s.streams, id)
+			s.streamRemoved(id)
+			return nil, ErrTooManyStreams
+		}
 		return str, nil
 	case <-s.closed:
 		s.mu.Lock()
 		// state of s.nextID doesn't matter here
 		delete(s.streams, id)
+		s.streamRemoved(id)
 		return nil, ErrSessionClosed
 	case <-time.After(s.streamAcceptDeadline):
 		s.mu.Lock()
 		// nextID can be cyclically reused, and previous instance
 		// may be in use by a different stream
 		delete(s.streams, id)
+		s.streamRemoved(id)
 		return nil, ErrAcceptTimeout
 	}
 }
@@ -214,10 +269,27 @@ func (s *Session) Close() error {
 	default:
 	}
 
+	// a resumable session is no longer waiting for Resume
+	s.resumeLock.Lock()
+	conn, broken := s.conn, s.broken
+	s.broken = true
+	if s.resumeTimer != nil {
+		s.resumeTimer.Stop()
+	}
+	s.resumeLock.Unlock()
+
 	// Check if channel has been closed
 	var err error
-	if s.closeConn {
-		err = s.conn.Close()
+	if s.closeConn && !broken {
+		if s.resumeGracePeriod != 0 {
+			// tell the remote end that the session is closing, as otherwise it
+			// would wait for the session to be resumed
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+		}
+		err = conn.Close()
 	}
 
 	// invoke callback
@@ -241,7 +313,14 @@ func (s *Session) Close() error {
 // Addr returns the address of this listener.  This is required for
 // implementing net.Listener, but its return value here is not very useful.
 func (s *Session) Addr() net.Addr {
-	return s.conn.LocalAddr()
+	return s.getConn().LocalAddr()
+}
+
+// getConn returns the session's current websocket connection.
+func (s *Session) getConn() *websocket.Conn {
+	s.resumeLock.Lock()
+	defer s.resumeLock.Unlock()
+	return s.conn
 }
 
 // IsClosed returns true if the session is closed.
@@ -263,21 +342,28 @@ func (s *Session) pongHandler(data string) error {
 }
 
 // sendKeepAlives sends a ping message every keepAliveInterval, until the
-// connection closes.  If there is an error sending the ping, or no pong is
-// received during the interval, the connection is aborted.
+// session closes.  If there is an error sending the ping, or no pong is
+// received during the interval, the connection is considered failed, and
+// the session is aborted (or, if resumable, waits to be resumed).
 func (s *Session) sendKeepAlives() {
 	ticker := time.NewTicker(s.keepAliveInterval)
+	defer ticker.Stop()
 	for {
-		s.sendLock.Lock()
-		err := s.conn.WriteControl(
-			websocket.PingMessage, nil,
-			// use a deadline of half the keepAliveInterval, to ensure the message
-			// is sent in a reasonable amount of time
-			time.Now().Add(s.keepAliveInterval/2))
-		s.sendLock.Unlock()
-		if err != nil {
-			s.abort(err)
-			return
+		s.resumeLock.Lock()
+		conn, broken := s.conn, s.broken
+		s.resumeLock.Unlock()
+
+		if !broken {
+			s.sendLock.Lock()
+			err := conn.WriteControl(
+				websocket.PingMessage, nil,
+				// use a deadline of half the keepAliveInterval, to ensure the message
+				// is sent in a reasonable amount of time
+				time.Now().Add(s.keepAliveInterval/2))
+			s.sendLock.Unlock()
+			if err != nil {
+				s.disconnect(conn, err)
+			}
 		}
 
 		select {
@@ -292,9 +378,9 @@ func (s *Session) sendKeepAlives() {
 		pongSeen := s.pongSeen
 		s.pongSeen = false
 		s.mu.Unlock()
-		if !pongSeen {
-			s.logger.Printf("No pong message seen; aborting session")
-			s.abort(ErrKeepAliveExpired)
+		if !pongSeen && !broken && conn == s.getConn() {
+			s.logger.Printf("No pong message seen; connection failed")
+			s.disconnect(conn, ErrKeepAliveExpired)
 		}
 	}
 }
@@ -308,8 +394,21 @@ func (s *Session) send(f frame) error {
 	}
 	s.sendLock.Lock()
 	defer s.sendLock.Unlock()
-	err := s.conn.WriteMessage(websocket.BinaryMessage, f.serialize())
-	return err
+	if s.resumeGracePeriod == 0 {
+		err := s.conn.WriteMessage(websocket.BinaryMessage, f.serialize())
+		return err
+	}
+
+	conn := s.sequence(f)
+	if conn == nil {
+		// the frame will be sent when the session is resumed
+		return nil
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, f.serialize()); err != nil {
+		// likewise, if the connection has failed
+		s.disconnect(conn, err)
+	}
+	return nil
 }
 
 // called when websocket connection is closed
@@ -323,9 +422,9 @@ func (s *Session) closeHandler(code int, text string) error {
 	return s.Close()
 }
 
-// recvLoop sits in a groutine and receives frames over the websocket
+// recvLoop sits in a groutine and receives frames over the given websocket
 // connection, calling various `handle` methods as appropriate.
-func (s *Session) recvLoop() {
+func (s *Session) recvLoop(conn *websocket.Conn) {
 	for {
 		select {
 		case <-s.closed:
@@ -333,10 +432,10 @@ func (s *Session) recvLoop() {
 		default:
 		}
 
-		t, msg, err := s.conn.ReadMessage()
+		t, msg, err := conn.ReadMessage()
 		if err != nil {
 			s.logger.Printf("error while reading from WS: %v", err)
-			s.abort(err)
+			s.disconnect(conn, err)
 			break
 		}
 		if t != websocket.BinaryMessage {
@@ -350,17 +449,27 @@ func (s *Session) recvLoop() {
 			continue
 		}
 
-		if fr.msg == msgSYN {
-			go s.handleSyn(fr.id)
-		} else {
-			s.mu.Lock()
-			str := s.streams[fr.id]
-			s.mu.Unlock()
-
-			if str != nil {
-				str.handleFrame(*fr)
-			}
+		s.recvLock.Lock()
+		if s.resumeGracePeriod == 0 || s.receive(conn, fr) {
+			s.handleFrame(fr)
 		}
+		s.recvLock.Unlock()
+	}
+}
+
+// handleFrame handles a received frame, passing it to the relevant stream.
+func (s *Session) handleFrame(fr *frame) {
+	if fr.msg == msgSYN {
+		go s.handleSyn(fr.id)
+		return
+	}
+
+	s.mu.Lock()
+	str := s.streams[fr.id]
+	s.mu.Unlock()
+
+	if str != nil {
+		str.handleFrame(*fr)
 	}
 }
 
@@ -378,6 +487,16 @@ func (s *Session) handleSyn(id uint32) {
 		return
 	}
 
+	// refuse the stream if there are already too many; the remote end's
+	// Open call then fails with ErrTooManyStreams
+	if s.atStreamLimit() {
+		s.logger.Printf("too many open streams; refusing stream: %d", id)
+		s.mu.Unlock()
+		_ = s.send(newFinFrame(id))
+		s.streamRemoved(id)
+		return
+	}
+
 	str := newStream(id, s)
 	s.streams[id] = str
 
@@ -390,6 +509,22 @@ func (s *Session) handleSyn(id uint32) {
 	}
 }
 
+// atStreamLimit returns true if the session has the maximum number of open
+// streams.  Streams that are dead but not yet removed are not counted.  It must
+// be called with s.mu held.
+func (s *Session) atStreamLimit() bool {
+	if s.maxStreams <= 0 {
+		return false
+	}
+	open := 0
+	for _, str := range s.streams {
+		if !str.isRemovable() {
+			open++
+		}
+	}
+	return open >= s.maxStreams
+}
+
 // abort session when error occurs
 func (s *Session) abort(e error) {
 	if s.IsClosed() {
@@ -419,6 +554,7 @@ func (s *Session) removeDeadStreams() {
 
 			if str.isRemovable() {
 				delete(s.streams, str.id)
+				s.streamRemoved(str.id)
 			}
 		}
 		s.mu.Unlock()
@@ -3,6 +3,7 @@ package wsmux
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	"net/http/httptest"
@@ -80,3 +81,80 @@ func TestEchoLarge(t *testing.T) {
 		t.Fatal("message not consistent")
 	}
 }
+
+func TestMaxStreams(t *testing.T) {
+	// the server echoes each stream, and allows two streams at once
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger(), MaxStreams: 2})
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(stream, stream)
+				_ = stream.Close()
+			}()
+		}
+	}))
+	defer server.Close()
+	conn, _, err := (&websocket.Dialer{}).Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger()})
+	defer session.Close()
+
+	stream1, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream2, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server refuses a third stream
+	_, err = session.Open()
+	if err != ErrTooManyStreams {
+		t.Fatalf("expected ErrTooManyStreams, got %v", err)
+	}
+
+	// once a stream has closed at both ends, another can be opened
+	_ = stream1.Close()
+	if _, err := ioutil.ReadAll(stream1); err != nil {
+		t.Fatal(err)
+	}
+	stream3, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream2.Close()
+	_ = stream3.Close()
+}
+
+func TestMaxStreamsLocal(t *testing.T) {
+	server := httptest.NewServer(genWebSocketHandler(t, func(t *testing.T, conn *websocket.Conn) {
+		session := Server(conn, Config{Log: genLogger()})
+		for {
+			if _, err := session.Accept(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	conn, _, err := (&websocket.Dialer{}).Dial(util.MakeWsURL(server.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Client(conn, Config{Log: genLogger(), MaxStreams: 1})
+	defer session.Close()
+
+	if _, err := session.Open(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Open()
+	if err != ErrTooManyStreams {
+		t.Fatalf("expected ErrTooManyStreams, got %v", err)
+	}
+}
@@ -68,6 +68,9 @@ type stream struct {
 	// closed when stream is accepted. Used in session.Open()
 	accepted chan struct{}
 
+	// true if the stream was opened by this end of the session
+	local bool
+
 	// associated session. used for sending frames and logging
 	session *Session
 
@@ -126,6 +129,16 @@ func (s *stream) handleFrame(fr frame) {
 		s.pushAndBroadcast(fr.payload)
 
 	case msgFIN:
+		select {
+		case <-s.accepted:
+		default:
+			if s.local {
+				// a msgFIN frame in place of a msgACK means the remote end
+				// refused the stream
+				s.refuse()
+				return
+			}
+		}
 		s.setRemoteClosed()
 	}
 }
@@ -234,6 +247,24 @@ func (s *stream) acceptStream(read uint32) {
 
 }
 
+// refuse handles the remote end refusing a locally-initiated stream.  The
+// stream becomes dead, and Session.Open fails.
+func (s *stream) refuse() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	defer s.c.Broadcast()
+	s.state = streamDead
+	s.endErr = ErrTooManyStreams
+	close(s.accepted)
+}
+
+// isRefused returns true if the remote end refused the stream
+func (s *stream) isRefused() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.endErr == ErrTooManyStreams
+}
+
 // A stream is considered removable if it is in the streamDead state and its
 // read buffer has been entirely consumed.
 func (s *stream) isRemovable() bool {
@@ -262,7 +293,7 @@ func (s *stream) setRemoteClosed() {
 // This is part of the net.Conn interface.  Its value in this context is not
 // particularly useful.
 func (s *stream) LocalAddr() net.Addr {
-	return s.session.conn.LocalAddr()
+	return s.session.getConn().LocalAddr()
 }
 
 // RemoteAddr returns the remote address of the underlying connection
@@ -270,7 +301,7 @@ func (s *stream) LocalAddr() net.Addr {
 // This is part of the net.Conn interface.  Its value in this context is not
 // particularly useful.
 func (s *stream) RemoteAddr() net.Addr {
-	return s.session.conn.RemoteAddr()
+	return s.session.getConn().RemoteAddr()
 }
 
 // Close closes the stream, sending a msgFin frame unless one has already been
@@ -327,6 +358,12 @@ func (s *stream) Read(buf []byte) (int, error) {
 
 	n, _ := s.b.Read(buf)
 
+	// once the remote end has closed the stream, it will send no more data, so
+	// has no use for a msgACK
+	if s.state == streamRemoteClosed || s.state == streamDead {
+		return n, nil
+	}
+
 	// send a msgACK to indicate we received n bytes.  Note that this is not sent when we receive the
 	// msgDAT frame, but when we are about to return it to the caller; this conveys information about how
 	// quickly this process is actually consuming the data, rather than just how quickly the local TCP
@@ -5,7 +5,8 @@ import (
 )
 
 var (
-	// ErrUnexpectedSigningMethod is returned when the signing method used by the given JWT is not HMAC.
+	// ErrUnexpectedSigningMethod is returned when the signing method used by the given JWT is not
+	// accepted, or cannot be used with the key it identifies.
 	ErrUnexpectedSigningMethod = errors.New("unexpected signing method on jwt")
 
 	// ErrTokenNotValid is returned when the jwt is not valid.
@@ -14,6 +15,14 @@ var (
 	// ErrAuthFailed is returned when jwt verification fails.
 	ErrAuthFailed = errors.New("auth failed")
 
+	// ErrMissingKeyID is returned when a jwt signed with an asymmetric
+	// algorithm has no kid header.
+	ErrMissingKeyID = errors.New("jwt has no kid header")
+
+	// ErrUnknownKeyID is returned when the kid header of a jwt does not match
+	// any configured public key.
+	ErrUnknownKeyID = errors.New("jwt kid header does not match any public key")
+
 	// ErrMissingSecret is returned when the proxy does not load both required secrets.
 	ErrMissingSecret = errors.New("both secrets must be loaded")
 )
@@ -0,0 +1,274 @@
+package wsproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// SigningMethodEdDSA is the EdDSA (Ed25519) signing method for JWTs, as
+	// defined in RFC 8037. It takes an ed25519.PrivateKey for signing and an
+	// ed25519.PublicKey for verification.
+	SigningMethodEdDSA = &signingMethodEdDSA{}
+
+	// asymmetricMethods are the asymmetric signing methods accepted by the
+	// proxy
+	asymmetricMethods = []string{"EdDSA", "ES256", "RS256"}
+)
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok || len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// checkKeyType checks that the given public key can verify tokens signed
+// with the given algorithm
+func checkKeyType(alg string, key crypto.PublicKey) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && k.Curve == elliptic.P256() {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if alg == "EdDSA" {
+			return nil
+		}
+	}
+	return ErrUnexpectedSigningMethod
+}
+
+// jsonWebKey is a public key in a JSON Web Key Set (RFC 7517), as used by
+// ParseJWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// ParseJWKS parses a JSON Web Key Set (RFC 7517), returning its public keys
+// by key ID. RSA keys, P-256 EC keys and Ed25519 OKP keys are supported.
+// Keys with no key ID, keys that are not for signatures, and keys of other
+// types are ignored.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kid == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", jwk.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		if jwk.Alg != "" {
+			if err := checkKeyType(jwk.Alg, key); err != nil {
+				return nil, fmt.Errorf("key %q: cannot be used with alg %q", jwk.Kid, jwk.Alg)
+			}
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of the JSON Web Key, or nil if its type
+// is not supported
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keySet holds the public keys that tokens signed with an asymmetric
+// algorithm are verified with, by key ID. Keys are either configured
+// statically, or read from a JWKS file, which is read again whenever it
+// changes, so that keys can be rotated without restarting the proxy.
+type keySet struct {
+	// mutex covers all of the fields below
+	mutex    sync.Mutex
+	static   map[string]crypto.PublicKey
+	jwksFile string
+	// jwksModTime and jwksSize identify the version of the JWKS file that
+	// jwksKeys were read from
+	jwksModTime time.Time
+	jwksSize    int64
+	jwksKeys    map[string]crypto.PublicKey
+}
+
+// newKeySet returns a keySet with the given static keys and JWKS file, which
+// may be nil and "" respectively. An error is returned if the JWKS file
+// cannot be read.
+func newKeySet(static map[string]crypto.PublicKey, jwksFile string) (*keySet, error) {
+	ks := &keySet{
+		static:   static,
+		jwksFile: jwksFile,
+	}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// empty returns true if no keys can ever be in the key set
+func (ks *keySet) empty() bool {
+	return len(ks.static) == 0 && ks.jwksFile == ""
+}
+
+// reload reads the JWKS file again, if it has changed since it was last
+// read. If the file cannot be read, the previous keys are kept and an error
+// is returned.
+func (ks *keySet) reload() error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if ks.jwksFile == "" {
+		return nil
+	}
+	info, err := os.Stat(ks.jwksFile)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(ks.jwksModTime) && info.Size() == ks.jwksSize {
+		return nil
+	}
+	data, err := ioutil.ReadFile(ks.jwksFile)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("invalid JWKS file %v: %v", ks.jwksFile, err)
+	}
+	ks.jwksKeys = keys
+	ks.jwksModTime = info.ModTime()
+	ks.jwksSize = info.Size()
+	return nil
+}
+
+// key returns the public key with the given key ID, checking that it can
+// verify tokens signed with the given algorithm
+func (ks *keySet) key(kid, alg string) (crypto.PublicKey, error) {
+	if kid == "" {
+		return nil, ErrMissingKeyID
+	}
+	ks.mutex.Lock()
+	key, ok := ks.static[kid]
+	if !ok {
+		key, ok = ks.jwksKeys[kid]
+	}
+	ks.mutex.Unlock()
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+	if err := checkKeyType(alg, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,181 @@
+package wsproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+// signedTokenGenerator generates a token for the given tunnel ID, signed with
+// the given method and private key, with the given kid header
+func signedTokenGenerator(t *testing.T, id string, method jwt.SigningMethod, kid string, privateKey interface{}) string {
+	now := time.Now()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iat": now.Unix(),
+		"nbf": now.Unix() - 300,
+		"exp": now.Add(24 * time.Hour).Unix(),
+		"tid": id,
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	tokString, err := token.SignedString(privateKey)
+	require.NoError(t, err)
+	return tokString
+}
+
+// jwk returns the JSON Web Key of the given public key
+func jwk(kid string, publicKey crypto.PublicKey) map[string]string {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": encode(k.N.Bytes()), "e": encode(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": encode(k.X.Bytes()), "y": encode(k.Y.Bytes())}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": encode(k)}
+	}
+	panic("unsupported key type")
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestAsymmetricJWT(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "wsproxy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwksFile, jwk("ec", &ecPrivate.PublicKey), jwk("rsa", &rsaPrivate.PublicKey))
+
+	p, err := newProxy(Config{
+		Upgrader: upgrader,
+		JWTPublicKeys: map[string]crypto.PublicKey{
+			"ed": edPublic,
+		},
+		JWKSFile:  jwksFile,
+		URLPrefix: "http://localhost",
+	})
+	require.NoError(t, err)
+
+	// tokens are verified with the key selected by their kid header
+	require.NoError(t, p.validateJWT("worker", signedTokenGenerator(t, "worker", SigningMethodEdDSA, "ed", edPrivate)))
+	require.NoError(t, p.validateJWT("worker", signedTokenGenerator(t, "worker", jwt.SigningMethodES256, "ec", ecPrivate)))
+	require.NoError(t, p.validateJWT("worker", signedTokenGenerator(t, "worker", jwt.SigningMethodRS256, "rsa", rsaPrivate)))
+
+	// claims are still checked
+	require.Error(t, p.validateJWT("other", signedTokenGenerator(t, "worker", SigningMethodEdDSA, "ed", edPrivate)))
+
+	for name, token := range map[string]string{
+		"missing kid":        signedTokenGenerator(t, "worker", SigningMethodEdDSA, "", edPrivate),
+		"unknown kid":        signedTokenGenerator(t, "worker", SigningMethodEdDSA, "unknown", edPrivate),
+		"wrong key for kid":  signedTokenGenerator(t, "worker", jwt.SigningMethodES256, "rsa", ecPrivate),
+		"wrong alg for key":  signedTokenGenerator(t, "worker", jwt.SigningMethodRS384, "rsa", rsaPrivate),
+		"HS256 without keys": tokenGenerator("worker", []byte("test-secret")),
+		"alg none":           signedTokenGenerator(t, "worker", jwt.SigningMethodNone, "ed", jwt.UnsafeAllowNoneSignatureType),
+	} {
+		require.Error(t, p.validateJWT("worker", token), name)
+	}
+
+	// keys are rotated by rewriting the JWKS file
+	rotatedPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rotatedToken := signedTokenGenerator(t, "worker", jwt.SigningMethodES256, "rotated", rotatedPrivate)
+	require.Error(t, p.validateJWT("worker", rotatedToken))
+	writeJWKS(t, jwksFile, jwk("rotated", &rotatedPrivate.PublicKey))
+	// ensure the modification time changes, regardless of its resolution
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(jwksFile, future, future))
+	require.NoError(t, p.validateJWT("worker", rotatedToken))
+	require.Error(t, p.validateJWT("worker", signedTokenGenerator(t, "worker", jwt.SigningMethodES256, "ec", ecPrivate)))
+
+	// an invalid JWKS file does not lose the previous keys
+	require.NoError(t, ioutil.WriteFile(jwksFile, []byte("not json"), 0644))
+	require.NoError(t, p.validateJWT("worker", rotatedToken))
+}
+
+func TestAsymmetricJWTRegister(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	// public keys can be used alongside secrets
+	proxy, err := New(Config{
+		Upgrader:      upgrader,
+		JWTSecretA:    []byte("test-secret"),
+		JWTSecretB:    []byte("another-secret"),
+		JWTPublicKeys: map[string]crypto.PublicKey{"ed": edPublic},
+		URLPrefix:     "http://localhost",
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	wsURL := util.MakeWsURL(server.URL)
+
+	for _, token := range []string{
+		signedTokenGenerator(t, "workerid", SigningMethodEdDSA, "ed", edPrivate),
+		workeridjwt,
+	} {
+		header := make(http.Header)
+		header.Set("Authorization", "Bearer "+token)
+		header.Set("x-websocktunnel-id", "workerid")
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keys, err := ParseJWKS([]byte(`{"keys": [
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "alg": "EdDSA", "x": "` + base64.RawURLEncoding.EncodeToString(edPublic) + `"},
+		{"kty": "OKP", "crv": "Ed25519", "x": "` + base64.RawURLEncoding.EncodeToString(edPublic) + `"},
+		{"kty": "OKP", "crv": "X25519", "kid": "exchange", "x": "AAAA"},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"}
+	]}`))
+	require.NoError(t, err)
+	require.Equal(t, map[string]crypto.PublicKey{"ed": edPublic}, keys)
+
+	for name, jwks := range map[string]string{
+		"not json":           `keys`,
+		"bad base64":         `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": "!!"}]}`,
+		"short key":          `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "x": "AAAA"}]}`,
+		"point not on curve": `{"keys": [{"kty": "EC", "crv": "P-256", "kid": "ec", "x": "AQ", "y": "AQ"}]}`,
+		"alg mismatch":       `{"keys": [{"kty": "OKP", "crv": "Ed25519", "kid": "ed", "alg": "RS256", "x": "` + base64.RawURLEncoding.EncodeToString(edPublic) + `"}]}`,
+	} {
+		_, err := ParseJWKS([]byte(jwks))
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,71 @@
+package wsproxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate of viewer requests to each client, using a
+// token bucket per client
+type rateLimiter struct {
+	mutex sync.Mutex
+	// rate at which tokens are added, per second; 0 for no limit
+	rate float64
+	// capacity of each bucket
+	burst   float64
+	buckets map[string]*tokenBucket
+	// now is overridden in tests
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter allowing the given number of requests
+// per second, in bursts of up to burst requests.  A rate of 0 allows any
+// number of requests.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// allow returns true if a request to the given client is allowed now,
+// consuming a token from its bucket if so
+func (rl *rateLimiter) allow(id string) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	bucket, ok := rl.buckets[id]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[id] = bucket
+	}
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// remove discards the bucket for the given client, when it disconnects
+func (rl *rateLimiter) remove(id string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	delete(rl.buckets, id)
+}
@@ -0,0 +1,193 @@
+package wsproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/client"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(2, 3)
+	rl.now = func() time.Time { return now }
+
+	// a burst of 3 is allowed, per client
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow("a"))
+	}
+	require.False(t, rl.allow("a"))
+	require.True(t, rl.allow("b"))
+
+	// tokens are added at 2 per second
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, rl.allow("a"))
+	require.False(t, rl.allow("a"))
+
+	// up to the burst size
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow("a"))
+	}
+	require.False(t, rl.allow("a"))
+
+	// no limit
+	rl = newRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		require.True(t, rl.allow("a"))
+	}
+}
+
+// startLimitedProxy starts a proxy with the given configuration, and a client
+// for ID "limited" that forwards requests to the given handler
+func startLimitedProxy(t *testing.T, config Config, handler http.Handler) (*httptest.Server, func()) {
+	config.Upgrader = upgrader
+	config.JWTSecretA = []byte("test-secret")
+	config.JWTSecretB = []byte("another-secret")
+	config.URLPrefix = "http://localhost"
+	config.Logger = genLogger()
+	proxy, err := New(config)
+	require.NoError(t, err)
+	server := httptest.NewServer(proxy)
+
+	local := httptest.NewServer(handler)
+	routes := client.Routes{{Prefix: "/", Port: local.Listener.Addr().(*net.TCPAddr).Port}}
+
+	cl, err := client.New(testConfigurer("limited", util.MakeWsURL(server.URL), client.RetryConfig{}, genLogger()))
+	require.NoError(t, err)
+	go func() {
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = routes.Forward(stream)
+			}()
+		}
+	}()
+
+	return server, func() {
+		_ = cl.Close()
+		local.Close()
+		server.Close()
+	}
+}
+
+func get(t *testing.T, url string) (int, string) {
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestProxyMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	server, stop := startLimitedProxy(t, Config{Metrics: metrics}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		status, _ := get(t, server.URL+"/limited/path")
+		require.Equal(t, 200, status)
+	}
+
+	metricsServer := httptest.NewServer(metrics)
+	defer metricsServer.Close()
+	// the last stream may not be counted as closed until the proxy's handler
+	// has returned
+	var body string
+	for i := 0; i < 100; i++ {
+		_, body = get(t, metricsServer.URL)
+		if strings.Contains(body, `websocktunnel_client_active_streams{client_id="limited"} 0`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Contains(t, body, "websocktunnel_clients 1\n")
+	require.Contains(t, body, `websocktunnel_client_active_streams{client_id="limited"} 0`)
+	require.Contains(t, body, `websocktunnel_client_requests_total{client_id="limited",kind="http"} 3`)
+	require.Contains(t, body, `websocktunnel_client_requests_total{client_id="limited",kind="websocket"} 0`)
+	require.Contains(t, body, `websocktunnel_client_limited_requests_total{client_id="limited",reason="rate"} 0`)
+
+	// bytes include the HTTP requests and responses
+	var bytesIn, bytesOut int
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, `websocktunnel_client_bytes_in_total{client_id="limited"} `) {
+			bytesIn, _ = strconv.Atoi(strings.Fields(line)[1])
+		}
+		if strings.HasPrefix(line, `websocktunnel_client_bytes_out_total{client_id="limited"} `) {
+			bytesOut, _ = strconv.Atoi(strings.Fields(line)[1])
+		}
+	}
+	require.True(t, bytesIn > 3*len("GET /path HTTP/1.1\r\n"), "bytes in: %d", bytesIn)
+	require.True(t, bytesOut > 3*1000, "bytes out: %d", bytesOut)
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	metrics := NewMetrics()
+	server, stop := startLimitedProxy(t, Config{Metrics: metrics, RequestsPerSecond: 0.001, RequestBurst: 2}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		status, _ := get(t, server.URL+"/limited/")
+		require.Equal(t, 200, status)
+	}
+	status, _ := get(t, server.URL+"/limited/")
+	require.Equal(t, 429, status)
+
+	metricsServer := httptest.NewServer(metrics)
+	defer metricsServer.Close()
+	_, body := get(t, metricsServer.URL)
+	require.Contains(t, body, `websocktunnel_client_limited_requests_total{client_id="limited",reason="rate"} 1`)
+}
+
+func TestProxyStreamLimit(t *testing.T) {
+	metrics := NewMetrics()
+	release := make(chan struct{})
+	server, stop := startLimitedProxy(t, Config{Metrics: metrics, MaxStreamsPerClient: 1}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer stop()
+
+	// hold one stream open
+	slow := make(chan int, 1)
+	go func() {
+		status, _ := get(t, server.URL+"/limited/slow")
+		slow <- status
+	}()
+	metricsServer := httptest.NewServer(metrics)
+	defer metricsServer.Close()
+	for i := 0; i < 100; i++ {
+		_, body := get(t, metricsServer.URL)
+		if strings.Contains(body, `websocktunnel_client_active_streams{client_id="limited"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status, _ := get(t, server.URL+"/limited/fast")
+	require.Equal(t, 429, status)
+
+	close(release)
+	require.Equal(t, 200, <-slow)
+
+	_, body := get(t, metricsServer.URL)
+	require.Contains(t, body, `websocktunnel_client_limited_requests_total{client_id="limited",reason="streams"} 1`)
+}
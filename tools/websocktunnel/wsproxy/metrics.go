@@ -0,0 +1,205 @@
+package wsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Kinds of viewer requests, as counted in metrics
+const (
+	requestHTTP      = "http"
+	requestWebsocket = "websocket"
+	requestTCP       = "tcp"
+)
+
+// Reasons for rejecting viewer requests, as counted in metrics
+const (
+	limitRate    = "rate"
+	limitStreams = "streams"
+)
+
+// Metrics collects metrics about the use of a proxy by each client, and
+// serves them in the Prometheus text exposition format.  Create one with
+// NewMetrics, pass it to the proxy in Config.Metrics, and serve it on an
+// internal port, as the metrics identify the connected clients.
+//
+// The metrics for a client are discarded once it has disconnected and its
+// last stream has closed, so that short-lived clients do not accumulate.
+type Metrics struct {
+	mutex   sync.Mutex
+	clients map[string]*clientMetrics
+}
+
+// clientMetrics are the metrics for one client
+type clientMetrics struct {
+	connected bool
+	// bytesIn counts bytes from viewers to the client, and bytesOut bytes from
+	// the client to viewers; these are accessed atomically
+	bytesIn  int64
+	bytesOut int64
+	// activeStreams is the number of open streams to the client
+	activeStreams int64
+	// requests counts viewer requests by kind
+	requests map[string]int64
+	// limited counts viewer requests rejected by limits, by reason
+	limited map[string]int64
+}
+
+// NewMetrics creates a new, empty, Metrics instance.
+func NewMetrics() *Metrics {
+	return &Metrics{clients: make(map[string]*clientMetrics)}
+}
+
+// client returns the metrics for the given client, creating them if
+// necessary.  It must be called with m.mutex held.
+func (m *Metrics) client(id string) *clientMetrics {
+	cm, ok := m.clients[id]
+	if !ok {
+		cm = &clientMetrics{
+			requests: make(map[string]int64),
+			limited:  make(map[string]int64),
+		}
+		m.clients[id] = cm
+	}
+	return cm
+}
+
+// discardIfIdle discards the metrics for the given client if it is no longer
+// in use.  It must be called with m.mutex held.
+func (m *Metrics) discardIfIdle(id string) {
+	if cm, ok := m.clients[id]; ok && !cm.connected && cm.activeStreams == 0 {
+		delete(m.clients, id)
+	}
+}
+
+func (m *Metrics) clientConnected(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client(id).connected = true
+}
+
+func (m *Metrics) clientDisconnected(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client(id).connected = false
+	m.discardIfIdle(id)
+}
+
+func (m *Metrics) request(id, kind string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client(id).requests[kind]++
+}
+
+func (m *Metrics) limited(id, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client(id).limited[reason]++
+}
+
+// streamOpened counts a new stream to the given client, returning a net.Conn
+// wrapping the stream that counts the bytes transferred over it and counts
+// the stream as closed when it is closed.
+func (m *Metrics) streamOpened(id string, stream net.Conn) net.Conn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	cm := m.client(id)
+	cm.activeStreams++
+	return &countingConn{Conn: stream, metrics: m, id: id, client: cm}
+}
+
+func (m *Metrics) streamClosed(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.client(id).activeStreams--
+	m.discardIfIdle(id)
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make([]string, 0, len(m.clients))
+	connected := 0
+	for id, cm := range m.clients {
+		ids = append(ids, id)
+		if cm.connected {
+			connected++
+		}
+	}
+	sort.Strings(ids)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP websocktunnel_clients Number of connected clients.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_clients gauge")
+	fmt.Fprintf(w, "websocktunnel_clients %d\n", connected)
+
+	fmt.Fprintln(w, "# HELP websocktunnel_client_bytes_in_total Bytes sent from viewers to the client.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_client_bytes_in_total counter")
+	for _, id := range ids {
+		fmt.Fprintf(w, "websocktunnel_client_bytes_in_total{client_id=%q} %d\n", id, atomic.LoadInt64(&m.clients[id].bytesIn))
+	}
+
+	fmt.Fprintln(w, "# HELP websocktunnel_client_bytes_out_total Bytes sent from the client to viewers.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_client_bytes_out_total counter")
+	for _, id := range ids {
+		fmt.Fprintf(w, "websocktunnel_client_bytes_out_total{client_id=%q} %d\n", id, atomic.LoadInt64(&m.clients[id].bytesOut))
+	}
+
+	fmt.Fprintln(w, "# HELP websocktunnel_client_active_streams Number of open streams to the client.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_client_active_streams gauge")
+	for _, id := range ids {
+		fmt.Fprintf(w, "websocktunnel_client_active_streams{client_id=%q} %d\n", id, m.clients[id].activeStreams)
+	}
+
+	fmt.Fprintln(w, "# HELP websocktunnel_client_requests_total Viewer requests to the client, by kind.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_client_requests_total counter")
+	for _, id := range ids {
+		for _, kind := range []string{requestHTTP, requestWebsocket, requestTCP} {
+			fmt.Fprintf(w, "websocktunnel_client_requests_total{client_id=%q,kind=%q} %d\n", id, kind, m.clients[id].requests[kind])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP websocktunnel_client_limited_requests_total Viewer requests to the client rejected by limits, by reason.")
+	fmt.Fprintln(w, "# TYPE websocktunnel_client_limited_requests_total counter")
+	for _, id := range ids {
+		for _, reason := range []string{limitRate, limitStreams} {
+			fmt.Fprintf(w, "websocktunnel_client_limited_requests_total{client_id=%q,reason=%q} %d\n", id, reason, m.clients[id].limited[reason])
+		}
+	}
+}
+
+// countingConn counts the bytes read from and written to a stream, and counts
+// the stream as closed when it is first closed
+type countingConn struct {
+	net.Conn
+	metrics *Metrics
+	id      string
+	client  *clientMetrics
+	closed  sync.Once
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.client.bytesOut, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.client.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.closed.Do(func() {
+		c.metrics.streamClosed(c.id)
+	})
+	return c.Conn.Close()
+}
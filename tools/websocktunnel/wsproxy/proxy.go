@@ -2,8 +2,14 @@ package wsproxy
 
 import (
 	"bufio"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"regexp"
 	"strings"
@@ -39,16 +45,62 @@ type Config struct {
 	// Logger is used to log proxy events. Refer util.Logger.
 	Logger *logrus.Logger
 
-	// JWTSecretA and JWTSecretB are used by the proxy to verify JWTs from Clients.
+	// JWTSecretA and JWTSecretB are used by the proxy to verify JWTs from
+	// Clients that are signed with HS256. Either both or neither must be set.
 	JWTSecretA []byte
 	JWTSecretB []byte
 
+	// JWTPublicKeys are used by the proxy to verify JWTs from Clients that
+	// are signed with EdDSA, ES256 or RS256, by key ID (the token's "kid"
+	// header). Supported key types are ed25519.PublicKey, *ecdsa.PublicKey
+	// (on curve P-256) and *rsa.PublicKey.
+	JWTPublicKeys map[string]crypto.PublicKey
+
+	// JWKSFile is the path of a JSON Web Key Set file (see ParseJWKS) holding
+	// further public keys, used in the same way as JWTPublicKeys. The file is
+	// read again whenever it changes, so that keys can be rotated without
+	// restarting the proxy.
+	JWKSFile string
+
 	// the prefix for publicly accessible URLs (used to generate the URLs sent
 	// to clients)
 	URLPrefix string
 
 	// Audience value for aud claim
 	Audience string
+
+	// Metrics, if set, collects metrics about the use of the proxy by each
+	// client.  See Metrics.
+	Metrics *Metrics
+
+	// MaxStreamsPerClient limits the number of streams open to each client at
+	// once.  Viewer requests beyond this are rejected with status 429.  Zero
+	// means no limit.
+	MaxStreamsPerClient int
+
+	// RequestsPerSecond limits the rate of viewer requests to each client,
+	// allowing bursts of up to RequestBurst requests (by default,
+	// RequestsPerSecond rounded up).  Viewer requests beyond this are rejected
+	// with status 429.  Zero means no limit.
+	RequestsPerSecond float64
+	RequestBurst      int
+
+	// ResumeGracePeriod, if non-zero, allows clients that ask for it to resume
+	// their sessions: when a client's connection is lost, its session and open
+	// streams are kept for this long, and a client reconnecting with the
+	// session's ID carries on where it left off.
+	ResumeGracePeriod time.Duration
+
+	// InstanceURL is the URL (http(s)://host(:port)) at which other instances
+	// of the proxy can reach this one.  If set, the proxy records the clients
+	// connected to it in the Registry, and forwards viewer requests for clients
+	// connected to other instances to those instances.
+	InstanceURL string
+
+	// Registry records which instance holds the session of each client.  To
+	// run several instances, this must be shared between them, such as a
+	// RedisRegistry.  Default: NewMemoryRegistry()
+	Registry Registry
 }
 
 // proxy is used to send http and ws requests to a registered client.
@@ -56,13 +108,22 @@ type Config struct {
 type proxy struct {
 	m               sync.RWMutex
 	pool            map[string]*wsmux.Session
+	sessionIDs      map[string]string
 	upgrader        websocket.Upgrader
 	logger          *logrus.Logger
 	onSessionRemove func(string)
 	jwtSecretA      []byte
 	jwtSecretB      []byte
+	keys            *keySet
 	urlPrefix       string
 	audience        string
+	metrics         *Metrics
+	maxStreams      int
+	limiter         *rateLimiter
+	resumeGrace     time.Duration
+	instanceURL     string
+	registry        Registry
+	registryLock    sync.Mutex
 }
 
 // New creates a new proxy instance and wraps it as an http.Handler.
@@ -110,15 +171,44 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func newProxy(conf Config) (*proxy, error) {
 	p := &proxy{
 		pool:       make(map[string]*wsmux.Session),
+		sessionIDs: make(map[string]string),
 		upgrader:   conf.Upgrader,
 		logger:     conf.Logger,
 		jwtSecretA: conf.JWTSecretA,
 		jwtSecretB: conf.JWTSecretB,
 		urlPrefix:  strings.TrimSuffix(conf.URLPrefix, "/"),
 		audience:   conf.Audience,
+		metrics:    conf.Metrics,
+		maxStreams: conf.MaxStreamsPerClient,
+		limiter:    newRateLimiter(conf.RequestsPerSecond, conf.RequestBurst),
+
+		resumeGrace: conf.ResumeGracePeriod,
+		instanceURL: strings.TrimSuffix(conf.InstanceURL, "/"),
+		registry:    conf.Registry,
 	}
 
-	if len(p.jwtSecretA) == 0 || len(p.jwtSecretB) == 0 {
+	if p.metrics == nil {
+		p.metrics = NewMetrics()
+	}
+
+	if p.registry == nil {
+		p.registry = NewMemoryRegistry()
+	}
+	if p.instanceURL != "" {
+		if u, err := url.Parse(p.instanceURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("wsproxy: invalid InstanceURL %q", p.instanceURL)
+		}
+		p.registry.Watch(p.instanceURL, p.dropReplacedSession)
+	}
+
+	keys, err := newKeySet(conf.JWTPublicKeys, conf.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+
+	if (len(p.jwtSecretA) == 0) != (len(p.jwtSecretB) == 0) ||
+		(len(p.jwtSecretA) == 0 && p.keys.empty()) {
 		panic("wsproxy: missing secrets")
 	}
 
@@ -150,9 +240,15 @@ func (p *proxy) getWorkerSession(id string) (*wsmux.Session, bool) {
 // removeTunnel is an idempotent operation which deletes a client session from the proxy's
 // pool
 func (p *proxy) removeTunnel(id string) {
+	// deferred calls run in reverse order, so the registry is updated after
+	// the lock is released
+	defer p.updateRegistry(id)
 	p.m.Lock()
 	defer p.m.Unlock()
 	delete(p.pool, id)
+	delete(p.sessionIDs, id)
+	p.limiter.remove(id)
+	p.metrics.clientDisconnected(id)
 	p.logf(id, "", "session removed")
 }
 
@@ -187,8 +283,29 @@ func (p *proxy) register(w http.ResponseWriter, r *http.Request, id, tokenString
 		return
 	}
 
+	// a session to be resumed may be held by another instance
+	resumable := p.resumeGrace != 0 && r.Header.Get("x-websocktunnel-resumable") == "true"
+	sessionID := r.Header.Get("x-websocktunnel-session-id")
+	if resumable && sessionID != "" && !p.holdsSession(id, sessionID) {
+		if instance := p.remoteInstance(id, r); instance != "" {
+			p.forward(w, r, id, instance)
+			return
+		}
+	}
+
+	defer p.updateRegistry(id)
 	p.m.Lock()
 
+	// resume the existing session, if the client asks to and it has not yet
+	// been closed
+	if resumable && sessionID != "" {
+		if existingSession := p.pool[id]; existingSession != nil && p.sessionIDs[id] == sessionID {
+			defer p.m.Unlock()
+			p.resume(w, r, id, sessionID, existingSession)
+			return
+		}
+	}
+
 	// remove any existing session forcibly
 	for {
 		existingSession := p.pool[id]
@@ -214,6 +331,11 @@ func (p *proxy) register(w http.ResponseWriter, r *http.Request, id, tokenString
 	url := p.urlPrefix + "/" + id
 	header.Set("x-websocktunnel-client-url", url)
 	p.logf(id, r.RemoteAddr, "sending url= %s", url)
+	sessionID = ""
+	if resumable {
+		sessionID = newSessionID()
+		header.Set("x-websocktunnel-session-id", sessionID)
+	}
 	conn, err := p.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		p.logger.Print(err)
@@ -229,13 +351,146 @@ func (p *proxy) register(w http.ResponseWriter, r *http.Request, id, tokenString
 				p.onSessionRemove(id)
 			}
 		},
-		Log: p.logger,
+		Log:        p.logger,
+		MaxStreams: p.maxStreams,
+	}
+	if resumable {
+		conf.ResumeGracePeriod = p.resumeGrace
 	}
 
 	p.pool[id] = wsmux.Server(conn, conf)
+	if resumable {
+		p.sessionIDs[id] = sessionID
+	}
+	p.metrics.clientConnected(id)
 	p.logf(id, r.RemoteAddr, "added new tunnel")
 }
 
+// resume resumes a client's existing session over a new connection.  It must
+// be called with p.m held.
+func (p *proxy) resume(w http.ResponseWriter, r *http.Request, id, sessionID string, session *wsmux.Session) {
+	header := make(http.Header)
+	header.Set("x-websocktunnel-client-url", p.urlPrefix+"/"+id)
+	header.Set("x-websocktunnel-session-id", sessionID)
+	conn, err := p.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		p.logger.Print(err)
+		return
+	}
+
+	if err := session.Resume(conn); err != nil {
+		p.logerrorf(id, r.RemoteAddr, "unable to resume session: %v", err)
+		_ = conn.Close()
+		return
+	}
+	p.logf(id, r.RemoteAddr, "resumed tunnel")
+}
+
+// holdsSession returns true if this instance holds the client's session with
+// the given ID
+func (p *proxy) holdsSession(id, sessionID string) bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.pool[id] != nil && p.sessionIDs[id] == sessionID
+}
+
+// updateRegistry records in the registry whether this instance holds the
+// client's session.  Updates are serialized, so the registry always ends up
+// agreeing with the pool.  This must not be called with p.m held.
+func (p *proxy) updateRegistry(id string) {
+	if p.instanceURL == "" {
+		return
+	}
+	p.registryLock.Lock()
+	defer p.registryLock.Unlock()
+
+	var err error
+	if _, ok := p.getWorkerSession(id); ok {
+		err = p.registry.Register(id, p.instanceURL)
+	} else {
+		err = p.registry.Unregister(id, p.instanceURL)
+	}
+	if err != nil {
+		p.logerrorf(id, "", "unable to update registry: %v", err)
+	}
+}
+
+// dropReplacedSession closes the client's session, if the registry now records
+// that another instance holds the client's session.  This happens when a
+// client connects to another instance without resuming its session here, such
+// as after a restart, while this instance is unaware that the old connection
+// has been lost.
+func (p *proxy) dropReplacedSession(id string) {
+	instance, err := p.registry.Lookup(id)
+	if err != nil {
+		p.logerrorf(id, "", "unable to look up client in registry: %v", err)
+		return
+	}
+	if instance == "" || instance == p.instanceURL {
+		return
+	}
+	session, ok := p.getWorkerSession(id)
+	if !ok {
+		return
+	}
+	p.logf(id, "", "client connected to %s, closing session", instance)
+	_ = session.Close()
+}
+
+// remoteInstance returns the URL of another instance holding the client's
+// session, to which the request should be forwarded, or "" if there is none.
+// Requests already forwarded from another instance are not forwarded again.
+func (p *proxy) remoteInstance(id string, r *http.Request) string {
+	if p.instanceURL == "" || r.Header.Get("x-websocktunnel-forwarded") != "" {
+		return ""
+	}
+	instance, err := p.registry.Lookup(id)
+	if err != nil {
+		p.logerrorf(id, r.RemoteAddr, "unable to look up client in registry: %v", err)
+		return ""
+	}
+	if instance == p.instanceURL {
+		return ""
+	}
+	return instance
+}
+
+// forward forwards a request to the given instance, including websocket
+// upgrades.
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request, id, instance string) {
+	target, err := url.Parse(instance)
+	if err != nil {
+		p.logerrorf(id, r.RemoteAddr, "invalid instance URL %q in registry", instance)
+		http.Error(w, http.StatusText(502), 502)
+		return
+	}
+	p.logf(id, r.RemoteAddr, "forwarding request to %s", instance)
+
+	forwarder := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Header.Set("x-websocktunnel-forwarded", "true")
+		},
+		// stream responses, such as long polls, as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logerrorf(id, r.RemoteAddr, "could not forward request to %s: %v", instance, err)
+			http.Error(w, http.StatusText(502), 502)
+		},
+	}
+	forwarder.ServeHTTP(w, r)
+}
+
+// newSessionID generates a random ID for a resumable session
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // serveRequest serves tunnel endpoints to viewers
 func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string, path string) {
 	// log new request arrival
@@ -244,6 +499,14 @@ func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string,
 
 	session, ok := p.getWorkerSession(id)
 
+	// forward the request if another instance holds the client's session
+	if !ok {
+		if instance := p.remoteInstance(id, r); instance != "" {
+			p.forward(w, r, id, instance)
+			return
+		}
+	}
+
 	// return 504 (bad gateway) if tunnel is not registered on this proxy
 	if !ok {
 		p.logerrorf(id, r.RemoteAddr, "could not find requested tunnel")
@@ -251,11 +514,32 @@ func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string,
 		return
 	}
 
+	kind := requestHTTP
+	if websocket.IsWebSocketUpgrade(r) {
+		kind = requestWebsocket
+		if isTCPPath(path) {
+			kind = requestTCP
+		}
+	}
+	p.metrics.request(id, kind)
+
+	if !p.limiter.allow(id) {
+		p.metrics.limited(id, limitRate)
+		p.logerrorf(id, r.RemoteAddr, "request rate limit exceeded")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests to this client", 429)
+		return
+	}
+
 	// set original path as header
 	r.Header.Set("x-websocktunnel-original-path", r.URL.Path)
 
 	// check for a websocket request
 	if websocket.IsWebSocketUpgrade(r) {
+		if isTCPPath(path) {
+			_ = p.tcpProxy(w, r, session, id, path)
+			return
+		}
 		_ = p.websocketProxy(w, r, session, id, path)
 		return
 	}
@@ -269,13 +553,16 @@ func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string,
 	}
 	r.URL = reqURI
 	p.logf(id, r.RemoteAddr, "attempting to open new stream")
-	reqStream, err := session.Open()
-	if err != nil {
-		p.logerrorf(id, r.RemoteAddr, "could not open stream: path=%s", path)
-		http.Error(w, http.StatusText(500), 500)
+	reqStream := p.openStream(w, r, session, id)
+	if reqStream == nil {
 		return
 	}
 
+	// stream body to viewer and close wsmux stream
+	defer func() {
+		_ = reqStream.Close()
+	}()
+
 	// rewrite path for tunnel and write request
 	err = r.Write(reqStream)
 	if err != nil {
@@ -308,11 +595,6 @@ func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string,
 		return
 	}
 
-	// stream body to viewer and close wsmux stream
-	defer func() {
-		_ = reqStream.Close()
-	}()
-
 	flusher, ok := w.(http.Flusher)
 	// flusher may not be implemented by a ResponseWriter wrapper
 	// simple copy
@@ -329,33 +611,71 @@ func (p *proxy) serveRequest(w http.ResponseWriter, r *http.Request, id string,
 	p.logf(id, r.RemoteAddr, "data transfered over request: %d bytes, error: %v", n, err)
 }
 
+// openStream opens a stream to the given client for a viewer request,
+// counting it in the proxy's metrics.  If the stream cannot be opened, an
+// error response is written to the viewer and nil is returned.
+func (p *proxy) openStream(w http.ResponseWriter, r *http.Request, session *wsmux.Session, id string) net.Conn {
+	stream, err := session.Open()
+	if err == wsmux.ErrTooManyStreams {
+		p.metrics.limited(id, limitStreams)
+		p.logerrorf(id, r.RemoteAddr, "too many open streams")
+		http.Error(w, "Too many open streams to this client", 429)
+		return nil
+	}
+	if err != nil {
+		p.logerrorf(id, r.RemoteAddr, "could not open stream: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return nil
+	}
+	return p.metrics.streamOpened(id, stream)
+}
+
+// verificationKey returns the key with which to verify the given token: the
+// given secret for HS256, or the public key identified by the token's kid
+// header for asymmetric signing methods
+func (p *proxy) verificationKey(id string, token *jwt.Token, secret []byte) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return secret, nil
+	}
+	// pick up any changes to the JWKS file; on failure, the previous keys are
+	// still used
+	if err := p.keys.reload(); err != nil {
+		p.logerrorf(id, "", "could not reload public keys: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return p.keys.key(kid, token.Method.Alg())
+}
+
 // validate jwt
-// jwt signing and verification algorithm must be HMAC
+// jwt signing and verification algorithm must be HMAC (HS256) if secrets are
+// configured, or EdDSA, ES256 or RS256 if public keys are configured
 func (p *proxy) validateJWT(id string, tokenString string) error {
+	validMethods := []string{}
+	if len(p.jwtSecretA) > 0 {
+		validMethods = append(validMethods, "HS256")
+	}
+	if !p.keys.empty() {
+		validMethods = append(validMethods, asymmetricMethods...)
+	}
+
 	// parse jwt token
 	// default parser verifies iat token if present. This can be a problem because of clocks not being
 	// in sync.
 	parser := &jwt.Parser{
-		ValidMethods:         []string{"HS256"},
+		ValidMethods:         validMethods,
 		SkipClaimsValidation: true, // Claims will be verified if token can be decoded using secret
 	}
 
 	token, err := parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrUnexpectedSigningMethod
-		}
-		return p.jwtSecretA, nil
+		return p.verificationKey(id, token, p.jwtSecretA)
 	})
 
-	if err != nil {
+	if err != nil && token != nil && token.Method == jwt.SigningMethodHS256 {
 		// log first error
 		p.logerrorf(id, "", "%v: trying with second secret", err)
 
 		token, err = parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, ErrUnexpectedSigningMethod
-			}
-			return p.jwtSecretB, nil
+			return p.verificationKey(id, token, p.jwtSecretB)
 		})
 	}
 
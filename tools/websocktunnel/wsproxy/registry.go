@@ -0,0 +1,516 @@
+package wsproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registry records which instance of the proxy holds the session of each
+// client, so that several instances can serve the same clients: a viewer
+// request arriving at an instance without the client's session is forwarded to
+// the instance that has it.  Instances are identified by their InstanceURL.
+type Registry interface {
+	// Register records that the given instance holds the client's session.
+	Register(id, instance string) error
+
+	// Unregister removes the record for the client, if it is for the given
+	// instance; a record for any other instance is left in place.
+	Unregister(id, instance string) error
+
+	// Lookup returns the instance holding the client's session, or "" if there
+	// is none.
+	Lookup(id string) (string, error)
+
+	// Watch arranges for replaced to be called, in a new goroutine, with the
+	// ID of each client whose record for the given instance is replaced by a
+	// record for another instance, so that the instance can drop the client's
+	// old session.  It replaces any earlier call for the same instance.
+	Watch(instance string, replaced func(id string))
+}
+
+// memoryRegistry is a Registry held in memory.  It is only shared by proxies in
+// the same process, so is useful for a single instance, or in tests.
+type memoryRegistry struct {
+	mutex     sync.Mutex
+	instances map[string]string
+	watchers  map[string]func(string)
+}
+
+// NewMemoryRegistry creates a new, empty, Registry held in memory.  This is the
+// default for a proxy.
+func NewMemoryRegistry() Registry {
+	return &memoryRegistry{
+		instances: make(map[string]string),
+		watchers:  make(map[string]func(string)),
+	}
+}
+
+func (m *memoryRegistry) Register(id, instance string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	previous := m.instances[id]
+	m.instances[id] = instance
+	if replaced := m.watchers[previous]; previous != instance && replaced != nil {
+		go replaced(id)
+	}
+	return nil
+}
+
+func (m *memoryRegistry) Unregister(id, instance string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.instances[id] == instance {
+		delete(m.instances, id)
+	}
+	return nil
+}
+
+func (m *memoryRegistry) Lookup(id string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.instances[id], nil
+}
+
+func (m *memoryRegistry) Watch(instance string, replaced func(id string)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watchers[instance] = replaced
+}
+
+const (
+	// prefix of the Redis keys for each client
+	redisKeyPrefix = "websocktunnel:client:"
+	// records in Redis expire after this long unless refreshed, so that those
+	// of an instance that stops abruptly are soon forgotten
+	defaultRedisTTL = time.Minute
+	// clients found not to be registered are not looked up again for this
+	// long, so that requests for unknown clients do not each reach Redis
+	defaultRedisUnknownTTL = time.Second
+	// at most this many clients found not to be registered are remembered
+	redisUnknownLimit = 10000
+	// maximum number of connections to the Redis server
+	redisPoolSize = 16
+	// timeout for connecting to the Redis server, and for each command
+	redisTimeout = 2 * time.Second
+)
+
+// redisUnregister deletes a key only if it has the given value
+const redisUnregister = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// redisRefresh resets the expiry (in milliseconds) of a key only if it has the
+// given value, setting it again if it has expired, and returns 0 if the key
+// has another value
+const redisRefresh = `local value = redis.call("get", KEYS[1])
+if value == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) end
+if value then return 0 end
+redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1`
+
+// RedisRegistry is a Registry shared by all instances through a Redis server.
+// Records expire unless refreshed, and the registry refreshes the records it
+// has registered until they are unregistered, replaced by another instance, or
+// the registry is closed.  Replaced records are found, and watchers called,
+// when they are next refreshed.  Clients found not to be registered are
+// remembered for a short while, so looking them up again does not reach Redis.
+type RedisRegistry struct {
+	addr       string
+	tls        bool
+	password   string
+	db         int
+	ttl        time.Duration
+	unknownTTL time.Duration
+
+	// pool of connections: slots limits the number of connections in use at
+	// once, and idle holds those not in use
+	slots chan struct{}
+	mutex sync.Mutex
+	idle  []*redisConn
+
+	// clients recently found not to be registered, and when to look them up
+	// again
+	unknownMutex sync.Mutex
+	unknown      map[string]time.Time
+
+	// records registered by this registry, refreshed periodically, and the
+	// watchers of the instances they are for
+	registeredMutex sync.Mutex
+	registered      map[string]string
+	watchers        map[string]func(string)
+
+	closed chan struct{}
+}
+
+// NewRedisRegistry creates a RedisRegistry using the Redis server at the given
+// URL, of the form redis://[:password@]host[:port][/db], or rediss:// to
+// connect using TLS.
+func NewRedisRegistry(redisURL string) (*RedisRegistry, error) {
+	return newRedisRegistry(redisURL, defaultRedisTTL)
+}
+
+func newRedisRegistry(redisURL string, ttl time.Duration) (*RedisRegistry, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q", redisURL)
+	}
+
+	r := &RedisRegistry{
+		addr:       u.Host,
+		tls:        u.Scheme == "rediss",
+		ttl:        ttl,
+		unknownTTL: defaultRedisUnknownTTL,
+		slots:      make(chan struct{}, redisPoolSize),
+		unknown:    make(map[string]time.Time),
+		registered: make(map[string]string),
+		watchers:   make(map[string]func(string)),
+		closed:     make(chan struct{}),
+	}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			r.password = password
+		} else {
+			r.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		r.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+
+	go r.refresh()
+	return r, nil
+}
+
+func (r *RedisRegistry) Register(id, instance string) error {
+	r.registeredMutex.Lock()
+	previous := r.registered[id]
+	r.registered[id] = instance
+	// another instance sharing this registry is replaced directly, as its
+	// record is no longer refreshed
+	if replaced := r.watchers[previous]; previous != "" && previous != instance && replaced != nil {
+		go replaced(id)
+	}
+	r.registeredMutex.Unlock()
+	r.forgetUnknown(id)
+	return r.set(id, instance)
+}
+
+func (r *RedisRegistry) Unregister(id, instance string) error {
+	r.registeredMutex.Lock()
+	if r.registered[id] == instance {
+		delete(r.registered, id)
+	}
+	r.registeredMutex.Unlock()
+	_, err := r.do("EVAL", redisUnregister, "1", redisKeyPrefix+id, instance)
+	return err
+}
+
+func (r *RedisRegistry) Lookup(id string) (string, error) {
+	if r.isUnknown(id) {
+		return "", nil
+	}
+	reply, err := r.do("GET", redisKeyPrefix+id)
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		r.setUnknown(id)
+		return "", nil
+	}
+	instance, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected reply from Redis: %v", reply)
+	}
+	return instance, nil
+}
+
+func (r *RedisRegistry) Watch(instance string, replaced func(id string)) {
+	r.registeredMutex.Lock()
+	defer r.registeredMutex.Unlock()
+	r.watchers[instance] = replaced
+}
+
+// Close stops refreshing the registered records, and closes the connections to
+// the Redis server.  The records are left to expire.
+func (r *RedisRegistry) Close() error {
+	select {
+	case <-r.closed:
+		return nil
+	default:
+		close(r.closed)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var err error
+	for _, c := range r.idle {
+		if closeErr := c.conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	r.idle = nil
+	return err
+}
+
+// isUnknown returns true if the client was recently found not to be registered
+func (r *RedisRegistry) isUnknown(id string) bool {
+	r.unknownMutex.Lock()
+	defer r.unknownMutex.Unlock()
+	expires, ok := r.unknown[id]
+	if ok && time.Now().After(expires) {
+		delete(r.unknown, id)
+		return false
+	}
+	return ok
+}
+
+// setUnknown remembers that the client was found not to be registered
+func (r *RedisRegistry) setUnknown(id string) {
+	r.unknownMutex.Lock()
+	defer r.unknownMutex.Unlock()
+	now := time.Now()
+	if len(r.unknown) >= redisUnknownLimit {
+		for unknown, expires := range r.unknown {
+			if now.After(expires) {
+				delete(r.unknown, unknown)
+			}
+		}
+		// still full of unexpired entries, so start afresh
+		if len(r.unknown) >= redisUnknownLimit {
+			r.unknown = make(map[string]time.Time)
+		}
+	}
+	r.unknown[id] = now.Add(r.unknownTTL)
+}
+
+// forgetUnknown forgets that the client was found not to be registered, as it
+// may since have been
+func (r *RedisRegistry) forgetUnknown(id string) {
+	r.unknownMutex.Lock()
+	defer r.unknownMutex.Unlock()
+	delete(r.unknown, id)
+}
+
+// set records the instance holding the client's session, to expire after the TTL
+func (r *RedisRegistry) set(id, instance string) error {
+	_, err := r.do("SET", redisKeyPrefix+id, instance, "PX", strconv.FormatInt(int64(r.ttl/time.Millisecond), 10))
+	return err
+}
+
+// refresh resets the expiry of the registered records, well before they
+// expire, until the registry is closed.  Records that have been replaced by
+// another instance are no longer refreshed, and the instance's watcher is
+// called.
+func (r *RedisRegistry) refresh() {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closed:
+			return
+		case <-ticker.C:
+		}
+
+		r.registeredMutex.Lock()
+		registered := make(map[string]string, len(r.registered))
+		for id, instance := range r.registered {
+			registered[id] = instance
+		}
+		r.registeredMutex.Unlock()
+
+		for id, instance := range registered {
+			// errors are retried at the next refresh
+			reply, err := r.do("EVAL", redisRefresh, "1", redisKeyPrefix+id, instance, strconv.FormatInt(int64(r.ttl/time.Millisecond), 10))
+			if err != nil || reply != int64(0) {
+				continue
+			}
+			r.registeredMutex.Lock()
+			replaced := r.watchers[instance]
+			if r.registered[id] == instance {
+				delete(r.registered, id)
+			} else {
+				// registered again since the copy was made
+				replaced = nil
+			}
+			r.registeredMutex.Unlock()
+			// the watcher looks up the instance now holding the session
+			r.forgetUnknown(id)
+			if replaced != nil {
+				go replaced(id)
+			}
+		}
+	}
+}
+
+// redisError is an error reply from the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to the Redis server
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends a command to the Redis server and returns its reply, using an idle
+// connection from the pool or connecting if there is none.  Replies are
+// strings, integers (int64) or nil.
+func (r *RedisRegistry) do(args ...string) (interface{}, error) {
+	select {
+	case <-r.closed:
+		return nil, errors.New("redis registry closed")
+	default:
+	}
+
+	select {
+	case <-r.closed:
+		return nil, errors.New("redis registry closed")
+	case r.slots <- struct{}{}:
+	}
+	defer func() { <-r.slots }()
+
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.command(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// the connection is in an unknown state, so do not reuse it
+			_ = c.conn.Close()
+			return nil, err
+		}
+	}
+	r.put(c)
+	return reply, err
+}
+
+// get takes an idle connection from the pool, or connects to the Redis server
+// if there is none.
+func (r *RedisRegistry) get() (*redisConn, error) {
+	r.mutex.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mutex.Unlock()
+		return c, nil
+	}
+	r.mutex.Unlock()
+	return r.connect()
+}
+
+// put returns a connection to the pool, or closes it if the registry has been
+// closed.
+func (r *RedisRegistry) put(c *redisConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.closed:
+		_ = c.conn.Close()
+	default:
+		r.idle = append(r.idle, c)
+	}
+}
+
+// connect connects to the Redis server, authenticating and selecting the
+// database if necessary.
+func (r *RedisRegistry) connect() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if r.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", r.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if r.password != "" {
+		if _, err := c.command("AUTH", r.password); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := c.command("SELECT", strconv.Itoa(r.db)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// command sends a command over the connection, in the Redis protocol, and
+// reads its reply.
+func (c *redisConn) command(args ...string) (interface{}, error) {
+	_ = c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads a single reply in the Redis protocol.  Arrays are not
+// supported, as no command used here returns one.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("malformed reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("unsupported reply from Redis: %q", line)
+}
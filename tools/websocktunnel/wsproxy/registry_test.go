@@ -0,0 +1,623 @@
+package wsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/client"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+// fakeRedis is a local stand-in for a Redis server, supporting the commands
+// used by RedisRegistry
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	m        sync.Mutex
+	data     map[string]string
+	commands []string
+	conns    []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{listener: listener, password: password, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.m.Lock()
+			f.conns = append(f.conns, conn)
+			f.m.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://" + f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(reader, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var l int
+			if _, err := fmt.Fscanf(reader, "$%d\r\n", &l); err != nil {
+				return
+			}
+			data := make([]byte, l+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:l])
+		}
+		_, _ = io.WriteString(conn, f.reply(args))
+	}
+}
+
+func (f *fakeRedis) reply(args []string) string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.commands = append(f.commands, strings.Join(args, " "))
+
+	switch {
+	case args[0] == "AUTH" && len(args) == 2:
+		if args[1] != f.password {
+			return "-ERR invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case args[0] == "SELECT":
+		return "+OK\r\n"
+	case args[0] == "GET" && len(args) == 2:
+		value, ok := f.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+		f.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case args[0] == "EVAL" && len(args) == 5 && args[1] == redisUnregister:
+		if f.data[args[3]] == args[4] {
+			delete(f.data, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case args[0] == "EVAL" && len(args) == 6 && args[1] == redisRefresh:
+		value, ok := f.data[args[3]]
+		if ok && value != args[4] {
+			return ":0\r\n"
+		}
+		f.data[args[3]] = args[4]
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// count returns the number of commands received with the given prefix
+func (f *fakeRedis) count(prefix string) int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n := 0
+	for _, command := range f.commands {
+		if strings.HasPrefix(command, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// drop drops all connections to the server
+func (f *fakeRedis) drop() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, conn := range f.conns {
+		_ = conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) close() {
+	_ = f.listener.Close()
+	f.drop()
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	registry := NewMemoryRegistry()
+	testRegistry(t, registry)
+}
+
+func TestRedisRegistry(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	registry, err := NewRedisRegistry(fake.url())
+	require.NoError(t, err)
+	defer registry.Close()
+	testRegistry(t, registry)
+
+	// the registry reconnects if the connection is lost
+	require.NoError(t, registry.Register("client", "http://instance-a"))
+	fake.drop()
+	var instance string
+	for i := 0; i < 2; i++ {
+		instance, err = registry.Lookup("client")
+		if err == nil {
+			break
+		}
+	}
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-a", instance)
+}
+
+func testRegistry(t *testing.T, registry Registry) {
+	instance, err := registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "", instance)
+
+	require.NoError(t, registry.Register("client", "http://instance-a"))
+	instance, err = registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-a", instance)
+
+	// a later registration replaces it, and an instance can only unregister
+	// its own record
+	require.NoError(t, registry.Register("client", "http://instance-b"))
+	require.NoError(t, registry.Unregister("client", "http://instance-a"))
+	instance, err = registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-b", instance)
+
+	require.NoError(t, registry.Unregister("client", "http://instance-b"))
+	instance, err = registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "", instance)
+}
+
+func TestRedisRegistryURL(t *testing.T) {
+	fake := newFakeRedis(t, "secret")
+	defer fake.close()
+	addr := fake.listener.Addr().String()
+
+	registry, err := NewRedisRegistry("redis://:secret@" + addr + "/2")
+	require.NoError(t, err)
+	defer registry.Close()
+	_, err = registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, 1, fake.count("AUTH secret"))
+	require.Equal(t, 1, fake.count("SELECT 2"))
+
+	// an error reply from the server is returned
+	registry2, err := NewRedisRegistry("redis://:wrong@" + addr)
+	require.NoError(t, err)
+	defer registry2.Close()
+	_, err = registry2.Lookup("client")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid password")
+
+	// rediss:// connects using TLS, which the fake server does not speak
+	registry3, err := NewRedisRegistry("rediss://" + addr)
+	require.NoError(t, err)
+	defer registry3.Close()
+	_, err = registry3.Lookup("client")
+	require.Error(t, err)
+
+	for _, invalid := range []string{"http://" + addr, "redis://", "redis://" + addr + "/db"} {
+		_, err := NewRedisRegistry(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestRedisRegistryRefresh(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	registry, err := newRedisRegistry(fake.url(), 30*time.Millisecond)
+	require.NoError(t, err)
+	defer registry.Close()
+
+	// records are set with the TTL, and refreshed until unregistered
+	refresh := "EVAL " + redisRefresh + " 1 " + redisKeyPrefix + "client http://instance-a 30"
+	require.NoError(t, registry.Register("client", "http://instance-a"))
+	require.Equal(t, 1, fake.count("SET "+redisKeyPrefix+"client http://instance-a PX 30"))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, fake.count(refresh) >= 3)
+
+	require.NoError(t, registry.Unregister("client", "http://instance-a"))
+	refreshed := fake.count(refresh)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, refreshed, fake.count(refresh))
+}
+
+func TestRedisRegistryUnknown(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	registryA, err := NewRedisRegistry(fake.url())
+	require.NoError(t, err)
+	defer registryA.Close()
+	registryA.unknownTTL = 100 * time.Millisecond
+	registryB, err := NewRedisRegistry(fake.url())
+	require.NoError(t, err)
+	defer registryB.Close()
+
+	// an unknown client is only looked up once for a while, even once another
+	// instance has registered it
+	get := "GET " + redisKeyPrefix + "client"
+	for i := 0; i < 3; i++ {
+		instance, err := registryA.Lookup("client")
+		require.NoError(t, err)
+		require.Equal(t, "", instance)
+	}
+	require.Equal(t, 1, fake.count(get))
+	require.NoError(t, registryB.Register("client", "http://instance-b"))
+	instance, err := registryA.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "", instance)
+	require.Equal(t, 1, fake.count(get))
+
+	time.Sleep(200 * time.Millisecond)
+	instance, err = registryA.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-b", instance)
+	require.Equal(t, 2, fake.count(get))
+
+	// a client registered by the same registry is found at once
+	instance, err = registryA.Lookup("other")
+	require.NoError(t, err)
+	require.Equal(t, "", instance)
+	require.NoError(t, registryA.Register("other", "http://instance-a"))
+	instance, err = registryA.Lookup("other")
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-a", instance)
+}
+
+func TestMemoryRegistryWatch(t *testing.T) {
+	testRegistryWatch(t, NewMemoryRegistry())
+}
+
+func TestRedisRegistryWatch(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	registry, err := newRedisRegistry(fake.url(), 30*time.Millisecond)
+	require.NoError(t, err)
+	defer registry.Close()
+	testRegistryWatch(t, registry)
+
+	// a replaced record is no longer refreshed, so is not overwritten
+	refresh := "EVAL " + redisRefresh + " 1 " + redisKeyPrefix + "client http://instance-a 30"
+	refreshed := fake.count(refresh)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, refreshed, fake.count(refresh))
+	instance, err := registry.Lookup("client")
+	require.NoError(t, err)
+	require.Equal(t, "http://instance-b", instance)
+}
+
+// testRegistryWatch tests that an instance is told when its record is replaced
+// by another instance
+func testRegistryWatch(t *testing.T, registry Registry) {
+	replaced := make(chan string, 10)
+	registry.Watch("http://instance-a", func(id string) {
+		replaced <- id
+	})
+	require.NoError(t, registry.Register("client", "http://instance-a"))
+	require.NoError(t, registry.Register("client", "http://instance-a"))
+	require.NoError(t, registry.Register("other", "http://instance-b"))
+	require.NoError(t, registry.Register("client", "http://instance-b"))
+	select {
+	case id := <-replaced:
+		require.Equal(t, "client", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher was not called")
+	}
+	select {
+	case id := <-replaced:
+		t.Fatalf("watcher called again for %q", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// startInstance starts an instance of the proxy, sharing the given registry
+func startInstance(t *testing.T, registry Registry) (*proxy, *httptest.Server) {
+	var p *proxy
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+	}))
+	var err error
+	p, err = newProxy(Config{
+		Upgrader:          upgrader,
+		JWTSecretA:        []byte("test-secret"),
+		JWTSecretB:        []byte("another-secret"),
+		URLPrefix:         "http://localhost",
+		Logger:            genLogger(),
+		ResumeGracePeriod: 10 * time.Second,
+		InstanceURL:       server.URL,
+		Registry:          registry,
+	})
+	require.NoError(t, err)
+	return p, server
+}
+
+func TestProxyInstances(t *testing.T) {
+	testProxyInstances(t, NewMemoryRegistry())
+}
+
+func TestProxyInstancesRedis(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	registry, err := NewRedisRegistry(fake.url())
+	require.NoError(t, err)
+	defer registry.Close()
+	testProxyInstances(t, registry)
+}
+
+// testProxyInstances tests that viewer requests to any instance reach a client
+// connected to another instance
+func testProxyInstances(t *testing.T, registry Registry) {
+	_, serverA := startInstance(t, registry)
+	defer serverA.Close()
+	_, serverB := startInstance(t, registry)
+	defer serverB.Close()
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from " + r.URL.Path))
+	}))
+	defer local.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	routes := client.Routes{
+		{Prefix: "/", Port: local.Listener.Addr().(*net.TCPAddr).Port},
+		{Prefix: "/", Port: echo.Addr().(*net.TCPAddr).Port, TCP: true},
+	}
+
+	cl, err := client.New(testConfigurer("multi", util.MakeWsURL(serverA.URL), client.RetryConfig{}, genLogger()))
+	require.NoError(t, err)
+	closed := false
+	defer func() {
+		if !closed {
+			_ = cl.Close()
+		}
+	}()
+	go func() {
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = routes.Forward(stream)
+			}()
+		}
+	}()
+
+	instance, err := registry.Lookup("multi")
+	require.NoError(t, err)
+	require.Equal(t, serverA.URL, instance)
+
+	// HTTP requests and websockets to either instance reach the client
+	for _, server := range []*httptest.Server{serverA, serverB} {
+		status, body := get(t, server.URL+"/multi/path?q=1")
+		require.Equal(t, 200, status)
+		require.Equal(t, "hello from /path", body)
+
+		viewer, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL)+"/multi/__tcp__", nil)
+		require.NoError(t, err)
+		require.NoError(t, viewer.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+		_, data, err := viewer.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(data))
+		_ = viewer.Close()
+	}
+
+	// a forwarded request is not forwarded again, even if the registry is
+	// out of date
+	require.NoError(t, registry.Register("stale", serverA.URL))
+	status, _ := get(t, serverB.URL+"/stale/")
+	require.Equal(t, 504, status)
+
+	// an instance that cannot be reached
+	require.NoError(t, registry.Register("unreachable", "http://127.0.0.1:1"))
+	status, _ = get(t, serverB.URL+"/unreachable/")
+	require.Equal(t, 502, status)
+
+	// once the client disconnects, it is removed from the registry
+	_ = cl.Close()
+	closed = true
+	for i := 0; i < 100; i++ {
+		instance, err = registry.Lookup("multi")
+		require.NoError(t, err)
+		if instance == "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, "", instance)
+	res, err := http.Get(serverB.URL + "/multi/")
+	require.NoError(t, err)
+	_, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, 504, res.StatusCode)
+}
+
+// Test that a client reconnecting to a different instance resumes its session
+// on the instance that holds it
+func TestProxyInstancesResume(t *testing.T) {
+	registry := NewMemoryRegistry()
+	a, serverA := startInstance(t, registry)
+	defer serverA.Close()
+	b, serverB := startInstance(t, registry)
+	defer serverB.Close()
+
+	r := newRelay(t, serverA.Listener.Addr().String())
+	defer r.close()
+	cl := startResumableClient(t, "roaming", r)
+	defer cl.Close()
+	session, ok := a.getWorkerSession("roaming")
+	require.True(t, ok)
+
+	viewer, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(serverB.URL)+"/roaming/__tcp__", nil)
+	require.NoError(t, err)
+	defer viewer.Close()
+	echo(t, viewer, "before")
+
+	// the client's next connection lands on the other instance
+	r.retarget(serverB.Listener.Addr().String())
+	r.cut()
+	echo(t, viewer, "during")
+
+	resumed, ok := a.getWorkerSession("roaming")
+	require.True(t, ok)
+	require.True(t, session == resumed)
+	_, ok = b.getWorkerSession("roaming")
+	require.False(t, ok)
+	instance, err := registry.Lookup("roaming")
+	require.NoError(t, err)
+	require.Equal(t, serverA.URL, instance)
+}
+
+func TestProxyInstancesMove(t *testing.T) {
+	registry := NewMemoryRegistry()
+	testProxyInstancesMove(t, registry, registry)
+}
+
+func TestProxyInstancesMoveRedis(t *testing.T) {
+	fake := newFakeRedis(t, "")
+	defer fake.close()
+	// each instance has its own connection to Redis, as in a deployment
+	registryA, err := newRedisRegistry(fake.url(), 30*time.Millisecond)
+	require.NoError(t, err)
+	defer registryA.Close()
+	registryB, err := newRedisRegistry(fake.url(), 30*time.Millisecond)
+	require.NoError(t, err)
+	defer registryB.Close()
+	// the test waits for B to find the client at A, so B must not remember
+	// it as unknown for long
+	registryB.unknownTTL = 10 * time.Millisecond
+	testProxyInstancesMove(t, registryA, registryB)
+}
+
+// testProxyInstancesMove tests that a client connecting to another instance
+// without resuming its session, while its old session is still held, moves
+// to that instance
+func testProxyInstancesMove(t *testing.T, registryA, registryB Registry) {
+	a, serverA := startInstance(t, registryA)
+	defer serverA.Close()
+	b, serverB := startInstance(t, registryB)
+	defer serverB.Close()
+
+	// the old connection is lost, but the old session is held for the grace
+	// period, as the client cannot reconnect to resume it
+	r := newRelay(t, serverA.Listener.Addr().String())
+	defer r.close()
+	old := startResumableClient(t, "mover", r)
+	defer old.Close()
+	var instance string
+	for i := 0; i < 100; i++ {
+		instance, _ = registryB.Lookup("mover")
+		if instance == serverA.URL {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, serverA.URL, instance)
+	r.retarget("127.0.0.1:1")
+	r.cut()
+	_, ok := a.getWorkerSession("mover")
+	require.True(t, ok)
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from new client"))
+	}))
+	defer local.Close()
+	cl, err := client.New(testConfigurer("mover", util.MakeWsURL(serverB.URL), client.RetryConfig{}, genLogger()))
+	require.NoError(t, err)
+	defer cl.Close()
+	go func() {
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = client.Routes{{Prefix: "/", Port: local.Listener.Addr().(*net.TCPAddr).Port}}.Forward(stream)
+			}()
+		}
+	}()
+
+	// the old session is closed, and the registry is left pointing at the
+	// new one
+	for i := 0; i < 100; i++ {
+		if _, ok = a.getWorkerSession("mover"); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.False(t, ok)
+	_, ok = b.getWorkerSession("mover")
+	require.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	for _, registry := range []Registry{registryA, registryB} {
+		instance, err = registry.Lookup("mover")
+		require.NoError(t, err)
+		require.Equal(t, serverB.URL, instance)
+	}
+
+	for _, server := range []*httptest.Server{serverA, serverB} {
+		status, body := get(t, server.URL+"/mover/")
+		require.Equal(t, 200, status)
+		require.Equal(t, "hello from new client", body)
+	}
+}
+
+func TestProxyInstanceURL(t *testing.T) {
+	for _, instanceURL := range []string{"localhost:8080", "ftp://localhost", "http://"} {
+		_, err := New(Config{
+			Upgrader:    upgrader,
+			JWTSecretA:  []byte("test-secret"),
+			JWTSecretB:  []byte("another-secret"),
+			InstanceURL: instanceURL,
+		})
+		require.Error(t, err, instanceURL)
+	}
+	_, err := New(Config{
+		Upgrader:    upgrader,
+		JWTSecretA:  []byte("test-secret"),
+		JWTSecretB:  []byte("another-secret"),
+		InstanceURL: "http://10.0.0.1:" + strconv.Itoa(8080),
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,229 @@
+package wsproxy
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/client"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+// relay relays TCP connections to a server, and can cut them all at once, as
+// if the network had failed
+type relay struct {
+	listener net.Listener
+	m        sync.Mutex
+	addr     string
+	conns    []net.Conn
+}
+
+func newRelay(t *testing.T, addr string) *relay {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	r := &relay{listener: listener, addr: addr}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			r.m.Lock()
+			addr := r.addr
+			r.m.Unlock()
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			r.m.Lock()
+			r.conns = append(r.conns, conn, upstream)
+			r.m.Unlock()
+			go func() {
+				_, _ = io.Copy(upstream, conn)
+				_ = upstream.Close()
+			}()
+			go func() {
+				_, _ = io.Copy(conn, upstream)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return r
+}
+
+func (r *relay) url() string {
+	return "ws://" + r.listener.Addr().String()
+}
+
+// retarget relays new connections to a different server
+func (r *relay) retarget(addr string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.addr = addr
+}
+
+func (r *relay) cut() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *relay) close() {
+	_ = r.listener.Close()
+	r.cut()
+}
+
+// startResumableClient starts a client for the given ID, connecting through
+// the given relay and asking to resume its session, which echoes raw TCP
+// streams
+func startResumableClient(t *testing.T, id string, r *relay) *client.Client {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	routes := client.Routes{{Prefix: "/", Port: echo.Addr().(*net.TCPAddr).Port, TCP: true}}
+
+	retry := client.RetryConfig{InitialDelay: 10 * time.Millisecond, MaxElapsedTime: 10 * time.Second}
+	configurer := testConfigurer(id, r.url(), retry, genLogger())
+	cl, err := client.New(func() (client.Config, error) {
+		config, err := configurer()
+		config.Resume = true
+		return config, err
+	})
+	require.NoError(t, err)
+	go func() {
+		defer echo.Close()
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				if e, ok := err.(client.Error); ok && e.Temporary() {
+					time.Sleep(10 * time.Millisecond)
+					continue
+				}
+				return
+			}
+			go func() {
+				_ = routes.Forward(stream)
+			}()
+		}
+	}()
+	return cl
+}
+
+// echo sends a message over a viewer's websocket and reads the echo
+func echo(t *testing.T, conn *websocket.Conn, message string) {
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte(message)))
+	var received string
+	for len(received) < len(message) {
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		received += string(data)
+	}
+	require.Equal(t, message, received)
+}
+
+func TestProxyResume(t *testing.T) {
+	p, err := newProxy(Config{
+		Upgrader:          upgrader,
+		JWTSecretA:        []byte("test-secret"),
+		JWTSecretB:        []byte("another-secret"),
+		URLPrefix:         "http://localhost",
+		Logger:            genLogger(),
+		ResumeGracePeriod: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+	r := newRelay(t, server.Listener.Addr().String())
+	defer r.close()
+
+	cl := startResumableClient(t, "resumable", r)
+	defer cl.Close()
+	session, ok := p.getWorkerSession("resumable")
+	require.True(t, ok)
+
+	viewer, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL)+"/resumable/__tcp__", nil)
+	require.NoError(t, err)
+	defer viewer.Close()
+	echo(t, viewer, "before")
+
+	// the viewer's stream survives the client's connection being cut, with
+	// data sent meanwhile delivered once the client has reconnected
+	r.cut()
+	echo(t, viewer, "during")
+
+	// the client is still served by the same session
+	resumed, ok := p.getWorkerSession("resumable")
+	require.True(t, ok)
+	require.True(t, session == resumed)
+
+	// and new streams work
+	viewer2, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL)+"/resumable/__tcp__", nil)
+	require.NoError(t, err)
+	defer viewer2.Close()
+	echo(t, viewer2, "new")
+}
+
+func TestProxyResumeDisabled(t *testing.T) {
+	p, err := newProxy(Config{
+		Upgrader:   upgrader,
+		JWTSecretA: []byte("test-secret"),
+		JWTSecretB: []byte("another-secret"),
+		URLPrefix:  "http://localhost",
+		Logger:     genLogger(),
+	})
+	require.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+	r := newRelay(t, server.Listener.Addr().String())
+	defer r.close()
+
+	cl := startResumableClient(t, "resumable", r)
+	defer cl.Close()
+	session, ok := p.getWorkerSession("resumable")
+	require.True(t, ok)
+
+	viewer, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL)+"/resumable/__tcp__", nil)
+	require.NoError(t, err)
+	defer viewer.Close()
+	echo(t, viewer, "before")
+
+	// without resumption, the viewer's stream ends when the connection is cut
+	r.cut()
+	_ = viewer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = viewer.ReadMessage()
+	require.Error(t, err)
+	require.False(t, strings.Contains(err.Error(), "timeout"), err.Error())
+
+	// but the client reconnects with a new session
+	for i := 0; i < 100; i++ {
+		if s, ok := p.getWorkerSession("resumable"); ok && s != session {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	viewer2, _, err := websocket.DefaultDialer.Dial(util.MakeWsURL(server.URL)+"/resumable/__tcp__", nil)
+	require.NoError(t, err)
+	defer viewer2.Close()
+	echo(t, viewer2, "new")
+}
@@ -0,0 +1,103 @@
+package wsproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/wsmux"
+)
+
+// TCPPath is the path, following a client's URL, at which viewers open
+// websocket connections that are bridged to raw TCP streams on the client.
+// Any path after TCPPath is passed to the client, which may use it to select
+// the TCP service to connect to.
+const TCPPath = "/__tcp__"
+
+// isTCPPath returns true if the given path (relative to a client's URL) is
+// for a raw TCP connection
+func isTCPPath(path string) bool {
+	path = strings.SplitN(path, "?", 2)[0]
+	return path == TCPPath || strings.HasPrefix(path, TCPPath+"/")
+}
+
+// tcpProxy bridges a viewer's websocket connection to a raw stream on the
+// client session. The stream is opened with a CONNECT request for the path
+// following TCPPath, and the client responds with 200 once it has connected
+// the stream to a TCP service. After that, the binary messages of the
+// websocket carry the data of the TCP connection in each direction.
+func (p *proxy) tcpProxy(w http.ResponseWriter, r *http.Request, session *wsmux.Session, tunnelID string, path string) error {
+	targetURI := strings.TrimPrefix(path, TCPPath)
+	if !strings.HasPrefix(targetURI, "/") {
+		targetURI = "/" + targetURI
+	}
+	target, err := url.ParseRequestURI(targetURI)
+	if err != nil {
+		http.Error(w, http.StatusText(400), 400)
+		return err
+	}
+
+	p.logf(tunnelID, r.RemoteAddr, "creating TCP bridge: path=%s", target.RequestURI())
+	stream := p.openStream(w, r, session, tunnelID)
+	if stream == nil {
+		return errors.New("could not create stream")
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	connectReq := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       r.Host,
+	}
+	connectReq.Header.Set("x-websocktunnel-original-path", r.URL.Path)
+	if err := connectReq.Write(stream); err != nil {
+		p.logerrorf(tunnelID, r.RemoteAddr, "could not write connect request: path=%s", target.RequestURI())
+		http.Error(w, http.StatusText(500), 500)
+		return err
+	}
+
+	// the client may send data as soon as it has responded, so all reads from
+	// the stream must go through this reader
+	reader := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		p.logerrorf(tunnelID, r.RemoteAddr, "could not read connect response: path=%s", target.RequestURI())
+		http.Error(w, http.StatusText(500), 500)
+		return err
+	}
+	if resp.StatusCode != 200 {
+		p.logerrorf(tunnelID, r.RemoteAddr, "client refused TCP connection: path=%s, status=%d", target.RequestURI(), resp.StatusCode)
+		http.Error(w, "Client could not connect to TCP service", 502)
+		return fmt.Errorf("client refused TCP connection with status %d", resp.StatusCode)
+	}
+
+	upgrader := websocket.Upgrader{
+		Subprotocols: websocket.Subprotocols(r),
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	viewerConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		p.logerrorf(tunnelID, r.RemoteAddr, "could not upgrade client connection: path=%s, error: %v", r.URL.RequestURI(), err)
+		return err
+	}
+	p.logf(tunnelID, r.RemoteAddr, "initiating TCP bridge")
+
+	err = util.BridgeWebsocket(viewerConn, reader, stream)
+	if err != nil {
+		p.logerrorf(tunnelID, r.RemoteAddr, "TCP bridge closed with err: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package wsproxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/client"
+	"github.com/taskcluster/taskcluster/v39/tools/websocktunnel/util"
+)
+
+func TestProxyTCP(t *testing.T) {
+	proxy, err := New(Config{
+		Upgrader:   upgrader,
+		JWTSecretA: []byte("test-secret"),
+		JWTSecretB: []byte("another-secret"),
+		URLPrefix:  "http://localhost",
+		Logger:     genLogger(),
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	wsURL := util.MakeWsURL(server.URL)
+
+	cl, err := client.New(testConfigurer("tcpclient", wsURL, client.RetryConfig{}, genLogger()))
+	require.NoError(t, err)
+	defer cl.Close()
+
+	// the client echoes each raw TCP stream back, prefixed with its path, and
+	// rejects those for the path /refused
+	go func() {
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, tcpReq, err := client.ParseStream(stream)
+				if err != nil || tcpReq == nil {
+					_ = stream.Close()
+					return
+				}
+				if tcpReq.Path == "/refused" {
+					_ = tcpReq.Reject(502)
+					return
+				}
+				conn, err := tcpReq.Accept()
+				if err != nil {
+					return
+				}
+				// the client may send data before the viewer does
+				_, _ = conn.Write([]byte(tcpReq.Path + ": "))
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	for path, expected := range map[string]string{
+		"/__tcp__":     "/: ",
+		"/__tcp__/vnc": "/vnc: ",
+	} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/tcpclient"+path, nil)
+		require.NoError(t, err)
+
+		_, greeting, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, expected, string(greeting))
+
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+		_, echo, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(echo))
+
+		_ = conn.Close()
+	}
+
+	// a refused connection fails the websocket handshake
+	_, res, err := websocket.DefaultDialer.Dial(wsURL+"/tcpclient/__tcp__/refused", nil)
+	require.Error(t, err)
+	require.Equal(t, 502, res.StatusCode)
+
+	// a client that is not connected
+	_, res, err = websocket.DefaultDialer.Dial(wsURL+"/noclient/__tcp__", nil)
+	require.Error(t, err)
+	require.Equal(t, 504, res.StatusCode)
+}
+
+func TestIsTCPPath(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/__tcp__":          true,
+		"/__tcp__/":         true,
+		"/__tcp__/ssh":      true,
+		"/__tcp__?a=b":      true,
+		"/__tcp__ssh":       false,
+		"/":                 false,
+		"/some/__tcp__":     false,
+		"/__tcp__x/__tcp__": false,
+	} {
+		require.Equal(t, expected, isTCPPath(path), path)
+	}
+}
+
+// Test that one client can serve several local services, with routes
+func TestProxyRoutes(t *testing.T) {
+	proxy, err := New(Config{
+		Upgrader:   upgrader,
+		JWTSecretA: []byte("test-secret"),
+		JWTSecretB: []byte("another-secret"),
+		URLPrefix:  "http://localhost",
+		Logger:     genLogger(),
+	})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	wsURL := util.MakeWsURL(server.URL)
+
+	// local HTTP services, responding with their name and the path they
+	// received
+	routes := client.Routes{}
+	for _, prefix := range []string{"/", "/livelog"} {
+		name := prefix
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name + " " + r.URL.RequestURI()))
+		}))
+		defer local.Close()
+		routes = append(routes, client.Route{Prefix: prefix, Port: local.Listener.Addr().(*net.TCPAddr).Port})
+	}
+
+	// a local TCP service, echoing data back
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	routes = append(routes, client.Route{Prefix: "/echo", Port: echo.Addr().(*net.TCPAddr).Port, TCP: true})
+
+	cl, err := client.New(testConfigurer("routeclient", wsURL, client.RetryConfig{}, genLogger()))
+	require.NoError(t, err)
+	defer cl.Close()
+	go func() {
+		for {
+			stream, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = routes.Forward(stream)
+			}()
+		}
+	}()
+
+	// paths are passed to the local services unchanged
+	for path, expected := range map[string]string{
+		"/index.html":        "/ /index.html",
+		"/livelog/token?a=b": "/livelog /livelog/token?a=b",
+		"/livelogs":          "/ /livelogs",
+	} {
+		res, err := http.Get(server.URL + "/routeclient" + path)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, expected, string(body))
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/routeclient/__tcp__/echo", nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	_ = conn.Close()
+
+	// there is no TCP route for other paths
+	_, res, err := websocket.DefaultDialer.Dial(wsURL+"/routeclient/__tcp__/ssh", nil)
+	require.Error(t, err)
+	require.Equal(t, 502, res.StatusCode)
+}
@@ -1,6 +1,7 @@
 package wsproxy
 
 import (
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -15,13 +16,11 @@ func (p *proxy) websocketProxy(w http.ResponseWriter, r *http.Request, session *
 	// at this point, we are sure that r is a http websocket upgrade request
 	// connClosure returns the wsmux stream to Dial
 	p.logf(tunnelID, r.RemoteAddr, "creating WS bridge: path=%s", r.URL.RequestURI())
-	stream, err := session.Open()
-	p.logf(tunnelID, r.RemoteAddr, "opened new stream for ws: path=%s", r.URL.RequestURI())
-
-	if err != nil {
-		p.logerrorf(tunnelID, r.RemoteAddr, "could not create stream: path=%s", r.URL.RequestURI())
-		return err
+	stream := p.openStream(w, r, session, tunnelID)
+	if stream == nil {
+		return errors.New("could not create stream")
 	}
+	p.logf(tunnelID, r.RemoteAddr, "opened new stream for ws: path=%s", r.URL.RequestURI())
 	connClosure := func(network, addr string) (net.Conn, error) {
 		return stream, nil
 	}
@@ -51,6 +50,7 @@ func (p *proxy) websocketProxy(w http.ResponseWriter, r *http.Request, session *
 	tunnelConn, _, err := dialer.Dial(uri, reqHeader)
 	if err != nil {
 		p.logerrorf(tunnelID, r.RemoteAddr, "could not dial tunnel: path=%s, error: %v", r.URL.RequestURI(), err)
+		_ = stream.Close()
 		return err
 	}
 
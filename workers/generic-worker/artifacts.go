@@ -448,8 +448,13 @@ func (task *TaskRun) uploadLog(name, path string) *CommandExecutionError {
 	)
 }
 
-func (task *TaskRun) uploadArtifact(artifact TaskArtifact) *CommandExecutionError {
+func (task *TaskRun) uploadArtifact(artifact TaskArtifact) (cee *CommandExecutionError) {
 	task.Artifacts[artifact.Base().Name] = artifact
+	summary := task.newArtifactSummary(artifact)
+	started := time.Now()
+	defer func() {
+		summary.finish(started, cee)
+	}()
 	payload, err := json.Marshal(artifact.RequestObject())
 	if err != nil {
 		panic(err)
@@ -39,8 +39,8 @@ func TestPublicDirectoryArtifact(t *testing.T) {
 		t.Fatalf("Error listing artifacts: %v", err)
 	}
 
-	if l := len(artifacts.Artifacts); l != 3 {
-		t.Fatalf("Was expecting 3 artifacts, but got %v", l)
+	if l := len(artifacts.Artifacts); l != 4 {
+		t.Fatalf("Was expecting 4 artifacts, but got %v", l)
 	}
 
 	// use the artifact names as keys in a map, so we can look up that each key exists
@@ -48,9 +48,10 @@ func TestPublicDirectoryArtifact(t *testing.T) {
 		artifacts.Artifacts[0].Name: true,
 		artifacts.Artifacts[1].Name: true,
 		artifacts.Artifacts[2].Name: true,
+		artifacts.Artifacts[3].Name: true,
 	}
 
-	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] {
+	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] || !a["public/logs/run-summary.json"] {
 		t.Fatalf("Wrong artifacts presented in task %v: %#v", taskID, a)
 	}
 }
@@ -93,8 +94,8 @@ func TestConflictingFileArtifactsInPayload(t *testing.T) {
 		t.Fatalf("Error listing artifacts: %v", err)
 	}
 
-	if l := len(artifacts.Artifacts); l != 3 {
-		t.Fatalf("Was expecting 3 artifacts, but got %v", l)
+	if l := len(artifacts.Artifacts); l != 4 {
+		t.Fatalf("Was expecting 4 artifacts, but got %v", l)
 	}
 
 	// use the artifact names as keys in a map, so we can look up that each key exists
@@ -102,9 +103,10 @@ func TestConflictingFileArtifactsInPayload(t *testing.T) {
 		artifacts.Artifacts[0].Name: true,
 		artifacts.Artifacts[1].Name: true,
 		artifacts.Artifacts[2].Name: true,
+		artifacts.Artifacts[3].Name: true,
 	}
 
-	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] {
+	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] || !a["public/logs/run-summary.json"] {
 		t.Fatalf("Wrong artifacts presented in task %v", taskID)
 	}
 }
@@ -177,8 +179,8 @@ func TestArtifactIncludedAsFileAndDirectoryInPayload(t *testing.T) {
 		t.Fatalf("Error listing artifacts: %v", err)
 	}
 
-	if l := len(artifacts.Artifacts); l != 3 {
-		t.Fatalf("Was expecting 3 artifacts, but got %v", l)
+	if l := len(artifacts.Artifacts); l != 4 {
+		t.Fatalf("Was expecting 4 artifacts, but got %v", l)
 	}
 
 	// use the artifact names as keys in a map, so we can look up that each key exists
@@ -186,9 +188,10 @@ func TestArtifactIncludedAsFileAndDirectoryInPayload(t *testing.T) {
 		artifacts.Artifacts[0].Name: true,
 		artifacts.Artifacts[1].Name: true,
 		artifacts.Artifacts[2].Name: true,
+		artifacts.Artifacts[3].Name: true,
 	}
 
-	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] {
+	if !a["public/build/X.txt"] || !a["public/logs/live.log"] || !a["public/logs/live_backing.log"] || !a["public/logs/run-summary.json"] {
 		t.Fatalf("Wrong artifacts presented in task %v", taskID)
 	}
 }
@@ -8,11 +8,14 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
 	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcqueue"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/cot"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/gwconfig"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -106,6 +109,19 @@ func TestChainOfTrustUpload(t *testing.T) {
 			ContentEncoding: "gzip",
 			Expires:         td.Expires,
 		},
+		"public/chain-of-trust-v2.json": {
+			Extracts: []string{
+				"8308d593eb56527137532595a60255a3fcfbe4b6b068e29b22d99742bad80f6f",
+			},
+			ContentType:     "text/plain; charset=utf-8",
+			ContentEncoding: "gzip",
+			Expires:         td.Expires,
+		},
+		"public/chain-of-trust-v2.json.sig": {
+			ContentType:     "application/octet-stream",
+			ContentEncoding: "gzip",
+			Expires:         td.Expires,
+		},
 		"public/build/X.txt": {
 			Extracts: []string{
 				"test artifact",
@@ -124,13 +140,13 @@ func TestChainOfTrustUpload(t *testing.T) {
 
 	expectedArtifacts.Validate(t, taskID, 0)
 
-	cotUnsignedBytes, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust.json")
-	var cotCert ChainOfTrustData
+	cotUnsignedBytes, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust-v2.json")
+	var cotCert cot.ChainOfTrustData
 	err := json.Unmarshal(cotUnsignedBytes, &cotCert)
 	if err != nil {
-		t.Fatalf("Could not interpret public/chain-of-trust.json as json")
+		t.Fatalf("Could not interpret public/chain-of-trust-v2.json as json")
 	}
-	cotSignature, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust.json.sig")
+	cotSignature, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust-v2.json.sig")
 	var ed25519Pubkey ed25519.PublicKey
 	base64Ed25519Pubkey, err := ioutil.ReadFile(filepath.Join("testdata", "ed25519_public_key"))
 	if err != nil {
@@ -142,8 +158,22 @@ func TestChainOfTrustUpload(t *testing.T) {
 	}
 	ed25519Verified := ed25519.Verify(ed25519Pubkey, cotUnsignedBytes, cotSignature)
 	if ed25519Verified != true {
+		t.Fatalf("Could not verify public/chain-of-trust-v2.json.sig signature against public/chain-of-trust-v2.json")
+	}
+
+	// version 1 document is still published, unchanged, for existing consumers
+	cotV1UnsignedBytes, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust.json")
+	cotV1Signature, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust.json.sig")
+	if !ed25519.Verify(ed25519Pubkey, cotV1UnsignedBytes, cotV1Signature) {
 		t.Fatalf("Could not verify public/chain-of-trust.json.sig signature against public/chain-of-trust.json")
 	}
+	cotV1Bytes, err := json.MarshalIndent(cotCert.V1(), "", "  ")
+	if err != nil {
+		t.Fatalf("Could not marshal version 1 chain of trust document: %v", err)
+	}
+	if string(cotV1UnsignedBytes) != string(cotV1Bytes) {
+		t.Fatalf("Expected public/chain-of-trust.json to be version 1 document:\n%s\nbut was:\n%s", cotV1Bytes, cotV1UnsignedBytes)
+	}
 
 	// This trickery is to convert a TaskDefinitionResponse into a
 	// TaskDefinitionRequest in order that we can compare. We cannot cast, so
@@ -200,6 +230,9 @@ func TestChainOfTrustUpload(t *testing.T) {
 	if cotCert.Environment.Region != "test-worker-group" {
 		t.Fatalf("Expected region to be \"test-worker-group\" but was %v", cotCert.Environment.Region)
 	}
+	if cotCert.SigningKey == nil || cotCert.SigningKey.KeyID != cot.KeyID(ed25519Pubkey) || cotCert.SigningKey.PublicKey != strings.TrimSpace(string(base64Ed25519Pubkey)) {
+		t.Fatalf("Expected signingKey to have keyId %v and publicKey %v but was %#v", cot.KeyID(ed25519Pubkey), string(base64Ed25519Pubkey), cotCert.SigningKey)
+	}
 
 	// Check artifact list in CoT includes the names (not paths) of all
 	// expected artifacts...
@@ -207,10 +240,12 @@ func TestChainOfTrustUpload(t *testing.T) {
 	// blacklist is for artifacts that by design should not be included in
 	// chain of trust artifact list
 	blacklist := map[string]bool{
-		"public/logs/live.log":           true,
-		"public/logs/live_backing.log":   true,
-		"public/chain-of-trust.json":     true,
-		"public/chain-of-trust.json.sig": true,
+		"public/logs/live.log":              true,
+		"public/logs/live_backing.log":      true,
+		"public/chain-of-trust.json":        true,
+		"public/chain-of-trust.json.sig":    true,
+		"public/chain-of-trust-v2.json":     true,
+		"public/chain-of-trust-v2.json.sig": true,
 	}
 	for artifactName := range expectedArtifacts {
 		if _, inBlacklist := blacklist[artifactName]; !inBlacklist {
@@ -233,6 +268,8 @@ func TestProtectedArtifactsReplaced(t *testing.T) {
 	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/logs/certified.log")...)
 	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/chain-of-trust.json")...)
 	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/chain-of-trust.json.sig")...)
+	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/chain-of-trust-v2.json")...)
+	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/chain-of-trust-v2.json.sig")...)
 	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/X.txt")...)
 	command = append(command, copyTestdataFileTo("SampleArtifacts/_/X.txt", "public/Y.txt")...)
 
@@ -265,6 +302,16 @@ func TestProtectedArtifactsReplaced(t *testing.T) {
 				Expires: expires,
 				Type:    "file",
 			},
+			{
+				Path:    "public/chain-of-trust-v2.json",
+				Expires: expires,
+				Type:    "file",
+			},
+			{
+				Path:    "public/chain-of-trust-v2.json.sig",
+				Expires: expires,
+				Type:    "file",
+			},
 			{
 				Path:    "public/X.txt",
 				Expires: expires,
@@ -298,8 +345,8 @@ func TestProtectedArtifactsReplaced(t *testing.T) {
 		t.Fatalf("Error listing artifacts: %v", err)
 	}
 
-	if l := len(artifacts.Artifacts); l != 7 {
-		t.Fatalf("Was expecting 7 artifacts, but got %v", l)
+	if l := len(artifacts.Artifacts); l != 10 {
+		t.Fatalf("Was expecting 10 artifacts, but got %v", l)
 	}
 
 	// use the artifact names as keys in a map, so we can look up that each key exists
@@ -318,9 +365,12 @@ func TestProtectedArtifactsReplaced(t *testing.T) {
 	for _, artifactName := range []string{
 		"public/logs/live.log",
 		"public/logs/live_backing.log",
+		"public/logs/run-summary.json",
 		"public/logs/certified.log",
 		"public/chain-of-trust.json",
 		"public/chain-of-trust.json.sig",
+		"public/chain-of-trust-v2.json",
+		"public/chain-of-trust-v2.json.sig",
 	} {
 		if !a[artifactName] {
 			t.Fatalf("Artifact %v missing in task %v", artifactName, taskID)
@@ -332,3 +382,322 @@ func TestProtectedArtifactsReplaced(t *testing.T) {
 		}
 	}
 }
+
+func TestChainOfTrustProvenance(t *testing.T) {
+
+	defer setup(t)()
+
+	expires := tcclient.Time(time.Now().Add(time.Minute * 30))
+
+	command := helloGoodbye()
+	command = append(command, copyTestdataFile("SampleArtifacts/_/X.txt")...)
+
+	payload := GenericWorkerPayload{
+		Command:    command,
+		MaxRunTime: 30,
+		Artifacts: []Artifact{
+			{
+				Path:    "SampleArtifacts/_/X.txt",
+				Expires: expires,
+				Type:    "file",
+				Name:    "public/build/X.txt",
+			},
+		},
+		Features: FeatureFlags{
+			ChainOfTrustProvenance: true,
+		},
+	}
+	td := testTask(t)
+
+	// Chain of trust is not allowed when running as current user
+	// since signing key cannot be secured
+	if config.RunTasksAsCurrentUser {
+		expectChainOfTrustKeyNotSecureMessage(t, td, payload)
+		return
+	}
+
+	taskID := submitAndAssert(t, td, payload, "completed", "completed")
+
+	// provenance implies chain of trust, so chain of trust files should also be published
+	for _, artifactName := range []string{
+		"public/chain-of-trust.json",
+		"public/chain-of-trust.json.sig",
+		"public/chain-of-trust-v2.json",
+		"public/chain-of-trust-v2.json.sig",
+	} {
+		_, _, _, _ = getArtifactContent(t, taskID, artifactName)
+	}
+
+	envelopeBytes, _, _, _ := getArtifactContent(t, taskID, "public/chain-of-trust.intoto.jsonl")
+	var envelope DSSEEnvelope
+	err := json.Unmarshal(envelopeBytes, &envelope)
+	if err != nil {
+		t.Fatalf("Could not interpret public/chain-of-trust.intoto.jsonl as json: %v", err)
+	}
+	if envelope.PayloadType != "application/vnd.in-toto+json" {
+		t.Fatalf("Expected payload type application/vnd.in-toto+json but got %q", envelope.PayloadType)
+	}
+	if len(envelope.Signatures) != 1 {
+		t.Fatalf("Expected 1 signature but got %v", len(envelope.Signatures))
+	}
+	statementBytes, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		t.Fatalf("Could not base64 decode DSSE payload: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	if err != nil {
+		t.Fatalf("Could not base64 decode DSSE signature: %v", err)
+	}
+	base64Ed25519Pubkey, err := ioutil.ReadFile(filepath.Join("testdata", "ed25519_public_key"))
+	if err != nil {
+		t.Fatalf("Error opening ed25519 public key file")
+	}
+	ed25519Pubkey, err := base64.StdEncoding.DecodeString(string(base64Ed25519Pubkey))
+	if err != nil {
+		t.Fatalf("Error converting ed25519 public key to a valid pubkey")
+	}
+	if !ed25519.Verify(ed25519Pubkey, dssePAE(envelope.PayloadType, statementBytes), sig) {
+		t.Fatalf("Could not verify DSSE signature of public/chain-of-trust.intoto.jsonl")
+	}
+	if envelope.Signatures[0].KeyID != cot.KeyID(ed25519Pubkey) {
+		t.Fatalf("Expected DSSE signature keyid %v but got %q", cot.KeyID(ed25519Pubkey), envelope.Signatures[0].KeyID)
+	}
+
+	var statement InTotoStatement
+	err = json.Unmarshal(statementBytes, &statement)
+	if err != nil {
+		t.Fatalf("Could not interpret DSSE payload as in-toto statement: %v", err)
+	}
+	if statement.Type != "https://in-toto.io/Statement/v0.1" {
+		t.Fatalf("Expected statement type https://in-toto.io/Statement/v0.1 but got %q", statement.Type)
+	}
+	if statement.PredicateType != "https://slsa.dev/provenance/v0.2" {
+		t.Fatalf("Expected predicate type https://slsa.dev/provenance/v0.2 but got %q", statement.PredicateType)
+	}
+	expectedSubject := InTotoSubject{
+		Name: "public/build/X.txt",
+		Digest: DigestSet{
+			"sha256": "8308d593eb56527137532595a60255a3fcfbe4b6b068e29b22d99742bad80f6f",
+		},
+	}
+	if len(statement.Subject) != 1 || !reflect.DeepEqual(statement.Subject[0], expectedSubject) {
+		t.Fatalf("Expected subjects to be [%#v] but got %#v", expectedSubject, statement.Subject)
+	}
+	if statement.Predicate.Invocation.Environment.TaskID != taskID {
+		t.Fatalf("Expected taskId to be %q but was %q", taskID, statement.Predicate.Invocation.Environment.TaskID)
+	}
+	if statement.Predicate.Invocation.ConfigSource.URI != config.RootURL+"/api/queue/v1/task/"+taskID {
+		t.Fatalf("Unexpected config source URI %q", statement.Predicate.Invocation.ConfigSource.URI)
+	}
+}
+
+func TestDSSEPAE(t *testing.T) {
+	// example from https://github.com/secure-systems-lab/dsse/blob/v1.0.0/protocol.md
+	pae := string(dssePAE("http://example.com/HelloWorld", []byte("hello world")))
+	expected := "DSSEv1 29 http://example.com/HelloWorld 11 hello world"
+	if pae != expected {
+		t.Fatalf("Expected PAE %q but got %q", expected, pae)
+	}
+}
+
+func TestActiveSigningKey(t *testing.T) {
+	at := func(date string) *time.Time {
+		parsed, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			panic(err)
+		}
+		return &parsed
+	}
+	keys := []*signingKey{
+		{Ed25519SigningKey: gwconfig.Ed25519SigningKey{KeyID: "legacy"}},
+		{Ed25519SigningKey: gwconfig.Ed25519SigningKey{KeyID: "2021-q1", NotBefore: at("2021-01-01T00:00:00Z"), NotAfter: at("2021-04-01T00:00:00Z")}},
+		{Ed25519SigningKey: gwconfig.Ed25519SigningKey{KeyID: "2021-q2", NotBefore: at("2021-03-25T00:00:00Z"), NotAfter: at("2021-07-01T00:00:00Z")}},
+	}
+	for _, test := range []struct {
+		time     string
+		expected string
+	}{
+		{time: "2020-12-31T23:59:59Z", expected: "legacy"},
+		{time: "2021-01-01T00:00:00Z", expected: "2021-q1"},
+		{time: "2021-03-25T00:00:00Z", expected: "2021-q2"},
+		{time: "2021-06-30T23:59:59Z", expected: "2021-q2"},
+		{time: "2021-07-01T00:00:00Z", expected: "legacy"},
+	} {
+		active := activeSigningKey(keys, *at(test.time))
+		if active == nil || active.KeyID != test.expected {
+			t.Errorf("Expected key %v to be active at %v but got %#v", test.expected, test.time, active)
+		}
+	}
+	if active := activeSigningKey(keys[1:], *at("2021-07-01T00:00:00Z")); active != nil {
+		t.Errorf("Expected no key to be active at 2021-07-01T00:00:00Z but got %#v", active)
+	}
+}
+
+func TestChainOfTrustMountsAndWorkerIdentity(t *testing.T) {
+
+	defer setup(t)()
+
+	taskID := CreateArtifactFromFile(t, "SampleArtifacts/_/X.txt", "SampleArtifacts/_/X.txt")
+
+	mounts := []MountEntry{
+		&FileMount{
+			File: filepath.Join("preloaded", "Mr X.txt"),
+			Content: json.RawMessage(`{
+				"taskId":   "` + taskID + `",
+				"artifact": "SampleArtifacts/_/X.txt"
+			}`),
+		},
+		&FileMount{
+			File: filepath.Join("preloaded", "raw.txt"),
+			Content: json.RawMessage(`{
+				"raw": "Hello Raw!"
+			}`),
+		},
+	}
+
+	payload := GenericWorkerPayload{
+		Mounts:     toMountArray(t, &mounts),
+		Command:    helloGoodbye(),
+		MaxRunTime: 30,
+		Features: FeatureFlags{
+			ChainOfTrust: true,
+		},
+	}
+	td := testTask(t)
+	td.Scopes = []string{"queue:get-artifact:SampleArtifacts/_/X.txt"}
+	td.Dependencies = []string{taskID}
+
+	// Chain of trust is not allowed when running as current user
+	// since signing key cannot be secured
+	if config.RunTasksAsCurrentUser {
+		expectChainOfTrustKeyNotSecureMessage(t, td, payload)
+		return
+	}
+
+	cotTaskID := submitAndAssert(t, td, payload, "completed", "completed")
+
+	cotUnsignedBytes, _, _, _ := getArtifactContent(t, cotTaskID, "public/chain-of-trust-v2.json")
+	var cotCert cot.ChainOfTrustData
+	err := json.Unmarshal(cotUnsignedBytes, &cotCert)
+	if err != nil {
+		t.Fatalf("Could not interpret public/chain-of-trust-v2.json as json")
+	}
+	if cotCert.Version != 2 {
+		t.Fatalf("Expected chainOfTrustVersion to be 2 but was %v", cotCert.Version)
+	}
+	if cotCert.Environment.GenericWorkerVersion != version {
+		t.Fatalf("Expected genericWorkerVersion to be %q but was %q", version, cotCert.Environment.GenericWorkerVersion)
+	}
+	if cotCert.Environment.GenericWorkerEngine != engine {
+		t.Fatalf("Expected genericWorkerEngine to be %q but was %q", engine, cotCert.Environment.GenericWorkerEngine)
+	}
+	if len(cotCert.Environment.GenericWorkerSHA256) != 64 {
+		t.Fatalf("Expected genericWorkerSha256 to be a SHA256 but was %q", cotCert.Environment.GenericWorkerSHA256)
+	}
+	expectedMounts := []cot.Mount{
+		{
+			Type: "fileMount",
+			Path: filepath.Join("preloaded", "Mr X.txt"),
+			Content: &cot.MountContent{
+				TaskID:   taskID,
+				Artifact: "SampleArtifacts/_/X.txt",
+				SHA256:   "8308d593eb56527137532595a60255a3fcfbe4b6b068e29b22d99742bad80f6f",
+			},
+		},
+		{
+			Type: "fileMount",
+			Path: filepath.Join("preloaded", "raw.txt"),
+			Content: &cot.MountContent{
+				// echo -n 'Hello Raw!' | shasum -a 256
+				SHA256: "241513e37d9d6a4d5c9c19e37f9b3f0186bd4557514ac1b47d0fbb5216fbd804",
+			},
+		},
+	}
+	if !reflect.DeepEqual(cotCert.Mounts, expectedMounts) {
+		t.Fatalf("Expected mounts %#v but got %#v", expectedMounts, cotCert.Mounts)
+	}
+}
+
+func TestVerifyChainOfTrust(t *testing.T) {
+
+	defer setup(t)()
+
+	if config.RunTasksAsCurrentUser {
+		t.Skip("Chain of trust is not allowed when running as current user")
+	}
+
+	expires := tcclient.Time(time.Now().Add(time.Minute * 30))
+
+	// upstream task publishes an artifact with chain of trust
+	upstreamPayload := GenericWorkerPayload{
+		Command:    append(helloGoodbye(), copyTestdataFile("SampleArtifacts/_/X.txt")...),
+		MaxRunTime: 30,
+		Artifacts: []Artifact{
+			{
+				Path:    "SampleArtifacts/_/X.txt",
+				Expires: expires,
+				Type:    "file",
+			},
+		},
+		Features: FeatureFlags{
+			ChainOfTrust: true,
+		},
+	}
+	upstreamTaskID := submitAndAssert(t, testTask(t), upstreamPayload, "completed", "completed")
+
+	// downstream task mounts the artifact of the upstream task
+	mounts := []MountEntry{
+		&FileMount{
+			File: filepath.Join("preloaded", "Mr X.txt"),
+			Content: json.RawMessage(`{
+				"taskId":   "` + upstreamTaskID + `",
+				"artifact": "SampleArtifacts/_/X.txt"
+			}`),
+		},
+	}
+	payload := GenericWorkerPayload{
+		Mounts:     toMountArray(t, &mounts),
+		Command:    helloGoodbye(),
+		MaxRunTime: 30,
+		Features: FeatureFlags{
+			ChainOfTrust: true,
+		},
+	}
+	td := testTask(t)
+	td.Scopes = []string{"queue:get-artifact:SampleArtifacts/_/X.txt"}
+	td.Dependencies = []string{upstreamTaskID}
+	taskID := submitAndAssert(t, td, payload, "completed", "completed")
+
+	base64Ed25519Pubkey, err := ioutil.ReadFile(filepath.Join("testdata", "ed25519_public_key"))
+	if err != nil {
+		t.Fatalf("Error opening ed25519 public key file")
+	}
+	publicKey, err := cot.ParsePublicKey(string(base64Ed25519Pubkey))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	verifier := &cot.Verifier{
+		Queue:           serviceFactory.Queue(nil, config.RootURL),
+		PublicKeys:      []ed25519.PublicKey{publicKey},
+		VerifyArtifacts: true,
+		Recursive:       true,
+	}
+	data, err := verifier.Verify(taskID)
+	if err != nil {
+		t.Fatalf("Chain of trust should have been verified, but got: %v", err)
+	}
+	if data.TaskID != taskID {
+		t.Fatalf("Expected taskId %v but got %v", taskID, data.TaskID)
+	}
+
+	// chain of trust should not verify with a different key
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	verifier.PublicKeys = []ed25519.PublicKey{otherPublicKey}
+	_, err = verifier.Verify(taskID)
+	if _, isVerificationError := err.(*cot.VerificationError); !isVerificationError {
+		t.Fatalf("Was expecting an error of type *cot.VerificationError but received error %#v", err)
+	}
+}
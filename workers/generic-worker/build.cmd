@@ -5,7 +5,7 @@
 :: cd to dir containing this script
 pushd %~dp0
 
-go get github.com/taskcluster/livelog github.com/gordonklaus/ineffassign || exit /b %ERRORLEVEL%
+go get github.com/gordonklaus/ineffassign || exit /b %ERRORLEVEL%
 cd gw-codegen
 go install -v || exit /b %ERRORLEVEL%
 cd ..
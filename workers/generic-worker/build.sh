@@ -115,7 +115,6 @@ fi
 ls -1 "$OUTPUT_DIR"/generic-worker-*
 
 CGO_ENABLED=0 go get \
-  github.com/taskcluster/taskcluster/v39/tools/livelog \
   github.com/taskcluster/taskcluster/v39/tools/taskcluster-proxy \
   golang.org/x/lint/golint \
   github.com/gordonklaus/ineffassign \
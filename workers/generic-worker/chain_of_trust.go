@@ -8,13 +8,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
 
-	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcqueue"
 	"github.com/taskcluster/taskcluster/v39/internal/scopes"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/cot"
 	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/fileutil"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/gwconfig"
 )
 
 const (
@@ -24,44 +27,37 @@ const (
 )
 
 var (
-	certifiedLogPath      = filepath.Join("generic-worker", "certified.log")
-	certifiedLogName      = "public/logs/certified.log"
-	unsignedCertPath      = filepath.Join("generic-worker", "chain-of-trust.json")
-	unsignedCertName      = "public/chain-of-trust.json"
-	ed25519SignedCertPath = filepath.Join("generic-worker", "chain-of-trust.json.sig")
-	ed25519SignedCertName = "public/chain-of-trust.json.sig"
+	certifiedLogPath        = filepath.Join("generic-worker", "certified.log")
+	certifiedLogName        = "public/logs/certified.log"
+	unsignedCertPath        = filepath.Join("generic-worker", "chain-of-trust.json")
+	unsignedCertName        = cot.DocumentName
+	ed25519SignedCertPath   = filepath.Join("generic-worker", "chain-of-trust.json.sig")
+	ed25519SignedCertName   = cot.SignatureName
+	unsignedCertV2Path      = filepath.Join("generic-worker", "chain-of-trust-v2.json")
+	unsignedCertV2Name      = cot.DocumentNameV2
+	ed25519SignedCertV2Path = filepath.Join("generic-worker", "chain-of-trust-v2.json.sig")
+	ed25519SignedCertV2Name = cot.SignatureNameV2
 )
 
 type ChainOfTrustFeature struct {
-	Ed25519PrivateKey ed25519.PrivateKey
+	// signingKeys are the configured chain of trust signing keys
+	signingKeys []*signingKey
+	// executableSHA256 is the SHA256 of the running generic-worker binary
+	executableSHA256 string
 }
 
-type ArtifactHash struct {
-	SHA256 string `json:"sha256"`
-}
-
-type CoTEnvironment struct {
-	PublicIPAddress  string `json:"publicIpAddress,omitempty"`
-	PrivateIPAddress string `json:"privateIpAddress"`
-	InstanceID       string `json:"instanceId"`
-	InstanceType     string `json:"instanceType"`
-	Region           string `json:"region"`
-}
-
-type ChainOfTrustData struct {
-	Version     int                            `json:"chainOfTrustVersion"`
-	Artifacts   map[string]ArtifactHash        `json:"artifacts"`
-	Task        tcqueue.TaskDefinitionResponse `json:"task"`
-	TaskID      string                         `json:"taskId"`
-	RunID       uint                           `json:"runId"`
-	WorkerGroup string                         `json:"workerGroup"`
-	WorkerID    string                         `json:"workerId"`
-	Environment CoTEnvironment                 `json:"environment"`
+type ChainOfTrustTaskFeature struct {
+	task             *TaskRun
+	signingKeys      []*signingKey
+	signingKey       *signingKey
+	executableSHA256 string
 }
 
-type ChainOfTrustTaskFeature struct {
-	task           *TaskRun
-	ed25519PrivKey ed25519.PrivateKey
+// signingKey is a chain of trust signing key, together with its validity
+// window
+type signingKey struct {
+	gwconfig.Ed25519SigningKey
+	privateKey ed25519.PrivateKey
 }
 
 func (feature *ChainOfTrustFeature) Name() string {
@@ -73,34 +69,90 @@ func (feature *ChainOfTrustFeature) PersistState() error {
 }
 
 func (feature *ChainOfTrustFeature) Initialise() (err error) {
-	feature.Ed25519PrivateKey, err = readEd25519PrivateKeyFromFile(config.Ed25519SigningKeyLocation)
+	keys := config.Ed25519SigningKeys
+	if config.Ed25519SigningKeyLocation != "" {
+		// a key without a validity window, which is therefore superseded by
+		// any configured key that has a notBefore in the past
+		keys = append([]gwconfig.Ed25519SigningKey{{Location: config.Ed25519SigningKeyLocation}}, keys...)
+	}
+	feature.signingKeys = make([]*signingKey, len(keys))
+	for i, key := range keys {
+		feature.signingKeys[i] = &signingKey{
+			Ed25519SigningKey: key,
+		}
+		feature.signingKeys[i].privateKey, err = readEd25519PrivateKeyFromFile(key.Location)
+		if err != nil {
+			return
+		}
+		// platform-specific mechanism to lock down file permissions
+		// of private signing key
+		err = fileutil.SecureFiles(key.Location)
+		if err != nil {
+			return
+		}
+		log.Printf("Loaded chain of trust signing key %v from %v", feature.signingKeys[i].publicKey().KeyID, key.Location)
+	}
+	if activeSigningKey(feature.signingKeys, time.Now()) == nil {
+		return fmt.Errorf("None of the %v configured chain of trust signing keys are valid at the current time", len(feature.signingKeys))
+	}
+
+	executable, err := os.Executable()
 	if err != nil {
 		return
 	}
+	feature.executableSHA256, err = fileutil.CalculateSHA256(executable)
+	return
+}
 
-	// platform-specific mechanism to lock down file permissions
-	// of private signing key
-	err = fileutil.SecureFiles(config.Ed25519SigningKeyLocation)
+// activeSigningKey returns the signing key to sign with at time t, which is
+// the key with the latest notBefore out of the keys that are valid at time t.
+// If more than one key qualifies, the one listed first is returned. If no key
+// is valid at time t, nil is returned.
+func activeSigningKey(keys []*signingKey, t time.Time) (active *signingKey) {
+	for _, key := range keys {
+		if key.NotBefore != nil && t.Before(*key.NotBefore) {
+			continue
+		}
+		if key.NotAfter != nil && !t.Before(*key.NotAfter) {
+			continue
+		}
+		if active == nil || key.NotBefore != nil && (active.NotBefore == nil || key.NotBefore.After(*active.NotBefore)) {
+			active = key
+		}
+	}
 	return
 }
 
+// publicKey returns the key ID and public key of the signing key, for
+// publishing in chain of trust artifacts
+func (key *signingKey) publicKey() *cot.PublicKey {
+	return cot.NewPublicKey(key.KeyID, key.privateKey.Public().(ed25519.PublicKey))
+}
+
 func (feature *ChainOfTrustFeature) IsEnabled(task *TaskRun) bool {
-	return task.Payload.Features.ChainOfTrust
+	return task.Payload.Features.ChainOfTrust || task.Payload.Features.ChainOfTrustProvenance
 }
 
 func (feature *ChainOfTrustFeature) NewTaskFeature(task *TaskRun) TaskFeature {
 	return &ChainOfTrustTaskFeature{
-		task:           task,
-		ed25519PrivKey: feature.Ed25519PrivateKey,
+		task:             task,
+		signingKeys:      feature.signingKeys,
+		executableSHA256: feature.executableSHA256,
 	}
 }
 
 func (feature *ChainOfTrustTaskFeature) ReservedArtifacts() []string {
-	return []string{
+	artifacts := []string{
 		unsignedCertName,
 		ed25519SignedCertName,
+		unsignedCertV2Name,
+		ed25519SignedCertV2Name,
 		certifiedLogName,
 	}
+	if feature.task.Payload.Features.ChainOfTrustProvenance {
+		artifacts = append(artifacts, provenanceName)
+	}
+	return artifacts
 }
 
 func (feature *ChainOfTrustTaskFeature) RequiredScopes() scopes.Required {
@@ -118,20 +170,28 @@ func (feature *ChainOfTrustTaskFeature) Start() *CommandExecutionError {
 	if err != nil {
 		return MalformedPayloadError(err)
 	}
+	// The signing key is chosen when the task starts, so that all chain of
+	// trust artifacts of the task are signed with the same key
+	feature.signingKey = activeSigningKey(feature.signingKeys, time.Now())
+	if feature.signingKey == nil {
+		return executionError(internalError, errored, errors.New("None of the configured chain of trust signing keys are valid at the current time"))
+	}
 	return nil
 }
 
 func (feature *ChainOfTrustTaskFeature) Stop(err *ExecutionErrors) {
+	if feature.signingKey == nil {
+		// Start failed, so there is nothing that can be signed
+		return
+	}
 	logFile := filepath.Join(taskContext.TaskDir, logPath)
 	certifiedLogFile := filepath.Join(taskContext.TaskDir, certifiedLogPath)
-	unsignedCert := filepath.Join(taskContext.TaskDir, unsignedCertPath)
-	ed25519SignedCert := filepath.Join(taskContext.TaskDir, ed25519SignedCertPath)
 	copyErr := copyFileContents(logFile, certifiedLogFile)
 	if copyErr != nil {
 		panic(copyErr)
 	}
 	err.add(feature.task.uploadLog(certifiedLogName, certifiedLogPath))
-	artifactHashes := map[string]ArtifactHash{}
+	artifactHashes := map[string]cot.ArtifactHash{}
 	for _, artifact := range feature.task.Artifacts {
 		switch a := artifact.(type) {
 		case *S3Artifact:
@@ -141,71 +201,129 @@ func (feature *ChainOfTrustTaskFeature) Stop(err *ExecutionErrors) {
 			if hashErr != nil {
 				panic(hashErr)
 			}
-			artifactHashes[a.Name] = ArtifactHash{
+			artifactHashes[a.Name] = cot.ArtifactHash{
 				SHA256: hash,
 			}
 		}
 	}
 
-	cotCert := &ChainOfTrustData{
-		Version:     1,
+	cotCert := &cot.ChainOfTrustData{
+		Version:     cot.Version,
 		Artifacts:   artifactHashes,
 		Task:        feature.task.Definition,
 		TaskID:      feature.task.TaskID,
 		RunID:       feature.task.RunID,
 		WorkerGroup: config.WorkerGroup,
 		WorkerID:    config.WorkerID,
-		Environment: CoTEnvironment{
-			PrivateIPAddress: config.PrivateIP.String(),
-			InstanceID:       config.InstanceID,
-			InstanceType:     config.InstanceType,
-			Region:           config.Region,
-		},
+		Environment: feature.environment(),
+		Mounts:      feature.mounts(),
+		SigningKey:  feature.signingKey.publicKey(),
 	}
 
-	if config.PublicIP != nil {
-		cotCert.Environment.PublicIPAddress = config.PublicIP.String()
+	// version 2 is published alongside an unchanged version 1 document, so
+	// that existing consumers of version 1 are not affected
+	feature.uploadSigned(err, cotCert.V1(), unsignedCertName, unsignedCertPath, ed25519SignedCertName, ed25519SignedCertPath)
+	feature.uploadSigned(err, cotCert, unsignedCertV2Name, unsignedCertV2Path, ed25519SignedCertV2Name, ed25519SignedCertV2Path)
+
+	if feature.task.Payload.Features.ChainOfTrustProvenance {
+		err.add(feature.uploadProvenance(artifactHashes))
 	}
+}
 
-	certBytes, e := json.MarshalIndent(cotCert, "", "  ")
+// uploadSigned uploads the given chain of trust document, and its detached
+// ed25519 signature
+func (feature *ChainOfTrustTaskFeature) uploadSigned(err *ExecutionErrors, document interface{}, certName, certPath, sigName, sigPath string) {
+	certBytes, e := json.MarshalIndent(document, "", "  ")
 	if e != nil {
 		panic(e)
 	}
-	// create unsigned chain-of-trust.json
-	e = ioutil.WriteFile(unsignedCert, certBytes, 0644)
+	// create unsigned chain of trust document
+	e = ioutil.WriteFile(filepath.Join(taskContext.TaskDir, certPath), certBytes, 0644)
 	if e != nil {
 		panic(e)
 	}
-	err.add(feature.task.uploadLog(unsignedCertName, unsignedCertPath))
+	err.add(feature.task.uploadLog(certName, certPath))
 
-	// create detached ed25519 chain-of-trust.json.sig
-	sig := ed25519.Sign(feature.ed25519PrivKey, certBytes)
-	e = ioutil.WriteFile(ed25519SignedCert, sig, 0644)
+	// create detached ed25519 signature
+	sig := ed25519.Sign(feature.signingKey.privateKey, certBytes)
+	e = ioutil.WriteFile(filepath.Join(taskContext.TaskDir, sigPath), sig, 0644)
 	if e != nil {
 		panic(e)
 	}
 	err.add(feature.task.uploadArtifact(
 		&S3Artifact{
 			BaseArtifact: &BaseArtifact{
-				Name:    ed25519SignedCertName,
+				Name:    sigName,
 				Expires: feature.task.Definition.Expires,
 			},
 			ContentType:     "application/octet-stream",
 			ContentEncoding: "gzip",
-			Path:            ed25519SignedCertPath,
+			Path:            sigPath,
 		},
 	))
 }
 
-func (cot *ChainOfTrustTaskFeature) ensureTaskUserCantReadPrivateCotKey() error {
-	c, err := cot.catCotKeyCommand()
-	if err != nil {
-		panic(fmt.Errorf("SERIOUS BUG: Could not create command (not even trying to execute it yet) to cat private chain of trust key %v - %v", config.Ed25519SigningKeyLocation, err))
+// environment returns the details of the worker and the environment it is
+// running in, for inclusion in chain of trust artifacts
+func (feature *ChainOfTrustTaskFeature) environment() cot.Environment {
+	env := cot.Environment{
+		PrivateIPAddress:      config.PrivateIP.String(),
+		InstanceID:            config.InstanceID,
+		InstanceType:          config.InstanceType,
+		Region:                config.Region,
+		GenericWorkerVersion:  version,
+		GenericWorkerRevision: revision,
+		GenericWorkerEngine:   engine,
+		GenericWorkerSHA256:   feature.executableSHA256,
+		DeploymentID:          config.DeploymentID,
+	}
+	if config.PublicIP != nil {
+		env.PublicIPAddress = config.PublicIP.String()
 	}
-	r := c.Execute()
-	if !r.Failed() {
-		log.Print(r.String())
-		return errors.New(ChainOfTrustKeyNotSecureMessage)
+	return env
+}
+
+// mounts returns the mounts of the task, including the resolved source and
+// SHA256 of their content, as recorded when they were mounted
+func (feature *ChainOfTrustTaskFeature) mounts() []cot.Mount {
+	mounts := []cot.Mount{}
+	for _, summary := range feature.task.mountSummaries {
+		mount := cot.Mount{
+			Type:      summary.Type,
+			Path:      summary.Path,
+			CacheName: summary.CacheName,
+		}
+		if summary.Type == "writableDirectoryCache" {
+			mount.CacheHit = summary.CacheHit
+		}
+		if summary.content != nil {
+			mount.Content = &cot.MountContent{
+				SHA256: summary.SHA256,
+			}
+			switch c := summary.content.(type) {
+			case *ArtifactContent:
+				mount.Content.TaskID = c.TaskID
+				mount.Content.Artifact = c.Artifact
+			case *URLContent:
+				mount.Content.URL = c.URL
+			}
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
+func (cot *ChainOfTrustTaskFeature) ensureTaskUserCantReadPrivateCotKey() error {
+	for _, key := range cot.signingKeys {
+		c, err := cot.catCotKeyCommand(key.Location)
+		if err != nil {
+			panic(fmt.Errorf("SERIOUS BUG: Could not create command (not even trying to execute it yet) to cat private chain of trust key %v - %v", key.Location, err))
+		}
+		r := c.Execute()
+		if !r.Failed() {
+			log.Print(r.String())
+			return errors.New(ChainOfTrustKeyNotSecureMessage)
+		}
 	}
 	return nil
 }
@@ -6,6 +6,6 @@ import (
 	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/process"
 )
 
-func (cot *ChainOfTrustTaskFeature) catCotKeyCommand() (*process.Command, error) {
-	return process.NewCommand([]string{"/bin/cat", config.Ed25519SigningKeyLocation}, cwd, cot.task.EnvVars(), taskContext.pd)
+func (cot *ChainOfTrustTaskFeature) catCotKeyCommand(keyLocation string) (*process.Command, error) {
+	return process.NewCommand([]string{"/bin/cat", keyLocation}, cwd, cot.task.EnvVars(), taskContext.pd)
 }
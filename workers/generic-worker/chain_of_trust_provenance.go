@@ -0,0 +1,278 @@
+// +build multiuser
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tcurls "github.com/taskcluster/taskcluster-lib-urls"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/cot"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	inTotoStatementType         = "https://in-toto.io/Statement/v0.1"
+	slsaProvenancePredicateType = "https://slsa.dev/provenance/v0.2"
+	// dssePayloadType is the DSSE payload type of an in-toto Statement
+	dssePayloadType = "application/vnd.in-toto+json"
+)
+
+var (
+	provenancePath = filepath.Join("generic-worker", "chain-of-trust.intoto.jsonl")
+	provenanceName = "public/chain-of-trust.intoto.jsonl"
+)
+
+type (
+	// DigestSet maps a hash algorithm name to the hex encoded digest
+	DigestSet map[string]string
+
+	// InTotoStatement is an in-toto Statement carrying a SLSA provenance
+	// predicate. See https://github.com/in-toto/attestation/tree/v0.1.0/spec
+	InTotoStatement struct {
+		Type          string          `json:"_type"`
+		Subject       []InTotoSubject `json:"subject"`
+		PredicateType string          `json:"predicateType"`
+		Predicate     SLSAProvenance  `json:"predicate"`
+	}
+
+	InTotoSubject struct {
+		Name   string    `json:"name"`
+		Digest DigestSet `json:"digest"`
+	}
+
+	// SLSAProvenance is a SLSA provenance predicate. See
+	// https://slsa.dev/provenance/v0.2
+	SLSAProvenance struct {
+		Builder    SLSABuilder    `json:"builder"`
+		BuildType  string         `json:"buildType"`
+		Invocation SLSAInvocation `json:"invocation"`
+		Metadata   SLSAMetadata   `json:"metadata"`
+		Materials  []SLSAMaterial `json:"materials"`
+	}
+
+	SLSABuilder struct {
+		ID string `json:"id"`
+	}
+
+	SLSAInvocation struct {
+		ConfigSource SLSAConfigSource `json:"configSource"`
+		// Parameters is the task payload
+		Parameters  json.RawMessage `json:"parameters"`
+		Environment SLSAEnvironment `json:"environment"`
+	}
+
+	SLSAConfigSource struct {
+		URI    string    `json:"uri"`
+		Digest DigestSet `json:"digest"`
+	}
+
+	SLSAEnvironment struct {
+		TaskID      string `json:"taskId"`
+		RunID       uint   `json:"runId"`
+		WorkerGroup string `json:"workerGroup"`
+		WorkerID    string `json:"workerId"`
+		cot.Environment
+	}
+
+	SLSAMetadata struct {
+		BuildInvocationID string           `json:"buildInvocationId"`
+		BuildStartedOn    time.Time        `json:"buildStartedOn"`
+		BuildFinishedOn   time.Time        `json:"buildFinishedOn"`
+		Completeness      SLSACompleteness `json:"completeness"`
+		Reproducible      bool             `json:"reproducible"`
+	}
+
+	SLSACompleteness struct {
+		Parameters  bool `json:"parameters"`
+		Environment bool `json:"environment"`
+		Materials   bool `json:"materials"`
+	}
+
+	SLSAMaterial struct {
+		URI    string    `json:"uri"`
+		Digest DigestSet `json:"digest"`
+	}
+
+	// DSSEEnvelope is a signed DSSE envelope. See
+	// https://github.com/secure-systems-lab/dsse/blob/v1.0.0/envelope.md
+	DSSEEnvelope struct {
+		PayloadType string          `json:"payloadType"`
+		Payload     string          `json:"payload"`
+		Signatures  []DSSESignature `json:"signatures"`
+	}
+
+	DSSESignature struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}
+)
+
+// provenance returns an in-toto Statement with a SLSA provenance predicate
+// for the task run. Its subjects are the given artifact hashes, and its
+// materials are the task definition and the resolved content of the task
+// mounts.
+func (feature *ChainOfTrustTaskFeature) provenance(artifactHashes map[string]cot.ArtifactHash) *InTotoStatement {
+	task := feature.task
+	taskDefinition, err := json.Marshal(task.Definition)
+	if err != nil {
+		panic(err)
+	}
+	statement := &InTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []InTotoSubject{},
+		PredicateType: slsaProvenancePredicateType,
+		Predicate: SLSAProvenance{
+			Builder: SLSABuilder{
+				ID: tcurls.UI(config.RootURL, "worker-manager/"+url.PathEscape(config.ProvisionerID+"/"+config.WorkerType)),
+			},
+			BuildType: payloadSchemaURL(),
+			Invocation: SLSAInvocation{
+				ConfigSource: SLSAConfigSource{
+					URI: tcurls.API(config.RootURL, "queue", "v1", "task/"+task.TaskID),
+					// digest of the task definition as returned by the queue,
+					// serialised as compact json by encoding/json (the copy in
+					// public/chain-of-trust.json is indented, so its bytes
+					// hash differently)
+					Digest: sha256DigestSet(taskDefinition),
+				},
+				Parameters: task.Definition.Payload,
+				Environment: SLSAEnvironment{
+					TaskID:      task.TaskID,
+					RunID:       task.RunID,
+					WorkerGroup: config.WorkerGroup,
+					WorkerID:    config.WorkerID,
+					Environment: feature.environment(),
+				},
+			},
+			Metadata: SLSAMetadata{
+				BuildInvocationID: task.TaskID + "/" + strconv.Itoa(int(task.RunID)),
+				BuildStartedOn:    task.LocalClaimTime.UTC(),
+				BuildFinishedOn:   time.Now().UTC(),
+				Completeness: SLSACompleteness{
+					// task commands may access anything, so only the
+					// parameters are known to be complete
+					Parameters: true,
+				},
+			},
+			Materials: []SLSAMaterial{},
+		},
+	}
+	names := make([]string, 0, len(artifactHashes))
+	for name := range artifactHashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		statement.Subject = append(statement.Subject, InTotoSubject{
+			Name: name,
+			Digest: DigestSet{
+				"sha256": artifactHashes[name].SHA256,
+			},
+		})
+	}
+	seen := map[string]bool{}
+	for _, mount := range task.mountSummaries {
+		var uri string
+		switch c := mount.content.(type) {
+		case *ArtifactContent:
+			uri = tcurls.API(config.RootURL, "queue", "v1", "task/"+c.TaskID+"/artifacts/"+c.Artifact)
+		case *URLContent:
+			uri = c.URL
+		default:
+			// raw and base64 content is included in the task definition
+			continue
+		}
+		if mount.SHA256 == "" || seen[uri+"@"+mount.SHA256] {
+			continue
+		}
+		seen[uri+"@"+mount.SHA256] = true
+		statement.Predicate.Materials = append(statement.Predicate.Materials, SLSAMaterial{
+			URI: uri,
+			Digest: DigestSet{
+				"sha256": mount.SHA256,
+			},
+		})
+	}
+	return statement
+}
+
+// payloadSchemaURL returns the URL of the task payload schema of this
+// worker, which is used as the SLSA build type
+func payloadSchemaURL() string {
+	var schema struct {
+		ID string `json:"$id"`
+	}
+	err := json.Unmarshal([]byte(taskPayloadSchema()), &schema)
+	if err != nil {
+		panic(err)
+	}
+	return tcurls.Schema(config.RootURL, "generic-worker", strings.TrimPrefix(schema.ID, "/schemas/generic-worker/"))
+}
+
+func sha256DigestSet(data []byte) DigestSet {
+	hash := sha256.Sum256(data)
+	return DigestSet{
+		"sha256": hex.EncodeToString(hash[:]),
+	}
+}
+
+// dssePAE returns the DSSE pre-authentication encoding of the given payload,
+// which is the message that gets signed
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// signDSSE returns a DSSE envelope containing the given payload, signed with
+// the given signing key
+func signDSSE(payloadType string, payload []byte, key *signingKey) *DSSEEnvelope {
+	return &DSSEEnvelope{
+		PayloadType: payloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []DSSESignature{
+			{
+				KeyID: key.publicKey().KeyID,
+				Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(key.privateKey, dssePAE(payloadType, payload))),
+			},
+		},
+	}
+}
+
+// uploadProvenance writes the signed provenance of the task run to a file in
+// the task directory, as a single line of json, and publishes it as an
+// artifact.
+func (feature *ChainOfTrustTaskFeature) uploadProvenance(artifactHashes map[string]cot.ArtifactHash) *CommandExecutionError {
+	statement, err := json.Marshal(feature.provenance(artifactHashes))
+	if err != nil {
+		panic(err)
+	}
+	envelope, err := json.Marshal(signDSSE(dssePayloadType, statement, feature.signingKey))
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(taskContext.TaskDir, provenancePath), append(envelope, '\n'), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return feature.task.uploadArtifact(
+		&S3Artifact{
+			BaseArtifact: &BaseArtifact{
+				Name:    provenanceName,
+				Expires: feature.task.Definition.Expires,
+			},
+			ContentType:     "application/json",
+			ContentEncoding: "gzip",
+			Path:            provenancePath,
+		},
+	)
+}
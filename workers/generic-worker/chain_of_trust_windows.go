@@ -4,6 +4,6 @@ import (
 	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/process"
 )
 
-func (cot *ChainOfTrustTaskFeature) catCotKeyCommand() (*process.Command, error) {
-	return process.NewCommand([]string{"cmd.exe", "/c", "type", config.Ed25519SigningKeyLocation}, cwd, nil, taskContext.pd)
+func (cot *ChainOfTrustTaskFeature) catCotKeyCommand(keyLocation string) (*process.Command, error) {
+	return process.NewCommand([]string{"cmd.exe", "/c", "type", keyLocation}, cwd, nil, taskContext.pd)
 }
@@ -0,0 +1,121 @@
+// +build !docker
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Env vars of a command should be applied on top of the task env vars
+func TestCommandEnv(t *testing.T) {
+	defer setup(t)()
+	commands := goRun(
+		"check-env.go",
+		"TASK_VAR",
+		"overridden",
+		"COMMAND_VAR",
+		"command value",
+		"OTHER_TASK_VAR",
+		"task value",
+	)
+	commands[len(commands)-1] = withOptions(
+		commands[len(commands)-1],
+		CommandWithOptions{
+			Env: map[string]string{
+				"TASK_VAR":    "overridden",
+				"COMMAND_VAR": "command value",
+			},
+		},
+	)
+	// the overrides do not apply to subsequent commands
+	commands = append(commands, goRun(
+		"check-env.go",
+		"TASK_VAR",
+		"task value",
+		"COMMAND_VAR",
+		"",
+	)...)
+	payload := GenericWorkerPayload{
+		Env: map[string]string{
+			"TASK_VAR":       "task value",
+			"OTHER_TASK_VAR": "task value",
+		},
+		Command:    commands,
+		MaxRunTime: 180,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+}
+
+// A command with a relative cwd should run in that directory, relative to the
+// task directory
+func TestCommandCwd(t *testing.T) {
+	defer setup(t)()
+	commands := goRun("check-env.go")
+	goRunCommand := commands[len(commands)-1]
+	// Replace the commands that copy check-env.go into the task directory,
+	// so that the go run command only succeeds if it runs in subdir.
+	commands = append(
+		commands[:len(commands)-3],
+		copyTestdataFileTo("check-env.go", "subdir/check-env.go")...,
+	)
+	commands = append(commands, withOptions(goRunCommand, CommandWithOptions{Cwd: "subdir"}))
+	// subsequent commands run in the task directory again
+	commands = append(commands, json.RawMessage(bytes.Replace(goRunCommand, []byte("check-env.go"), []byte("subdir/check-env.go"), 1)))
+	payload := GenericWorkerPayload{
+		Command:    commands,
+		MaxRunTime: 180,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+}
+
+// A command that exceeds its own maxRunTime should be aborted and fail the
+// task, even though the task maxRunTime has not been exceeded
+func TestCommandMaxRunTimeExceeded(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: append(
+			[]json.RawMessage{withOptions(sleep(20)[0], CommandWithOptions{MaxRunTime: 2})},
+			helloGoodbye()...,
+		),
+		MaxRunTime: 60,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "max run time of command (2 seconds) exceeded") {
+		t.Fatalf("Was expecting log file to mention command max run time exceeded, but it doesn't:\n%v", logtext)
+	}
+	if strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was not expecting commands after aborted command to run, but they did:\n%v", logtext)
+	}
+}
+
+// A command that exceeds its own maxRunTime with continueOnError set should
+// not fail the task
+func TestCommandMaxRunTimeExceededContinueOnError(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: append(
+			[]json.RawMessage{withOptions(sleep(20)[0], CommandWithOptions{MaxRunTime: 2, ContinueOnError: true})},
+			helloGoodbye()...,
+		),
+		MaxRunTime: 60,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting commands after aborted command to run, but they didn't:\n%v", logtext)
+	}
+}
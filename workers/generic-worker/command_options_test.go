@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// A failing command with continueOnError set should not fail the task, and
+// subsequent commands should still run
+func TestCommandContinueOnError(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: append(
+			[]json.RawMessage{withOptions(returnExitCode(1)[0], CommandWithOptions{ContinueOnError: true})},
+			helloGoodbye()...,
+		),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "continuing since continueOnError is set") {
+		t.Fatalf("Was expecting log file to mention continueOnError, but it doesn't:\n%v", logtext)
+	}
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting commands after failed command to run, but they didn't:\n%v", logtext)
+	}
+}
+
+// A failing command without continueOnError should fail the task, and
+// subsequent commands should not run
+func TestCommandWithOptionsFailure(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: append(
+			[]json.RawMessage{withOptions(returnExitCode(1)[0], CommandWithOptions{})},
+			helloGoodbye()...,
+		),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+
+	logtext := LogText(t)
+	if strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was not expecting commands after failed command to run, but they did:\n%v", logtext)
+	}
+}
+
+// Exit codes specified in OnExitStatus should resolve as intermittent, even
+// if continueOnError is set
+func TestCommandContinueOnErrorIntermittent(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: append(
+			[]json.RawMessage{withOptions(returnExitCode(123)[0], CommandWithOptions{ContinueOnError: true})},
+			helloGoodbye()...,
+		),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Retry: []int64{123},
+		},
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "exception", "intermittent-task")
+}
+
+// Unknown properties of a command object should be rejected
+func TestCommandWithOptionsInvalid(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    toCommandArray([]map[string]interface{}{{"command": helloGoodbye()[0], "shell": "bash"}}),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "exception", "malformed-payload")
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -127,3 +129,147 @@ func TestBoolAsString(t *testing.T) {
 		t.Fatalf("Was expecting error text to include %q but it didn't: %v", expectedErrorText, err)
 	}
 }
+
+func TestValidateConfigValid(t *testing.T) {
+	exitCode := validateConfig(filepath.Join("testdata", "config", "valid.json"))
+	if exitCode != TASKS_COMPLETE {
+		t.Fatalf("Was expecting exit code %v but got %v", TASKS_COMPLETE, exitCode)
+	}
+}
+
+func TestValidateConfigUnknownKey(t *testing.T) {
+	file := &gwconfig.File{
+		Path: filepath.Join("testdata", "config", "unknown-key.json"),
+	}
+	err := file.Validate()
+	invalid, isInvalid := err.(*gwconfig.InvalidConfigFileError)
+	if !isInvalid {
+		t.Fatalf("Was expecting an error of type *gwconfig.InvalidConfigFileError but received error %#v", err)
+	}
+	// both problems should be reported, not just the first one
+	if len(invalid.Errors) != 2 {
+		t.Fatalf("Was expecting 2 errors, but got %v: %v", len(invalid.Errors), err)
+	}
+	for _, expectedErrorText := range []string{
+		"Additional property idleTimeoutSec is not allowed",
+		"taskclusterProxyPort: Must be less than or equal to 65535",
+	} {
+		if !strings.Contains(err.Error(), expectedErrorText) {
+			t.Fatalf("Was expecting error text to include %q but it didn't: %v", expectedErrorText, err)
+		}
+	}
+	if exitCode := validateConfig(file.Path); exitCode != INVALID_CONFIG {
+		t.Fatalf("Was expecting exit code %v but got %v", INVALID_CONFIG, exitCode)
+	}
+}
+
+func TestValidateConfigWrongType(t *testing.T) {
+	file := &gwconfig.File{
+		Path: filepath.Join("testdata", "config", "bool-as-string.json"),
+	}
+	err := file.Validate()
+	if err == nil {
+		t.Fatal("Was expecting to get an error back due to a bool being specified as a string, but didn't get one!")
+	}
+	expectedErrorText := `shutdownMachineOnIdle: Invalid type. Expected: boolean, given: string`
+	if !strings.Contains(err.Error(), expectedErrorText) {
+		t.Fatalf("Was expecting error text to include %q but it didn't: %v", expectedErrorText, err)
+	}
+}
+
+func TestValidateConfigInconsistent(t *testing.T) {
+	file := &gwconfig.File{
+		Path: filepath.Join("testdata", "config", "wst-audience-only.json"),
+	}
+	err := file.Validate()
+	if err != nil {
+		t.Fatalf("Config file should conform to config schema, but got: %v", err)
+	}
+	err = loadConfig(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// the worker still runs with this config, for existing deployments
+	err = config.Validate()
+	if err != nil {
+		t.Fatalf("Config should be valid, but got: %v", err)
+	}
+	err = config.CheckConsistency()
+	if _, isInconsistent := err.(gwconfig.InconsistentConfigError); !isInconsistent {
+		t.Fatalf("Was expecting an error of type gwconfig.InconsistentConfigError but received error %#v", err)
+	}
+	if exitCode := validateConfig(file.Path); exitCode != INVALID_CONFIG {
+		t.Fatalf("Was expecting exit code %v but got %v", INVALID_CONFIG, exitCode)
+	}
+}
+
+func TestValidateConfigSigningKeys(t *testing.T) {
+	file := &gwconfig.File{
+		Path: filepath.Join("testdata", "config", "signing-keys.json"),
+	}
+	err := file.Validate()
+	if err != nil {
+		t.Fatalf("Config file should conform to config schema, but got: %v", err)
+	}
+	err = loadConfig(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// both keys have keyId 2021-q1
+	err = config.Validate()
+	if _, isInconsistent := err.(gwconfig.InconsistentConfigError); !isInconsistent {
+		t.Fatalf("Was expecting an error of type gwconfig.InconsistentConfigError but received error %#v", err)
+	}
+	config.Ed25519SigningKeys[1].KeyID = "2021-q2"
+	err = config.Validate()
+	if err != nil {
+		t.Fatalf("Config should be valid, but got: %v", err)
+	}
+	config.Ed25519SigningKeys[1].NotBefore = config.Ed25519SigningKeys[0].NotAfter
+	config.Ed25519SigningKeys[1].NotAfter = config.Ed25519SigningKeys[0].NotAfter
+	err = config.Validate()
+	if _, isInconsistent := err.(gwconfig.InconsistentConfigError); !isInconsistent {
+		t.Fatalf("Was expecting an error of type gwconfig.InconsistentConfigError but received error %#v", err)
+	}
+}
+
+// TestConfigSchemaDefaults checks that the defaults declared in the config
+// schema match the defaults applied by loadConfig.
+func TestConfigSchemaDefaults(t *testing.T) {
+	file := &gwconfig.File{
+		Path: filepath.Join("testdata", "config", "noip.json"),
+	}
+	err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var loaded map[string]interface{}
+	err = json.Unmarshal([]byte(config.String()), &loaded)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Default interface{} `json:"default"`
+		} `json:"properties"`
+	}
+	err = json.Unmarshal([]byte(gwconfig.Schema()), &schema)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, property := range schema.Properties {
+		// loadConfig adds generic-worker metadata to workerTypeMetadata,
+		// and noip.json specifies a workerGroup
+		if property.Default == nil || name == "workerTypeMetadata" || name == "workerGroup" {
+			continue
+		}
+		value, set := loaded[name]
+		if !set {
+			// properties with omitempty json tag are not included when empty
+			value = ""
+		}
+		if !reflect.DeepEqual(property.Default, value) {
+			t.Errorf("Config schema declares default %#v for property %v but loadConfig sets %#v", property.Default, name, value)
+		}
+	}
+}
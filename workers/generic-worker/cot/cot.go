@@ -0,0 +1,166 @@
+// Package cot contains the chain of trust data types published by
+// generic-worker, and a Verifier for checking chain of trust documents of
+// tasks. See
+// https://github.com/taskcluster/taskcluster/blob/main/dev-docs/chain-of-trust.md
+package cot
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcqueue"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// Version is the current chain of trust document version, published as
+	// DocumentNameV2
+	Version = 2
+	// VersionV1 is the version of the chain of trust document published as
+	// DocumentName, which is unchanged for the sake of existing consumers
+	VersionV1 = 1
+
+	// DocumentName is the artifact name of the version 1 chain of trust
+	// document
+	DocumentName = "public/chain-of-trust.json"
+	// SignatureName is the artifact name of the detached ed25519 signature
+	// of the version 1 chain of trust document
+	SignatureName = "public/chain-of-trust.json.sig"
+	// DocumentNameV2 is the artifact name of the version 2 chain of trust
+	// document
+	DocumentNameV2 = "public/chain-of-trust-v2.json"
+	// SignatureNameV2 is the artifact name of the detached ed25519 signature
+	// of the version 2 chain of trust document
+	SignatureNameV2 = "public/chain-of-trust-v2.json.sig"
+)
+
+// PublicKey identifies the ed25519 key that a chain of trust document was
+// signed with. Since chain of trust version 2.
+type PublicKey struct {
+	KeyID string `json:"keyId"`
+	// PublicKey is the base64 encoded ed25519 public key
+	PublicKey string `json:"publicKey"`
+}
+
+type ArtifactHash struct {
+	SHA256 string `json:"sha256"`
+}
+
+type Environment struct {
+	PublicIPAddress  string `json:"publicIpAddress,omitempty"`
+	PrivateIPAddress string `json:"privateIpAddress"`
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	Region           string `json:"region"`
+	// Since chain of trust version 2
+	GenericWorkerVersion  string `json:"genericWorkerVersion"`
+	GenericWorkerRevision string `json:"genericWorkerRevision,omitempty"`
+	GenericWorkerEngine   string `json:"genericWorkerEngine"`
+	GenericWorkerSHA256   string `json:"genericWorkerSha256"`
+	DeploymentID          string `json:"deploymentId"`
+}
+
+// Mount describes a mount of the task, and the content that it was populated
+// with. Since chain of trust version 2.
+type Mount struct {
+	// Type is one of fileMount, readOnlyDirectory or writableDirectoryCache
+	Type string `json:"type"`
+	// Path is the file or directory, relative to the task directory, that the
+	// content is mounted at
+	Path      string `json:"path"`
+	CacheName string `json:"cacheName,omitempty"`
+	// CacheHit is true if a writable directory cache was mounted with content
+	// from a previous task, in which case the cache content is not recorded
+	CacheHit bool          `json:"cacheHit,omitempty"`
+	Content  *MountContent `json:"content,omitempty"`
+}
+
+// MountContent describes the resolved source of the content of a mount. Raw
+// and base64 content have neither taskId, artifact nor url, since the content
+// is included in the task definition.
+type MountContent struct {
+	TaskID   string `json:"taskId,omitempty"`
+	Artifact string `json:"artifact,omitempty"`
+	URL      string `json:"url,omitempty"`
+	// SHA256 of the content file (which may be an archive)
+	SHA256 string `json:"sha256"`
+}
+
+// EnvironmentV1 is the environment of a version 1 chain of trust document
+type EnvironmentV1 struct {
+	PublicIPAddress  string `json:"publicIpAddress,omitempty"`
+	PrivateIPAddress string `json:"privateIpAddress"`
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	Region           string `json:"region"`
+}
+
+// ChainOfTrustDataV1 is a version 1 chain of trust document
+type ChainOfTrustDataV1 struct {
+	Version     int                            `json:"chainOfTrustVersion"`
+	Artifacts   map[string]ArtifactHash        `json:"artifacts"`
+	Task        tcqueue.TaskDefinitionResponse `json:"task"`
+	TaskID      string                         `json:"taskId"`
+	RunID       uint                           `json:"runId"`
+	WorkerGroup string                         `json:"workerGroup"`
+	WorkerID    string                         `json:"workerId"`
+	Environment EnvironmentV1                  `json:"environment"`
+}
+
+// ChainOfTrustData is a chain of trust document. Version 2 documents have
+// all of the properties of version 1 documents, and more.
+type ChainOfTrustData struct {
+	Version     int                            `json:"chainOfTrustVersion"`
+	Artifacts   map[string]ArtifactHash        `json:"artifacts"`
+	Task        tcqueue.TaskDefinitionResponse `json:"task"`
+	TaskID      string                         `json:"taskId"`
+	RunID       uint                           `json:"runId"`
+	WorkerGroup string                         `json:"workerGroup"`
+	WorkerID    string                         `json:"workerId"`
+	Environment Environment                    `json:"environment"`
+	// Since chain of trust version 2
+	Mounts     []Mount    `json:"mounts"`
+	SigningKey *PublicKey `json:"signingKey,omitempty"`
+}
+
+// V1 returns the version 1 chain of trust document with the same content as
+// data, without the properties added in version 2
+func (data *ChainOfTrustData) V1() *ChainOfTrustDataV1 {
+	return &ChainOfTrustDataV1{
+		Version:     VersionV1,
+		Artifacts:   data.Artifacts,
+		Task:        data.Task,
+		TaskID:      data.TaskID,
+		RunID:       data.RunID,
+		WorkerGroup: data.WorkerGroup,
+		WorkerID:    data.WorkerID,
+		Environment: EnvironmentV1{
+			PublicIPAddress:  data.Environment.PublicIPAddress,
+			PrivateIPAddress: data.Environment.PrivateIPAddress,
+			InstanceID:       data.Environment.InstanceID,
+			InstanceType:     data.Environment.InstanceType,
+			Region:           data.Environment.Region,
+		},
+	}
+}
+
+// KeyID returns the default key ID of the given ed25519 public key, which is
+// derived from the SHA256 of the key. It is used for signing keys that have
+// not been configured with an explicit key ID.
+func KeyID(publicKey ed25519.PublicKey) string {
+	hash := sha256.Sum256(publicKey)
+	return "ed25519-" + hex.EncodeToString(hash[:8])
+}
+
+// NewPublicKey returns the PublicKey for the given key ID and ed25519 public
+// key. If keyID is empty, the default key ID of the key is used (see KeyID).
+func NewPublicKey(keyID string, publicKey ed25519.PublicKey) *PublicKey {
+	if keyID == "" {
+		keyID = KeyID(publicKey)
+	}
+	return &PublicKey{
+		KeyID:     keyID,
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+	}
+}
@@ -0,0 +1,290 @@
+package cot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/taskcluster/httpbackoff/v3"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/tc"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Verifier verifies the chain of trust documents of tasks
+type Verifier struct {
+	Queue tc.Queue
+	// PublicKeys are the ed25519 public keys that chain of trust documents
+	// may be signed with. Documents that name the key they were signed with
+	// are only checked against that key, which must be one of PublicKeys.
+	PublicKeys []ed25519.PublicKey
+	// If VerifyArtifacts is true, the artifacts listed in chain of trust
+	// documents are downloaded, and their SHA256 compared against the
+	// document
+	VerifyArtifacts bool
+	// If Recursive is true, the upstream tasks whose artifacts were mounted
+	// by a task are also verified, and the SHA256 of the mounted artifacts
+	// are compared against the chain of trust documents of the upstream
+	// tasks
+	Recursive bool
+}
+
+// VerificationError is returned when the chain of trust document of a task
+// could not be verified
+type VerificationError struct {
+	TaskID string
+	Reason string
+}
+
+func (err *VerificationError) Error() string {
+	return "Chain of trust verification failed for task " + err.TaskID + ": " + err.Reason
+}
+
+// ParsePublicKey parses a base64 encoded ed25519 public key, as output by
+// `generic-worker new-ed25519-keypair`
+func ParsePublicKey(base64PublicKey string) (ed25519.PublicKey, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(base64PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ed25519 public key: %v", err)
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid ed25519 public key: expected %v bytes but got %v", ed25519.PublicKeySize, len(publicKey))
+	}
+	return publicKey, nil
+}
+
+// ParsePublicKeyFile parses the content of a public key file, as output by
+// `generic-worker new-ed25519-keypair`, which is either a base64 encoded
+// ed25519 public key, or (with --output-key-id) a json PublicKey
+func ParsePublicKeyFile(content []byte) (ed25519.PublicKey, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return ParsePublicKey(string(content))
+	}
+	var publicKey PublicKey
+	err := json.Unmarshal(content, &publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key json: %v", err)
+	}
+	return ParsePublicKey(publicKey.PublicKey)
+}
+
+// Verify checks the chain of trust document of the given task, and returns
+// it if it is valid. If v.Recursive is true, the chain of trust documents of
+// upstream tasks are also verified.
+func (v *Verifier) Verify(taskID string) (*ChainOfTrustData, error) {
+	return v.verify(taskID, map[string]*ChainOfTrustData{})
+}
+
+func (v *Verifier) verify(taskID string, verified map[string]*ChainOfTrustData) (*ChainOfTrustData, error) {
+	if data, done := verified[taskID]; done {
+		return data, nil
+	}
+	log.Printf("Verifying chain of trust of task %v", taskID)
+	failed := func(format string, a ...interface{}) (*ChainOfTrustData, error) {
+		return nil, &VerificationError{
+			TaskID: taskID,
+			Reason: fmt.Sprintf(format, a...),
+		}
+	}
+	// tasks run by workers that predate chain of trust version 2 only have
+	// a version 1 document
+	documentName, signatureName := DocumentNameV2, SignatureNameV2
+	document, err := v.download(taskID, documentName)
+	if _, notFound := err.(*artifactNotFoundError); notFound {
+		documentName, signatureName = DocumentName, SignatureName
+		document, err = v.download(taskID, documentName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signature, err := v.download(taskID, signatureName)
+	if err != nil {
+		return nil, err
+	}
+	// The document is interpreted before its signature is checked, only in
+	// order to select the public key to check the signature with
+	var data ChainOfTrustData
+	err = json.Unmarshal(document, &data)
+	if err != nil {
+		return failed("could not interpret %v as json: %v", documentName, err)
+	}
+	publicKeys := v.PublicKeys
+	if data.SigningKey != nil {
+		publicKey, err := ParsePublicKey(data.SigningKey.PublicKey)
+		if err != nil {
+			return failed("signing key %v in %v: %v", data.SigningKey.KeyID, documentName, err)
+		}
+		publicKeys = nil
+		for _, trusted := range v.PublicKeys {
+			if bytes.Equal(publicKey, trusted) {
+				publicKeys = []ed25519.PublicKey{trusted}
+				break
+			}
+		}
+		if publicKeys == nil {
+			return failed("%v was signed with key %v which is not one of the %v given public key(s)", documentName, data.SigningKey.KeyID, len(v.PublicKeys))
+		}
+	}
+	if !signatureValid(publicKeys, document, signature) {
+		return failed("signature %v is not valid for %v with any of the %v given public key(s)", signatureName, documentName, len(publicKeys))
+	}
+	if data.Version < 1 || data.Version > Version {
+		return failed("unsupported chain of trust version %v", data.Version)
+	}
+	if data.TaskID != taskID {
+		return failed("%v is for task %v", documentName, data.TaskID)
+	}
+
+	// the task definition in the document must match the one held by the queue
+	task, err := v.Queue.Task(taskID)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch task definition of task %v: %v", taskID, err)
+	}
+	equal, err := jsonEqual(task, data.Task)
+	if err != nil {
+		return nil, err
+	}
+	if !equal {
+		return failed("task definition in %v does not match task definition from queue", documentName)
+	}
+
+	if v.VerifyArtifacts {
+		for name, hash := range data.Artifacts {
+			actual, err := v.artifactSHA256(taskID, name)
+			if err != nil {
+				return nil, err
+			}
+			if actual != hash.SHA256 {
+				return failed("artifact %v has SHA256 %v but %v lists %v", name, actual, documentName, hash.SHA256)
+			}
+		}
+	}
+	verified[taskID] = &data
+
+	if v.Recursive {
+		for _, mount := range data.Mounts {
+			if mount.Content == nil || mount.Content.TaskID == "" {
+				continue
+			}
+			upstream, err := v.verify(mount.Content.TaskID, verified)
+			if err != nil {
+				return nil, err
+			}
+			hash, listed := upstream.Artifacts[mount.Content.Artifact]
+			if !listed {
+				return failed("mounted artifact %v of task %v is not listed in its chain of trust document", mount.Content.Artifact, mount.Content.TaskID)
+			}
+			if hash.SHA256 != mount.Content.SHA256 {
+				return failed("mounted artifact %v of task %v has SHA256 %v but the chain of trust document of task %v lists %v", mount.Content.Artifact, mount.Content.TaskID, mount.Content.SHA256, mount.Content.TaskID, hash.SHA256)
+			}
+		}
+	}
+	log.Printf("Chain of trust of task %v verified", taskID)
+	return &data, nil
+}
+
+func signatureValid(publicKeys []ed25519.PublicKey, document, signature []byte) bool {
+	for _, publicKey := range publicKeys {
+		if ed25519.Verify(publicKey, document, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// download returns the content of the given artifact of the latest run of
+// the given task
+func (v *Verifier) download(taskID, name string) ([]byte, error) {
+	var content []byte
+	err := v.fetch(taskID, name, func(body io.Reader) (err error) {
+		content, err = ioutil.ReadAll(body)
+		return
+	})
+	return content, err
+}
+
+// artifactSHA256 returns the SHA256 of the given artifact of the latest run
+// of the given task
+func (v *Verifier) artifactSHA256(taskID, name string) (string, error) {
+	hasher := sha256.New()
+	err := v.fetch(taskID, name, func(body io.Reader) error {
+		hasher.Reset()
+		_, err := io.Copy(hasher, body)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// artifactNotFoundError is returned when a task has no artifact with the
+// given name
+type artifactNotFoundError struct {
+	taskID string
+	name   string
+}
+
+func (err *artifactNotFoundError) Error() string {
+	return fmt.Sprintf("Task %v has no artifact %v", err.taskID, err.name)
+}
+
+func (v *Verifier) fetch(taskID, name string, read func(body io.Reader) error) error {
+	signedURL, err := v.Queue.GetLatestArtifact_SignedURL(taskID, name, time.Minute*30)
+	if err != nil {
+		return fmt.Errorf("Could not get URL of artifact %v of task %v: %v", name, taskID, err)
+	}
+	// Include the reading of the response body inside the retry function, so
+	// that connectivity loss while reading is also retried
+	_, _, err = httpbackoff.Retry(func() (resp *http.Response, tempError error, permError error) {
+		resp, err := http.Get(signedURL.String())
+		if err != nil {
+			return resp, err, nil
+		}
+		defer resp.Body.Close()
+		// non-2xx status codes are handled by httpbackoff
+		if resp.StatusCode/100 != 2 {
+			return resp, nil, nil
+		}
+		err = read(resp.Body)
+		if err != nil {
+			return resp, err, nil
+		}
+		return resp, nil, nil
+	})
+	if e, ok := err.(httpbackoff.BadHttpResponseCode); ok && e.HttpResponseCode == http.StatusNotFound {
+		return &artifactNotFoundError{taskID: taskID, name: name}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not download artifact %v of task %v: %v", name, taskID, err)
+	}
+	return nil
+}
+
+// jsonEqual returns true if a and b have the same json representation,
+// ignoring formatting and property order
+func jsonEqual(a, b interface{}) (bool, error) {
+	var values [2]interface{}
+	for i, x := range []interface{}{a, b} {
+		j, err := json.Marshal(x)
+		if err != nil {
+			return false, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(j))
+		decoder.UseNumber()
+		err = decoder.Decode(&values[i])
+		if err != nil {
+			return false, err
+		}
+	}
+	return reflect.DeepEqual(values[0], values[1]), nil
+}
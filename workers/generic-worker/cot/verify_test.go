@@ -0,0 +1,221 @@
+package cot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcqueue"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/tc"
+	"golang.org/x/crypto/ed25519"
+)
+
+// fakeQueue serves task definitions and artifacts of tasks from memory
+type fakeQueue struct {
+	tc.Queue
+	server    *httptest.Server
+	tasks     map[string]*tcqueue.TaskDefinitionResponse
+	artifacts map[string][]byte
+}
+
+// newFakeQueue returns a new fakeQueue, whose server should be closed by the
+// caller
+func newFakeQueue() *fakeQueue {
+	queue := &fakeQueue{
+		tasks:     map[string]*tcqueue.TaskDefinitionResponse{},
+		artifacts: map[string][]byte{},
+	}
+	queue.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, exists := queue.artifacts[strings.TrimPrefix(r.URL.Path, "/")]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	return queue
+}
+
+func (queue *fakeQueue) Task(taskID string) (*tcqueue.TaskDefinitionResponse, error) {
+	return queue.tasks[taskID], nil
+}
+
+func (queue *fakeQueue) GetLatestArtifact_SignedURL(taskID, name string, duration time.Duration) (*url.URL, error) {
+	return url.Parse(queue.server.URL + "/" + taskID + "/" + name)
+}
+
+// addTask adds a task with the given artifacts and mounts, and a chain of
+// trust document signed with the given key
+func (queue *fakeQueue) addTask(t *testing.T, taskID string, artifacts map[string]string, mounts []Mount, privateKey ed25519.PrivateKey) {
+	task := &tcqueue.TaskDefinitionResponse{
+		TaskGroupID: taskID,
+		Payload:     json.RawMessage(`{"command":[["true"]]}`),
+	}
+	queue.tasks[taskID] = task
+	data := &ChainOfTrustData{
+		Version:   Version,
+		Artifacts: map[string]ArtifactHash{},
+		Task:      *task,
+		TaskID:     taskID,
+		Mounts:     mounts,
+		SigningKey: NewPublicKey("", privateKey.Public().(ed25519.PublicKey)),
+	}
+	for name, content := range artifacts {
+		queue.artifacts[taskID+"/"+name] = []byte(content)
+		data.Artifacts[name] = ArtifactHash{
+			SHA256: sha256Hex(content),
+		}
+	}
+	// like generic-worker, publish both version 1 and version 2 documents
+	queue.publish(t, taskID, DocumentName, SignatureName, data.V1(), privateKey)
+	queue.publish(t, taskID, DocumentNameV2, SignatureNameV2, data, privateKey)
+}
+
+// publish adds the given chain of trust document of a task, and its signature
+func (queue *fakeQueue) publish(t *testing.T, taskID, documentName, signatureName string, data interface{}, privateKey ed25519.PrivateKey) {
+	document, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.artifacts[taskID+"/"+documentName] = document
+	queue.artifacts[taskID+"/"+signatureName] = ed25519.Sign(privateKey, document)
+}
+
+func sha256Hex(content string) string {
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newFakeQueue()
+	defer queue.server.Close()
+	queue.addTask(t, "upstream", map[string]string{"public/build/X.txt": "test artifact"}, nil, privateKey)
+	queue.addTask(t, "downstream", map[string]string{"public/build/Y.txt": "another test artifact"}, []Mount{
+		{
+			Type: "fileMount",
+			Path: "X.txt",
+			Content: &MountContent{
+				TaskID:   "upstream",
+				Artifact: "public/build/X.txt",
+				SHA256:   sha256Hex("test artifact"),
+			},
+		},
+	}, privateKey)
+
+	verifier := &Verifier{
+		Queue:           queue,
+		PublicKeys:      []ed25519.PublicKey{otherPublicKey, publicKey},
+		VerifyArtifacts: true,
+		Recursive:       true,
+	}
+	data, err := verifier.Verify("downstream")
+	if err != nil {
+		t.Fatalf("Chain of trust should have been verified, but got: %v", err)
+	}
+	if data.TaskID != "downstream" {
+		t.Fatalf("Expected taskId downstream but got %v", data.TaskID)
+	}
+
+	// tampered artifact
+	queue.artifacts["upstream/public/build/X.txt"] = []byte("tampered artifact")
+	_, err = verifier.Verify("downstream")
+	if err == nil || !strings.Contains(err.Error(), "artifact public/build/X.txt has SHA256 "+sha256Hex("tampered artifact")) {
+		t.Fatalf("Was expecting tampered upstream artifact to be detected, but got: %v", err)
+	}
+
+	// not recursive, so upstream task isn't checked
+	verifier.Recursive = false
+	_, err = verifier.Verify("downstream")
+	if err != nil {
+		t.Fatalf("Chain of trust should have been verified, but got: %v", err)
+	}
+
+	// tampered task definition
+	queue.tasks["downstream"].Payload = json.RawMessage(`{"command":[["false"]]}`)
+	_, err = verifier.Verify("downstream")
+	if err == nil || !strings.Contains(err.Error(), "task definition in public/chain-of-trust-v2.json does not match") {
+		t.Fatalf("Was expecting tampered task definition to be detected, but got: %v", err)
+	}
+
+	// wrong key
+	verifier.PublicKeys = []ed25519.PublicKey{otherPublicKey}
+	_, err = verifier.Verify("upstream")
+	if _, isVerificationError := err.(*VerificationError); !isVerificationError {
+		t.Fatalf("Was expecting an error of type *VerificationError but received error %#v", err)
+	}
+	if !strings.Contains(err.Error(), "was signed with key "+KeyID(publicKey)) {
+		t.Fatalf("Was expecting error to name the signing key, but got: %v", err)
+	}
+}
+
+// Tasks with only a version 1 document, published by older workers, can still
+// be verified
+func TestVerifyV1(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newFakeQueue()
+	defer queue.server.Close()
+	queue.addTask(t, "old", map[string]string{"public/build/X.txt": "test artifact"}, nil, privateKey)
+	delete(queue.artifacts, "old/"+DocumentNameV2)
+	delete(queue.artifacts, "old/"+SignatureNameV2)
+
+	verifier := &Verifier{
+		Queue:           queue,
+		PublicKeys:      []ed25519.PublicKey{publicKey},
+		VerifyArtifacts: true,
+		Recursive:       true,
+	}
+	data, err := verifier.Verify("old")
+	if err != nil {
+		t.Fatalf("Chain of trust should have been verified, but got: %v", err)
+	}
+	if data.Version != VersionV1 || data.SigningKey != nil {
+		t.Fatalf("Expected version 1 document without signing key, but got %#v", data)
+	}
+
+	// the version 1 document is checked in the same way
+	queue.tasks["old"].Payload = json.RawMessage(`{"command":[["false"]]}`)
+	_, err = verifier.Verify("old")
+	if err == nil || !strings.Contains(err.Error(), "task definition in public/chain-of-trust.json does not match") {
+		t.Fatalf("Was expecting tampered task definition to be detected, but got: %v", err)
+	}
+}
+
+func TestParsePublicKeyFile(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(NewPublicKey("", publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{
+		NewPublicKey("", publicKey).PublicKey + "\n",
+		string(j),
+	} {
+		parsed, err := ParsePublicKeyFile([]byte(content))
+		if err != nil {
+			t.Fatalf("Could not parse public key file %q: %v", content, err)
+		}
+		if KeyID(parsed) != KeyID(publicKey) {
+			t.Fatalf("Expected public key with key ID %v but got %v", KeyID(publicKey), KeyID(parsed))
+		}
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"os"
 
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/cot"
 	"golang.org/x/crypto/ed25519"
 )
 
-func generateEd25519Keypair(privateKeyFile string) error {
+// generateEd25519Keypair writes a new ed25519 private key to privateKeyFile,
+// and the public key to standard out. If outputKeyID is true, the public key
+// is written as a json object that also includes the key ID of the key.
+func generateEd25519Keypair(privateKeyFile string, outputKeyID bool) error {
 	publicKey, privateKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
 		return err
@@ -17,7 +22,11 @@ func generateEd25519Keypair(privateKeyFile string) error {
 	if err != nil {
 		return err
 	}
-	err = writeEd25519PublicKeyToLog(publicKey)
+	if outputKeyID {
+		err = writeEd25519PublicKeyWithKeyIDToLog(publicKey)
+	} else {
+		err = writeEd25519PublicKeyToLog(publicKey)
+	}
 	if err != nil {
 		return err
 	}
@@ -30,6 +39,15 @@ func writeEd25519PublicKeyToLog(publicKey []byte) error {
 	return nil
 }
 
+func writeEd25519PublicKeyWithKeyIDToLog(publicKey ed25519.PublicKey) error {
+	j, err := json.MarshalIndent(cot.NewPublicKey("", publicKey), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, _ = os.Stdout.Write(append(j, '\n'))
+	return nil
+}
+
 func writeEd25519PrivateKeyToFile(privateKey ed25519.PrivateKey, privateKeyFile string) error {
 	seed := base64.StdEncoding.EncodeToString(privateKey.Seed())
 	f, err := os.Create(privateKeyFile)
@@ -127,12 +127,73 @@ type (
 		Base64 string `json:"base64"`
 	}
 
+	CommandArguments []string
+
+	// A command, together with options that control how it is run.
+	//
+	// Since: generic-worker 39.2.0
+	CommandWithOptions struct {
+
+		// The command to run, as an array of arguments.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Array items:
+		Command []string `json:"command"`
+
+		// If true, a failure of this command (a non-zero exit code, or exceeding
+		// its `maxRunTime`) is logged but does not cause the task to fail, and
+		// subsequent commands are still run. Exit codes listed in
+		// `onExitStatus.retry` still resolve the task as
+		// `exception/intermittent-task`.
+		//
+		// Since: generic-worker 39.2.0
+		ContinueOnError bool `json:"continueOnError,omitempty"`
+
+		// The directory to run the command in. Relative paths are interpreted
+		// relative to the task directory. If not set, the command runs in the
+		// task directory.
+		//
+		// Since: generic-worker 39.2.0
+		Cwd string `json:"cwd,omitempty"`
+
+		// Env vars to set for this command only. These are applied on top of
+		// the env vars of the task payload, overriding any with the same name.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Map entries:
+		Env map[string]string `json:"env,omitempty"`
+
+		// Maximum time the command can run in seconds. If exceeded, the command
+		// is killed and treated as a failed command. Time spent running the
+		// command still counts towards the `maxRunTime` of the task.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Mininum:    1
+		// Maximum:    86400
+		MaxRunTime int64 `json:"maxRunTime,omitempty"`
+	}
+
 	// By default tasks will be resolved with `state/reasonResolved`: `completed/completed`
 	// if all task commands have a zero exit code, or `failed/failed` if any command has a
 	// non-zero exit code. This payload property allows customsation of the task resolution
 	// based on exit code of task commands.
 	ExitCodeHandling struct {
 
+		// Exit codes for any command in the task payload to cause the writable
+		// directory caches mounted by this task to be purged, rather than
+		// preserved for subsequent tasks. This is useful if a command detects
+		// that a cache has become corrupted. The task resolution is not
+		// affected.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Array items:
+		// Mininum:    1
+		PurgeCaches []int64 `json:"purgeCaches,omitempty"`
+
 		// Exit codes for any command in the task payload to cause this task to
 		// be resolved as `exception/intermittent-task`. Typically the Queue
 		// will then schedule a new run of the existing `taskId` (rerun) if not
@@ -145,6 +206,18 @@ type (
 		// Array items:
 		// Mininum:    1
 		Retry []int64 `json:"retry,omitempty"`
+
+		// Non-zero exit codes for any command in the task payload to be treated
+		// as success, as if the command had exited with exit code 0. An exit
+		// code may not be listed in both `success` and `retry`. Commands that
+		// are killed for exceeding their max run time are never treated as
+		// successful.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Array items:
+		// Mininum:    1
+		Success []int64 `json:"success,omitempty"`
 	}
 
 	// Feature flags enable additional functionality.
@@ -156,6 +229,10 @@ type (
 		// taskcluster requests within the scope(s) of a particular task. See
 		// [the github project](https://github.com/taskcluster/taskcluster/tree/main/tools/taskcluster-proxy) for more information.
 		//
+		// Each request proxied for the task is recorded in the task artifact
+		// `private/logs/taskcluster-proxy-audit.jsonl` (since generic-worker
+		// 39.2.0). Request and response bodies are not recorded.
+		//
 		// Since: generic-worker 10.6.0
 		TaskclusterProxy bool `json:"taskclusterProxy,omitempty"`
 	}
@@ -184,14 +261,18 @@ type (
 		// Since: generic-worker 1.0.0
 		Artifacts []Artifact `json:"artifacts,omitempty"`
 
-		// One array per command (each command is an array of arguments). Several arrays
-		// for several commands.
+		// One entry per command. Several entries for several commands. Each entry is
+		// either an array of arguments, or an object which additionally allows the
+		// working directory, environment variables, maximum run time and error
+		// handling of the command to be specified.
 		//
 		// Since: generic-worker 0.0.1
 		//
 		// Array items:
-		// Array items:
-		Command [][]string `json:"command"`
+		// One of:
+		//   * CommandArguments
+		//   * CommandWithOptions
+		Command []json.RawMessage `json:"command"`
 
 		// Env vars must be string to __string__ mappings (not number or boolean). For example:
 		// ```
@@ -211,6 +292,10 @@ type (
 		//   * `TASKCLUSTER_PROXY_URL` (if taskcluster proxy feature enabled) - the
 		//      taskcluster authentication proxy for making unauthenticated taskcluster
 		//      API calls
+		//   * `TASKCLUSTER_PROXY_SOCKET` (if taskcluster proxy feature enabled, and
+		//      worker config property `taskclusterProxyUnixSocket` is `true`, in place
+		//      of `TASKCLUSTER_PROXY_URL`) - the path of the unix domain socket of the
+		//      taskcluster authentication proxy (since generic-worker 39.2.0)
 		//   * `TASKCLUSTER_WORKER_LOCATION`. See
 		//     [RFC #0148](https://github.com/taskcluster/taskcluster-rfcs/blob/master/rfcs/0148-taskcluster-worker-location.md)
 		//     for details.
@@ -244,6 +329,41 @@ type (
 		//   * ReadOnlyDirectory
 		Mounts []json.RawMessage `json:"mounts,omitempty"`
 
+		// Commands to run after the commands in `command` have finished,
+		// regardless of whether they succeeded, failed, or the task exceeded its
+		// `maxRunTime`. They are not run if the task is cancelled, or the worker
+		// is shutting down. This is useful for collecting diagnostics, such as
+		// core dumps or test logs, after a task failure. Entries take the same
+		// form as those in `command`.
+		//
+		// All of the commands are run, even if some of them fail, and their
+		// failures do not affect the task resolution. The env var
+		// `TASK_EXIT_CODE` is set to the exit code of the last command in
+		// `command` that was run, and the env var `TASK_STATUS` is set to the
+		// resolution the task commands would give the task (`completed`,
+		// `failed` or `exception`).
+		//
+		// The commands do not count towards the `maxRunTime` of the task, but
+		// are instead limited by `onExitMaxRunTime`.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Array items:
+		// One of:
+		//   * CommandArguments
+		//   * CommandWithOptions
+		OnExit []json.RawMessage `json:"onExit,omitempty"`
+
+		// Maximum time, in seconds, that all of the commands in `onExit` may run
+		// for in total. Any command still running when this time is exceeded
+		// is killed. Defaults to 300 seconds.
+		//
+		// Since: generic-worker 39.2.0
+		//
+		// Mininum:    1
+		// Maximum:    3600
+		OnExitMaxRunTime int64 `json:"onExitMaxRunTime,omitempty"`
+
 		// By default tasks will be resolved with `state/reasonResolved`: `completed/completed`
 		// if all task commands have a zero exit code, or `failed/failed` if any command has a
 		// non-zero exit code. This payload property allows customsation of the task resolution
@@ -381,6 +501,70 @@ func taskPayloadSchema() string {
   "$schema": "/schemas/common/metaschema.json#",
   "additionalProperties": false,
   "definitions": {
+    "command": {
+      "oneOf": [
+        {
+          "items": {
+            "type": "string"
+          },
+          "minItems": 1,
+          "title": "Command Arguments",
+          "type": "array",
+          "uniqueItems": false
+        },
+        {
+          "$ref": "#/definitions/commandWithOptions"
+        }
+      ],
+      "title": "Command"
+    },
+    "commandWithOptions": {
+      "additionalProperties": false,
+      "description": "A command, together with options that control how it is run.\n\nSince: generic-worker 39.2.0",
+      "properties": {
+        "command": {
+          "description": "The command to run, as an array of arguments.\n\nSince: generic-worker 39.2.0",
+          "items": {
+            "type": "string"
+          },
+          "minItems": 1,
+          "title": "Command Arguments",
+          "type": "array",
+          "uniqueItems": false
+        },
+        "continueOnError": {
+          "description": "If true, a failure of this command (a non-zero exit code, or exceeding\nits ` + "`" + `maxRunTime` + "`" + `) is logged but does not cause the task to fail, and\nsubsequent commands are still run. Exit codes listed in\n` + "`" + `onExitStatus.retry` + "`" + ` still resolve the task as\n` + "`" + `exception/intermittent-task` + "`" + `.\n\nSince: generic-worker 39.2.0",
+          "title": "Continue on error",
+          "type": "boolean"
+        },
+        "cwd": {
+          "description": "The directory to run the command in. Relative paths are interpreted\nrelative to the task directory. If not set, the command runs in the\ntask directory.\n\nSince: generic-worker 39.2.0",
+          "title": "Working directory",
+          "type": "string"
+        },
+        "env": {
+          "additionalProperties": {
+            "type": "string"
+          },
+          "description": "Env vars to set for this command only. These are applied on top of\nthe env vars of the task payload, overriding any with the same name.\n\nSince: generic-worker 39.2.0",
+          "title": "Env var overrides",
+          "type": "object"
+        },
+        "maxRunTime": {
+          "description": "Maximum time the command can run in seconds. If exceeded, the command\nis killed and treated as a failed command. Time spent running the\ncommand still counts towards the ` + "`" + `maxRunTime` + "`" + ` of the task.\n\nSince: generic-worker 39.2.0",
+          "maximum": 86400,
+          "minimum": 1,
+          "multipleOf": 1,
+          "title": "Maximum run time of command in seconds",
+          "type": "integer"
+        }
+      },
+      "required": [
+        "command"
+      ],
+      "title": "Command With Options",
+      "type": "object"
+    },
     "content": {
       "oneOf": [
         {
@@ -641,14 +825,10 @@ func taskPayloadSchema() string {
       "uniqueItems": true
     },
     "command": {
-      "description": "One array per command (each command is an array of arguments). Several arrays\nfor several commands.\n\nSince: generic-worker 0.0.1",
+      "description": "One entry per command. Several entries for several commands. Each entry is\neither an array of arguments, or an object which additionally allows the\nworking directory, environment variables, maximum run time and error\nhandling of the command to be specified.\n\nSince: generic-worker 0.0.1",
       "items": {
-        "items": {
-          "type": "string"
-        },
-        "minItems": 1,
-        "type": "array",
-        "uniqueItems": false
+        "$ref": "#/definitions/command",
+        "title": "Command"
       },
       "minItems": 1,
       "title": "Commands to run",
@@ -659,7 +839,7 @@ func taskPayloadSchema() string {
       "additionalProperties": {
         "type": "string"
       },
-      "description": "Env vars must be string to __string__ mappings (not number or boolean). For example:\n` + "`" + `` + "`" + `` + "`" + `\n{\n  \"PATH\": \"/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin\",\n  \"GOOS\": \"darwin\",\n  \"FOO_ENABLE\": \"true\",\n  \"BAR_TOTAL\": \"3\"\n}\n` + "`" + `` + "`" + `` + "`" + `\n\nNote, the following environment variables will automatically be set in the task\ncommands:\n  * ` + "`" + `TASK_ID` + "`" + ` - the task ID of the currently running task\n  * ` + "`" + `RUN_ID` + "`" + ` - the run ID of the currently running task\n  * ` + "`" + `TASKCLUSTER_ROOT_URL` + "`" + ` - the root URL of the taskcluster deployment\n  * ` + "`" + `TASKCLUSTER_PROXY_URL` + "`" + ` (if taskcluster proxy feature enabled) - the\n     taskcluster authentication proxy for making unauthenticated taskcluster\n     API calls\n  * ` + "`" + `TASKCLUSTER_WORKER_LOCATION` + "`" + `. See\n    [RFC #0148](https://github.com/taskcluster/taskcluster-rfcs/blob/master/rfcs/0148-taskcluster-worker-location.md)\n    for details.\n\nSince: generic-worker 0.0.1",
+      "description": "Env vars must be string to __string__ mappings (not number or boolean). For example:\n` + "`" + `` + "`" + `` + "`" + `\n{\n  \"PATH\": \"/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin\",\n  \"GOOS\": \"darwin\",\n  \"FOO_ENABLE\": \"true\",\n  \"BAR_TOTAL\": \"3\"\n}\n` + "`" + `` + "`" + `` + "`" + `\n\nNote, the following environment variables will automatically be set in the task\ncommands:\n  * ` + "`" + `TASK_ID` + "`" + ` - the task ID of the currently running task\n  * ` + "`" + `RUN_ID` + "`" + ` - the run ID of the currently running task\n  * ` + "`" + `TASKCLUSTER_ROOT_URL` + "`" + ` - the root URL of the taskcluster deployment\n  * ` + "`" + `TASKCLUSTER_PROXY_URL` + "`" + ` (if taskcluster proxy feature enabled) - the\n     taskcluster authentication proxy for making unauthenticated taskcluster\n     API calls\n  * ` + "`" + `TASKCLUSTER_PROXY_SOCKET` + "`" + ` (if taskcluster proxy feature enabled, and\n     worker config property ` + "`" + `taskclusterProxyUnixSocket` + "`" + ` is ` + "`" + `true` + "`" + `, in place\n     of ` + "`" + `TASKCLUSTER_PROXY_URL` + "`" + `) - the path of the unix domain socket of the\n     taskcluster authentication proxy (since generic-worker 39.2.0)\n  * ` + "`" + `TASKCLUSTER_WORKER_LOCATION` + "`" + `. See\n    [RFC #0148](https://github.com/taskcluster/taskcluster-rfcs/blob/master/rfcs/0148-taskcluster-worker-location.md)\n    for details.\n\nSince: generic-worker 0.0.1",
       "title": "Env vars",
       "type": "object"
     },
@@ -668,7 +848,7 @@ func taskPayloadSchema() string {
       "description": "Feature flags enable additional functionality.\n\nSince: generic-worker 5.3.0",
       "properties": {
         "taskclusterProxy": {
-          "description": "The taskcluster proxy provides an easy and safe way to make authenticated\ntaskcluster requests within the scope(s) of a particular task. See\n[the github project](https://github.com/taskcluster/taskcluster/tree/main/tools/taskcluster-proxy) for more information.\n\nSince: generic-worker 10.6.0",
+          "description": "The taskcluster proxy provides an easy and safe way to make authenticated\ntaskcluster requests within the scope(s) of a particular task. See\n[the github project](https://github.com/taskcluster/taskcluster/tree/main/tools/taskcluster-proxy) for more information.\n\nEach request proxied for the task is recorded in the task artifact\n` + "`" + `private/logs/taskcluster-proxy-audit.jsonl` + "`" + ` (since generic-worker\n39.2.0). Request and response bodies are not recorded.\n\nSince: generic-worker 10.6.0",
           "title": "Run [taskcluster-proxy](https://github.com/taskcluster/taskcluster/tree/main/tools/taskcluster-proxy) to allow tasks to dynamically proxy requests to taskcluster services",
           "type": "boolean"
         }
@@ -694,10 +874,39 @@ func taskPayloadSchema() string {
       "type": "array",
       "uniqueItems": false
     },
+    "onExit": {
+      "description": "Commands to run after the commands in ` + "`" + `command` + "`" + ` have finished,\nregardless of whether they succeeded, failed, or the task exceeded its\n` + "`" + `maxRunTime` + "`" + `. They are not run if the task is cancelled, or the worker\nis shutting down. This is useful for collecting diagnostics, such as\ncore dumps or test logs, after a task failure. Entries take the same\nform as those in ` + "`" + `command` + "`" + `.\n\nAll of the commands are run, even if some of them fail, and their\nfailures do not affect the task resolution. The env var\n` + "`" + `TASK_EXIT_CODE` + "`" + ` is set to the exit code of the last command in\n` + "`" + `command` + "`" + ` that was run, and the env var ` + "`" + `TASK_STATUS` + "`" + ` is set to the\nresolution the task commands would give the task (` + "`" + `completed` + "`" + `,\n` + "`" + `failed` + "`" + ` or ` + "`" + `exception` + "`" + `).\n\nThe commands do not count towards the ` + "`" + `maxRunTime` + "`" + ` of the task, but\nare instead limited by ` + "`" + `onExitMaxRunTime` + "`" + `.\n\nSince: generic-worker 39.2.0",
+      "items": {
+        "$ref": "#/definitions/command",
+        "title": "Command"
+      },
+      "title": "Commands to run on exit",
+      "type": "array",
+      "uniqueItems": false
+    },
+    "onExitMaxRunTime": {
+      "description": "Maximum time, in seconds, that all of the commands in ` + "`" + `onExit` + "`" + ` may run\nfor in total. Any command still running when this time is exceeded\nis killed. Defaults to 300 seconds.\n\nSince: generic-worker 39.2.0",
+      "maximum": 3600,
+      "minimum": 1,
+      "multipleOf": 1,
+      "title": "Maximum run time of onExit commands in seconds",
+      "type": "integer"
+    },
     "onExitStatus": {
       "additionalProperties": false,
       "description": "By default tasks will be resolved with ` + "`" + `state/reasonResolved` + "`" + `: ` + "`" + `completed/completed` + "`" + `\nif all task commands have a zero exit code, or ` + "`" + `failed/failed` + "`" + ` if any command has a\nnon-zero exit code. This payload property allows customsation of the task resolution\nbased on exit code of task commands.",
       "properties": {
+        "purgeCaches": {
+          "description": "Exit codes for any command in the task payload to cause the writable\ndirectory caches mounted by this task to be purged, rather than\npreserved for subsequent tasks. This is useful if a command detects\nthat a cache has become corrupted. The task resolution is not\naffected.\n\nSince: generic-worker 39.2.0",
+          "items": {
+            "minimum": 1,
+            "title": "Exit codes",
+            "type": "integer"
+          },
+          "title": "Purge caches exit codes",
+          "type": "array",
+          "uniqueItems": true
+        },
         "retry": {
           "description": "Exit codes for any command in the task payload to cause this task to\nbe resolved as ` + "`" + `exception/intermittent-task` + "`" + `. Typically the Queue\nwill then schedule a new run of the existing ` + "`" + `taskId` + "`" + ` (rerun) if not\nall task runs have been exhausted.\n\nSee [itermittent tasks](https://docs.taskcluster.net/docs/reference/platform/taskcluster-queue/docs/worker-interaction#intermittent-tasks) for more detail.\n\nSince: generic-worker 10.10.0",
           "items": {
@@ -708,6 +917,17 @@ func taskPayloadSchema() string {
           "title": "Intermittent task exit codes",
           "type": "array",
           "uniqueItems": true
+        },
+        "success": {
+          "description": "Non-zero exit codes for any command in the task payload to be treated\nas success, as if the command had exited with exit code 0. An exit\ncode may not be listed in both ` + "`" + `success` + "`" + ` and ` + "`" + `retry` + "`" + `. Commands that\nare killed for exceeding their max run time are never treated as\nsuccessful.\n\nSince: generic-worker 39.2.0",
+          "items": {
+            "minimum": 1,
+            "title": "Exit codes",
+            "type": "integer"
+          },
+          "title": "Success exit codes",
+          "type": "array",
+          "uniqueItems": true
         }
       },
       "required": [],
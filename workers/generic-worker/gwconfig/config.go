@@ -10,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"sync"
+	"time"
 
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
 )
@@ -36,6 +37,7 @@ type (
 		DisableReboots                 bool                   `json:"disableReboots"`
 		DownloadsDir                   string                 `json:"downloadsDir"`
 		Ed25519SigningKeyLocation      string                 `json:"ed25519SigningKeyLocation"`
+		Ed25519SigningKeys             []Ed25519SigningKey    `json:"ed25519SigningKeys"`
 		IdleTimeoutSecs                uint                   `json:"idleTimeoutSecs"`
 		InstanceID                     string                 `json:"instanceId"`
 		InstanceType                   string                 `json:"instanceType"`
@@ -53,6 +55,7 @@ type (
 		ShutdownMachineOnInternalError bool                   `json:"shutdownMachineOnInternalError"`
 		TaskclusterProxyExecutable     string                 `json:"taskclusterProxyExecutable"`
 		TaskclusterProxyPort           uint16                 `json:"taskclusterProxyPort"`
+		TaskclusterProxyUnixSocket     bool                   `json:"taskclusterProxyUnixSocket"`
 		TasksDir                       string                 `json:"tasksDir"`
 		WorkerGroup                    string                 `json:"workerGroup"`
 		WorkerID                       string                 `json:"workerId"`
@@ -63,6 +66,18 @@ type (
 		WSTServerURL                   string                 `json:"wstServerURL"`
 	}
 
+	// Ed25519SigningKey is a chain of trust signing key. Of the signing keys
+	// whose validity window includes the current time, the one with the
+	// latest NotBefore is used for signing.
+	Ed25519SigningKey struct {
+		// KeyID identifies the key in chain of trust artifacts. If empty, an
+		// ID is derived from the public key.
+		KeyID     string     `json:"keyId,omitempty"`
+		Location  string     `json:"location"`
+		NotBefore *time.Time `json:"notBefore,omitempty"`
+		NotAfter  *time.Time `json:"notAfter,omitempty"`
+	}
+
 	PrivateConfig struct {
 		AccessToken string `json:"accessToken"`
 		Certificate string `json:"certificate"`
@@ -71,6 +86,10 @@ type (
 	MissingConfigError struct {
 		Setting string
 	}
+
+	InconsistentConfigError struct {
+		Reason string
+	}
 )
 
 func (c *Config) String() string {
@@ -99,9 +118,11 @@ func (c *Config) String() string {
 	return string(j)
 }
 
+// Validate checks that all required config settings have been defined, and
+// that config settings are consistent with each other. The content of the
+// config file itself can be checked against the config schema with
+// File.Validate.
 func (c *Config) Validate() error {
-	// TODO: we should be using json schema here
-
 	fields := []struct {
 		value      interface{}
 		name       string
@@ -111,8 +132,6 @@ func (c *Config) Validate() error {
 		{value: c.CachesDir, name: "cachesDir", disallowed: ""},
 		{value: c.ClientID, name: "clientId", disallowed: ""},
 		{value: c.DownloadsDir, name: "downloadsDir", disallowed: ""},
-		{value: c.Ed25519SigningKeyLocation, name: "ed25519SigningKeyLocation", disallowed: ""},
-		{value: c.LiveLogExecutable, name: "livelogExecutable", disallowed: ""},
 		{value: c.ProvisionerID, name: "provisionerId", disallowed: ""},
 		{value: c.RootURL, name: "rootURL", disallowed: ""},
 		{value: c.TasksDir, name: "tasksDir", disallowed: ""},
@@ -127,7 +146,42 @@ func (c *Config) Validate() error {
 		}
 	}
 
-	// all required config set!
+	if c.Ed25519SigningKeyLocation == "" && len(c.Ed25519SigningKeys) == 0 {
+		return MissingConfigError{Setting: "ed25519SigningKeyLocation"}
+	}
+	for i, key := range c.Ed25519SigningKeys {
+		if key.Location == "" {
+			return MissingConfigError{Setting: fmt.Sprintf("ed25519SigningKeys[%v].location", i)}
+		}
+	}
+
+	// all required config set, now check for inconsistent combinations
+	keyIDs := map[string]bool{}
+	for i, key := range c.Ed25519SigningKeys {
+		if key.NotBefore != nil && key.NotAfter != nil && !key.NotAfter.After(*key.NotBefore) {
+			return InconsistentConfigError{Reason: fmt.Sprintf("config setting \"ed25519SigningKeys[%v].notAfter\" must be later than \"ed25519SigningKeys[%v].notBefore\"", i, i)}
+		}
+		if key.KeyID != "" {
+			if keyIDs[key.KeyID] {
+				return InconsistentConfigError{Reason: fmt.Sprintf("config setting \"ed25519SigningKeys\" contains more than one key with keyId %q", key.KeyID)}
+			}
+			keyIDs[key.KeyID] = true
+		}
+	}
+	return nil
+}
+
+// CheckConsistency checks for combinations of config settings that the worker
+// has always accepted, but that are almost certainly mistakes. Since existing
+// deployments may rely on them, the worker only warns about them at startup,
+// whereas the validate-config target reports them as invalid.
+func (c *Config) CheckConsistency() error {
+	if (c.WSTAudience == "") != (c.WSTServerURL == "") {
+		return InconsistentConfigError{Reason: "config settings \"wstAudience\" and \"wstServerURL\" must either both be set, or both be unset"}
+	}
+	if c.ShutdownMachineOnIdle && c.IdleTimeoutSecs == 0 {
+		return InconsistentConfigError{Reason: "config setting \"shutdownMachineOnIdle\" is true but \"idleTimeoutSecs\" is 0, so the worker will never be idle"}
+	}
 	return nil
 }
 
@@ -135,6 +189,10 @@ func (err MissingConfigError) Error() string {
 	return "Config setting \"" + err.Setting + "\" has not been defined"
 }
 
+func (err InconsistentConfigError) Error() string {
+	return "Inconsistent config: " + err.Reason
+}
+
 func (c *Config) Credentials() *tcclient.Credentials {
 	c.credsMutex.Lock()
 	creds := &tcclient.Credentials{
@@ -4,3 +4,7 @@ package gwconfig
 
 type PublicEngineConfig struct {
 }
+
+// engineSchemaProperties are the config file properties that are specific to
+// the docker engine
+const engineSchemaProperties = `{}`
@@ -5,3 +5,13 @@ package gwconfig
 type PublicEngineConfig struct {
 	RunTasksAsCurrentUser bool `json:"runTasksAsCurrentUser"`
 }
+
+// engineSchemaProperties are the config file properties that are specific to
+// the multiuser engine
+const engineSchemaProperties = `{
+  "runTasksAsCurrentUser": {
+    "description": "If true, users will still be created for tasks, but tasks will be executed as the current OS user.",
+    "type": "boolean",
+    "default": false
+  }
+}`
@@ -0,0 +1,336 @@
+package gwconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type (
+	// InvalidConfigFileError is returned when a generic-worker config file
+	// does not conform to the config schema (see Schema).
+	InvalidConfigFileError struct {
+		Path   string
+		Errors []string
+	}
+)
+
+// commonSchema is the json schema for the config file properties that are
+// supported by all engines. Properties that are specific to an engine are
+// declared in engineSchemaProperties, and merged in by Schema.
+//
+// Note, defaults listed here should match those set in loadConfig.
+const commonSchema = `{
+  "$schema": "http://json-schema.org/draft-06/schema#",
+  "title": "Generic Worker Config",
+  "description": "Config file for generic-worker. See ` + "`generic-worker --help`" + ` for a full description of each property.",
+  "type": "object",
+  "additionalProperties": false,
+  "required": [
+    "accessToken",
+    "clientId",
+    "rootURL",
+    "workerId",
+    "workerType"
+  ],
+  "anyOf": [
+    {
+      "required": ["ed25519SigningKeyLocation"]
+    },
+    {
+      "required": ["ed25519SigningKeys"]
+    }
+  ],
+  "properties": {
+    "accessToken": {
+      "description": "Taskcluster access token used by generic worker to talk to taskcluster queue.",
+      "type": "string",
+      "minLength": 1
+    },
+    "availabilityZone": {
+      "description": "The EC2 availability zone of the worker.",
+      "type": "string"
+    },
+    "cachesDir": {
+      "description": "The directory where task caches should be stored on the worker.",
+      "type": "string",
+      "minLength": 1,
+      "default": "caches"
+    },
+    "certificate": {
+      "description": "Taskcluster certificate, when using temporary credentials only.",
+      "type": "string"
+    },
+    "checkForNewDeploymentEverySecs": {
+      "description": "The number of seconds between consecutive checks for a new deployment of the current worker type.",
+      "type": "integer",
+      "minimum": 0,
+      "default": 1800
+    },
+    "cleanUpTaskDirs": {
+      "description": "Whether to delete task directories after the task completes.",
+      "type": "boolean",
+      "default": true
+    },
+    "clientId": {
+      "description": "Taskcluster client ID used by generic worker to talk to taskcluster queue.",
+      "type": "string",
+      "minLength": 1
+    },
+    "deploymentId": {
+      "description": "If the deploymentId of the latest worker pool configuration differs from this value, the worker will shut itself down.",
+      "type": "string"
+    },
+    "disableReboots": {
+      "description": "If true, no system reboot will be initiated by generic-worker.",
+      "type": "boolean",
+      "default": false
+    },
+    "downloadsDir": {
+      "description": "The directory to cache downloaded files for populating preloaded caches and readonly mounts.",
+      "type": "string",
+      "minLength": 1,
+      "default": "downloads"
+    },
+    "ed25519SigningKeyLocation": {
+      "description": "The ed25519 signing key for signing artifacts with. Either this, or ed25519SigningKeys, or both, must be set.",
+      "type": "string",
+      "minLength": 1
+    },
+    "ed25519SigningKeys": {
+      "description": "Chain of trust signing keys with validity windows, for rotating keys without a flag day. Of the keys valid at the time of signing (including ed25519SigningKeyLocation, which is always valid), the one with the latest notBefore is used.",
+      "type": "array",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["location"],
+        "properties": {
+          "keyId": {
+            "description": "Identifies the key in chain of trust artifacts. Defaults to an ID derived from the public key.",
+            "type": "string",
+            "minLength": 1
+          },
+          "location": {
+            "description": "The file containing the ed25519 signing key.",
+            "type": "string",
+            "minLength": 1
+          },
+          "notBefore": {
+            "description": "The key is not used for signing before this time.",
+            "type": "string",
+            "format": "date-time"
+          },
+          "notAfter": {
+            "description": "The key is not used for signing from this time.",
+            "type": "string",
+            "format": "date-time"
+          }
+        }
+      },
+      "default": []
+    },
+    "idleTimeoutSecs": {
+      "description": "How many seconds to wait without getting a new task to perform, before the worker process exits. A value of 0 means never exit due to being idle.",
+      "type": "integer",
+      "minimum": 0,
+      "default": 0
+    },
+    "instanceId": {
+      "description": "The EC2 instance ID of the worker. Used by chain of trust.",
+      "type": "string"
+    },
+    "instanceType": {
+      "description": "The EC2 instance Type of the worker. Used by chain of trust.",
+      "type": "string"
+    },
+    "livelogExecutable": {
+      "description": "Deprecated, and ignored. Livelog is now served from within the generic-worker process.",
+      "type": "string"
+    },
+    "numberOfTasksToRun": {
+      "description": "If zero, run tasks indefinitely. Otherwise, after this many tasks, exit.",
+      "type": "integer",
+      "minimum": 0,
+      "default": 0
+    },
+    "privateIP": {
+      "description": "The private IP of the worker, used by chain of trust.",
+      "$ref": "#/definitions/ipAddress"
+    },
+    "provisionerId": {
+      "description": "The taskcluster provisioner which is taking care of provisioning environments with generic-worker running on them.",
+      "type": "string",
+      "minLength": 1,
+      "default": "test-provisioner"
+    },
+    "publicIP": {
+      "description": "The IP address for VNC access. Also used by chain of trust when present.",
+      "$ref": "#/definitions/ipAddress"
+    },
+    "region": {
+      "description": "The EC2 region of the worker. Used by chain of trust.",
+      "type": "string"
+    },
+    "requiredDiskSpaceMegabytes": {
+      "description": "The garbage collector will ensure at least this number of megabytes of disk space are available when each task starts.",
+      "type": "integer",
+      "minimum": 0,
+      "default": 10240
+    },
+    "rootURL": {
+      "description": "The root URL of the taskcluster deployment to which clientId and accessToken grant access.",
+      "type": "string",
+      "format": "uri"
+    },
+    "runAfterUserCreation": {
+      "description": "If non-empty, a command to be executed as each newly created task user, before a task is run as that user.",
+      "type": "string",
+      "default": ""
+    },
+    "sentryProject": {
+      "description": "The project name used in https://sentry.io for reporting worker crashes.",
+      "type": "string",
+      "default": "generic-worker"
+    },
+    "shutdownMachineOnIdle": {
+      "description": "If true, when the worker reaches its idle timeout (see idleTimeoutSecs), the worker will issue an OS shutdown command.",
+      "type": "boolean",
+      "default": false
+    },
+    "shutdownMachineOnInternalError": {
+      "description": "If true, if the worker encounters an unrecoverable error it will shutdown the host computer.",
+      "type": "boolean",
+      "default": false
+    },
+    "taskclusterProxyExecutable": {
+      "description": "Filepath of taskcluster-proxy executable to use.",
+      "type": "string",
+      "minLength": 1,
+      "default": "taskcluster-proxy"
+    },
+    "taskclusterProxyPort": {
+      "description": "Port number for taskcluster-proxy HTTP requests.",
+      "type": "integer",
+      "minimum": 1,
+      "maximum": 65535,
+      "default": 80
+    },
+    "taskclusterProxyUnixSocket": {
+      "description": "If true, taskcluster-proxy listens on a unix domain socket in the task directory, owned by the task user, rather than on taskclusterProxyPort, so that other users on the host cannot use the proxy. The path of the socket is given to tasks in environment variable TASKCLUSTER_PROXY_SOCKET instead of TASKCLUSTER_PROXY_URL.",
+      "type": "boolean",
+      "default": false
+    },
+    "tasksDir": {
+      "description": "The location where task directories should be created on the worker. The default varies by platform.",
+      "type": "string",
+      "minLength": 1
+    },
+    "workerGroup": {
+      "description": "An identifier to uniquely identify which pool of workers this worker logically belongs to.",
+      "type": "string",
+      "minLength": 1,
+      "default": "test-worker-group"
+    },
+    "workerId": {
+      "description": "A name to uniquely identify your worker.",
+      "type": "string",
+      "minLength": 1
+    },
+    "workerLocation": {
+      "description": "If non-empty, task commands will have environment variable TASKCLUSTER_WORKER_LOCATION set to this value.",
+      "type": "string",
+      "default": ""
+    },
+    "workerType": {
+      "description": "The worker type (worker pool name, without provisionerId) of the worker.",
+      "type": "string",
+      "minLength": 1
+    },
+    "workerTypeMetadata": {
+      "description": "This arbitrary json blob will be included at the top of each task log.",
+      "type": "object",
+      "default": {}
+    },
+    "wstAudience": {
+      "description": "The audience value for which to request websocktunnel credentials. Must be set if, and only if, wstServerURL is set.",
+      "type": "string"
+    },
+    "wstServerURL": {
+      "description": "The URL of the websocktunnel server with which to expose live logs. Must be set if, and only if, wstAudience is set.",
+      "type": "string"
+    }
+  },
+  "definitions": {
+    "ipAddress": {
+      "type": "string",
+      "anyOf": [
+        {
+          "format": "ipv4"
+        },
+        {
+          "format": "ipv6"
+        },
+        {
+          "maxLength": 0
+        }
+      ]
+    }
+  }
+}`
+
+// Schema returns the json schema that generic-worker config files must
+// conform to, for the engine that generic-worker has been built with.
+func Schema() string {
+	var schema map[string]interface{}
+	err := json.Unmarshal([]byte(commonSchema), &schema)
+	if err != nil {
+		panic(err)
+	}
+	var engineProperties map[string]interface{}
+	err = json.Unmarshal([]byte(engineSchemaProperties), &engineProperties)
+	if err != nil {
+		panic(err)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for name, property := range engineProperties {
+		properties[name] = property
+	}
+	j, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(j)
+}
+
+// Validate checks that the config file conforms to the config schema (see
+// Schema). Unlike UpdateConfig, all problems with the file are reported,
+// rather than just the first one.
+func (cf *File) Validate() error {
+	configData, err := ioutil.ReadFile(cf.Path)
+	if err != nil {
+		return err
+	}
+	schemaLoader := gojsonschema.NewStringLoader(Schema())
+	docLoader := gojsonschema.NewBytesLoader(configData)
+	result, err := gojsonschema.Validate(schemaLoader, docLoader)
+	if err != nil {
+		return fmt.Errorf("Error validating generic worker config file %v: %v", cf.Path, err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	invalid := &InvalidConfigFileError{
+		Path: cf.Path,
+	}
+	for _, desc := range result.Errors() {
+		invalid.Errors = append(invalid.Errors, desc.String())
+	}
+	return invalid
+}
+
+func (err *InvalidConfigFileError) Error() string {
+	return "Config file " + err.Path + " does not conform to the generic-worker config schema:\n  * " + strings.Join(err.Errors, "\n  * ")
+}
@@ -3,12 +3,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 )
 
-func checkSHASums() [][]string {
-	return [][]string{
+func checkSHASums() []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"chmod",
 			"u+x",
@@ -17,11 +18,11 @@ func checkSHASums() [][]string {
 		{
 			"preloaded/check-shasums.sh",
 		},
-	}
+	})
 }
 
-func incrementCounterInCache() [][]string {
-	return [][]string{
+func incrementCounterInCache() []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"/bin/bash",
 			"-c",
@@ -32,11 +33,11 @@ func incrementCounterInCache() [][]string {
 			  echo -n "${x}" > "my-task-caches/test-modifications/counter"
 			fi`,
 		},
-	}
+	})
 }
 
-func GoEnv() [][]string {
-	return [][]string{
+func GoEnv() []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"go",
 			"env",
@@ -52,21 +53,21 @@ func GoEnv() [][]string {
 			"go",
 			"version",
 		},
-	}
+	})
 }
 
-func logOncePerSecond(count uint, file string) [][]string {
-	return [][]string{
+func logOncePerSecond(count uint, file string) []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"/bin/bash",
 			"-c",
 			// don't use ping since that isn't available on travis-ci.org !
 			fmt.Sprintf(`for ((i=0; i<%v; i++)); do echo $i; sleep 1; done > '%v'`, count, file),
 		},
-	}
+	})
 }
 
-func goRun(goFile string, args ...string) [][]string {
+func goRun(goFile string, args ...string) []json.RawMessage {
 	copy := copyTestdataFile(goFile)
 	run := []string{
 		"go",
@@ -74,14 +75,14 @@ func goRun(goFile string, args ...string) [][]string {
 		goFile,
 	}
 	runWithArgs := append(run, args...)
-	return append(copy, runWithArgs)
+	return append(copy, toCommandArray([][]string{runWithArgs})...)
 }
 
-func sleep(seconds uint) [][]string {
-	return [][]string{
+func sleep(seconds uint) []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"sleep",
 			strconv.Itoa(int(seconds)),
 		},
-	}
+	})
 }
@@ -3,13 +3,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"path/filepath"
 )
 
-func helloGoodbye() [][]string {
-	return [][]string{
+func helloGoodbye() []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"echo",
 			"hello world!",
@@ -18,30 +19,30 @@ func helloGoodbye() [][]string {
 			"echo",
 			"goodbye world!",
 		},
-	}
+	})
 }
 
 func rawHelloGoodbye() string {
 	return `["echo", "hello world!"], ["echo", "goodbye world!"]`
 }
 
-func returnExitCode(exitCode uint) [][]string {
-	return [][]string{
+func returnExitCode(exitCode uint) []json.RawMessage {
+	return toCommandArray([][]string{
 		{
 			"/bin/bash",
 			"-c",
 			fmt.Sprintf("exit %d", exitCode),
 		},
-	}
+	})
 }
 
-func copyTestdataFile(path string) [][]string {
+func copyTestdataFile(path string) []json.RawMessage {
 	return copyTestdataFileTo(path, path)
 }
 
-func copyTestdataFileTo(src, dest string) [][]string {
+func copyTestdataFileTo(src, dest string) []json.RawMessage {
 	sourcePath := filepath.Join(testdataDir, src)
-	return [][]string{
+	return toCommandArray([][]string{
 		{
 			"mkdir",
 			"-p",
@@ -52,9 +53,9 @@ func copyTestdataFileTo(src, dest string) [][]string {
 			sourcePath,
 			dest,
 		},
-	}
+	})
 }
 
-func singleCommandNoArgs(command string) [][]string {
-	return [][]string{{command}}
+func singleCommandNoArgs(command string) []json.RawMessage {
+	return toCommandArray([][]string{{command}})
 }
@@ -210,6 +210,37 @@ func submitAndAssert(t *testing.T, td *tcqueue.TaskDefinitionRequest, payload Ge
 	return taskID
 }
 
+// withOptions converts a single command, in the form returned by helper
+// functions such as helloGoodbye(), into its object form, with the given
+// options applied.
+func withOptions(command json.RawMessage, options CommandWithOptions) json.RawMessage {
+	err := json.Unmarshal(command, &options.Command)
+	if err != nil {
+		panic(fmt.Sprintf("Could not convert %s to command: %v", command, err))
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		panic(fmt.Sprintf("Could not convert %#v to json: %v", options, err))
+	}
+	return json.RawMessage(b)
+}
+
+// toCommandArray converts a list of commands, such as a [][]string of
+// command arguments, into the type required by GenericWorkerPayload.Command.
+func toCommandArray(x interface{}) []json.RawMessage {
+	b, err := json.Marshal(x)
+	if err != nil {
+		panic(fmt.Sprintf("Could not convert %#v to json: %v", x, err))
+	}
+
+	rawMessageArray := []json.RawMessage{}
+	err = json.Unmarshal(b, &rawMessageArray)
+	if err != nil {
+		panic(fmt.Sprintf("Could not convert json bytes to []json.RawMessage: %v", err))
+	}
+	return rawMessageArray
+}
+
 func toMountArray(t *testing.T, x interface{}) []json.RawMessage {
 	b, err := json.Marshal(x)
 	if err != nil {
@@ -335,7 +366,6 @@ func CreateArtifactFromFile(t *testing.T, path string, name string) (taskID stri
 type Test struct {
 	t                  *testing.T
 	Config             *gwconfig.Config
-	OldInternalPUTPort uint16
 	OldInternalGETPort uint16
 	OldConfigureForGCP bool
 	srv                *http.Server
@@ -365,7 +395,6 @@ func GWTest(t *testing.T) *Test {
 			IdleTimeoutSecs:           60,
 			InstanceID:                "test-instance-id",
 			InstanceType:              "p3.enormous",
-			LiveLogExecutable:         "livelog",
 			NumberOfTasksToRun:        1,
 			PrivateIP:                 net.ParseIP("87.65.43.21"),
 			ProvisionerID:             "test-provisioner",
@@ -470,13 +499,11 @@ func GWTest(t *testing.T) *Test {
 	// we need to use a non-default port for the livelog internalGETPort, so
 	// that we don't conflict with a generic-worker in which the tests are
 	// running
-	internalPUTPort = 30584
 	internalGETPort = 30583
 
 	return &Test{
 		t:                  t,
 		Config:             testConfig,
-		OldInternalPUTPort: internalPUTPort,
 		OldInternalGETPort: internalGETPort,
 		srv:                srv,
 		router:             r,
@@ -497,7 +524,6 @@ func (gwtest *Test) Setup() error {
 }
 
 func (gwtest *Test) Teardown() {
-	internalPUTPort = gwtest.OldInternalPUTPort
 	internalGETPort = gwtest.OldInternalGETPort
 	gwtest.t.Logf("Removing test directory %v...", filepath.Join(testdataDir, gwtest.t.Name()))
 	err := os.RemoveAll(filepath.Join(testdataDir, gwtest.t.Name()))
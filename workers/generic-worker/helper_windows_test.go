@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,30 +12,30 @@ import (
 	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/win32"
 )
 
-func helloGoodbye() []string {
-	return []string{
+func helloGoodbye() []json.RawMessage {
+	return toCommandArray([]string{
 		"echo hello world!",
 		"echo goodbye world!",
-	}
+	})
 }
 
 func rawHelloGoodbye() string {
 	return `"echo hello world!", "echo goodbye world!"`
 }
 
-func checkSHASums() []string {
-	return []string{
+func checkSHASums() []json.RawMessage {
+	return toCommandArray([]string{
 		"PowerShell.exe -NoProfile -ExecutionPolicy Bypass -File preloaded\\check-shasums.ps1",
-	}
+	})
 }
 
-func returnExitCode(exitCode uint) []string {
-	return []string{
+func returnExitCode(exitCode uint) []json.RawMessage {
+	return toCommandArray([]string{
 		fmt.Sprintf("exit %d", exitCode),
-	}
+	})
 }
 
-func incrementCounterInCache() []string {
+func incrementCounterInCache() []json.RawMessage {
 	// The `echo | set /p dummyName...` construction is to avoid printing a
 	// newline. See answer by xmechanix on:
 	// http://stackoverflow.com/questions/7105433/windows-batch-echo-without-new-line/19468559#19468559
@@ -48,36 +49,36 @@ func incrementCounterInCache() []string {
 		  echo | set /p dummyName="1" > my-task-caches\test-modifications\counter
 		)
 `
-	return []string{command}
+	return toCommandArray([]string{command})
 }
 
-func GoEnv() []string {
-	return []string{
+func GoEnv() []json.RawMessage {
+	return toCommandArray([]string{
 		"go env",
 		"set",
 		"where go",
 		"go version",
-	}
+	})
 }
 
-func logOncePerSecond(count uint, file string) []string {
+func logOncePerSecond(count uint, file string) []json.RawMessage {
 	return goRunFileOutput(file, "spawn-orphan-process.go", strconv.Itoa(int(count)))
 	// return []string{
 	// 	"ping 127.0.0.1 -n " + strconv.Itoa(int(count)) + " > " + file,
 	// }
 }
 
-func sleep(seconds uint) []string {
-	return []string{
+func sleep(seconds uint) []json.RawMessage {
+	return toCommandArray([]string{
 		"ping 127.0.0.1 -n " + strconv.Itoa(int(seconds+1)) + " > nul",
-	}
+	})
 }
 
-func goRun(goFile string, args ...string) []string {
+func goRun(goFile string, args ...string) []json.RawMessage {
 	return goRunFileOutput("", goFile, args...)
 }
 
-func goRunFileOutput(outputFile, goFile string, args ...string) []string {
+func goRunFileOutput(outputFile, goFile string, args ...string) []json.RawMessage {
 	prepare := []string{}
 	for _, envVar := range []string{
 		"PATH", "GOPATH", "GOROOT",
@@ -86,12 +87,12 @@ func goRunFileOutput(outputFile, goFile string, args ...string) []string {
 			prepare = append(prepare, "set "+envVar+"="+win32.CMDExeEscape(val))
 		}
 	}
-	prepare = append(prepare, copyTestdataFile(goFile)...)
+	commands := append(toCommandArray(prepare), copyTestdataFile(goFile)...)
 
 	cmd := []string{"go", "run", goFile}
 	cmd = append(cmd, args...)
 
-	return append(prepare, run(cmd, outputFile))
+	return append(commands, toCommandArray([]string{run(cmd, outputFile)})...)
 }
 
 // run runs the command line args specified in args and redirects the output to
@@ -138,19 +139,19 @@ func makeCmdLine(args []string) string {
 	return s
 }
 
-func copyTestdataFile(path string) []string {
+func copyTestdataFile(path string) []json.RawMessage {
 	return copyTestdataFileTo(path, path)
 }
 
-func copyTestdataFileTo(src, dest string) []string {
+func copyTestdataFileTo(src, dest string) []json.RawMessage {
 	destFile := strings.Replace(dest, "/", "\\", -1)
 	sourceFile := filepath.Join(testdataDir, strings.Replace(src, "/", "\\", -1))
-	return []string{
+	return toCommandArray([]string{
 		run([]string{"if", "not", "exist", filepath.Dir(destFile), "mkdir", filepath.Dir(destFile)}, ""),
 		run([]string{"copy", sourceFile, destFile}, ""),
-	}
+	})
 }
 
-func singleCommandNoArgs(command string) []string {
-	return []string{command}
+func singleCommandNoArgs(command string) []json.RawMessage {
+	return toCommandArray([]string{command})
 }
@@ -19,10 +19,9 @@ import (
 var (
 	livelogName = "public/logs/live.log"
 
-	// The ports on which the livelog process listens locally.  These ports are not exposed
-	// outside of the host.  However, in CI they must differ from those of the generic-worker
+	// The port on which livelog listens locally.  This port is not exposed
+	// outside of the host.  However, in CI it must differ from that of the generic-worker
 	// instance running the test suite.
-	internalPUTPort uint16 = 60098
 	internalGETPort uint16 = 60099
 )
 
@@ -71,7 +70,7 @@ func (l *LiveLogTask) RequiredScopes() scopes.Required {
 }
 
 func (l *LiveLogTask) Start() *CommandExecutionError {
-	liveLog, err := livelog.New(config.LiveLogExecutable, internalPUTPort, internalGETPort)
+	liveLog, err := livelog.New(internalGETPort)
 	if err != nil {
 		log.Printf("WARNING: could not create livelog: %s", err)
 		// then run without livelog, is only a "best effort" service
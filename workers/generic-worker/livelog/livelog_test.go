@@ -5,49 +5,24 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
-	"runtime"
 	"testing"
-	"time"
-
-	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/tchttputil"
 )
 
 func TestLiveLog(t *testing.T) {
-	var executable string
-	switch runtime.GOOS {
-	case "windows":
-		executable = "livelog.exe"
-	default:
-		executable = "livelog"
+	ll, err := New(34568)
+	if err != nil {
+		t.Fatalf("Could not initiate livelog:\n%s", err)
 	}
-	ll, err := New(executable, 34567, 34568)
-	// Do defer before checking err since err could be a different error and
-	// process may have already started up.
-	//
-	// TODO: Think about if there is a better way to handle this, e.g. with a
-	// callback function or the method itself killing the process if there is
-	// an error after process is started up, etc.
 	defer func() {
 		err := ll.Terminate()
 		if err != nil {
-			t.Fatalf("Failed to terminate livelog process:\n%s", err)
+			t.Fatalf("Failed to terminate livelog:\n%s", err)
 		}
 	}()
-	if err != nil {
-		t.Fatalf("Could not initiate livelog process:\n%s", err)
-	}
 	_, err = fmt.Fprintln(ll.LogWriter, "Test line")
 	if err != nil {
 		t.Fatalf("Could not write test line to livelog:\n%s", err)
 	}
-	// This is required since livelog does not open the GET port until it first
-	// writes data to it, which probably should be fixed in the livelog
-	// codebase. Ideally it would serve both ports on initialisation, not
-	// requiring data to be PUT first.
-	err = tchttputil.WaitForLocalTCPListener(ll.GETPort, time.Minute*1)
-	if err != nil {
-		t.Fatalf("%s", err)
-	}
 	resp, err := http.Get(ll.GetURL)
 	if err != nil {
 		t.Fatalf("Could not GET livelog from URL %s:\n%s", ll.GetURL, err)
@@ -66,3 +41,20 @@ func TestLiveLog(t *testing.T) {
 		t.Fatalf("Live log feed did not match data written:\n%q != %q\nGET url: %s\nFull Response:\n%s", string(respString), "Test line\n", ll.GetURL, string(rawResp))
 	}
 }
+
+func TestLiveLogPortInUse(t *testing.T) {
+	ll, err := New(34569)
+	if err != nil {
+		t.Fatalf("Could not initiate livelog:\n%s", err)
+	}
+	defer func() {
+		err := ll.Terminate()
+		if err != nil {
+			t.Fatalf("Failed to terminate livelog:\n%s", err)
+		}
+	}()
+	_, err = New(34569)
+	if err == nil {
+		t.Fatal("Expected an error starting a second livelog on the same port")
+	}
+}
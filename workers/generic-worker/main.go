@@ -11,6 +11,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,6 +24,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	docopt "github.com/docopt/docopt-go"
@@ -66,6 +68,10 @@ var (
 	revision = "" // this is set during build with `-ldflags "-X main.revision=$(git rev-parse HEAD)"`
 )
 
+// defaultOnExitMaxRunTime is the max run time, in seconds, of the onExit
+// commands of a task, if task.payload.onExitMaxRunTime is not specified
+const defaultOnExitMaxRunTime = 300
+
 func persistFeaturesState() (err error) {
 	for _, feature := range Features {
 		err := feature.PersistState()
@@ -117,6 +123,12 @@ func main() {
 	case arguments["show-payload-schema"]:
 		fmt.Println(taskPayloadSchema())
 
+	case arguments["show-config-schema"]:
+		fmt.Println(gwconfig.Schema())
+
+	case arguments["validate-config"]:
+		os.Exit(int(validateConfig(arguments["--config"].(string))))
+
 	case arguments["run"]:
 		withWorkerRunner := arguments["--with-worker-runner"].(bool)
 		if withWorkerRunner {
@@ -183,8 +195,11 @@ func main() {
 		// platform specific...
 		err := install(arguments)
 		exitOnError(CANT_INSTALL_GENERIC_WORKER, err, "Error installing generic worker")
+	case arguments["verify-cot"]:
+		serviceFactory = &tc.ClientFactory{}
+		os.Exit(int(verifyChainOfTrust(arguments)))
 	case arguments["new-ed25519-keypair"]:
-		err := generateEd25519Keypair(arguments["--file"].(string))
+		err := generateEd25519Keypair(arguments["--file"].(string), arguments["--output-key-id"].(bool))
 		exitOnError(CANT_CREATE_ED25519_KEYPAIR, err, "Error generating ed25519 keypair %v for worker", arguments["--file"].(string))
 	default:
 		// platform specific...
@@ -197,8 +212,9 @@ func loadConfig(configFile *gwconfig.File) error {
 
 	// first assign defaults
 
-	// TODO: would be better to have a json schema, and also define defaults in
-	// only one place if possible (defaults also declared in `usage`)
+	// TODO: would be better to define defaults in only one place if possible
+	// (defaults also declared in `usage` and in the config schema, see
+	// gwconfig.Schema)
 	config = &gwconfig.Config{
 		PublicConfig: gwconfig.PublicConfig{
 			CachesDir:                      "caches",
@@ -206,8 +222,8 @@ func loadConfig(configFile *gwconfig.File) error {
 			CleanUpTaskDirs:                true,
 			DisableReboots:                 false,
 			DownloadsDir:                   "downloads",
+			Ed25519SigningKeys:             []gwconfig.Ed25519SigningKey{},
 			IdleTimeoutSecs:                0,
-			LiveLogExecutable:              "livelog",
 			NumberOfTasksToRun:             0,
 			ProvisionerID:                  "test-provisioner",
 			RequiredDiskSpaceMegabytes:     10240,
@@ -218,6 +234,7 @@ func loadConfig(configFile *gwconfig.File) error {
 			ShutdownMachineOnInternalError: false,
 			TaskclusterProxyExecutable:     "taskcluster-proxy",
 			TaskclusterProxyPort:           80,
+			TaskclusterProxyUnixSocket:     false,
 			TasksDir:                       defaultTasksDir(),
 			WorkerGroup:                    "test-worker-group",
 			WorkerLocation:                 "",
@@ -332,6 +349,39 @@ func CwdOrPanic() string {
 	return cwd
 }
 
+// validateConfig checks that the given config file conforms to the config
+// schema, and that the resulting config (after defaults have been applied) is
+// complete and consistent, without running the worker. All problems found
+// with the config file are logged.
+func validateConfig(configFilePath string) ExitCode {
+	configFile := &gwconfig.File{
+		Path: configFilePath,
+	}
+	err := configFile.Validate()
+	if err != nil {
+		log.Printf("Invalid config: %v", err)
+		if _, isInvalid := err.(*gwconfig.InvalidConfigFileError); isInvalid {
+			return INVALID_CONFIG
+		}
+		return CANT_LOAD_CONFIG
+	}
+	err = loadConfig(configFile)
+	if err != nil {
+		log.Printf("Error loading configuration: %v", err)
+		return CANT_LOAD_CONFIG
+	}
+	err = config.Validate()
+	if err == nil {
+		err = config.CheckConsistency()
+	}
+	if err != nil {
+		log.Printf("Invalid config: %v", err)
+		return INVALID_CONFIG
+	}
+	log.Printf("Config file %v is valid", configFilePath)
+	return TASKS_COMPLETE
+}
+
 func RunWorker() (exitCode ExitCode) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -345,6 +395,10 @@ func RunWorker() (exitCode ExitCode) {
 		log.Printf("Invalid config: %v", err)
 		return INVALID_CONFIG
 	}
+	err = config.CheckConsistency()
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+	}
 
 	// This *DOESN'T* output secret fields, so is SAFE
 	log.Printf("Config: %v", config)
@@ -570,7 +624,8 @@ func ClaimWork() *TaskRun {
 			TaskClaimResponse: tcqueue.TaskClaimResponse(taskResponse),
 			Artifacts:         map[string]TaskArtifact{},
 			featureArtifacts: map[string]string{
-				logName: "Native Log",
+				logName:        "Native Log",
+				runSummaryName: "Run Summary",
 			},
 			LocalClaimTime: localClaimTime,
 		}
@@ -627,6 +682,15 @@ func (task *TaskRun) validatePayload() *CommandExecutionError {
 	if err != nil {
 		return MalformedPayloadError(err)
 	}
+	err = task.parseCommands()
+	if err != nil {
+		return MalformedPayloadError(err)
+	}
+	for _, code := range task.Payload.OnExitStatus.Success {
+		if task.IsIntermittentExitCode(code) {
+			return MalformedPayloadError(fmt.Errorf("Malformed payload: exit code %v is listed in both task.payload.onExitStatus.retry and task.payload.onExitStatus.success", code))
+		}
+	}
 	for _, artifact := range task.Payload.Artifacts {
 		// The default artifact expiry is task expiry, but is only applied when
 		// the task artifacts are resolved. We intentionally don't modify
@@ -722,7 +786,19 @@ func (err *CommandExecutionError) Error() string {
 }
 
 func (task *TaskRun) IsIntermittentExitCode(c int64) bool {
-	for _, code := range task.Payload.OnExitStatus.Retry {
+	return exitCodeIn(c, task.Payload.OnExitStatus.Retry)
+}
+
+func (task *TaskRun) IsSuccessExitCode(c int64) bool {
+	return exitCodeIn(c, task.Payload.OnExitStatus.Success)
+}
+
+func (task *TaskRun) IsPurgeCachesExitCode(c int64) bool {
+	return exitCodeIn(c, task.Payload.OnExitStatus.PurgeCaches)
+}
+
+func exitCodeIn(c int64, codes []int64) bool {
+	for _, code := range codes {
 		if c == code {
 			return true
 		}
@@ -730,18 +806,97 @@ func (task *TaskRun) IsIntermittentExitCode(c int64) bool {
 	return false
 }
 
-func (task *TaskRun) ExecuteCommand(index int) *CommandExecutionError {
+// PurgeCachesRequested returns true if any task command that has run exited
+// with an exit code listed in task.payload.onExitStatus.purgeCaches.
+func (task *TaskRun) PurgeCachesRequested() bool {
+	for _, result := range task.CommandResults[:len(task.Payload.Command)] {
+		if result != nil && task.IsPurgeCachesExitCode(int64(result.ExitCode())) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCommands populates task.CommandDefinitions from task.Payload.Command,
+// followed by task.Payload.OnExit. Commands may be specified either in plain
+// form, or as an object with additional options; in both cases they are
+// converted to a CommandWithOptions.
+func (task *TaskRun) parseCommands() error {
+	rawCommands := append(append([]json.RawMessage{}, task.Payload.Command...), task.Payload.OnExit...)
+	task.CommandDefinitions = make([]CommandWithOptions, len(rawCommands))
+	for i, rawCommand := range rawCommands {
+		var err error
+		if bytes.HasPrefix(bytes.TrimSpace(rawCommand), []byte("{")) {
+			err = json.Unmarshal(rawCommand, &task.CommandDefinitions[i])
+		} else {
+			err = json.Unmarshal(rawCommand, &task.CommandDefinitions[i].Command)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not interpret command %v (%s): %v", i, rawCommand, err)
+		}
+	}
+	return nil
+}
+
+// commandDir returns the directory that the command with the given index
+// should be run from. Relative paths are interpreted relative to the task
+// directory.
+func (task *TaskRun) commandDir(index int) string {
+	dir := task.CommandDefinitions[index].Cwd
+	if dir == "" {
+		return taskContext.TaskDir
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(taskContext.TaskDir, dir)
+}
+
+// runCommand prepares and executes the command with the given index,
+// applying the max run time of the individual command, if one is specified.
+// It returns the result of the command, its duration, and whether the
+// command was killed for exceeding its max run time.
+func (task *TaskRun) runCommand(index int) (result *process.Result, duration time.Duration, maxRunTimeExceeded bool) {
+	command := task.CommandDefinitions[index]
 	task.Infof("Executing command %v: %v", index, task.formatCommand(index))
 	log.Print("Executing command " + strconv.Itoa(index) + ": " + task.Commands[index].String())
 	cee := task.prepareCommand(index)
 	if cee != nil {
 		panic(cee)
 	}
-	result := task.Commands[index].Execute()
+	var maxRunTimer *time.Timer
+	if command.MaxRunTime > 0 {
+		maxRunTimer = time.AfterFunc(
+			time.Second*time.Duration(command.MaxRunTime),
+			func() {
+				task.Warnf("Command %v exceeded its max run time of %v seconds - killing it", index, command.MaxRunTime)
+				task.killCommand(task.Commands[index])
+			},
+		)
+	}
+	started := time.Now()
+	result = task.Commands[index].Execute()
+	finished := time.Now()
+	// Stop() returns false if the timer has already fired
+	maxRunTimeExceeded = maxRunTimer != nil && !maxRunTimer.Stop()
+	// Round(0) forces wall time calculation instead of monotonic time in case machine slept etc
+	duration = finished.Round(0).Sub(started)
+	task.CommandResults[index] = result
+	if maxRunTimeExceeded {
+		task.commandAbortReasons[index] = fmt.Sprintf("max run time of command (%v seconds) exceeded", command.MaxRunTime)
+	}
+	return
+}
+
+func (task *TaskRun) ExecuteCommand(index int) *CommandExecutionError {
+	command := task.CommandDefinitions[index]
+	result, duration, maxRunTimeExceeded := task.runCommand(index)
 	if ae := task.StatusManager.AbortException(); ae != nil {
+		task.commandAbortReasons[index] = ae.Error()
 		return ae
 	}
 	task.Infof("%v", result)
+	task.Infof("Command %v duration: %v", index, duration)
 
 	switch {
 	case result.Failed():
@@ -751,11 +906,22 @@ func (task *TaskRun) ExecuteCommand(index int) *CommandExecutionError {
 				Reason:     intermittentTask,
 				TaskStatus: errored,
 			}
-		} else {
-			return &CommandExecutionError{
-				Cause:      result.FailureCause(),
-				TaskStatus: failed,
-			}
+		}
+		if !maxRunTimeExceeded && task.IsSuccessExitCode(int64(result.ExitCode())) {
+			task.Infof("Command %v exited with exit code %v, which is treated as success since it is listed in task payload.onExitStatus.success", index, result.ExitCode())
+			return nil
+		}
+		var cause error = result.FailureCause()
+		if maxRunTimeExceeded {
+			cause = fmt.Errorf("Command %v aborted - max run time of command (%v seconds) exceeded", index, command.MaxRunTime)
+		}
+		if command.ContinueOnError {
+			task.Warnf("Command %v failed, but continuing since continueOnError is set: %v", index, cause)
+			return nil
+		}
+		return &CommandExecutionError{
+			Cause:      cause,
+			TaskStatus: failed,
 		}
 	case result.Crashed():
 		panic(result.CrashCause())
@@ -763,6 +929,77 @@ func (task *TaskRun) ExecuteCommand(index int) *CommandExecutionError {
 	return nil
 }
 
+// executeOnExitCommands runs the commands in task.payload.onExit, after the
+// task commands have completed. Failures of these commands are logged, but do
+// not affect the task resolution. The commands are not run if the task was
+// aborted for any reason other than exceeding its max run time, e.g. due to
+// cancellation or worker shutdown.
+func (task *TaskRun) executeOnExitCommands(err *ExecutionErrors) {
+	if len(task.Payload.OnExit) == 0 {
+		return
+	}
+	// from now on, aborting the task (e.g. due to cancellation or worker
+	// shutdown) kills the onExit commands too
+	atomic.StoreInt32(&task.runningOnExit, 1)
+	if ae := task.StatusManager.AbortException(); ae != nil && ae.TaskStatus != failed {
+		task.Warnf("Not running onExit commands since task was aborted: %v", ae)
+		return
+	}
+	task.Info("=== Running onExit Commands ===")
+
+	exitCode := ""
+	for _, result := range task.CommandResults[:len(task.Payload.Command)] {
+		if result != nil {
+			exitCode = strconv.Itoa(int(result.ExitCode()))
+		}
+	}
+	status, _ := err.Resolution()
+	for name, value := range map[string]string{
+		"TASK_EXIT_CODE": exitCode,
+		"TASK_STATUS":    status,
+	} {
+		if e := task.setVariable(name, value); e != nil {
+			panic(e)
+		}
+	}
+
+	onExitMaxRunTime := task.Payload.OnExitMaxRunTime
+	if onExitMaxRunTime == 0 {
+		onExitMaxRunTime = defaultOnExitMaxRunTime
+	}
+	var timedOut int32
+	t := time.AfterFunc(
+		time.Second*time.Duration(onExitMaxRunTime),
+		func() {
+			atomic.StoreInt32(&timedOut, 1)
+			task.Warnf("onExit commands exceeded max run time of %v seconds - killing them", onExitMaxRunTime)
+			for _, command := range task.Commands[len(task.Payload.Command):] {
+				task.killCommand(command)
+			}
+		},
+	)
+	defer t.Stop()
+
+	for i := len(task.Payload.Command); i < len(task.CommandDefinitions); i++ {
+		if atomic.LoadInt32(&timedOut) == 1 {
+			task.Warnf("Not running command %v since onExit commands exceeded their max run time", i)
+			continue
+		}
+		result, duration, _ := task.runCommand(i)
+		if atomic.LoadInt32(&timedOut) == 1 {
+			task.commandAbortReasons[i] = fmt.Sprintf("max run time of onExit commands (%v seconds) exceeded", onExitMaxRunTime)
+		}
+		task.Infof("%v", result)
+		task.Infof("Command %v duration: %v", i, duration)
+		switch {
+		case result.Failed():
+			task.Warnf("onExit command %v failed, which does not affect task resolution: %v", i, result.FailureCause())
+		case result.Crashed():
+			task.Warnf("onExit command %v crashed, which does not affect task resolution: %v", i, result.CrashCause())
+		}
+	}
+}
+
 type ExecutionErrors []*CommandExecutionError
 
 func (e *ExecutionErrors) add(err *CommandExecutionError) {
@@ -804,6 +1041,19 @@ func (e *ExecutionErrors) Occurred() bool {
 	return len(*e) > 0
 }
 
+// Resolution returns the state (completed, failed or exception) and reason
+// that the task will be resolved with, based on the errors that have
+// occurred.
+func (e *ExecutionErrors) Resolution() (state string, reason string) {
+	if !e.Occurred() {
+		return "completed", "completed"
+	}
+	if (*e)[0].TaskStatus == failed {
+		return "failed", "failed"
+	}
+	return "exception", string((*e)[0].Reason)
+}
+
 func (task *TaskRun) resolve(e *ExecutionErrors) *CommandExecutionError {
 	log.Printf("Resolving task %v ...", task.TaskID)
 	if !e.Occurred() {
@@ -830,15 +1080,25 @@ func (task *TaskRun) setMaxRunTimer() *time.Timer {
 }
 
 func (task *TaskRun) kill() {
-	for _, command := range task.Commands {
-		output, err := command.Kill()
-		if len(output) > 0 {
-			task.Info(string(output))
-		}
-		if err != nil {
-			log.Printf("WARNING: %v", err)
-			task.Warnf("%v", err)
-		}
+	commands := task.Commands
+	// onExit commands must still run after the task commands are aborted for
+	// exceeding the task max run time, so are only killed once running
+	if atomic.LoadInt32(&task.runningOnExit) == 0 && len(commands) > len(task.Payload.Command) {
+		commands = commands[:len(task.Payload.Command)]
+	}
+	for _, command := range commands {
+		task.killCommand(command)
+	}
+}
+
+func (task *TaskRun) killCommand(command *process.Command) {
+	output, err := command.Kill()
+	if len(output) > 0 {
+		task.Info(string(output))
+	}
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		task.Warnf("%v", err)
 	}
 }
 
@@ -900,6 +1160,7 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 		}
 		task.closeLog(logHandle)
 		err.add(task.uploadLog(logName, logPath))
+		err.add(task.uploadRunSummary(err))
 	}()
 
 	task.logHeader()
@@ -910,9 +1171,11 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 	}
 	log.Printf("Running task %v/tasks/%v/runs/%v", config.RootURL, task.TaskID, task.RunID)
 
-	task.Commands = make([]*process.Command, len(task.Payload.Command))
+	task.Commands = make([]*process.Command, len(task.CommandDefinitions))
+	task.CommandResults = make([]*process.Result, len(task.CommandDefinitions))
+	task.commandAbortReasons = make([]string, len(task.CommandDefinitions))
 	// generate commands, in case features want to modify them
-	for i := range task.Payload.Command {
+	for i := range task.CommandDefinitions {
 		err := task.generateCommand(i) // platform specific
 		if err != nil {
 			panic(err)
@@ -923,13 +1186,19 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 	type TaskFeatureOrigin struct {
 		taskFeature TaskFeature
 		feature     Feature
+		summary     *FeatureSummary
 	}
 
 	taskFeatureOrigins := []TaskFeatureOrigin{}
 
 	// create task features
 	for _, feature := range Features {
-		if feature.IsEnabled(task) {
+		featureSummary := &FeatureSummary{
+			Name:    feature.Name(),
+			Enabled: feature.IsEnabled(task),
+		}
+		task.featureSummaries = append(task.featureSummaries, featureSummary)
+		if featureSummary.Enabled {
 			log.Printf("Creating task feature %v...", feature.Name())
 			taskFeature := feature.NewTaskFeature(task)
 			requiredScopes := taskFeature.RequiredScopes()
@@ -957,6 +1226,7 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 				TaskFeatureOrigin{
 					taskFeature: taskFeature,
 					feature:     feature,
+					summary:     featureSummary,
 				},
 			)
 		}
@@ -969,13 +1239,22 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 	for _, taskFeatureOrigin := range taskFeatureOrigins {
 
 		log.Printf("Starting task feature %v...", taskFeatureOrigin.feature.Name())
-		err.add(taskFeatureOrigin.taskFeature.Start())
+		taskFeatureOrigin.summary.Started = true
+		if startErr := taskFeatureOrigin.taskFeature.Start(); startErr != nil {
+			taskFeatureOrigin.summary.StartError = startErr.Error()
+			err.add(startErr)
+		}
 
 		// make sure we defer Stop() even if Start() returns an error, since the feature may have made
 		// changes that need cleaning up in Stop() before it hit the error that it returned...
 		defer func(taskFeatureOrigin TaskFeatureOrigin) {
 			log.Printf("Stopping task feature %v...", taskFeatureOrigin.feature.Name())
+			errorCount := len(*err)
 			taskFeatureOrigin.taskFeature.Stop(err)
+			taskFeatureOrigin.summary.Stopped = true
+			for _, stopErr := range (*err)[errorCount:] {
+				taskFeatureOrigin.summary.StopErrors = append(taskFeatureOrigin.summary.StopErrors, stopErr.Error())
+			}
 		}(taskFeatureOrigin)
 
 		if err.Occurred() {
@@ -1055,10 +1334,14 @@ func (task *TaskRun) Run() (err *ExecutionErrors) {
 	for i := range task.Payload.Command {
 		err.add(task.ExecuteCommand(i))
 		if err.Occurred() {
-			return
+			break
 		}
 	}
 
+	// onExit commands are not subject to the task max run time
+	t.Stop()
+	task.executeOnExitCommands(err)
+
 	return
 }
 
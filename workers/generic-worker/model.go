@@ -25,6 +25,13 @@ type (
 		Artifacts map[string]TaskArtifact `json:"-"`
 		Status    TaskStatus              `json:"-"`
 		Commands  []*process.Command      `json:"-"`
+		// CommandDefinitions has an entry for each command in task.payload.command,
+		// followed by task.payload.onExit, converted to a CommandWithOptions if
+		// specified in plain form
+		CommandDefinitions []CommandWithOptions `json:"-"`
+		// CommandResults has an entry for each command in CommandDefinitions,
+		// which is nil if the command was not run
+		CommandResults []*process.Result `json:"-"`
 		// not exported
 		logMux         sync.RWMutex
 		logWriter      io.Writer
@@ -43,6 +50,14 @@ type (
 		// be useful for the user. Normally this map would get appended to by
 		// features when they are started.
 		featureArtifacts map[string]string
+		// set (atomically) to 1 once the onExit commands start running, before
+		// which only the task commands are killed when the task is aborted
+		runningOnExit int32
+		// Data recorded during the task run for the run summary artifact
+		commandAbortReasons []string
+		mountSummaries      []*MountSummary
+		artifactSummaries   []*ArtifactSummary
+		featureSummaries    []*FeatureSummary
 	}
 
 	TaskStatus       string
@@ -95,7 +110,7 @@ func (task *TaskRun) String() string {
 	response += fmt.Sprintf("Worker Type:             %v\n", task.Definition.WorkerType)
 	response += "==========================================\n"
 	response += fmt.Sprintf("Artifacts:               %v\n", task.Payload.Artifacts)
-	response += fmt.Sprintf("Command:                 %#v\n", task.Payload.Command)
+	response += fmt.Sprintf("Command:                 %s\n", task.Payload.Command)
 	response += fmt.Sprintf("Env:                     %#v\n", task.Payload.Env)
 	response += fmt.Sprintf("Max Run Time:            %v\n", task.Payload.MaxRunTime)
 	response += "==========================================\n"
@@ -357,12 +357,18 @@ func (taskMount *TaskMount) Start() *CommandExecutionError {
 	}
 	// loop through all mounts described in payload
 	for _, mount := range taskMount.mounts {
+		summary := newMountSummary(mount)
+		taskMount.task.mountSummaries = append(taskMount.task.mountSummaries, summary)
+		started := time.Now()
 		err = mount.Mount(taskMount.task)
+		// Round(0) forces wall time calculation instead of monotonic time in case machine slept etc
+		summary.DurationSeconds = time.Now().Round(0).Sub(started).Seconds()
 		// An error is returned if it is a task problem, such as an invalid url
 		// to download content, or a downloaded archive cannot be extracted.
 		// If the problem is internal (e.g. can't mount a writable cache) then
 		// this is handled by a panic.
 		if err != nil {
+			summary.Error = err.Error()
 			return Failure(fmt.Errorf("[mounts] %s", err))
 		}
 		taskMount.mounted = append(taskMount.mounted, mount)
@@ -370,10 +376,47 @@ func (taskMount *TaskMount) Start() *CommandExecutionError {
 	return nil
 }
 
+// newMountSummary returns a summary of the given mount for the run summary
+// of the task. Details of the content of the mount are filled in when it is
+// mounted.
+func newMountSummary(mount MountEntry) *MountSummary {
+	switch m := mount.(type) {
+	case *WritableDirectoryCache:
+		return &MountSummary{
+			Type:      "writableDirectoryCache",
+			Path:      m.Directory,
+			CacheName: m.CacheName,
+		}
+	case *ReadOnlyDirectory:
+		return &MountSummary{
+			Type: "readOnlyDirectory",
+			Path: m.Directory,
+		}
+	case *FileMount:
+		return &MountSummary{
+			Type: "fileMount",
+			Path: m.File,
+		}
+	}
+	return &MountSummary{}
+}
+
 // called when a task has completed
 func (taskMount *TaskMount) Stop(err *ExecutionErrors) {
+	purgeCaches := taskMount.task.PurgeCachesRequested()
 	// loop through all mounts described in payload
 	for i, mount := range taskMount.mounted {
+		if w, isCache := mount.(*WritableDirectoryCache); isCache && purgeCaches {
+			// The cache directory inside the task will be cleaned up when the
+			// task directory is deleted, so it just needs to be removed from
+			// the cache table.
+			taskMount.task.Infof("[mounts] Purging cache %v since a task command exited with an exit code listed in task payload.onExitStatus.purgeCaches", w.CacheName)
+			e := directoryCaches[w.CacheName].Expunge(taskMount.task)
+			if e != nil {
+				panic(e)
+			}
+			continue
+		}
 		e := mount.Unmount(taskMount.task)
 		if e != nil {
 			fsc, errfsc := mount.FSContent()
@@ -433,6 +476,7 @@ func (w *WritableDirectoryCache) Mount(task *TaskRun) error {
 	if _, dirCacheExists := directoryCaches[w.CacheName]; dirCacheExists {
 		// bump counter
 		directoryCaches[w.CacheName].Hits++
+		task.currentMountSummary().CacheHit = true
 		// move it into place...
 		src := directoryCaches[w.CacheName].Location
 		parentDir := filepath.Dir(target)
@@ -592,6 +636,25 @@ func ensureCached(fsContent FSContent, task *TaskRun) (file string, err error) {
 	cacheKey := fsContent.UniqueKey()
 	var sha256 string
 	requiredSHA256 := fsContent.RequiredSHA256()
+	summary := task.currentMountSummary()
+	summary.Source = fsContent.String()
+	summary.content = fsContent
+	defer func() {
+		if err != nil {
+			return
+		}
+		if fileInfo, statErr := os.Stat(file); statErr == nil {
+			summary.Bytes = fileInfo.Size()
+		}
+		// raw and base64 content is not hashed when written to file
+		if sha256 == "" {
+			sha256, err = fileutil.CalculateSHA256(file)
+			if err != nil {
+				panic(fmt.Sprintf("Internal worker bug! Cannot calculate SHA256 of file %v: %v", file, err))
+			}
+		}
+		summary.SHA256 = sha256
+	}()
 	if _, inCache := fileCaches[cacheKey]; inCache {
 		file = fileCaches[cacheKey].Location
 		// Sanity check - if file is in file map, but not on file system,
@@ -610,10 +673,12 @@ func ensureCached(fsContent FSContent, task *TaskRun) (file string, err error) {
 		}
 		if requiredSHA256 == "" {
 			task.Warnf("[mounts] No SHA256 specified in task mounts for %v - SHA256 from downloaded file %v is %v.", cacheKey, file, sha256)
+			summary.CacheHit = true
 			return
 		}
 		if requiredSHA256 == sha256 {
 			task.Infof("[mounts] Found existing download for %v (%v) with correct SHA256 %v", cacheKey, file, sha256)
+			summary.CacheHit = true
 			return
 		}
 		task.Infof("Found existing download of %v (%v) with SHA256 %v but task definition explicitly requires %v so deleting it", cacheKey, file, sha256, requiredSHA256)
@@ -528,3 +528,45 @@ func TestWritableDirectoryCacheNoSHA256(t *testing.T) {
 		},
 	)
 }
+
+// TestPurgeCachesExitCode tests that writable directory caches are purged if
+// a task command exits with an exit code listed in
+// task.payload.onExitStatus.purgeCaches, and preserved otherwise.
+func TestPurgeCachesExitCode(t *testing.T) {
+	defer setup(t)()
+
+	mounts := []MountEntry{
+		&WritableDirectoryCache{
+			CacheName: "purge-me",
+			Directory: t.Name(),
+		},
+	}
+
+	execute := func(exitCode uint) {
+		payload := GenericWorkerPayload{
+			Mounts:     toMountArray(t, &mounts),
+			Command:    returnExitCode(exitCode),
+			MaxRunTime: 30,
+			OnExitStatus: ExitCodeHandling{
+				PurgeCaches: []int64{7},
+			},
+		}
+		td := testTask(t)
+		td.Scopes = []string{"generic-worker:cache:purge-me"}
+		_ = submitAndAssert(t, td, payload, "failed", "failed")
+	}
+
+	execute(8)
+	if _, exists := directoryCaches["purge-me"]; !exists {
+		t.Fatal("Was expecting cache purge-me to be preserved, since exit code is not listed in onExitStatus.purgeCaches")
+	}
+
+	execute(7)
+	if _, exists := directoryCaches["purge-me"]; exists {
+		t.Fatal("Was expecting cache purge-me to be purged, since exit code is listed in onExitStatus.purgeCaches")
+	}
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "Purging cache purge-me") {
+		t.Fatalf("Was expecting log to mention cache purge, but it doesn't:\n%v", logtext)
+	}
+}
@@ -17,7 +17,7 @@ import (
 )
 
 func (task *TaskRun) formatCommand(index int) string {
-	return shell.Escape(task.Payload.Command[index]...)
+	return shell.Escape(task.CommandDefinitions[index].Command...)
 }
 
 func platformFeatures() []Feature {
@@ -47,7 +47,12 @@ func deleteDir(path string) error {
 
 func (task *TaskRun) generateCommand(index int) error {
 	var err error
-	task.Commands[index], err = process.NewCommand(task.Payload.Command[index], taskContext.TaskDir, task.EnvVars(), taskContext.pd)
+	env := task.EnvVars()
+	// env vars of the individual command take precedence over task env vars
+	for k, v := range task.CommandDefinitions[index].Env {
+		env = append(env, k+"="+v)
+	}
+	task.Commands[index], err = process.NewCommand(task.CommandDefinitions[index].Command, task.commandDir(index), env, taskContext.pd)
 	if err != nil {
 		return err
 	}
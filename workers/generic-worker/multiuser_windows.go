@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	stdlibruntime "runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -24,7 +25,7 @@ import (
 )
 
 func (task *TaskRun) formatCommand(index int) string {
-	return task.Payload.Command[index]
+	return task.CommandDefinitions[index].Command
 }
 
 func platformFeatures() []Feature {
@@ -97,8 +98,10 @@ func (task *TaskRun) prepareCommand(index int) *CommandExecutionError {
 	// user.
 
 	// If this is first command, take env from task payload, and cd into home
-	// directory
-	if index == 0 {
+	// directory. Do the same if there is no env file from a previous command,
+	// which can happen if an onExit command runs after the first task command
+	// was killed before it completed.
+	if _, err := os.Stat(env); index == 0 || os.IsNotExist(err) {
 		envVars := map[string]string{}
 		for k, v := range task.Payload.Env {
 			envVars[k] = v
@@ -147,6 +150,30 @@ func (task *TaskRun) prepareCommand(index int) *CommandExecutionError {
 		contents += "cd \"" + dirString + "\"\r\n"
 	}
 
+	// Apply any env vars and working directory of the individual command,
+	// saving the values they replace, so that they can be restored after the
+	// command has run, and do not persist into subsequent commands.
+	restore := ""
+	commandEnv := task.CommandDefinitions[index].Env
+	envVars := make([]string, 0, len(commandEnv))
+	for envVar := range commandEnv {
+		envVars = append(envVars, envVar)
+	}
+	sort.Strings(envVars)
+	for i, envVar := range envVars {
+		saved := "GW_SAVED_ENV_" + strconv.Itoa(i)
+		contents += "set \"" + saved + "=%" + envVar + "%\"\r\n"
+		contents += setEnvVarCommand(envVar, commandEnv[envVar])
+		restore += "set \"" + envVar + "=%" + saved + "%\"\r\n"
+		restore += "set " + saved + "=\r\n"
+	}
+	if task.CommandDefinitions[index].Cwd != "" {
+		contents += "set \"GW_SAVED_DIR=%CD%\"\r\n"
+		contents += "cd \"" + task.commandDir(index) + "\"\r\n"
+		restore += "cd \"%GW_SAVED_DIR%\"\r\n"
+		restore += "set GW_SAVED_DIR=\r\n"
+	}
+
 	// see http://blogs.msdn.com/b/oldnewthing/archive/2008/09/26/8965755.aspx
 	// need to explicitly unset as we rely on it later
 	contents += "set errorlevel=\r\n"
@@ -165,8 +192,11 @@ func (task *TaskRun) prepareCommand(index int) *CommandExecutionError {
 	// store exit code
 	contents += "set tcexitcode=%errorlevel%\r\n"
 
+	// restore the env vars and working directory replaced for this command
+	contents += restore
+
 	// now store env for next command, unless this is the last command
-	if index != len(task.Payload.Command)-1 {
+	if index != len(task.CommandDefinitions)-1 {
 		contents += "set > " + env + "\r\n"
 		contents += "cd > " + dir + "\r\n"
 	}
@@ -187,7 +217,7 @@ func (task *TaskRun) prepareCommand(index int) *CommandExecutionError {
 	// Now make the actual task a .bat script
 	fileContents := []byte(strings.Join([]string{
 		"@echo on",
-		task.Payload.Command[index],
+		task.CommandDefinitions[index].Command,
 	}, "\r\n"))
 
 	err = ioutil.WriteFile(
@@ -22,7 +22,7 @@ func TestAppDataNotShared(t *testing.T) {
 
 	// First task:
 	payload1 := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			// make sure vars are set
 			// https://bugzilla.mozilla.org/show_bug.cgi?id=1338602
 			`if not defined APPDATA exit /b 68`,
@@ -31,7 +31,7 @@ func TestAppDataNotShared(t *testing.T) {
 			"echo hello > %LOCALAPPDATA%\\sir.txt",
 			`if not exist "%APPDATA%\hello.txt" exit /b 64`,
 			`if not exist "%LOCALAPPDATA%\sir.txt" exit /b 65`,
-		},
+		}),
 		MaxRunTime: 10,
 	}
 	td1 := testTask(t)
@@ -40,7 +40,7 @@ func TestAppDataNotShared(t *testing.T) {
 
 	// Second task:
 	payload2 := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			// make sure vars are set
 			// https://bugzilla.mozilla.org/show_bug.cgi?id=1338602
 			`if not defined APPDATA exit /b 70`,
@@ -49,7 +49,7 @@ func TestAppDataNotShared(t *testing.T) {
 			// fresh folders created
 			`if exist "%APPDATA%\hello.txt" exit /b 66`,
 			`if exist "%LOCALAPPDATA%\sir.txt" exit /b 67`,
-		},
+		}),
 		MaxRunTime: 10,
 	}
 	td2 := testTask(t)
@@ -74,7 +74,7 @@ func TestNoCreateFileMappingError(t *testing.T) {
 		// run several bash commands, as running one is horribly slow, but
 		// let's make sure if you run a lot of them, they are not all slow -
 		// hopefully just the first one is the problem
-		Command: []string{
+		Command: toCommandArray([]string{
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
@@ -87,7 +87,7 @@ func TestNoCreateFileMappingError(t *testing.T) {
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
 			`c:\mozilla-build\msys\bin\bash.exe -c "echo hello"`,
-		},
+		}),
 		MaxRunTime: 120,
 	}
 	td := testTask(t)
@@ -105,7 +105,7 @@ func TestDesktopResizeAndMovePointer(t *testing.T) {
 	}
 	commands := copyTestdataFile("mouse_and_screen_resolution.py")
 	commands = append(commands, copyTestdataFile("machine-configuration.json")...)
-	commands = append(commands, "python mouse_and_screen_resolution.py --configuration-file machine-configuration.json")
+	commands = append(commands, toCommandArray([]string{"python mouse_and_screen_resolution.py --configuration-file machine-configuration.json"})...)
 	payload := GenericWorkerPayload{
 		Command:    commands,
 		MaxRunTime: 90,
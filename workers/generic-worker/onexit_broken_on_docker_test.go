@@ -0,0 +1,83 @@
+// +build !docker
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// onExit commands should be told the exit code of the last task command, and
+// the resolution the task commands gave the task
+func TestOnExitEnvVars(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command: returnExitCode(3),
+		OnExit: goRun(
+			"check-env.go",
+			"TASK_EXIT_CODE",
+			"3",
+			"TASK_STATUS",
+			"failed",
+		),
+		MaxRunTime: 180,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "All ok") {
+		t.Fatalf("Was expecting onExit commands to see task exit status, but they didn't:\n%v", logtext)
+	}
+}
+
+// onExit commands should run after the task exceeds its max run time
+func TestOnExitAfterMaxRunTimeExceeded(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    sleep(30),
+		OnExit:     helloGoodbye(),
+		MaxRunTime: 5,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "max run time exceeded") {
+		t.Fatalf("Was expecting log to mention max run time exceeded, but it doesn't:\n%v", logtext)
+	}
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting onExit commands to run, but they didn't:\n%v", logtext)
+	}
+	// aborting the task commands must not abort the onExit commands, which on
+	// the multiuser engine would otherwise be started and left running
+	onExitLog := logtext[strings.Index(logtext, "=== Running onExit Commands ==="):]
+	if strings.Contains(onExitLog, "ABORTED") || strings.Contains(onExitLog, "does not affect task resolution") {
+		t.Fatalf("Was expecting onExit commands to succeed, but they didn't:\n%v", logtext)
+	}
+}
+
+// onExit commands that exceed onExitMaxRunTime should be killed, without
+// affecting task resolution
+func TestOnExitMaxRunTimeExceeded(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:          returnExitCode(0),
+		OnExit:           append(sleep(30), helloGoodbye()...),
+		OnExitMaxRunTime: 3,
+		MaxRunTime:       30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "onExit commands exceeded max run time of 3 seconds") {
+		t.Fatalf("Was expecting log to mention onExit max run time exceeded, but it doesn't:\n%v", logtext)
+	}
+	if strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was not expecting onExit commands to run after onExitMaxRunTime exceeded, but they did:\n%v", logtext)
+	}
+}
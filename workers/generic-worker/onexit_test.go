@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// onExit commands should run after successful task commands
+func TestOnExitAfterSuccess(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    returnExitCode(0),
+		OnExit:     helloGoodbye(),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting onExit commands to run, but they didn't:\n%v", logtext)
+	}
+}
+
+// onExit commands should run after a task command fails, and subsequent task
+// commands should not run
+func TestOnExitAfterFailure(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    append(returnExitCode(3), singleCommandNoArgs("this-command-should-not-run")...),
+		OnExit:     helloGoodbye(),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting onExit commands to run, but they didn't:\n%v", logtext)
+	}
+	if strings.Contains(logtext, "this-command-should-not-run") {
+		t.Fatalf("Was not expecting task commands after failed command to run, but they did:\n%v", logtext)
+	}
+}
+
+// Failures of onExit commands should not affect task resolution, and should
+// not prevent subsequent onExit commands from running
+func TestOnExitFailureIgnored(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    returnExitCode(0),
+		OnExit:     append(returnExitCode(5), helloGoodbye()...),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "which does not affect task resolution") {
+		t.Fatalf("Was expecting log to mention onExit command failure, but it doesn't:\n%v", logtext)
+	}
+	if !strings.Contains(logtext, "goodbye world!") {
+		t.Fatalf("Was expecting all onExit commands to run, but they didn't:\n%v", logtext)
+	}
+}
+
+// Exit codes listed in onExitStatus.retry should not apply to onExit commands
+func TestOnExitIntermittentCodeIgnored(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    returnExitCode(0),
+		OnExit:     returnExitCode(123),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Retry: []int64{123},
+		},
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Exit codes specified in onExitStatus.success should be treated as success,
+// and subsequent commands should still run
+func TestSuccessExitCode(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    append(returnExitCode(3), helloGoodbye()...),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Success: []int64{3},
+		},
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "completed", "completed")
+
+	logtext := LogText(t)
+	if !strings.Contains(logtext, "which is treated as success") {
+		t.Fatalf("Was expecting log to mention exit code treated as success, but it doesn't:\n%v", logtext)
+	}
+}
+
+// Exit codes _not_ specified in onExitStatus.success should resolve normally
+func TestSuccessExitCodeNotListed(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    returnExitCode(4),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Success: []int64{3},
+		},
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "failed", "failed")
+}
+
+// An exit code may not be listed in both onExitStatus.success and
+// onExitStatus.retry
+func TestSuccessAndRetryExitCodeConflict(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    returnExitCode(3),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Retry:   []int64{3, 4},
+			Success: []int64{3},
+		},
+	}
+	td := testTask(t)
+
+	_ = submitAndAssert(t, td, payload, "exception", "malformed-payload")
+}
@@ -138,6 +138,12 @@ func (c *Command) SetEnv(envVar, value string) {
 func (c *Command) Kill() (killOutput string, err error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	select {
+	case <-c.abort:
+		// already killed
+		return "", nil
+	default:
+	}
 	// abort even if process hasn't started
 	close(c.abort)
 	if c.Process == nil {
@@ -58,6 +58,15 @@ func (c *Command) Execute() (r *Result) {
 	r = &Result{}
 	started := time.Now()
 	c.mutex.Lock()
+	select {
+	case <-c.abort:
+		// killed before being started, so don't start it
+		c.mutex.Unlock()
+		r.SystemError = fmt.Errorf("Process aborted")
+		r.Aborted = true
+		return
+	default:
+	}
 	err := c.Start()
 	c.mutex.Unlock()
 	if err != nil {
@@ -112,6 +112,12 @@ func NewCommand(commandLine []string, workingDirectory string, env []string, pd
 func (c *Command) Kill() (killOutput string, err error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	select {
+	case <-c.abort:
+		// already killed
+		return "", nil
+	default:
+	}
 	if c.Process == nil {
 		// If process hasn't been started yet, nothing to kill
 		return "", nil
@@ -79,6 +79,12 @@ func (c *Command) SetEnv(envVar, value string) {
 func (c *Command) Kill() (killOutput string, err error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	select {
+	case <-c.abort:
+		// already killed
+		return "", nil
+	default:
+	}
 	if c.Process == nil {
 		// If process hasn't been started yet, nothing to kill
 		return "", nil
@@ -10,13 +10,13 @@ func TestRunAsAdministratorDisabled(t *testing.T) {
 		t.Skip("Skipping since running as current user...")
 	}
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`whoami /groups`,
 			// S-1-16-12288 is SID of 'High Mandatory Level' which implies process is elevated
 			// See also https://msdn.microsoft.com/en-us/library/bb625963.aspx
 			// and https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_token_elevation
 			`whoami /groups | C:\Windows\System32\find.exe "S-1-16-12288" > nul`,
-		},
+		}),
 		MaxRunTime: 10,
 	}
 	td := testTask(t)
@@ -30,13 +30,13 @@ func TestRunAsAdministratorEnabledMissingScopes(t *testing.T) {
 		t.Skip("Skipping since running as current user...")
 	}
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`whoami /groups`,
 			// S-1-16-12288 is SID of 'High Mandatory Level' which implies process is elevated
 			// See also https://msdn.microsoft.com/en-us/library/bb625963.aspx
 			// and https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_token_elevation
 			`whoami /groups | C:\Windows\System32\find.exe "S-1-16-12288" > nul`,
-		},
+		}),
 		MaxRunTime: 10,
 		Features: FeatureFlags{
 			RunAsAdministrator: true,
@@ -59,13 +59,13 @@ func TestRunAsAdministratorMissingOSGroup(t *testing.T) {
 		t.Skip("Skipping since running as current user...")
 	}
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`whoami /groups`,
 			// S-1-16-12288 is SID of 'High Mandatory Level' which implies process is elevated
 			// See also https://msdn.microsoft.com/en-us/library/bb625963.aspx
 			// and https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_token_elevation
 			`whoami /groups | C:\Windows\System32\find.exe "S-1-16-12288" > nul`,
-		},
+		}),
 		MaxRunTime: 10,
 		OSGroups:   []string{}, // Administrators not included!
 		Features: FeatureFlags{
@@ -89,9 +89,9 @@ func TestRunAsAdministratorMissingOSGroup(t *testing.T) {
 func TestChainOfTrustWithRunAsAdministrator(t *testing.T) {
 	defer setup(t)()
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`type "` + config.Ed25519SigningKeyLocation + `"`,
-		},
+		}),
 		MaxRunTime: 5,
 		OSGroups:   []string{"Administrators"},
 		Features: FeatureFlags{
@@ -123,9 +123,9 @@ func TestChainOfTrustWithRunAsAdministrator(t *testing.T) {
 func TestChainOfTrustWithoutRunAsAdministrator(t *testing.T) {
 	defer setup(t)()
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`type "` + config.Ed25519SigningKeyLocation + `"`,
-		},
+		}),
 		MaxRunTime: 5,
 		OSGroups:   []string{"Administrators"},
 		Features: FeatureFlags{
@@ -161,13 +161,13 @@ func TestRunAsAdministratorEnabled(t *testing.T) {
 		t.Skip("Skipping since running as current user...")
 	}
 	payload := GenericWorkerPayload{
-		Command: []string{
+		Command: toCommandArray([]string{
 			`whoami /groups`,
 			// S-1-16-12288 is SID of 'High Mandatory Level' which implies process is elevated
 			// See also https://msdn.microsoft.com/en-us/library/bb625963.aspx
 			// and https://docs.microsoft.com/en-us/windows/desktop/api/winnt/ns-winnt-_token_elevation
 			`whoami /groups | C:\Windows\System32\find.exe "S-1-16-12288" > nul`,
-		},
+		}),
 		MaxRunTime: 10,
 		Features: FeatureFlags{
 			RunAsAdministrator: true,
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
+)
+
+var (
+	runSummaryPath = filepath.Join("generic-worker", "run-summary.json")
+	runSummaryName = "public/logs/run-summary.json"
+)
+
+type (
+	// RunSummary is a machine readable summary of a task run, published as
+	// artifact public/logs/run-summary.json at the end of the task run.
+	RunSummary struct {
+		TaskID      string   `json:"taskId"`
+		RunID       uint     `json:"runId"`
+		WorkerGroup string   `json:"workerGroup"`
+		WorkerID    string   `json:"workerId"`
+		Version     string   `json:"genericWorkerVersion"`
+		Revision    string   `json:"genericWorkerRevision,omitempty"`
+		Engine      string   `json:"engine"`
+		State       string   `json:"state"`
+		Reason      string   `json:"reasonResolved"`
+		Errors      []string `json:"errors"`
+		// Commands lists the commands of task.payload.command, followed by
+		// those of task.payload.onExit
+		Commands  []*CommandSummary  `json:"commands"`
+		Mounts    []*MountSummary    `json:"mounts"`
+		Artifacts []*ArtifactSummary `json:"artifacts"`
+		Features  []*FeatureSummary  `json:"features"`
+	}
+
+	CommandSummary struct {
+		// Command is an array of arguments on posix platforms, and a command
+		// line on Windows
+		Command interface{} `json:"command"`
+		OnExit  bool        `json:"onExit"`
+		// Executed is false if the command was not run, for example due to a
+		// previous command failing
+		Executed bool `json:"executed"`
+		// ExitCode is only set if the command was executed
+		ExitCode        *int64  `json:"exitCode,omitempty"`
+		DurationSeconds float64 `json:"durationSeconds"`
+		AbortReason     string  `json:"abortReason,omitempty"`
+	}
+
+	MountSummary struct {
+		// Type is one of fileMount, readOnlyDirectory or
+		// writableDirectoryCache
+		Type string `json:"type"`
+		// Path is the file or directory, relative to the task directory,
+		// that the content is mounted at
+		Path      string `json:"path"`
+		CacheName string `json:"cacheName,omitempty"`
+		// Source describes where the content of the mount came from, if it
+		// has any content
+		Source string `json:"source,omitempty"`
+		// CacheHit is true if the mount was satisfied from an existing
+		// writable directory cache, or content previously downloaded by the
+		// worker, rather than fetching its content
+		CacheHit bool `json:"cacheHit"`
+		// Bytes is the size of the content file (which may be an archive) of
+		// the mount
+		Bytes int64 `json:"bytes,omitempty"`
+		// SHA256 is the SHA256 of the content file of the mount
+		SHA256          string  `json:"sha256,omitempty"`
+		DurationSeconds float64 `json:"durationSeconds"`
+		Error           string  `json:"error,omitempty"`
+		// content is the resolved content of the mount, if it has any
+		content FSContent
+	}
+
+	ArtifactSummary struct {
+		Name        string        `json:"name"`
+		StorageType string        `json:"storageType"`
+		Expires     tcclient.Time `json:"expires"`
+		// Bytes is the size of the artifact file, for s3 artifacts
+		Bytes                 int64   `json:"bytes,omitempty"`
+		UploadDurationSeconds float64 `json:"uploadDurationSeconds"`
+		// Result is either "uploaded" or "failed"
+		Result string `json:"result"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	FeatureSummary struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+		// Started is true if the feature was started, even if its Start
+		// method returned an error
+		Started    bool     `json:"started"`
+		StartError string   `json:"startError,omitempty"`
+		Stopped    bool     `json:"stopped"`
+		StopErrors []string `json:"stopErrors,omitempty"`
+	}
+)
+
+// currentMountSummary returns the summary of the mount currently being
+// mounted. Mounts are mounted sequentially, so this is the most recently
+// added mount summary.
+func (task *TaskRun) currentMountSummary() *MountSummary {
+	if len(task.mountSummaries) == 0 {
+		// not mounting as part of a task mount, so nothing to record
+		return &MountSummary{}
+	}
+	return task.mountSummaries[len(task.mountSummaries)-1]
+}
+
+func (task *TaskRun) runSummary(err *ExecutionErrors) *RunSummary {
+	state, reason := err.Resolution()
+	summary := &RunSummary{
+		TaskID:      task.TaskID,
+		RunID:       task.RunID,
+		WorkerGroup: config.WorkerGroup,
+		WorkerID:    config.WorkerID,
+		Version:     version,
+		Revision:    revision,
+		Engine:      engine,
+		State:       state,
+		Reason:      reason,
+		Errors:      []string{},
+		Commands:    []*CommandSummary{},
+		Mounts:      task.mountSummaries,
+		Artifacts:   task.artifactSummaries,
+		Features:    task.featureSummaries,
+	}
+	if summary.Mounts == nil {
+		summary.Mounts = []*MountSummary{}
+	}
+	if summary.Artifacts == nil {
+		summary.Artifacts = []*ArtifactSummary{}
+	}
+	if summary.Features == nil {
+		summary.Features = []*FeatureSummary{}
+	}
+	if err.Occurred() {
+		for _, e := range *err {
+			summary.Errors = append(summary.Errors, e.Error())
+		}
+	}
+	for i, command := range task.CommandDefinitions {
+		commandSummary := &CommandSummary{
+			Command: command.Command,
+			OnExit:  i >= len(task.Payload.Command),
+		}
+		if i < len(task.CommandResults) && task.CommandResults[i] != nil {
+			result := task.CommandResults[i]
+			exitCode := int64(result.ExitCode())
+			commandSummary.Executed = true
+			commandSummary.ExitCode = &exitCode
+			commandSummary.DurationSeconds = result.Duration.Seconds()
+		}
+		if i < len(task.commandAbortReasons) {
+			commandSummary.AbortReason = task.commandAbortReasons[i]
+		}
+		summary.Commands = append(summary.Commands, commandSummary)
+	}
+	return summary
+}
+
+// uploadRunSummary writes the run summary of the task to a file in the task
+// directory, and publishes it as an artifact.
+func (task *TaskRun) uploadRunSummary(err *ExecutionErrors) *CommandExecutionError {
+	summaryBytes, e := json.MarshalIndent(task.runSummary(err), "", "  ")
+	if e != nil {
+		panic(e)
+	}
+	e = ioutil.WriteFile(filepath.Join(taskContext.TaskDir, runSummaryPath), summaryBytes, 0644)
+	if e != nil {
+		panic(e)
+	}
+	return task.uploadArtifact(
+		&S3Artifact{
+			BaseArtifact: &BaseArtifact{
+				Name: runSummaryName,
+				// run summary expires when task expires, like the task logs
+				Expires: task.Definition.Expires,
+			},
+			ContentType:     "application/json",
+			ContentEncoding: "gzip",
+			Path:            runSummaryPath,
+		},
+	)
+}
+
+// newArtifactSummary returns a summary of the given artifact, which is added
+// to the run summary of the task.
+func (task *TaskRun) newArtifactSummary(artifact TaskArtifact) *ArtifactSummary {
+	summary := &ArtifactSummary{
+		Name:    artifact.Base().Name,
+		Expires: artifact.Base().Expires,
+	}
+	switch a := artifact.(type) {
+	case *S3Artifact:
+		summary.StorageType = "s3"
+		if fileInfo, err := os.Stat(filepath.Join(taskContext.TaskDir, a.Path)); err == nil {
+			summary.Bytes = fileInfo.Size()
+		}
+	case *RedirectArtifact:
+		summary.StorageType = "reference"
+	case *ErrorArtifact:
+		summary.StorageType = "error"
+	}
+	task.artifactSummaries = append(task.artifactSummaries, summary)
+	return summary
+}
+
+// finish records the outcome of uploading the artifact, which started at
+// the given time
+func (summary *ArtifactSummary) finish(started time.Time, err *CommandExecutionError) {
+	// Round(0) forces wall time calculation instead of monotonic time in case machine slept etc
+	summary.UploadDurationSeconds = time.Now().Round(0).Sub(started).Seconds()
+	summary.Result = "uploaded"
+	if err != nil {
+		summary.Result = "failed"
+		summary.Error = err.Error()
+	}
+}
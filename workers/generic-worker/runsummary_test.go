@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func getRunSummary(t *testing.T, taskID string) *RunSummary {
+	b, _, _, _ := getArtifactContent(t, taskID, "public/logs/run-summary.json")
+	summary := new(RunSummary)
+	err := json.Unmarshal(b, summary)
+	if err != nil {
+		t.Fatalf("Could not interpret public/logs/run-summary.json as json: %v\n%s", err, b)
+	}
+	return summary
+}
+
+func TestRunSummaryCommands(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    append(append(returnExitCode(0), returnExitCode(3)...), returnExitCode(0)...),
+		OnExit:     returnExitCode(4),
+		MaxRunTime: 30,
+	}
+	td := testTask(t)
+
+	taskID := submitAndAssert(t, td, payload, "failed", "failed")
+
+	summary := getRunSummary(t, taskID)
+	if summary.TaskID != taskID || summary.State != "failed" || summary.Reason != "failed" {
+		t.Fatalf("Run summary has wrong task resolution: %#v", summary)
+	}
+	if len(summary.Errors) == 0 {
+		t.Fatal("Was expecting run summary to list task errors, but it doesn't")
+	}
+	if len(summary.Commands) != 4 {
+		t.Fatalf("Was expecting 4 commands in run summary but got %v", len(summary.Commands))
+	}
+	for i, expected := range []struct {
+		onExit   bool
+		executed bool
+		exitCode int64
+	}{
+		{onExit: false, executed: true, exitCode: 0},
+		{onExit: false, executed: true, exitCode: 3},
+		{onExit: false, executed: false},
+		{onExit: true, executed: true, exitCode: 4},
+	} {
+		command := summary.Commands[i]
+		if command.OnExit != expected.onExit || command.Executed != expected.executed {
+			t.Fatalf("Command %v has wrong run summary: %#v", i, command)
+		}
+		if expected.executed && (command.ExitCode == nil || *command.ExitCode != expected.exitCode) {
+			t.Fatalf("Was expecting command %v to have exit code %v in run summary: %#v", i, expected.exitCode, command)
+		}
+		if !expected.executed && command.ExitCode != nil {
+			t.Fatalf("Was not expecting command %v to have an exit code in run summary: %#v", i, command)
+		}
+	}
+
+	found := false
+	for _, artifact := range summary.Artifacts {
+		if artifact.Name == "public/logs/live_backing.log" {
+			found = true
+			if artifact.StorageType != "s3" || artifact.Result != "uploaded" || artifact.Bytes == 0 {
+				t.Fatalf("Run summary has wrong details for task log: %#v", artifact)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Was expecting run summary to include task log, but it doesn't: %#v", summary.Artifacts)
+	}
+
+	if len(summary.Features) != len(Features) {
+		t.Fatalf("Was expecting %v features in run summary but got %v", len(Features), len(summary.Features))
+	}
+	for _, feature := range summary.Features {
+		if feature.Enabled != (feature.Started && feature.Stopped) {
+			t.Fatalf("Was expecting enabled features to have been started and stopped: %#v", feature)
+		}
+	}
+}
+
+func TestRunSummaryMounts(t *testing.T) {
+	defer setup(t)()
+
+	mounts := []MountEntry{
+		&WritableDirectoryCache{
+			CacheName: "run-summary-cache",
+			Directory: "my-cache",
+		},
+	}
+	payload := GenericWorkerPayload{
+		Mounts:     toMountArray(t, &mounts),
+		Command:    helloGoodbye(),
+		MaxRunTime: 30,
+	}
+
+	for _, cacheHit := range []bool{false, true} {
+		td := testTask(t)
+		td.Scopes = []string{"generic-worker:cache:run-summary-cache"}
+		taskID := submitAndAssert(t, td, payload, "completed", "completed")
+
+		summary := getRunSummary(t, taskID)
+		if len(summary.Mounts) != 1 {
+			t.Fatalf("Was expecting 1 mount in run summary but got %v", len(summary.Mounts))
+		}
+		mount := summary.Mounts[0]
+		if mount.Type != "writableDirectoryCache" || mount.Path != "my-cache" || mount.CacheName != "run-summary-cache" || mount.CacheHit != cacheHit || mount.Error != "" {
+			t.Fatalf("Run summary has wrong details for mount (was expecting cache hit %v): %#v", cacheHit, mount)
+		}
+	}
+}
+
+func TestRunSummaryMalformedPayload(t *testing.T) {
+	defer setup(t)()
+	payload := GenericWorkerPayload{
+		Command:    helloGoodbye(),
+		MaxRunTime: 30,
+		OnExitStatus: ExitCodeHandling{
+			Retry:   []int64{5},
+			Success: []int64{5},
+		},
+	}
+	td := testTask(t)
+
+	taskID := submitAndAssert(t, td, payload, "exception", "malformed-payload")
+
+	summary := getRunSummary(t, taskID)
+	if summary.State != "exception" || summary.Reason != "malformed-payload" {
+		t.Fatalf("Run summary has wrong task resolution: %#v", summary)
+	}
+}
@@ -16,7 +16,7 @@ import (
 )
 
 func (task *TaskRun) formatCommand(index int) string {
-	return shell.Escape(task.Payload.Command[index]...)
+	return shell.Escape(task.CommandDefinitions[index].Command...)
 }
 
 func PlatformTaskEnvironmentSetup(taskDirName string) (reboot bool) {
@@ -52,7 +52,12 @@ func deleteDir(path string) error {
 
 func (task *TaskRun) generateCommand(index int) error {
 	var err error
-	task.Commands[index], err = process.NewCommand(task.Payload.Command[index], taskContext.TaskDir, task.EnvVars())
+	env := task.EnvVars()
+	// env vars of the individual command take precedence over task env vars
+	for k, v := range task.CommandDefinitions[index].Env {
+		env = append(env, k+"="+v)
+	}
+	task.Commands[index], err = process.NewCommand(task.CommandDefinitions[index].Command, task.commandDir(index), env)
 	if err != nil {
 		return err
 	}
@@ -36,6 +36,9 @@ func TestNewTaskDirectoryForEachTask(t *testing.T) {
 			return nil
 		}
 		t.Logf("Found file %v", path)
+		if info.Name() == "run-summary.json" {
+			return nil
+		}
 		if info.Name() != "live_backing.log" {
 			return fmt.Errorf("Discovered file with name %q but was expecting %q", info.Name(), "live_backing.log")
 		}
@@ -6,12 +6,24 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
 	"github.com/taskcluster/taskcluster/v39/internal/scopes"
 	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/tcproxy"
 )
 
+var (
+	taskclusterProxyAuditLogPath = filepath.Join("generic-worker", "taskcluster-proxy-audit.jsonl")
+	taskclusterProxyAuditLogName = "private/logs/taskcluster-proxy-audit.jsonl"
+	// taskclusterProxySocketName is the name of the unix domain socket the
+	// proxy listens on, in the task directory, if
+	// config.TaskclusterProxyUnixSocket is true
+	taskclusterProxySocketName = "taskcluster-proxy.sock"
+)
+
 type TaskclusterProxyFeature struct {
 }
 
@@ -38,7 +50,9 @@ type TaskclusterProxyTask struct {
 }
 
 func (l *TaskclusterProxyTask) ReservedArtifacts() []string {
-	return []string{}
+	return []string{
+		taskclusterProxyAuditLogName,
+	}
 }
 
 func (feature *TaskclusterProxyFeature) NewTaskFeature(task *TaskRun) TaskFeature {
@@ -53,9 +67,17 @@ func (l *TaskclusterProxyTask) RequiredScopes() scopes.Required {
 }
 
 func (l *TaskclusterProxyTask) Start() *CommandExecutionError {
-	// Set TASKCLUSTER_PROXY_URL in the task environment
-	err := l.task.setVariable("TASKCLUSTER_PROXY_URL",
-		fmt.Sprintf("http://localhost:%d", config.TaskclusterProxyPort))
+	// Set TASKCLUSTER_PROXY_URL (or TASKCLUSTER_PROXY_SOCKET) in the task
+	// environment
+	unixSocket := ""
+	var err error
+	if config.TaskclusterProxyUnixSocket {
+		unixSocket = filepath.Join(taskContext.TaskDir, taskclusterProxySocketName)
+		err = l.task.setVariable("TASKCLUSTER_PROXY_SOCKET", unixSocket)
+	} else {
+		err = l.task.setVariable("TASKCLUSTER_PROXY_URL",
+			fmt.Sprintf("http://localhost:%d", config.TaskclusterProxyPort))
+	}
 	if err != nil {
 		return MalformedPayloadError(err)
 	}
@@ -67,6 +89,7 @@ func (l *TaskclusterProxyTask) Start() *CommandExecutionError {
 	taskclusterProxy, err := tcproxy.New(
 		config.TaskclusterProxyExecutable,
 		config.TaskclusterProxyPort,
+		unixSocket,
 		config.RootURL,
 		&tcclient.Credentials{
 			AccessToken:      l.task.TaskClaimResponse.Credentials.AccessToken,
@@ -74,11 +97,21 @@ func (l *TaskclusterProxyTask) Start() *CommandExecutionError {
 			ClientID:         l.task.TaskClaimResponse.Credentials.ClientID,
 			AuthorizedScopes: scopes,
 		},
+		time.Time(l.task.Definition.Deadline),
+		filepath.Join(taskContext.TaskDir, taskclusterProxyAuditLogPath),
 	)
 	if err != nil {
 		return executionError(internalError, errored, fmt.Errorf("Could not start taskcluster proxy: %s", err))
 	}
 	l.taskclusterProxy = taskclusterProxy
+	if unixSocket != "" {
+		// the socket is created accessible only to the worker, so hand it
+		// over to the task user
+		err = makeFileReadWritableForTaskUser(l.task, unixSocket)
+		if err != nil {
+			return executionError(internalError, errored, fmt.Errorf("Could not grant task user access to taskcluster proxy socket: %s", err))
+		}
+	}
 	l.taskStatusChangeListener = &TaskStatusChangeListener{
 		Name: "taskcluster-proxy",
 		Callback: func(ts TaskStatus) {
@@ -92,12 +125,12 @@ func (l *TaskclusterProxyTask) Start() *CommandExecutionError {
 				panic(err)
 			}
 			buffer := bytes.NewBuffer(b)
-			putURL := fmt.Sprintf("http://localhost:%v/credentials", config.TaskclusterProxyPort)
+			putURL := taskclusterProxy.URL() + "/credentials"
 			req, err := http.NewRequest("PUT", putURL, buffer)
 			if err != nil {
 				panic(fmt.Sprintf("Could not create PUT request to taskcluster-proxy /credentials endpoint: %v", err))
 			}
-			client := &http.Client{}
+			client := taskclusterProxy.HTTPClient()
 			res, err := client.Do(req)
 			if err != nil {
 				panic(fmt.Sprintf("Could not PUT to %v: %v", putURL, err))
@@ -116,10 +149,29 @@ func (l *TaskclusterProxyTask) Start() *CommandExecutionError {
 
 func (l *TaskclusterProxyTask) Stop(err *ExecutionErrors) {
 	l.task.StatusManager.DeregisterListener(l.taskStatusChangeListener)
+	if l.taskclusterProxy == nil {
+		// Start() failed before the proxy was started
+		return
+	}
 	errTerminate := l.taskclusterProxy.Terminate()
 	if errTerminate != nil {
 		// no need to raise an exception, machine will reboot anyway
 		l.task.Warnf("[taskcluster-proxy] Could not terminate taskcluster proxy process: %s", errTerminate)
 		log.Printf("WARNING: could not terminate taskcluster proxy writer: %s", errTerminate)
 	}
+	// The audit log is created by taskcluster-proxy when it starts
+	if _, statErr := os.Stat(filepath.Join(taskContext.TaskDir, taskclusterProxyAuditLogPath)); statErr != nil {
+		return
+	}
+	err.add(l.task.uploadArtifact(
+		&S3Artifact{
+			BaseArtifact: &BaseArtifact{
+				Name:    taskclusterProxyAuditLogName,
+				Expires: l.task.Definition.Expires,
+			},
+			ContentType:     "application/x-ndjson",
+			ContentEncoding: "gzip",
+			Path:            taskclusterProxyAuditLogPath,
+		},
+	))
 }
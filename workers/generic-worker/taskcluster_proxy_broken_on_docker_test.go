@@ -12,6 +12,10 @@ func TestTaskclusterProxy(t *testing.T) {
 
 	defer setup(t)()
 
+	testTaskclusterProxy(t)
+}
+
+func testTaskclusterProxy(t *testing.T) {
 	taskID := CreateArtifactFromFile(t, "SampleArtifacts/_/X.txt", "SampleArtifacts/_/X.txt")
 
 	// We base64 encode the url, because I can't get to the bottom of the
@@ -69,6 +73,14 @@ func TestTaskclusterProxy(t *testing.T) {
 			ContentEncoding: "gzip",
 			Expires:         td.Expires,
 		},
+		"private/logs/taskcluster-proxy-audit.jsonl": {
+			Extracts: []string{
+				`"method":"GET","service":"queue","apiVersion":"v1","path":"/task/` + td.Dependencies[0] + `/artifacts/SampleArtifacts%2F_%2FX.txt"`,
+			},
+			ContentType:     "application/x-ndjson",
+			ContentEncoding: "gzip",
+			Expires:         td.Expires,
+		},
 	}
 
 	expectedArtifacts.Validate(t, taskID, 0)
@@ -0,0 +1,25 @@
+// +build !docker,!windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTaskclusterProxyUnixSocket(t *testing.T) {
+
+	defer setup(t)()
+
+	// unix domain socket paths are limited to around 100 bytes, which is
+	// exceeded by the task directories of the test suite
+	tasksDir, err := ioutil.TempDir("", "gw")
+	if err != nil {
+		t.Fatalf("Could not create tasks directory: %v", err)
+	}
+	defer os.RemoveAll(tasksDir)
+	config.TasksDir = tasksDir
+	config.TaskclusterProxyUnixSocket = true
+	testTaskclusterProxy(t)
+}
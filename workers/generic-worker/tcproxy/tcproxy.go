@@ -4,9 +4,11 @@
 package tcproxy
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
@@ -16,31 +18,55 @@ import (
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
 )
 
+// maxUnixSocketPathLength is the longest unix domain socket path that can be
+// used on all supported platforms (macOS allows 103 bytes, linux 107)
+const maxUnixSocketPathLength = 103
+
 // TaskclusterProxy provides access to a taskcluster-proxy process running on the OS.
 type TaskclusterProxy struct {
 	mut      sync.Mutex
 	command  *exec.Cmd
 	HTTPPort uint16
-	Pid      int
+	// UnixSocket is the path of the unix domain socket the proxy listens on,
+	// or "" if it listens on HTTPPort
+	UnixSocket string
+	Pid        int
 }
 
 // New starts a tcproxy OS process using the executable specified, and returns
-// a *TaskclusterProxy.
-func New(taskclusterProxyExecutable string, httpPort uint16, rootURL string, creds *tcclient.Credentials) (*TaskclusterProxy, error) {
+// a *TaskclusterProxy. If unixSocket is not empty, the proxy listens on the
+// unix domain socket unixSocket (accessible only to the current user) rather
+// than on httpPort. If deadline is not zero, temporary credentials handed out
+// by the proxy expire no later than deadline. If auditLog is not empty, the
+// proxy appends a record of each proxied request to the file auditLog.
+func New(taskclusterProxyExecutable string, httpPort uint16, unixSocket string, rootURL string, creds *tcclient.Credentials, deadline time.Time, auditLog string) (*TaskclusterProxy, error) {
+	if len(unixSocket) > maxUnixSocketPathLength {
+		return nil, fmt.Errorf("Unix domain socket path %v is %v bytes long, but may be at most %v bytes long", unixSocket, len(unixSocket), maxUnixSocketPathLength)
+	}
 	args := []string{
-		"--port", strconv.Itoa(int(httpPort)),
 		"--root-url", rootURL,
 		"--client-id", creds.ClientID,
 		"--access-token", creds.AccessToken,
-		"--ip-address", "127.0.0.1",
+	}
+	if unixSocket != "" {
+		args = append(args, "--unix-socket", unixSocket, "--unix-socket-mode", "0600")
+	} else {
+		args = append(args, "--port", strconv.Itoa(int(httpPort)), "--ip-address", "127.0.0.1")
 	}
 	if creds.Certificate != "" {
 		args = append(args, "--certificate", creds.Certificate)
 	}
+	if !deadline.IsZero() {
+		args = append(args, "--task-deadline", deadline.UTC().Format(time.RFC3339Nano))
+	}
+	if auditLog != "" {
+		args = append(args, "--audit-log", auditLog)
+	}
 	args = append(args, creds.AuthorizedScopes...)
 	l := &TaskclusterProxy{
-		command:  exec.Command(taskclusterProxyExecutable, args...),
-		HTTPPort: httpPort,
+		command:    exec.Command(taskclusterProxyExecutable, args...),
+		HTTPPort:   httpPort,
+		UnixSocket: unixSocket,
 	}
 	l.command.Stdout = os.Stdout
 	l.command.Stderr = os.Stderr
@@ -53,10 +79,38 @@ func New(taskclusterProxyExecutable string, httpPort uint16, rootURL string, cre
 	l.Pid = l.command.Process.Pid
 	log.Printf("Started taskcluster proxy process (PID %v)", l.Pid)
 	// Just to be safe, let's make sure the port is actually active before returning.
-	err = waitForPortToBeActive(httpPort)
+	if unixSocket != "" {
+		err = waitToBeActive("unix", unixSocket)
+	} else {
+		err = waitToBeActive("tcp", "localhost:"+strconv.Itoa(int(httpPort)))
+	}
 	return l, err
 }
 
+// URL returns the base URL of the proxy. If the proxy listens on a unix
+// domain socket, requests to the URL must be made with HTTPClient.
+func (l *TaskclusterProxy) URL() string {
+	if l.UnixSocket != "" {
+		return "http://localhost"
+	}
+	return fmt.Sprintf("http://localhost:%d", l.HTTPPort)
+}
+
+// HTTPClient returns an *http.Client that connects to the proxy
+func (l *TaskclusterProxy) HTTPClient() *http.Client {
+	if l.UnixSocket == "" {
+		return &http.Client{}
+	}
+	unixSocket := l.UnixSocket
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", unixSocket)
+			},
+		},
+	}
+}
+
 func (l *TaskclusterProxy) Terminate() error {
 	l.mut.Lock()
 	defer func() {
@@ -69,21 +123,22 @@ func (l *TaskclusterProxy) Terminate() error {
 	defer func() {
 		log.Printf("Stopped taskcluster proxy process (PID %v)", l.Pid)
 		l.HTTPPort = 0
+		l.UnixSocket = ""
 		l.Pid = 0
 		l.command = nil
 	}()
 	return l.command.Process.Kill()
 }
 
-func waitForPortToBeActive(port uint16) error {
+func waitToBeActive(network, address string) error {
 	deadline := time.Now().Add(60 * time.Second)
 	for time.Now().Before(deadline) {
-		conn, err := net.DialTimeout("tcp", "localhost:"+strconv.Itoa(int(port)), 60*time.Second)
+		conn, err := net.DialTimeout(network, address, 60*time.Second)
 		if err == nil {
 			_ = conn.Close()
 			return nil
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	return fmt.Errorf("Timeout waiting for taskcluster-proxy port %v to be active", port)
+	return fmt.Errorf("Timeout waiting for taskcluster-proxy %v address %v to be active", network, address)
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"runtime"
 	"testing"
+	"time"
 
 	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
 	"github.com/taskcluster/taskcluster/v39/clients/client-go/tcauth"
@@ -28,7 +29,7 @@ func TestTcProxy(t *testing.T) {
 		Certificate:      certificate,
 		AuthorizedScopes: []string{"queue:get-artifact:SampleArtifacts/_/X.txt"},
 	}
-	ll, err := New(executable, 34569, rootURL, creds)
+	ll, err := New(executable, 34569, "", rootURL, creds, time.Time{}, "")
 	// Do defer before checking err since err could be a different error and
 	// process may have already started up.
 	defer func() {
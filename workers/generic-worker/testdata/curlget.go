@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
@@ -12,7 +14,7 @@ import (
 
 func main() {
 	if len(os.Args) != 2 {
-		log.Fatal("Usage: go run curlget.go <base64 encoded url>\n<base64 encoded url> will have the current $TASKCLUSTER_PROXY_URL substituted for the string TASKCLUSTER_PROXY_URL")
+		log.Fatal("Usage: go run curlget.go <base64 encoded url>\n<base64 encoded url> will have the current $TASKCLUSTER_PROXY_URL substituted for the string TASKCLUSTER_PROXY_URL, or if $TASKCLUSTER_PROXY_SOCKET is set, the request is made over that unix domain socket")
 	}
 	base64EncodedURL := os.Args[1]
 	urlBytes, err := base64.StdEncoding.DecodeString(base64EncodedURL)
@@ -20,9 +22,20 @@ func main() {
 		log.Fatalf("%v", err)
 	}
 	log.Printf("Program arguments: %#v", os.Args)
-	url := strings.Replace(string(urlBytes), "TASKCLUSTER_PROXY_URL", os.Getenv("TASKCLUSTER_PROXY_URL"), -1)
+	proxyURL := os.Getenv("TASKCLUSTER_PROXY_URL")
+	client := &http.Client{}
+	// taskcluster-proxy may listen on a unix domain socket instead
+	if socket := os.Getenv("TASKCLUSTER_PROXY_SOCKET"); socket != "" {
+		proxyURL = "http://localhost"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	url := strings.Replace(string(urlBytes), "TASKCLUSTER_PROXY_URL", proxyURL, -1)
 	log.Printf("URL: %#v", url)
-	res, err := http.Get(url)
+	res, err := client.Get(url)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
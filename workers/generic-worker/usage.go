@@ -18,6 +18,7 @@ const (
 	INVALID_CONFIG              ExitCode = 73
 	CANT_CREATE_ED25519_KEYPAIR ExitCode = 75
 	CANT_CONNECT_PROTOCOL_PIPE  ExitCode = 78
+	CANT_VERIFY_CHAIN_OF_TRUST  ExitCode = 79
 )
 
 func usage(versionName string) string {
@@ -33,7 +34,12 @@ and reports back results to the queue.
                                             [--with-worker-runner]
                                             [--worker-runner-protocol-pipe PIPE]` + installServiceSummary() + `
     generic-worker show-payload-schema
-    generic-worker new-ed25519-keypair      --file ED25519-PRIVATE-KEY-FILE` + customTargetsSummary() + `
+    generic-worker show-config-schema
+    generic-worker validate-config          [--config         CONFIG-FILE]
+    generic-worker new-ed25519-keypair      --file ED25519-PRIVATE-KEY-FILE [--output-key-id]
+    generic-worker verify-cot               --task-id TASK-ID
+                                            (--public-key PUBLIC-KEY-FILE)...
+                                            [--verify-artifacts] [--recursive]` + customTargetsSummary() + `
     generic-worker --help
     generic-worker --version
 
@@ -46,11 +52,41 @@ and reports back results to the queue.
                                             payload is validated against a json schema baked
                                             into the release. This option outputs the json
                                             schema used in this version of the generic
-                                            worker.` + installService() + `
+                                            worker.
+    show-config-schema                      Outputs the json schema that the generic-worker
+                                            config file (see --config option) must conform
+                                            to, for this version and engine of the generic
+                                            worker.
+    validate-config                         Validates the config file (see --config option)
+                                            against the config schema, and checks that
+                                            required settings are defined and that settings
+                                            are consistent with each other, without running
+                                            the worker. Exits with exit code 0 if the config
+                                            is valid, or 73 if not. All problems found with
+                                            the config file are reported.` + installService() + `
     new-ed25519-keypair                     This will generate a fresh, new ed25519
                                             compliant private/public key pair. The public
                                             key will be written to stdout and the private
-                                            key will be written to the specified file.` + customTargets() + `
+                                            key will be written to the specified file.
+                                            With --output-key-id, the public key is
+                                            written as a json object that also contains
+                                            the key ID that chain of trust artifacts
+                                            signed with the key will refer to (unless
+                                            an explicit keyId is configured for the key,
+                                            see ed25519SigningKeys).
+    verify-cot                              Downloads the chain of trust document
+                                            (public/chain-of-trust-v2.json, or
+                                            public/chain-of-trust.json if the task has no
+                                            version 2 document) of the given task and its
+                                            signature, and verifies the signature against
+                                            the given public keys. The task
+                                            definition in the document is compared to the
+                                            task definition held by the queue. The
+                                            taskcluster root URL is read from environment
+                                            variable TASKCLUSTER_ROOT_URL, and credentials
+                                            (if any) from TASKCLUSTER_CLIENT_ID,
+                                            TASKCLUSTER_ACCESS_TOKEN and
+                                            TASKCLUSTER_CERTIFICATE.` + customTargets() + `
 
   Options:
     --config CONFIG-FILE                    Json configuration file to use. See
@@ -68,7 +104,23 @@ and reports back results to the queue.
     --file PRIVATE-KEY-FILE                 The path to the file to write the private key
                                             to. The parent directory must already exist.
                                             If the file exists it will be overwritten,
-                                            otherwise it will be created.` + sidSID() + `
+                                            otherwise it will be created.
+    --output-key-id                         Output the public key and its key ID as json.
+    --task-id TASK-ID                       The taskId of the task to verify.
+    --public-key PUBLIC-KEY-FILE            A file containing a base64 encoded ed25519
+                                            public key (or json object containing one), as
+                                            output by new-ed25519-keypair, that the chain
+                                            of trust document may be signed with. May be
+                                            given multiple times. Documents that name the
+                                            key they were signed with must have been signed
+                                            with one of these keys.
+    --verify-artifacts                      Download the artifacts listed in the chain of
+                                            trust document, and check their SHA256 matches
+                                            the document.
+    --recursive                             Also verify the upstream tasks whose artifacts
+                                            were mounted by the task, and check that the
+                                            SHA256 of the mounted artifacts match the chain
+                                            of trust documents of the upstream tasks.` + sidSID() + `
     --help                                  Display this help text.
     --version                               The release version of the generic-worker.
 
@@ -86,6 +138,7 @@ and reports back results to the queue.
           clientId                          Taskcluster client ID used by generic worker to
                                             talk to taskcluster queue.
           ed25519SigningKeyLocation         The ed25519 signing key for signing artifacts with.
+                                            May be omitted if ed25519SigningKeys is set.
           rootURL                           The root URL of the taskcluster deployment to which
                                             clientId and accessToken grant access. For example,
                                             'https://community-tc.services.mozilla.com/'.
@@ -138,6 +191,21 @@ and reports back results to the queue.
                                             directory will be created if it does not exist. This
                                             may be a relative path to the current directory, or
                                             an absolute path. [default: "downloads"]
+          ed25519SigningKeys                A list of additional chain of trust signing keys,
+                                            for rotating keys without redeploying all workers
+                                            at once. Each key is a json object with properties
+                                            location (the file containing the ed25519 signing
+                                            key), and optionally keyId, notBefore and notAfter
+                                            (RFC 3339 timestamps). Of the keys whose validity
+                                            window contains the time a task starts (including
+                                            ed25519SigningKeyLocation, which has no validity
+                                            window), the key with the latest notBefore signs
+                                            the chain of trust artifacts of the task. Chain of
+                                            trust documents contain the keyId and public key
+                                            of the key that signed them. If keyId is not set,
+                                            it is derived from the public key (see
+                                            new-ed25519-keypair --output-key-id).
+                                            [default: []]
           idleTimeoutSecs                   How many seconds to wait without getting a new
                                             task to perform, before the worker process exits.
                                             An integer, >= 0. A value of 0 means "never reach
@@ -146,9 +214,8 @@ and reports back results to the queue.
                                             [default: 0]
           instanceID                        The EC2 instance ID of the worker. Used by chain of trust.
           instanceType                      The EC2 instance Type of the worker. Used by chain of trust.
-          livelogExecutable                 Filepath of LiveLog executable to use; see
-                                            https://github.com/taskcluster/livelog
-                                            [default: "livelog"]
+          livelogExecutable                 Deprecated, and ignored. Livelog is now served from
+                                            within the generic-worker process.
           numberOfTasksToRun                If zero, run tasks indefinitely. Otherwise, after
                                             this many tasks, exit. [default: 0]
           privateIP                         The private IP of the worker, used by chain of trust.
@@ -202,6 +269,13 @@ and reports back results to the queue.
                                             [default: "taskcluster-proxy"]
           taskclusterProxyPort              Port number for taskcluster-proxy HTTP requests.
                                             [default: 80]
+          taskclusterProxyUnixSocket        If true, taskcluster-proxy listens on a unix domain
+                                            socket in the task directory, owned by the task
+                                            user, rather than on taskclusterProxyPort, so that
+                                            other users on the host cannot use the proxy. Tasks
+                                            are given the path of the socket in environment
+                                            variable TASKCLUSTER_PROXY_SOCKET instead of
+                                            TASKCLUSTER_PROXY_URL. [default: false]
           tasksDir                          The location where task directories should be
                                             created on the worker.
                                             [default (varies by platform): ` + fmt.Sprintf("%q", defaultTasksDir()) + `]
@@ -263,5 +337,6 @@ and reports back results to the queue.
     73     The config provided to the worker is invalid.` + exitCode74() + `
     75     Not able to create an ed25519 key pair.` + exitCode77() + `
     78     Not able to connect to --worker-runner-protocol-pipe.
+    79     Chain of trust verification failed (see verify-cot target).
 `
 }
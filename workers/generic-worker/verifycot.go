@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	tcclient "github.com/taskcluster/taskcluster/v39/clients/client-go"
+	"github.com/taskcluster/taskcluster/v39/workers/generic-worker/cot"
+	"golang.org/x/crypto/ed25519"
+)
+
+// verifyChainOfTrust verifies the chain of trust document of the task given
+// on the command line, using the taskcluster root URL and credentials from
+// the environment
+func verifyChainOfTrust(arguments map[string]interface{}) ExitCode {
+	rootURL := os.Getenv("TASKCLUSTER_ROOT_URL")
+	if rootURL == "" {
+		log.Print("Environment variable TASKCLUSTER_ROOT_URL must be set in order to verify chain of trust")
+		return CANT_VERIFY_CHAIN_OF_TRUST
+	}
+	verifier := &cot.Verifier{
+		Queue:           serviceFactory.Queue(tcclient.CredentialsFromEnvVars(), rootURL),
+		PublicKeys:      []ed25519.PublicKey{},
+		VerifyArtifacts: arguments["--verify-artifacts"].(bool),
+		Recursive:       arguments["--recursive"].(bool),
+	}
+	for _, publicKeyFile := range arguments["--public-key"].([]string) {
+		content, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			log.Printf("Could not read public key file %v: %v", publicKeyFile, err)
+			return CANT_VERIFY_CHAIN_OF_TRUST
+		}
+		publicKey, err := cot.ParsePublicKeyFile(content)
+		if err != nil {
+			log.Printf("Could not read public key file %v: %v", publicKeyFile, err)
+			return CANT_VERIFY_CHAIN_OF_TRUST
+		}
+		verifier.PublicKeys = append(verifier.PublicKeys, publicKey)
+	}
+	_, err := verifier.Verify(arguments["--task-id"].(string))
+	if err != nil {
+		log.Print(err)
+		return CANT_VERIFY_CHAIN_OF_TRUST
+	}
+	return TASKS_COMPLETE
+}